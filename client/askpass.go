@@ -0,0 +1,84 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// ErrInteractiveAuthRequired is returned in batch mode when authentication
+// would need to prompt the user
+var ErrInteractiveAuthRequired = errors.New("Authentication requires a prompt but prompting is disabled in batch mode")
+var ErrEmptyPassword = errors.New("Password file is empty")
+
+// askpassVariable names the environment variable holding the path of a
+// program that supplies passwords and passphrases, like SSH_ASKPASS
+const askpassVariable = "UCP_ASKPASS"
+
+// askpass runs the program named by UCP_ASKPASS with prompt as its only
+// argument and returns the first line it writes to stdout. ok is false if
+// UCP_ASKPASS isn't set.
+func askpass(prompt string) (response string, ok bool, e error) {
+	program := os.Getenv(askpassVariable)
+	if program == "" {
+		return "", false, nil
+	}
+
+	var stdout bytes.Buffer
+	cmd := exec.Command(program, prompt)
+	cmd.Stdout = &stdout
+	cmd.Stderr = os.Stderr
+	if e = cmd.Run(); e != nil {
+		return "", true, fmt.Errorf("%s %s: %s", askpassVariable, program, e.Error())
+	}
+
+	response = strings.SplitN(stdout.String(), "\n", 2)[0]
+	return strings.TrimSuffix(response, "\r"), true, nil
+}
+
+// readPasswordFile reads a password from the first line of path. Like ssh
+// with private keys, the file is refused unless it is a regular file owned
+// by the current user that no one else can read or write.
+func readPasswordFile(path string) (password string, e error) {
+	var info os.FileInfo
+	if info, e = os.Stat(path); e != nil {
+		return
+	}
+
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%s is not a regular file", path)
+	}
+
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("Permissions %04o for %s are too open, the file must only be accessible by its owner", info.Mode().Perm(), path)
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Getuid() {
+		return "", fmt.Errorf("%s is not owned by the current user", path)
+	}
+
+	var contents []byte
+	if contents, e = ioutil.ReadFile(path); e != nil {
+		return
+	}
+
+	password = strings.SplitN(string(contents), "\n", 2)[0]
+	if password = strings.TrimSuffix(password, "\r"); password == "" {
+		return "", ErrEmptyPassword
+	}
+	return
+}
+
+// ExitCode returns the process exit code for an error, BatchAuthCode if
+// batch mode prevented a prompt and ErrorCode otherwise
+func ExitCode(e error) int {
+	if e == ErrInteractiveAuthRequired {
+		return BatchAuthCode
+	}
+	return ErrorCode
+}
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AskpassTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (s *AskpassTestSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "askpass")
+	s.Require().Nil(err)
+	os.Unsetenv(askpassVariable)
+}
+
+func (s *AskpassTestSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+	os.Unsetenv(askpassVariable)
+	Batch = false
+	PasswordFile = ""
+}
+
+func (s *AskpassTestSuite) writeFile(name, contents string, mode os.FileMode) string {
+	path := filepath.Join(s.dir, name)
+	s.Require().Nil(ioutil.WriteFile(path, []byte(contents), mode))
+	s.Require().Nil(os.Chmod(path, mode))
+	return path
+}
+
+func (s *AskpassTestSuite) TestPasswordFile() {
+	PasswordFile = s.writeFile("password", "s3cret\nignored\n", 0600)
+
+	password, err := (&Prompt{}).GetPassword()
+	s.Nil(err)
+	s.Equal("s3cret", password)
+}
+
+func (s *AskpassTestSuite) TestPasswordFilePermissions() {
+	_, err := readPasswordFile(s.writeFile("readable", "s3cret\n", 0644))
+	s.NotNil(err)
+	s.Contains(err.Error(), "too open")
+
+	_, err = readPasswordFile(s.dir)
+	s.NotNil(err)
+
+	_, err = readPasswordFile(s.writeFile("empty", "\n", 0600))
+	s.Equal(ErrEmptyPassword, err)
+}
+
+func (s *AskpassTestSuite) TestAskpass() {
+	os.Setenv(askpassVariable, s.writeFile("askpass.sh", "#!/bin/sh\necho \"answer to $1\"\n", 0700))
+	Batch = true
+
+	passphrase, err := (&Prompt{}).GetPassphrase("key.pem")
+	s.Nil(err)
+	s.Equal("answer to Enter passphrase for key.pem: ", passphrase)
+}
+
+func (s *AskpassTestSuite) TestAskpassFailure() {
+	os.Setenv(askpassVariable, s.writeFile("askpass.sh", "#!/bin/sh\nexit 1\n", 0700))
+
+	_, err := (&Prompt{}).GetPassword()
+	s.NotNil(err)
+}
+
+func (s *AskpassTestSuite) TestBatchNeverPrompts() {
+	Batch = true
+
+	_, err := (&Prompt{}).GetPassword()
+	s.Equal(ErrInteractiveAuthRequired, err)
+
+	_, err = loadPrivateKey(encryptedKeyPath, &Prompt{})
+	s.Equal(ErrInteractiveAuthRequired, err)
+
+	s.Equal(BatchAuthCode, ExitCode(err))
+	s.Equal(ErrorCode, ExitCode(ErrBadRequest))
+}
+
+func TestAskpass(t *testing.T) {
+	suite.Run(t, new(AskpassTestSuite))
+}
@@ -0,0 +1,231 @@
+package client
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+
+	unet "github.com/murphybytes/ucp/net"
+	"github.com/murphybytes/ucp/wire"
+)
+
+var ErrInvalidSize = errors.New("Size must be a number of bytes, optionally followed by K, M or G")
+var ErrInvalidPattern = errors.New("Pattern must be zero or random")
+
+// BenchCommand is the subcommand that runs a benchmark
+const BenchCommand = "bench"
+
+// BenchmarkResult holds the measurements taken during a benchmark
+type BenchmarkResult struct {
+	Bytes      int64
+	Duration   time.Duration
+	CPUTime    time.Duration
+	RoundTrips []time.Duration
+}
+
+// Throughput returns the bytes received per second
+func (r BenchmarkResult) Throughput() float64 {
+	if r.Duration <= 0 {
+		return 0
+	}
+	return float64(r.Bytes) / r.Duration.Seconds()
+}
+
+// CPUPerGB returns the CPU time the client used for each GB received
+func (r BenchmarkResult) CPUPerGB() time.Duration {
+	if r.Bytes == 0 {
+		return 0
+	}
+	return time.Duration(float64(r.CPUTime) * 1e9 / float64(r.Bytes))
+}
+
+// RoundTripPercentile returns the chunk round trip time below which
+// percentile percent of the round trips fall
+func (r BenchmarkResult) RoundTripPercentile(percentile float64) time.Duration {
+	if len(r.RoundTrips) == 0 {
+		return 0
+	}
+
+	sorted := append([]time.Duration{}, r.RoundTrips...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	i := int(percentile/100*float64(len(sorted))+0.5) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// Benchmark has the server send size bytes of generated data, which are
+// thrown away as they arrive. Neither end touches a disk, so the result
+// shows what the network, the encryption and the protocol can manage.
+// A chunk's round trip is the time from asking for it to receiving it.
+// The data isn't hashed, the stream's size is the only check made.
+func Benchmark(size int64, pattern wire.BenchmarkPattern, conn unet.EncodeConn) (result BenchmarkResult, e error) {
+	transferInfo := wire.FileTransferInformation{
+		FileTransferType: wire.Benchmark,
+		FileSize:         size,
+		Pattern:          pattern,
+	}
+
+	if e = requestTransfer(conn, transferInfo); e != nil {
+		return
+	}
+
+	if e = conn.Read(&transferInfo); e != nil {
+		return
+	}
+
+	if transferInfo.Error != nil {
+		e = transferInfo.Error
+		return
+	}
+
+	cpuStarted := cpuTime()
+	started := time.Now()
+	if e = conn.Write(wire.FileTransferStart); e != nil {
+		return
+	}
+
+	requested := started
+	for {
+		var chunk wire.FileChunk
+		var buffer []byte
+		if buffer, e = conn.ReadData(&chunk); e != nil {
+			return
+		}
+
+		if buffer == nil {
+			if chunk.Error != nil {
+				e = chunk.Error
+				return
+			}
+			if chunk.End == nil {
+				e = ErrBadRequest
+				return
+			}
+			if chunk.End.Size != result.Bytes {
+				e = fmt.Errorf("Received %d of %d bytes", result.Bytes, chunk.End.Size)
+				return
+			}
+			break
+		}
+
+		result.RoundTrips = append(result.RoundTrips, time.Since(requested))
+		result.Bytes += int64(len(buffer))
+		unet.PutBuffer(buffer)
+
+		requested = time.Now()
+		if e = conn.Write(wire.FileTransferMore); e != nil {
+			return
+		}
+	}
+
+	result.Duration = time.Since(started)
+	result.CPUTime = cpuTime() - cpuStarted
+	return
+}
+
+// cpuTime returns the user and system CPU time used by the process
+func cpuTime() time.Duration {
+	var usage syscall.Rusage
+	if syscall.Getrusage(syscall.RUSAGE_SELF, &usage) != nil {
+		return 0
+	}
+	return time.Duration(usage.Utime.Nano() + usage.Stime.Nano())
+}
+
+// parseBench reads the flags of the bench subcommand from args and returns
+// a command that runs the benchmark they describe and prints its result
+func parseBench(args []string) (command Command, e error) {
+	var sizeFlag, patternFlag string
+	flags := flag.NewFlagSet(BenchCommand, flag.ContinueOnError)
+	flags.StringVar(&sizeFlag, "size", "1G", "Bytes to transfer, K, M and G suffixes are accepted")
+	flags.StringVar(&patternFlag, "pattern", "zero", "Data the server generates: zero or random")
+	if e = flags.Parse(args); e != nil {
+		return
+	}
+
+	var size int64
+	if size, e = parseSize(sizeFlag); e != nil {
+		return
+	}
+
+	var pattern wire.BenchmarkPattern
+	if pattern, e = parsePattern(patternFlag); e != nil {
+		return
+	}
+
+	return func(conn unet.EncodeConn) (code int, e error) {
+		var result BenchmarkResult
+		if result, e = Benchmark(size, pattern, conn); e != nil {
+			return
+		}
+		printBenchmark(Stdout, result)
+		return SuccessCode, nil
+	}, nil
+}
+
+// parseSize reads a number of bytes such as 512, 100K, 10M or 2G. The
+// suffixes are powers of 1024.
+func parseSize(value string) (size int64, e error) {
+	if value == "" {
+		return 0, ErrInvalidSize
+	}
+
+	multiplier := int64(1)
+	switch value[len(value)-1] {
+	case 'K', 'k':
+		multiplier = 1 << 10
+	case 'M', 'm':
+		multiplier = 1 << 20
+	case 'G', 'g':
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		value = value[:len(value)-1]
+	}
+
+	if size, e = strconv.ParseInt(value, 10, 64); e != nil || size < 0 || size > math.MaxInt64/multiplier {
+		return 0, ErrInvalidSize
+	}
+
+	return size * multiplier, nil
+}
+
+func parsePattern(value string) (pattern wire.BenchmarkPattern, e error) {
+	switch value {
+	case "zero":
+		return wire.ZeroPattern, nil
+	case "random":
+		return wire.RandomPattern, nil
+	}
+	return 0, ErrInvalidPattern
+}
+
+// formatRate returns bytes per second in MB/s and Gbit/s, both decimal
+// like the CPU time per GB
+func formatRate(bytesPerSecond float64) string {
+	return fmt.Sprintf("%.1f MB/s (%.2f Gbit/s)", bytesPerSecond/1e6, bytesPerSecond*8/1e9)
+}
+
+func printBenchmark(out io.Writer, result BenchmarkResult) {
+	fmt.Fprintf(out, "Received %d bytes in %s\n", result.Bytes, result.Duration.Round(time.Millisecond))
+	fmt.Fprintf(out, "Throughput: %s\n", formatRate(result.Throughput()))
+	fmt.Fprintf(out, "Client CPU: %s, %s per GB\n", result.CPUTime.Round(time.Millisecond), result.CPUPerGB().Round(time.Millisecond))
+	fmt.Fprintf(out, "Chunk round trip: p50 %s, p90 %s, p99 %s, max %s over %d chunks\n",
+		result.RoundTripPercentile(50).Round(time.Microsecond),
+		result.RoundTripPercentile(90).Round(time.Microsecond),
+		result.RoundTripPercentile(99).Round(time.Microsecond),
+		result.RoundTripPercentile(100).Round(time.Microsecond),
+		len(result.RoundTrips))
+}
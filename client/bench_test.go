@@ -0,0 +1,73 @@
+package client
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/murphybytes/ucp/wire"
+	"github.com/stretchr/testify/suite"
+)
+
+type BenchTestSuite struct {
+	suite.Suite
+}
+
+func (s *BenchTestSuite) TestParseSize() {
+	for value, expected := range map[string]int64{
+		"0":    0,
+		"512":  512,
+		"100K": 100 << 10,
+		"10m":  10 << 20,
+		"2G":   2 << 30,
+	} {
+		size, err := parseSize(value)
+		s.Nil(err, value)
+		s.Equal(expected, size, value)
+	}
+
+	for _, value := range []string{"", "G", "-1", "1T", "10000000000G"} {
+		_, err := parseSize(value)
+		s.Equal(ErrInvalidSize, err, value)
+	}
+}
+
+func (s *BenchTestSuite) TestParsePattern() {
+	pattern, err := parsePattern("random")
+	s.Nil(err)
+	s.Equal(wire.RandomPattern, pattern)
+
+	_, err = parsePattern("ones")
+	s.Equal(ErrInvalidPattern, err)
+}
+
+func (s *BenchTestSuite) TestParseBench() {
+	command, err := parseBench([]string{"-size", "10M", "-pattern", "random"})
+	s.Nil(err)
+	s.NotNil(command)
+
+	_, err = parseBench([]string{"-size", "10T"})
+	s.Equal(ErrInvalidSize, err)
+
+	_, err = parseBench([]string{"-pattern", "ones"})
+	s.Equal(ErrInvalidPattern, err)
+}
+
+func (s *BenchTestSuite) TestPrintBenchmark() {
+	var out bytes.Buffer
+	printBenchmark(&out, BenchmarkResult{
+		Bytes:      1 << 30,
+		Duration:   2 * time.Second,
+		CPUTime:    time.Second,
+		RoundTrips: []time.Duration{time.Millisecond, 2 * time.Millisecond},
+	})
+
+	s.Equal("Received 1073741824 bytes in 2s\n"+
+		"Throughput: 536.9 MB/s (4.29 Gbit/s)\n"+
+		"Client CPU: 1s, 931ms per GB\n"+
+		"Chunk round trip: p50 1ms, p90 2ms, p99 2ms, max 2ms over 2 chunks\n", out.String())
+}
+
+func TestBenchTestSuite(t *testing.T) {
+	suite.Run(t, new(BenchTestSuite))
+}
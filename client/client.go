@@ -1,9 +1,7 @@
 package client
 
 import (
-	"crypto/aes"
 	"crypto/cipher"
-	"crypto/rsa"
 	"errors"
 	"flag"
 	"fmt"
@@ -14,9 +12,11 @@ import (
 	"strconv"
 
 	_ "github.com/joho/godotenv/autoload"
+	"github.com/murphybytes/ucp/crypto"
 	unet "github.com/murphybytes/ucp/net"
 	"github.com/murphybytes/ucp/server"
 	"github.com/murphybytes/ucp/wire"
+	"golang.org/x/crypto/ssh"
 )
 
 // TODO: Add option to compress files before send/recv
@@ -24,6 +24,12 @@ import (
 const (
 	ErrorCode   = 1
 	SuccessCode = 0
+	// BatchAuthCode is the exit code used in batch mode when authentication
+	// would need to prompt the user
+	BatchAuthCode = 3
+	// PartialFailureCode is the exit code used when some of the transfers in
+	// a manifest failed and others succeeded
+	PartialFailureCode = 4
 )
 
 // UCPDirectory path to keys and known_hosts file
@@ -36,11 +42,38 @@ var Host string
 var Port int
 
 var GenerateKeys bool
+
+// KeyType type of key created by -generate-keys
+var KeyType string
 var ShowHelp bool
 
+// NoAgent disables signing with ssh-agent
+var NoAgent bool
+
+// PasswordFile file the password is read from instead of prompting
+var PasswordFile string
+
+// Batch disables all prompts, authentication that needs a prompt fails
+var Batch bool
+
 var RemoteUser string
 
+// BatchFile manifest of transfers performed in place of the client's own,
+// - for standard input
+var BatchFile string
+
+// ReportFile file the results of a batch are written to, standard output
+// if not set
+var ReportFile string
+
+// Concurrency number of transfers in a batch run at once
+var Concurrency int
+
+// ContinueOnError performs the rest of a batch after a transfer fails
+var ContinueOnError bool
+
 var ErrBadRequest = errors.New("Unexpected or invalid request")
+var ErrServerSignature = errors.New("Server could not prove it holds its host key")
 
 func init() {
 	UCPDirectory = getUcpDirectory()
@@ -48,7 +81,15 @@ func init() {
 	flag.StringVar(&Host, "host", os.Getenv("UCP_HOST"), "IP Address or Hostname for UCP server")
 	flag.StringVar(&RemoteUser, "user", GetCurrentUserName(), "The name of the remote user who owns the file")
 	flag.IntVar(&Port, "port", getIntFromEnvironment(os.Getenv("UCP_PORT"), server.DefaultPort), "Port for UCP server")
-	flag.BoolVar(&GenerateKeys, "generate-keys", false, "Generate rsa keys and exit.")
+	flag.BoolVar(&GenerateKeys, "generate-keys", false, "Generate keys and exit.")
+	flag.StringVar(&KeyType, "type", crypto.DefaultKeyType, "Type of key to generate: ed25519, ecdsa or rsa")
+	flag.BoolVar(&NoAgent, "no-agent", false, "Don't use ssh-agent even if SSH_AUTH_SOCK is set.")
+	flag.StringVar(&PasswordFile, "password-file", "", "Read the password from the first line of this file, which must only be accessible by its owner.")
+	flag.BoolVar(&Batch, "batch", false, fmt.Sprintf("Never prompt, exit with status %d if authentication needs a password or passphrase that can't be read from -password-file or UCP_ASKPASS.", BatchAuthCode))
+	flag.StringVar(&BatchFile, "batch-file", "", "Perform the transfers listed in this manifest over a single session, - for standard input.")
+	flag.StringVar(&ReportFile, "report", "", "Write the result of each transfer in -batch-file to this file as JSON lines, standard output if not set.")
+	flag.IntVar(&Concurrency, "concurrency", DefaultConcurrency, "Number of transfers in -batch-file to run at once, the server may allow fewer.")
+	flag.BoolVar(&ContinueOnError, "continue-on-error", false, "Perform the rest of -batch-file after a transfer fails rather than skipping it.")
 	flag.BoolVar(&ShowHelp, "help", false, "Show help message.")
 }
 
@@ -69,7 +110,7 @@ func getUcpDirectory() (dir string) {
 			panic(e.Error())
 		}
 	}
-	fmt.Println("DIR", dir)
+	fmt.Fprintln(os.Stderr, "DIR", dir)
 	return
 }
 
@@ -90,53 +131,91 @@ func ExitOnError(e error, msgs ...string) {
 			descriptions += msg
 		}
 
-		fmt.Println(descriptions, e.Error())
-		os.Exit(ErrorCode)
+		fmt.Fprintln(os.Stderr, descriptions, e.Error())
+		os.Exit(ExitCode(e))
 	}
 }
 
-// CreateRSAEncryptedConnection creates a network connection that will RSA encrypt
-// bytes before sending them.  Takes an RSA private key and a network connection
-// as arguments.
-func CreateRSAEncryptedConnection(privateKey *rsa.PrivateKey, conn net.Conn) (econn *unet.GobEncoderReaderWriter, e error) {
+// CreateEncryptedConnection performs the handshake with the server and
+// returns a connection that uses AES encryption. The client and server agree
+// on the AES key with an ephemeral Curve25519 key exchange and then each
+// signs the session with its identity key. The server's host key is checked
+// against known_hosts before the client identifies itself.
+func CreateEncryptedConnection(signer ssh.Signer, conn net.Conn) (aesEncryptedConn unet.EncodeConn, e error) {
 	readerWriter := unet.NewReaderWriter(conn)
 	rw := unet.NewGobEncoderReaderWriter(readerWriter)
 
-	var serverPublicKey rsa.PublicKey
-	if e = rw.Read(&serverPublicKey); e != nil {
+	var hello wire.ServerHello
+	if e = rw.Read(&hello); e != nil {
 		return
 	}
 
-	if e = rw.Write(privateKey.PublicKey); e != nil {
+	if hello.Error != nil {
+		return nil, hello.Error
+	}
+
+	if hello.HostKey == nil {
+		return nil, ErrBadRequest
+	}
+
+	var hostKey ssh.PublicKey
+	if hostKey, e = ssh.ParsePublicKey(hello.HostKey); e != nil {
 		return
 	}
 
-	econn = unet.NewGobEncoderReaderWriter(
-		unet.NewRSAReaderWriter(&serverPublicKey, privateKey, readerWriter),
-	)
+	if e = verifyServer(hostKey, hello.HostCertificate); e != nil {
+		return
+	}
 
-	return
-}
+	var kex *crypto.KeyExchange
+	if kex, e = crypto.NewKeyExchange(); e != nil {
+		return
+	}
+
+	clientHello := wire.ClientHello{
+		PublicKey:   signer.PublicKey().Marshal(),
+		KeyExchange: kex.Public,
+	}
+	if clientHello.Certificate, e = loadUserCertificate(); e != nil {
+		return
+	}
+
+	if e = rw.Write(clientHello); e != nil {
+		return
+	}
 
-// CreateAESEncryptedConnection creates a connection that uses AES encryption.  AES (Symmetric Key) encryption is much faster than RSA
-func CreateAESEncryptedConnection(rootConn net.Conn, asyncEncryptedConn unet.EncodeConn) (aesEncryptedConn unet.EncodeConn, e error) {
-	var aesParams wire.SymmetricEncryptionParms
-	if e = asyncEncryptedConn.Read(&aesParams); e != nil {
+	var secret []byte
+	if secret, e = kex.SharedSecret(hello.KeyExchange); e != nil {
 		return
 	}
 
-	var block cipher.Block
-	if block, e = aes.NewCipher(aesParams.Key); e != nil {
+	sessionID := crypto.SessionID(hello.HostKey, hello.KeyExchange, clientHello.PublicKey, kex.Public, secret)
+
+	var seal, open cipher.AEAD
+	if seal, open, e = crypto.SessionCiphers(secret, sessionID, crypto.RoleClient); e != nil {
 		return
 	}
 
 	aesEncryptedConn = unet.NewGobEncoderReaderWriter(
-		unet.NewCryptoReaderWriter(block, aesParams.InitializationVector,
-			unet.NewReaderWriter(rootConn)))
+		unet.NewCryptoReaderWriter(seal, open, readerWriter))
+
+	var serverSignature wire.SessionSignature
+	if e = aesEncryptedConn.Read(&serverSignature); e != nil {
+		return nil, e
+	}
+
+	if e = crypto.VerifySession(hostKey, crypto.RoleServer, sessionID, serverSignature.Signature); e != nil {
+		return nil, ErrServerSignature
+	}
+
+	var clientSignature wire.SessionSignature
+	if clientSignature.Signature, e = crypto.SignSession(signer, crypto.RoleClient, sessionID); e != nil {
+		return nil, e
+	}
 
-	// ack that we've established aes encrypted connection
-	aesParams.ClientAck = true
-	e = aesEncryptedConn.Write(aesParams)
+	if e = aesEncryptedConn.Write(clientSignature); e != nil {
+		return nil, e
+	}
 
 	return
 }
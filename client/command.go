@@ -0,0 +1,39 @@
+package client
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+
+	unet "github.com/murphybytes/ucp/net"
+)
+
+var ErrBatchCommand = errors.New("-batch-file can't be used with a command")
+
+// Command runs over an authenticated connection in place of the transfer
+// the client performs by default, and returns the exit code the client
+// should end with
+type Command func(conn unet.EncodeConn) (code int, e error)
+
+// ParseCommand returns the command given after the flags on the command
+// line, or nil if there is none and the client should perform its
+// transfer. A batch is run in place of the transfer if -batch-file is set.
+// It must be called once flag.Parse has been.
+func ParseCommand() (command Command, e error) {
+	args := flag.Args()
+	if BatchFile != "" {
+		if len(args) > 0 {
+			return nil, ErrBatchCommand
+		}
+		return parseBatch()
+	}
+
+	if len(args) == 0 {
+		return
+	}
+
+	if args[0] == BenchCommand {
+		return parseBench(args[1:])
+	}
+	return nil, fmt.Errorf("Unknown command %q", args[0])
+}
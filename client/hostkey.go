@@ -0,0 +1,204 @@
+package client
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/murphybytes/ucp/server"
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrHostKeyMismatch = errors.New("Host key does not match known_hosts")
+var ErrHostKeyRevoked = errors.New("Host key has been revoked")
+
+const (
+	markerCertAuthority = "cert-authority"
+	markerRevoked       = "revoked"
+)
+
+// knownHostsPath returns the location of the client known_hosts file
+func knownHostsPath() string {
+	return filepath.Join(UCPDirectory, "known_hosts")
+}
+
+// certificatePath returns the location of the user certificate, named the
+// way ssh-keygen -s names the certificate for the public-key file
+func certificatePath() string {
+	return filepath.Join(UCPDirectory, "public-key-cert.pub")
+}
+
+// verifyServer checks the server key against the known_hosts file if there
+// is one
+func verifyServer(hostKey ssh.PublicKey, hostCertificate []byte) (e error) {
+	var knownHosts []byte
+	if knownHosts, e = ioutil.ReadFile(knownHostsPath()); e != nil {
+		if os.IsNotExist(e) {
+			return nil
+		}
+		return
+	}
+
+	return VerifyHostKey(Host, Port, hostKey, hostCertificate, knownHosts)
+}
+
+// loadUserCertificate returns the user certificate in SSH wire format or nil
+// if the user doesn't have one
+func loadUserCertificate() (certificate []byte, e error) {
+	if certificate, e = server.LoadCertificate(certificatePath()); os.IsNotExist(e) {
+		return nil, nil
+	}
+	return
+}
+
+// VerifyHostKey checks the key sent by the server, and its certificate if it
+// sent one, against the entries in knownHosts, which uses the OpenSSH
+// known_hosts format. Plain entries for host must match the server key.
+// @cert-authority entries for host accept a host certificate signed by the
+// CA that names host as a principal. @revoked keys are always refused. If
+// there are no entries for host the key is accepted.
+func VerifyHostKey(host string, port int, hostKey ssh.PublicKey, hostCertificate []byte, knownHosts []byte) (e error) {
+	var cert *ssh.Certificate
+	if hostCertificate != nil {
+		if cert, e = server.ParseCertificate(hostCertificate); e != nil {
+			return
+		}
+	}
+
+	names := []string{host, fmt.Sprintf("[%s]:%d", host, port)}
+	var authorities []ssh.PublicKey
+	known := false
+
+	for rest := knownHosts; len(rest) > 0; {
+		var (
+			marker string
+			hosts  []string
+			key    ssh.PublicKey
+		)
+		if marker, hosts, key, _, rest, e = ssh.ParseKnownHosts(rest); e == io.EOF {
+			break
+		} else if e != nil {
+			return fmt.Errorf("%s: %s", knownHostsPath(), e.Error())
+		}
+
+		if marker == markerRevoked {
+			if sameKey(key, hostKey) || (cert != nil && sameKey(key, cert.SignatureKey)) {
+				return ErrHostKeyRevoked
+			}
+			continue
+		}
+
+		if !matchesHostPatterns(hosts, names) {
+			continue
+		}
+
+		known = true
+		switch marker {
+		case markerCertAuthority:
+			authorities = append(authorities, key)
+		case "":
+			if sameKey(key, hostKey) {
+				return nil
+			}
+		}
+	}
+
+	if !known {
+		fmt.Fprintln(os.Stderr, "Warning: no known_hosts entry for", host)
+		return nil
+	}
+
+	if cert == nil || len(authorities) == 0 {
+		return ErrHostKeyMismatch
+	}
+
+	return server.NewCertificateAuthority(authorities, nil).CheckHostCertificate(cert, hostKey, host)
+}
+
+func sameKey(a, b ssh.PublicKey) bool {
+	return bytes.Equal(a.Marshal(), b.Marshal())
+}
+
+// matchesHostPatterns returns true if one of names matches the host
+// patterns of a known_hosts entry and none matches a negated pattern
+func matchesHostPatterns(patterns, names []string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		for _, name := range names {
+			if matchesHostPattern(pattern, name) {
+				if negated {
+					return false
+				}
+				matched = true
+			}
+		}
+	}
+	return matched
+}
+
+func matchesHostPattern(pattern, name string) bool {
+	if strings.HasPrefix(pattern, "|1|") {
+		return matchesHashedHost(pattern, name)
+	}
+
+	return matchWildcard(strings.ToLower(pattern), strings.ToLower(name))
+}
+
+// matchWildcard matches name against a pattern where * matches any run of
+// characters and ? matches a single character. Unlike filepath.Match
+// brackets are literal so patterns such as [host]:port work.
+func matchWildcard(pattern, name string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(name); i >= 0; i-- {
+				if matchWildcard(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(name) == 0 {
+				return false
+			}
+		default:
+			if len(name) == 0 || name[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// matchesHashedHost matches a host name hashed by ssh-keygen -H
+func matchesHashedHost(pattern, name string) bool {
+	fields := strings.Split(pattern, "|")
+	if len(fields) != 4 {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(fields[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.StdEncoding.DecodeString(fields[3])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(name))
+	return hmac.Equal(mac.Sum(nil), expected)
+}
@@ -0,0 +1,120 @@
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ssh"
+)
+
+type HostKeyTestSuite struct {
+	suite.Suite
+	hostKey *rsa.PrivateKey
+	ca      ssh.Signer
+	cert    []byte
+}
+
+func (s *HostKeyTestSuite) SetupSuite() {
+	var err error
+	s.hostKey, err = rsa.GenerateKey(rand.Reader, 1024)
+	s.Require().Nil(err)
+
+	caKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	s.Require().Nil(err)
+	s.ca, err = ssh.NewSignerFromKey(caKey)
+	s.Require().Nil(err)
+}
+
+func (s *HostKeyTestSuite) SetupTest() {
+	s.cert = nil
+}
+
+func (s *HostKeyTestSuite) publicKey() ssh.PublicKey {
+	key, err := ssh.NewPublicKey(&s.hostKey.PublicKey)
+	s.Require().Nil(err)
+	return key
+}
+
+func (s *HostKeyTestSuite) entry(hosts string, key ssh.PublicKey) []byte {
+	return []byte(fmt.Sprintf("%s %s", hosts, ssh.MarshalAuthorizedKey(key)))
+}
+
+func (s *HostKeyTestSuite) certify(principals ...string) {
+	cert := &ssh.Certificate{
+		Key:             s.publicKey(),
+		CertType:        ssh.HostCert,
+		KeyId:           "files",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),
+	}
+	s.Require().Nil(cert.SignCert(rand.Reader, s.ca))
+	s.cert = cert.Marshal()
+}
+
+func (s *HostKeyTestSuite) TestUnknownHostIsAccepted() {
+	s.Nil(VerifyHostKey("files.example.com", 8978, s.publicKey(), s.cert, []byte("# nothing here\n")))
+}
+
+func (s *HostKeyTestSuite) TestKnownHostKey() {
+	knownHosts := s.entry("other.example.com", s.ca.PublicKey())
+	knownHosts = append(knownHosts, s.entry("[files.example.com]:8978", s.publicKey())...)
+	s.Nil(VerifyHostKey("files.example.com", 8978, s.publicKey(), s.cert, knownHosts))
+
+	knownHosts = s.entry("*.example.com", s.ca.PublicKey())
+	s.Equal(ErrHostKeyMismatch, VerifyHostKey("files.example.com", 8978, s.publicKey(), s.cert, knownHosts))
+}
+
+func (s *HostKeyTestSuite) TestHashedHostName() {
+	salt := []byte("0123456789abcdefghij")
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte("files.example.com"))
+	hashed := fmt.Sprintf("|1|%s|%s", base64.StdEncoding.EncodeToString(salt), base64.StdEncoding.EncodeToString(mac.Sum(nil)))
+
+	s.Equal(ErrHostKeyMismatch, VerifyHostKey("files.example.com", 8978, s.publicKey(), s.cert, s.entry(hashed, s.ca.PublicKey())))
+	s.Nil(VerifyHostKey("other.example.com", 8978, s.publicKey(), s.cert, s.entry(hashed, s.ca.PublicKey())))
+}
+
+func (s *HostKeyTestSuite) TestHostCertificate() {
+	knownHosts := s.entry("@cert-authority *.example.com,!test.example.com", s.ca.PublicKey())
+
+	s.Equal(ErrHostKeyMismatch, VerifyHostKey("files.example.com", 8978, s.publicKey(), s.cert, knownHosts))
+
+	s.certify("files.example.com")
+	s.Nil(VerifyHostKey("files.example.com", 8978, s.publicKey(), s.cert, knownHosts))
+
+	s.certify("test.example.com")
+	s.Nil(VerifyHostKey("test.example.com", 8978, s.publicKey(), s.cert, knownHosts))
+
+	s.certify("other.example.com")
+	s.NotNil(VerifyHostKey("files.example.com", 8978, s.publicKey(), s.cert, knownHosts))
+}
+
+func (s *HostKeyTestSuite) TestRevokedKeys() {
+	s.certify("files.example.com")
+	knownHosts := s.entry("@cert-authority *.example.com", s.ca.PublicKey())
+	revokedCA := append(s.entry("@revoked *", s.ca.PublicKey()), knownHosts...)
+	s.Equal(ErrHostKeyRevoked, VerifyHostKey("files.example.com", 8978, s.publicKey(), s.cert, revokedCA))
+
+	revokedHost := append(s.entry("@revoked *", s.publicKey()), knownHosts...)
+	s.Equal(ErrHostKeyRevoked, VerifyHostKey("files.example.com", 8978, s.publicKey(), s.cert, revokedHost))
+}
+
+func (s *HostKeyTestSuite) TestMatchWildcard() {
+	s.True(matchWildcard("[files.example.com]:8978", "[files.example.com]:8978"))
+	s.True(matchWildcard("*.example.com", "files.example.com"))
+	s.True(matchWildcard("10.0.0.?", "10.0.0.1"))
+	s.False(matchWildcard("10.0.0.?", "10.0.0.10"))
+	s.False(matchWildcard("*.example.com", "example.org"))
+}
+
+func TestHostKeyTestSuite(t *testing.T) {
+	suite.Run(t, new(HostKeyTestSuite))
+}
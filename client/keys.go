@@ -0,0 +1,112 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/murphybytes/ucp/crypto"
+	"golang.org/x/crypto/ssh"
+)
+
+// maxPassphraseAttempts is the number of times the user is asked for the
+// passphrase of an encrypted private key
+const maxPassphraseAttempts = 3
+
+var ErrTooManyPassphraseAttempts = errors.New("Too many incorrect passphrase attempts")
+
+// privateKeyPath returns the location of the user private key
+func privateKeyPath() string {
+	return filepath.Join(UCPDirectory, "private-key.pem")
+}
+
+// publicKeyPath returns the location of the user public key
+func publicKeyPath() string {
+	return filepath.Join(UCPDirectory, "public-key")
+}
+
+// LoadSigner returns the key used to identify the user to the server. If
+// ssh-agent is running, SSH_AUTH_SOCK is set and the agent holds the ucp key
+// the handshake is signed by the agent. Otherwise the private key is read
+// from the ucp directory and prompt is asked for the passphrase if the key
+// is encrypted.
+func LoadSigner(prompt Prompter) (signer ssh.Signer, e error) {
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" && !NoAgent {
+		var err error
+		if signer, err = getAgentSigner(socket); err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: not using ssh-agent,", err.Error())
+		}
+		if signer != nil {
+			return
+		}
+	}
+
+	return loadPrivateKey(privateKeyPath(), prompt)
+}
+
+// getAgentSigner returns a signer for the ucp public key if the agent holds
+// it. If there is no public key file the first key held by the agent is
+// used. A nil signer is returned if the agent doesn't hold the key.
+func getAgentSigner(socket string) (signer ssh.Signer, e error) {
+	var publicKey ssh.PublicKey
+	if contents, err := ioutil.ReadFile(publicKeyPath()); err == nil {
+		if publicKey, _, _, _, e = ssh.ParseAuthorizedKey(contents); e != nil {
+			return nil, fmt.Errorf("%s: %s", publicKeyPath(), e.Error())
+		}
+	}
+
+	var agent *crypto.Agent
+	if agent, e = crypto.DialAgent(socket); e != nil {
+		return
+	}
+
+	if signer, e = agent.Signer(publicKey); e != nil {
+		agent.Close()
+		if e == crypto.ErrAgentFailure {
+			return
+		}
+		return nil, nil
+	}
+
+	return
+}
+
+// loadPrivateKey reads the private key at path, prompting for its
+// passphrase if it is encrypted
+func loadPrivateKey(path string, prompt Prompter) (signer ssh.Signer, e error) {
+	var contents []byte
+	if contents, e = ioutil.ReadFile(path); e != nil {
+		return
+	}
+
+	var key interface{}
+	if key, e = crypto.ParsePrivateKey(contents); e == crypto.ErrEncryptedKey {
+		key, e = decryptPrivateKey(path, contents, prompt)
+	}
+
+	if e == ErrInteractiveAuthRequired {
+		return
+	} else if e != nil {
+		return nil, fmt.Errorf("%s: %s", path, e.Error())
+	}
+
+	return ssh.NewSignerFromKey(key)
+}
+
+func decryptPrivateKey(path string, contents []byte, prompt Prompter) (key interface{}, e error) {
+	for attempt := 0; attempt < maxPassphraseAttempts; attempt++ {
+		var passphrase string
+		if passphrase, e = prompt.GetPassphrase(path); e != nil {
+			return
+		}
+
+		if key, e = crypto.ParsePrivateKeyWithPassphrase(contents, []byte(passphrase)); e != crypto.ErrIncorrectPassphrase {
+			return
+		}
+		fmt.Fprintln(os.Stderr, e.Error())
+	}
+
+	return nil, ErrTooManyPassphraseAttempts
+}
@@ -0,0 +1,49 @@
+package client
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+var encryptedKeyPath = filepath.Join("..", "crypto", "testdata", "openssh_ed25519_encrypted")
+
+type KeysTestSuite struct {
+	suite.Suite
+	prompt *MockPrompt
+}
+
+func (s *KeysTestSuite) SetupTest() {
+	s.prompt = &MockPrompt{}
+}
+
+func (s *KeysTestSuite) TestLoadEncryptedKey() {
+	s.prompt.On("GetPassphrase", encryptedKeyPath).Return("wrong", nil).Once()
+	s.prompt.On("GetPassphrase", encryptedKeyPath).Return("secret", nil).Once()
+
+	signer, err := loadPrivateKey(encryptedKeyPath, s.prompt)
+	s.Nil(err)
+	s.NotNil(signer)
+	s.prompt.AssertExpectations(s.T())
+}
+
+func (s *KeysTestSuite) TestTooManyPassphraseAttempts() {
+	s.prompt.On("GetPassphrase", encryptedKeyPath).Return("wrong", nil).Times(maxPassphraseAttempts)
+
+	_, err := loadPrivateKey(encryptedKeyPath, s.prompt)
+	s.NotNil(err)
+	s.Contains(err.Error(), ErrTooManyPassphraseAttempts.Error())
+	s.prompt.AssertExpectations(s.T())
+}
+
+func (s *KeysTestSuite) TestLoadUnencryptedKey() {
+	signer, err := loadPrivateKey(filepath.Join("..", "crypto", "testdata", "openssh_ecdsa"), s.prompt)
+	s.Nil(err)
+	s.NotNil(signer)
+	s.prompt.AssertNotCalled(s.T(), "GetPassphrase", encryptedKeyPath)
+}
+
+func TestKeys(t *testing.T) {
+	suite.Run(t, new(KeysTestSuite))
+}
@@ -0,0 +1,377 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	unet "github.com/murphybytes/ucp/net"
+	"github.com/murphybytes/ucp/wire"
+)
+
+var ErrManifestRemote = errors.New("One of source and destination must be a remote path starting with a colon, the other a local path")
+var ErrManifestStdio = errors.New("Standard input and output can't be used in a manifest")
+var ErrManifestDownloadOptions = errors.New("no-clobber and backup only apply to uploads")
+var ErrInvalidConcurrency = errors.New("Concurrency must be at least 1")
+
+// RemotePrefix marks the path on the server in a manifest entry
+const RemotePrefix = ":"
+
+// DefaultConcurrency is the number of transfers in a batch run at once
+// unless -concurrency says otherwise
+const DefaultConcurrency = 4
+
+// maxManifestLine is the longest line a manifest may have
+const maxManifestLine = 64 * 1024
+
+// ManifestEntry is a transfer listed in a manifest. One of Source and
+// Destination is a path on the server, written with RemotePrefix in front of
+// it, and the other a local path. NoClobber and Backup are the UploadOptions
+// of an upload.
+type ManifestEntry struct {
+	Line        int    `json:"-"`
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	NoClobber   bool   `json:"no_clobber"`
+	Backup      string `json:"backup"`
+}
+
+// IsUpload returns true if the entry copies a local file to the server
+func (m *ManifestEntry) IsUpload() bool {
+	return strings.HasPrefix(m.Destination, RemotePrefix)
+}
+
+// Paths returns the local and remote paths of the entry
+func (m *ManifestEntry) Paths() (localPath, remotePath string) {
+	if m.IsUpload() {
+		return m.Source, strings.TrimPrefix(m.Destination, RemotePrefix)
+	}
+	return m.Destination, strings.TrimPrefix(m.Source, RemotePrefix)
+}
+
+// Options returns the upload options of the entry
+func (m *ManifestEntry) Options() UploadOptions {
+	return UploadOptions{NoClobber: m.NoClobber, BackupSuffix: m.Backup}
+}
+
+func (m *ManifestEntry) validate() error {
+	if strings.HasPrefix(m.Source, RemotePrefix) == m.IsUpload() {
+		return ErrManifestRemote
+	}
+
+	localPath, remotePath := m.Paths()
+	if localPath == "" || remotePath == "" {
+		return ErrManifestRemote
+	}
+
+	if localPath == StdioPath {
+		return ErrManifestStdio
+	}
+
+	if !m.IsUpload() && (m.NoClobber || m.Backup != "") {
+		return ErrManifestDownloadOptions
+	}
+
+	if m.NoClobber && m.Backup != "" {
+		return errors.New("no-clobber and backup can't be used together")
+	}
+	return nil
+}
+
+// ParseManifest reads the transfers listed in a manifest. Each line is
+// either a JSON object with the fields of a ManifestEntry, or a source and
+// destination separated by white space and followed by any of the options
+// no-clobber and backup=SUFFIX. Paths that contain white space must be
+// given as JSON. Blank lines and lines starting with # are ignored.
+func ParseManifest(r io.Reader) (entries []ManifestEntry, e error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxManifestLine)
+
+	var line int
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		var entry ManifestEntry
+		if strings.HasPrefix(text, "{") {
+			e = parseJSONEntry(text, &entry)
+		} else {
+			e = parseTextEntry(text, &entry)
+		}
+		if e == nil {
+			e = entry.validate()
+		}
+		if e != nil {
+			return nil, fmt.Errorf("Manifest line %d: %s", line, e.Error())
+		}
+
+		entry.Line = line
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+func parseJSONEntry(text string, entry *ManifestEntry) error {
+	decoder := json.NewDecoder(strings.NewReader(text))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(entry)
+}
+
+func parseTextEntry(text string, entry *ManifestEntry) error {
+	fields := strings.Fields(text)
+	if len(fields) < 2 {
+		return errors.New("Expected a source and a destination")
+	}
+
+	entry.Source, entry.Destination = fields[0], fields[1]
+	for _, option := range fields[2:] {
+		switch {
+		case option == "no-clobber":
+			entry.NoClobber = true
+		case strings.HasPrefix(option, "backup="):
+			entry.Backup = strings.TrimPrefix(option, "backup=")
+		default:
+			return fmt.Errorf("Unknown option %q", option)
+		}
+	}
+	return nil
+}
+
+// Outcomes of manifest entries
+const (
+	ManifestSucceeded = "ok"
+	ManifestFailed    = "failed"
+	ManifestSkipped   = "skipped"
+)
+
+// ManifestResult reports what happened to a manifest entry. Entries that
+// weren't attempted because an earlier one failed are skipped.
+type ManifestResult struct {
+	Line           int    `json:"line"`
+	Source         string `json:"source"`
+	Destination    string `json:"destination"`
+	Status         string `json:"status"`
+	Bytes          int64  `json:"bytes"`
+	DurationMillis int64  `json:"duration_ms"`
+	Error          string `json:"error,omitempty"`
+}
+
+// RunManifest performs the transfers in entries over a single session,
+// up to concurrency of them at once, or fewer if the server allows fewer.
+// Unless continueOnError is set no more transfers are started once one has
+// failed. The results are in the order of entries. An error is returned if
+// the server refuses the batch.
+func RunManifest(entries []ManifestEntry, concurrency int, continueOnError bool, conn unet.EncodeConn) (results []ManifestResult, e error) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	transferInfo := wire.FileTransferInformation{
+		FileTransferType: wire.Batch,
+		Concurrency:      concurrency,
+	}
+
+	if e = requestTransfer(conn, transferInfo); e != nil {
+		return
+	}
+
+	if e = conn.Read(&transferInfo); e != nil {
+		return
+	}
+
+	if transferInfo.Error != nil {
+		return nil, transferInfo.Error
+	}
+
+	if transferInfo.Concurrency < 1 || transferInfo.Concurrency > concurrency {
+		return nil, ErrBadRequest
+	}
+
+	results = make([]ManifestResult, len(entries))
+	for i := range entries {
+		results[i] = ManifestResult{
+			Line:        entries[i].Line,
+			Source:      entries[i].Source,
+			Destination: entries[i].Destination,
+			Status:      ManifestSkipped,
+		}
+	}
+
+	mux := unet.NewMux(conn, 0)
+	var mu sync.Mutex
+	var next int
+	var failed bool
+
+	// take returns the next entry to perform, if there is one and no
+	// earlier failure stops the batch
+	take := func() (i int, ok bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if next == len(entries) || (failed && !continueOnError) {
+			return 0, false
+		}
+		next++
+		return next - 1, true
+	}
+
+	var workers sync.WaitGroup
+	for n := 0; n < transferInfo.Concurrency; n++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for i, ok := take(); ok; i, ok = take() {
+				runManifestEntry(mux, &entries[i], &results[i])
+
+				if results[i].Status == ManifestFailed {
+					mu.Lock()
+					failed = true
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	workers.Wait()
+
+	return
+}
+
+// runManifestEntry performs a single transfer on a channel of its own
+func runManifestEntry(mux *unet.Mux, entry *ManifestEntry, result *ManifestResult) {
+	started := time.Now()
+	localPath, remotePath := entry.Paths()
+
+	channel, e := mux.Open()
+	if e == nil {
+		if entry.IsUpload() {
+			e = SendFile(localPath, remotePath, entry.Options(), channel)
+		} else {
+			e = ReceiveFile(localPath, remotePath, channel)
+		}
+		channel.Close()
+	}
+
+	result.DurationMillis = int64(time.Since(started) / time.Millisecond)
+	if e != nil {
+		result.Status = ManifestFailed
+		result.Error = e.Error()
+		return
+	}
+
+	result.Status = ManifestSucceeded
+	if info, err := os.Stat(localPath); err == nil {
+		result.Bytes = info.Size()
+	}
+}
+
+// WriteManifestReport writes results to w as JSON, one result per line
+func WriteManifestReport(w io.Writer, results []ManifestResult) (e error) {
+	encoder := json.NewEncoder(w)
+	for i := range results {
+		if e = encoder.Encode(&results[i]); e != nil {
+			return
+		}
+	}
+	return
+}
+
+// ManifestExitCode returns SuccessCode if every entry succeeded,
+// PartialFailureCode if some did and ErrorCode if none did
+func ManifestExitCode(results []ManifestResult) int {
+	var succeeded int
+	for _, result := range results {
+		if result.Status == ManifestSucceeded {
+			succeeded++
+		}
+	}
+
+	switch succeeded {
+	case len(results):
+		return SuccessCode
+	case 0:
+		return ErrorCode
+	}
+	return PartialFailureCode
+}
+
+// parseBatch returns the command that performs the transfers listed in
+// BatchFile. The manifest is read before the client connects, so a bad one
+// fails before the session has started. The report is only written once
+// the transfers have been performed, so one from an earlier run is left as
+// it was if the batch can't be run.
+func parseBatch() (command Command, e error) {
+	if Concurrency < 1 {
+		return nil, ErrInvalidConcurrency
+	}
+
+	var entries []ManifestEntry
+	if entries, e = loadManifest(BatchFile); e != nil {
+		return nil, fmt.Errorf("Unable to read manifest: %s", e.Error())
+	}
+
+	return func(conn unet.EncodeConn) (code int, e error) {
+		var results []ManifestResult
+		if results, e = RunManifest(entries, Concurrency, ContinueOnError, conn); e != nil {
+			return
+		}
+
+		printSummary(os.Stderr, results)
+		if e = writeReport(ReportFile, results); e != nil {
+			return
+		}
+		return ManifestExitCode(results), nil
+	}, nil
+}
+
+// writeReport writes results to the file at path, or to Stdout if path
+// isn't set
+func writeReport(path string, results []ManifestResult) (e error) {
+	if path == "" {
+		return WriteManifestReport(Stdout, results)
+	}
+
+	var f *os.File
+	if f, e = os.Create(path); e != nil {
+		return
+	}
+
+	if e = WriteManifestReport(f, results); e != nil {
+		f.Close()
+		return
+	}
+	return f.Close()
+}
+
+// loadManifest reads the manifest at path, StdioPath for Stdin
+func loadManifest(path string) (entries []ManifestEntry, e error) {
+	in := Stdin
+	if path != StdioPath {
+		var f *os.File
+		if f, e = os.Open(path); e != nil {
+			return
+		}
+		defer f.Close()
+		in = f
+	}
+
+	return ParseManifest(in)
+}
+
+// printSummary reports how many entries ended each way
+func printSummary(out io.Writer, results []ManifestResult) {
+	counts := make(map[string]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	fmt.Fprintf(out, "%d transfers: %d succeeded, %d failed, %d skipped\n", len(results),
+		counts[ManifestSucceeded], counts[ManifestFailed], counts[ManifestSkipped])
+}
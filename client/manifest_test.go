@@ -0,0 +1,173 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type ManifestSuite struct {
+	suite.Suite
+}
+
+func (s *ManifestSuite) TestParse() {
+	manifest := `
+# nightly transfers
+/data/a.csv   :/srv/incoming/a.csv  no-clobber
+:/srv/outgoing/b.csv /data/b.csv
+{"source": "/data/with space.csv", "destination": ":/srv/incoming/with space.csv", "backup": ".orig"}
+`
+	entries, err := ParseManifest(strings.NewReader(manifest))
+	s.Require().Nil(err)
+	s.Require().Len(entries, 3)
+
+	s.Equal(3, entries[0].Line)
+	s.True(entries[0].IsUpload())
+	localPath, remotePath := entries[0].Paths()
+	s.Equal("/data/a.csv", localPath)
+	s.Equal("/srv/incoming/a.csv", remotePath)
+	s.Equal(UploadOptions{NoClobber: true}, entries[0].Options())
+
+	s.False(entries[1].IsUpload())
+	localPath, remotePath = entries[1].Paths()
+	s.Equal("/data/b.csv", localPath)
+	s.Equal("/srv/outgoing/b.csv", remotePath)
+
+	localPath, remotePath = entries[2].Paths()
+	s.Equal("/data/with space.csv", localPath)
+	s.Equal("/srv/incoming/with space.csv", remotePath)
+	s.Equal(UploadOptions{BackupSuffix: ".orig"}, entries[2].Options())
+}
+
+func (s *ManifestSuite) TestParseErrors() {
+	for _, line := range []string{
+		"/data/a.csv",
+		"/data/a.csv /data/b.csv",
+		":/srv/a.csv :/srv/b.csv",
+		"/data/a.csv :",
+		"- :/srv/a.csv",
+		":/srv/a.csv /data/a.csv no-clobber",
+		"/data/a.csv :/srv/a.csv no-clobber backup=.orig",
+		"/data/a.csv :/srv/a.csv compress",
+		`{"source": "/data/a.csv", "destination": ":/srv/a.csv", "mode": "0600"}`,
+		`{"source": "/data/a.csv"`,
+	} {
+		_, err := ParseManifest(strings.NewReader("\n" + line + "\n"))
+		s.Require().NotNil(err, line)
+		s.True(strings.HasPrefix(err.Error(), "Manifest line 2: "), err.Error())
+	}
+}
+
+func (s *ManifestSuite) TestExitCode() {
+	ok := ManifestResult{Status: ManifestSucceeded}
+	failed := ManifestResult{Status: ManifestFailed}
+	skipped := ManifestResult{Status: ManifestSkipped}
+
+	s.Equal(SuccessCode, ManifestExitCode(nil))
+	s.Equal(SuccessCode, ManifestExitCode([]ManifestResult{ok, ok}))
+	s.Equal(PartialFailureCode, ManifestExitCode([]ManifestResult{ok, failed}))
+	s.Equal(PartialFailureCode, ManifestExitCode([]ManifestResult{ok, skipped}))
+	s.Equal(ErrorCode, ManifestExitCode([]ManifestResult{failed, skipped}))
+}
+
+func (s *ManifestSuite) TestLoadManifest() {
+	f, err := ioutil.TempFile("", "manifest")
+	s.Require().Nil(err)
+	defer os.Remove(f.Name())
+	f.WriteString("/data/a.csv :/srv/incoming/a.csv\n")
+	f.Close()
+
+	entries, err := loadManifest(f.Name())
+	s.Nil(err)
+	s.Len(entries, 1)
+
+	_, err = loadManifest(f.Name() + ".missing")
+	s.NotNil(err)
+}
+
+func (s *ManifestSuite) TestParseBatch() {
+	defer func(batchFile string, concurrency int) {
+		BatchFile, Concurrency = batchFile, concurrency
+	}(BatchFile, Concurrency)
+
+	f, err := ioutil.TempFile("", "manifest")
+	s.Require().Nil(err)
+	defer os.Remove(f.Name())
+	f.WriteString("/data/a.csv :/srv/incoming/a.csv\n")
+	f.Close()
+
+	BatchFile, Concurrency = f.Name(), 0
+	_, err = parseBatch()
+	s.Equal(ErrInvalidConcurrency, err)
+
+	Concurrency = DefaultConcurrency
+	command, err := parseBatch()
+	s.Nil(err)
+	s.NotNil(command)
+
+	BatchFile = f.Name() + ".missing"
+	_, err = parseBatch()
+	s.NotNil(err)
+}
+
+func (s *ManifestSuite) TestBatchLeavesReportIfNotRun() {
+	defer func(batchFile, reportFile string) {
+		BatchFile, ReportFile = batchFile, reportFile
+	}(BatchFile, ReportFile)
+
+	dir, err := ioutil.TempDir("", "batch")
+	s.Require().Nil(err)
+	defer os.RemoveAll(dir)
+	BatchFile = filepath.Join(dir, "manifest")
+	ReportFile = filepath.Join(dir, "report")
+	s.Require().Nil(ioutil.WriteFile(BatchFile, []byte("/data/a.csv :/srv/incoming/a.csv\n"), 0600))
+	s.Require().Nil(ioutil.WriteFile(ReportFile, []byte("earlier\n"), 0600))
+
+	command, err := parseBatch()
+	s.Require().Nil(err)
+
+	conn := new(MockConnection)
+	conn.On("Read", mock.Anything).Return(errors.New("connection closed"))
+	_, err = command(conn)
+	s.NotNil(err)
+
+	report, err := ioutil.ReadFile(ReportFile)
+	s.Nil(err)
+	s.Equal("earlier\n", string(report))
+}
+
+func (s *ManifestSuite) TestWriteReport() {
+	dir, err := ioutil.TempDir("", "report")
+	s.Require().Nil(err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "report")
+	s.Nil(writeReport(path, []ManifestResult{{Line: 1, Status: ManifestSucceeded}}))
+	report, err := ioutil.ReadFile(path)
+	s.Nil(err)
+	s.Equal(`{"line":1,"source":"","destination":"","status":"ok","bytes":0,"duration_ms":0}`+"\n", string(report))
+
+	s.NotNil(writeReport(filepath.Join(dir, "missing", "report"), nil))
+}
+
+func (s *ManifestSuite) TestPrintSummary() {
+	var out bytes.Buffer
+	printSummary(&out, []ManifestResult{
+		{Status: ManifestSucceeded},
+		{Status: ManifestSucceeded},
+		{Status: ManifestFailed},
+		{Status: ManifestSkipped},
+	})
+	s.Equal("4 transfers: 2 succeeded, 1 failed, 1 skipped\n", out.String())
+}
+
+func TestManifestSuite(t *testing.T) {
+	suite.Run(t, new(ManifestSuite))
+}
@@ -0,0 +1,258 @@
+package client
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+
+	unet "github.com/murphybytes/ucp/net"
+	"github.com/murphybytes/ucp/server"
+	"github.com/murphybytes/ucp/wire"
+)
+
+// requestTransfer waits for the server to ask what the client wants and
+// sends transferInfo in reply
+func requestTransfer(conn unet.EncodeConn, transferInfo wire.FileTransferInformation) (e error) {
+	var request wire.Conversation
+	if e = conn.Read(&request); e != nil {
+		return
+	}
+
+	if request == wire.ServerShutdown {
+		return wire.ErrServerShutdown
+	}
+
+	if request != wire.FileTransferInformationRequest {
+		return ErrBadRequest
+	}
+
+	return conn.Write(transferInfo)
+}
+
+// StdioPath as a local path reads an upload from Stdin or writes a
+// download to Stdout
+const StdioPath = "-"
+
+// Stdin and Stdout are used in place of a local file for StdioPath
+var Stdin io.Reader = os.Stdin
+var Stdout io.Writer = os.Stdout
+
+// ReceiveFile downloads remotePath from the server to localPath. The local
+// file is only created once the server has opened the remote one.
+func ReceiveFile(localPath, remotePath string, conn unet.EncodeConn) (e error) {
+	transferInfo := wire.FileTransferInformation{
+		FileTransferType: wire.FileSend,
+		FileName:         remotePath,
+	}
+
+	if e = requestTransfer(conn, transferInfo); e != nil {
+		return
+	}
+
+	if e = conn.Read(&transferInfo); e != nil {
+		return
+	}
+
+	if transferInfo.Error != nil {
+		return transferInfo.Error
+	}
+
+	out := Stdout
+	var localFile *os.File
+	if localPath != StdioPath {
+		if localFile, e = os.Create(localPath); e != nil {
+			conn.Write(wire.FileTransferAbort)
+			return
+		}
+		defer localFile.Close()
+		out = localFile
+	}
+
+	if e = conn.Write(wire.FileTransferStart); e != nil {
+		return
+	}
+
+	if e = receiveStream(out, conn); e != nil || localFile == nil {
+		return
+	}
+
+	return localFile.Close()
+}
+
+// receiveStream writes the file data sent by the server to out until the
+// server ends the stream, then checks all of it arrived
+func receiveStream(out io.Writer, conn unet.EncodeConn) (e error) {
+	hash := sha256.New()
+	var received int64
+	for {
+		var chunk wire.FileChunk
+		var buffer []byte
+		if buffer, e = conn.ReadData(&chunk); e != nil {
+			return
+		}
+
+		if buffer == nil {
+			switch {
+			case chunk.Error != nil:
+				return chunk.Error
+			case chunk.End == nil:
+				return ErrBadRequest
+			}
+			return chunk.End.Check(received, hex.EncodeToString(hash.Sum(nil)))
+		}
+
+		received += int64(len(buffer))
+		hash.Write(buffer)
+		_, e = out.Write(buffer)
+		unet.PutBuffer(buffer)
+		if e != nil {
+			conn.Write(wire.FileTransferFail)
+			return
+		}
+
+		if e = conn.Write(wire.FileTransferMore); e != nil {
+			return
+		}
+	}
+}
+
+// UploadOptions control what happens when an upload's destination exists.
+// NoClobber has the server refuse the upload, BackupSuffix has it keep the
+// file being replaced under its name with the suffix added. By default the
+// file is replaced.
+type UploadOptions struct {
+	NoClobber    bool
+	BackupSuffix string
+}
+
+// SendFile uploads localPath to remotePath on the server. The file is sent
+// in buffers no larger than the server asks for, followed by the end of
+// the stream.
+func SendFile(localPath, remotePath string, options UploadOptions, conn unet.EncodeConn) (e error) {
+	if localPath == StdioPath {
+		return sendStream(Stdin, wire.UnknownSize, remotePath, options, conn)
+	}
+
+	var localFile *os.File
+	if localFile, e = os.Open(localPath); e != nil {
+		return
+	}
+	defer localFile.Close()
+
+	var info os.FileInfo
+	if info, e = localFile.Stat(); e != nil {
+		return
+	}
+
+	size := info.Size()
+	if !info.Mode().IsRegular() {
+		size = wire.UnknownSize
+	}
+
+	return sendStream(localFile, size, remotePath, options, conn)
+}
+
+// sendStream uploads what it reads from in to remotePath. size is only
+// used to tell the server how much to expect and may be UnknownSize.
+func sendStream(in io.Reader, size int64, remotePath string, options UploadOptions, conn unet.EncodeConn) (e error) {
+	transferInfo := wire.FileTransferInformation{
+		FileTransferType: wire.FileReceive,
+		FileName:         remotePath,
+		FileSize:         size,
+		NoClobber:        options.NoClobber,
+		BackupSuffix:     options.BackupSuffix,
+	}
+
+	if e = requestTransfer(conn, transferInfo); e != nil {
+		return
+	}
+
+	var reply wire.FileTransferInformation
+	if e = conn.Read(&reply); e != nil {
+		return
+	}
+
+	if reply.Error != nil {
+		return reply.Error
+	}
+
+	chunkSize := reply.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = server.PipeBufferSize
+	}
+
+	// the server replies once the stream has ended, or as soon as it stops
+	// the upload part way, so its reply is read while the file is sent
+	replies := readReply(conn)
+
+	buffer := make([]byte, chunkSize)
+	hash := sha256.New()
+	var sent int64
+	for {
+		select {
+		case reply = <-replies:
+			if reply.Error != nil {
+				return reply.Error
+			}
+			return ErrBadRequest
+		default:
+		}
+
+		var read int
+		read, e = io.ReadFull(in, buffer)
+		if read > 0 {
+			if err := conn.WriteData(buffer[:read]); err != nil {
+				// a server that stopped the upload says why before it
+				// goes away
+				if reply = <-replies; reply.Error != nil {
+					return reply.Error
+				}
+				return err
+			}
+			hash.Write(buffer[:read])
+			sent += int64(read)
+		}
+
+		if e == io.EOF || e == io.ErrUnexpectedEOF {
+			break
+		}
+
+		if e != nil {
+			// the server throws away what it has been sent and tells us
+			// it has before we give up
+			conn.Write(wire.FileChunk{Error: wire.NewError(wire.UnknownError, e.Error())})
+			<-replies
+			return
+		}
+	}
+
+	end := &wire.EndOfStream{Size: sent, Hash: hex.EncodeToString(hash.Sum(nil))}
+	if e = conn.Write(wire.FileChunk{End: end}); e != nil {
+		return
+	}
+
+	if reply = <-replies; reply.Error != nil {
+		return reply.Error
+	}
+
+	if reply.FileSize != sent {
+		return fmt.Errorf("Server received %d of %d bytes", reply.FileSize, sent)
+	}
+	return
+}
+
+// readReply reads the server's reply to an upload in the background. A
+// reply that can't be read carries the error in its place.
+func readReply(conn unet.EncodeConn) <-chan wire.FileTransferInformation {
+	replies := make(chan wire.FileTransferInformation, 1)
+	go func() {
+		var reply wire.FileTransferInformation
+		if err := conn.Read(&reply); err != nil {
+			reply.Error = err
+		}
+		replies <- reply
+	}()
+	return replies
+}
@@ -3,6 +3,7 @@ package client
 import (
 	"errors"
 	"fmt"
+	"os"
 
 	"github.com/murphybytes/ucp/net"
 	"github.com/murphybytes/ucp/wire"
@@ -11,18 +12,51 @@ import (
 
 type Prompter interface {
 	GetPassword() (string, error)
+	GetPassphrase(keyPath string) (string, error)
 }
 
+// Prompt asks for passwords and passphrases. A password is read from
+// PasswordFile if it is set. Otherwise the program named by UCP_ASKPASS is
+// run if it is set, and the terminal is used as a last resort unless Batch
+// is set.
 type Prompt struct {
 }
 
 func (p *Prompt) GetPassword() (pwd string, e error) {
-	fmt.Println("Enter Password: ")
+	if PasswordFile != "" {
+		return readPasswordFile(PasswordFile)
+	}
+	return p.read("Enter Password: ")
+}
+
+func (p *Prompt) GetPassphrase(keyPath string) (passphrase string, e error) {
+	return p.read(fmt.Sprintf("Enter passphrase for %s: ", keyPath))
+}
+
+func (p *Prompt) read(prompt string) (response string, e error) {
+	var ok bool
+	if response, ok, e = askpass(prompt); ok {
+		return
+	}
+
+	if Batch {
+		return "", ErrInteractiveAuthRequired
+	}
+
+	// prompt on the terminal rather than standard input and output, which
+	// may be carrying the file being transferred
+	var in, out *os.File = os.Stdin, os.Stderr
+	if tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0); err == nil {
+		defer tty.Close()
+		in, out = tty, tty
+	}
+
+	fmt.Fprintln(out, prompt)
 	var buff []byte
-	if buff, e = terminal.ReadPassword(0); e != nil {
+	if buff, e = terminal.ReadPassword(int(in.Fd())); e != nil {
 		return
 	}
-	pwd = string(buff)
+	response = string(buff)
 	return
 }
 
@@ -33,6 +67,10 @@ func HandleUserAuthorization(conn net.EncodeConn, prompt Prompter) (e error) {
 		return
 	}
 
+	if request == wire.ServerShutdown {
+		return wire.ErrServerShutdown
+	}
+
 	if request != wire.UserNameRequest {
 		return ErrBadRequest
 	}
@@ -51,7 +89,12 @@ func HandleUserAuthorization(conn net.EncodeConn, prompt Prompter) (e error) {
 		switch response.AuthResponse {
 		case wire.Authorized:
 			return
-		case wire.NonexistantUser, wire.IncorrectPassword:
+		case wire.NonexistantUser, wire.IncorrectPassword, wire.Unauthorized:
+			return errors.New(response.Description)
+		case wire.Rejected:
+			if response.Error != nil {
+				return response.Error
+			}
 			return errors.New(response.Description)
 		case wire.PasswordRequired:
 			var pwd string
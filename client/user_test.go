@@ -22,6 +22,17 @@ func (mc *MockConnection) Read(v interface{}) error {
 	return args.Error(0)
 }
 
+func (mc *MockConnection) WriteData(data []byte) error {
+	args := mc.Called(data)
+	return args.Error(0)
+}
+
+func (mc *MockConnection) ReadData(v interface{}) ([]byte, error) {
+	args := mc.Called(v)
+	data, _ := args.Get(0).([]byte)
+	return data, args.Error(1)
+}
+
 type MockPrompt struct {
 	mock.Mock
 }
@@ -31,6 +42,11 @@ func (mp *MockPrompt) GetPassword() (pwd string, e error) {
 	return args.String(0), args.Error(1)
 }
 
+func (mp *MockPrompt) GetPassphrase(keyPath string) (passphrase string, e error) {
+	args := mp.Called(keyPath)
+	return args.String(0), args.Error(1)
+}
+
 type UserTestSuite struct {
 	suite.Suite
 	prompt *MockPrompt
@@ -301,6 +317,26 @@ func (s *UserTestSuite) TestAuthWithNonExistantUser() {
 
 }
 
+func (s *UserTestSuite) TestAuthWhenServerShuttingDown() {
+
+	s.conn.On(
+		"Read",
+		mock.AnythingOfType("*wire.Conversation"),
+	).Return(
+		nil,
+	).Run(
+		func(args mock.Arguments) {
+			arg := args.Get(0).(*wire.Conversation)
+			*arg = wire.ServerShutdown
+		},
+	)
+
+	e := HandleUserAuthorization(s.conn, s.prompt)
+	s.Equal(wire.ErrServerShutdown, e)
+	s.conn.AssertNotCalled(s.T(), "Write", mock.Anything)
+
+}
+
 func TestUserTestSuite(t *testing.T) {
 	suite.Run(t, new(UserTestSuite))
 }
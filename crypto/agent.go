@@ -0,0 +1,194 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrAgentFailure = errors.New("ssh-agent refused the request")
+var ErrNoAgentKeys = errors.New("ssh-agent holds no keys")
+
+// ssh-agent protocol messages, see draft-miller-ssh-agent
+const (
+	agentFailure           = 5
+	agentRequestIdentities = 11
+	agentIdentitiesAnswer  = 12
+	agentSignRequest       = 13
+	agentSignResponse      = 14
+)
+
+// maxAgentReplySize limits the size of a reply read from the agent
+const maxAgentReplySize = 256 * 1024
+
+// Agent is a client for a running ssh-agent. It signs data with keys held by
+// the agent so the private key is never read by ucp.
+type Agent struct {
+	mu   sync.Mutex
+	conn io.ReadWriteCloser
+}
+
+// DialAgent connects to the ssh-agent listening on the unix socket at path,
+// normally the value of SSH_AUTH_SOCK
+func DialAgent(path string) (agent *Agent, e error) {
+	var conn net.Conn
+	if conn, e = net.Dial("unix", path); e != nil {
+		return
+	}
+	return NewAgent(conn), nil
+}
+
+// NewAgent returns an Agent that talks to an ssh-agent over conn
+func NewAgent(conn io.ReadWriteCloser) *Agent {
+	return &Agent{conn: conn}
+}
+
+// Close closes the connection to the agent
+func (a *Agent) Close() error {
+	return a.conn.Close()
+}
+
+// Signers returns a signer for each key held by the agent
+func (a *Agent) Signers() (signers []ssh.Signer, e error) {
+	var reply []byte
+	if reply, e = a.call([]byte{agentRequestIdentities}); e != nil {
+		return
+	}
+
+	if reply[0] != agentIdentitiesAnswer {
+		return nil, ErrAgentFailure
+	}
+
+	var answer struct {
+		NumKeys uint32
+		Keys    []byte `ssh:"rest"`
+	}
+	if e = ssh.Unmarshal(reply[1:], &answer); e != nil {
+		return
+	}
+
+	rest := answer.Keys
+	for i := uint32(0); i < answer.NumKeys; i++ {
+		var identity struct {
+			Blob    []byte
+			Comment string
+			Rest    []byte `ssh:"rest"`
+		}
+		if e = ssh.Unmarshal(rest, &identity); e != nil {
+			return nil, e
+		}
+		rest = identity.Rest
+
+		var key ssh.PublicKey
+		if key, e = ssh.ParsePublicKey(identity.Blob); e != nil {
+			return nil, e
+		}
+		signers = append(signers, &agentSigner{agent: a, key: key})
+	}
+
+	return
+}
+
+// Signer returns a signer for the agent key that matches key, or the first
+// key held by the agent if key is nil
+func (a *Agent) Signer(key ssh.PublicKey) (signer ssh.Signer, e error) {
+	var signers []ssh.Signer
+	if signers, e = a.Signers(); e != nil {
+		return
+	}
+
+	for _, s := range signers {
+		if key == nil || bytes.Equal(s.PublicKey().Marshal(), key.Marshal()) {
+			return s, nil
+		}
+	}
+
+	if key == nil {
+		return nil, ErrNoAgentKeys
+	}
+	return nil, fmt.Errorf("ssh-agent does not hold key %s", KeyFingerprint(key))
+}
+
+func (a *Agent) sign(key ssh.PublicKey, data []byte) (signature *ssh.Signature, e error) {
+	request := ssh.Marshal(struct {
+		Key   []byte
+		Data  []byte
+		Flags uint32
+	}{key.Marshal(), data, 0})
+
+	var reply []byte
+	if reply, e = a.call(append([]byte{agentSignRequest}, request...)); e != nil {
+		return
+	}
+
+	if reply[0] != agentSignResponse {
+		return nil, ErrAgentFailure
+	}
+
+	var response struct {
+		Signature []byte
+	}
+	if e = ssh.Unmarshal(reply[1:], &response); e != nil {
+		return
+	}
+
+	signature = new(ssh.Signature)
+	if e = ssh.Unmarshal(response.Signature, signature); e != nil {
+		return nil, e
+	}
+	return
+}
+
+// call sends a request to the agent and reads its reply. Every message is
+// prefixed with its length.
+func (a *Agent) call(request []byte) (reply []byte, e error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	message := make([]byte, 4+len(request))
+	binary.BigEndian.PutUint32(message, uint32(len(request)))
+	copy(message[4:], request)
+	if _, e = a.conn.Write(message); e != nil {
+		return
+	}
+
+	var length [4]byte
+	if _, e = io.ReadFull(a.conn, length[:]); e != nil {
+		return
+	}
+
+	size := binary.BigEndian.Uint32(length[:])
+	if size == 0 || size > maxAgentReplySize {
+		return nil, fmt.Errorf("Invalid ssh-agent reply size %d", size)
+	}
+
+	reply = make([]byte, size)
+	if _, e = io.ReadFull(a.conn, reply); e != nil {
+		return nil, e
+	}
+
+	if reply[0] == agentFailure {
+		return nil, ErrAgentFailure
+	}
+	return
+}
+
+// agentSigner is an ssh.Signer that signs with a key held by the agent
+type agentSigner struct {
+	agent *Agent
+	key   ssh.PublicKey
+}
+
+func (s *agentSigner) PublicKey() ssh.PublicKey {
+	return s.key
+}
+
+func (s *agentSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.agent.sign(s.key, data)
+}
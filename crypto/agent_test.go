@@ -0,0 +1,123 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// serveAgent answers ssh-agent requests on conn with keys
+func serveAgent(conn net.Conn, keys []ssh.Signer) {
+	defer conn.Close()
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		request := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+
+		reply := []byte{agentFailure}
+		switch request[0] {
+		case agentRequestIdentities:
+			reply = append([]byte{agentIdentitiesAnswer}, ssh.Marshal(struct{ N uint32 }{uint32(len(keys))})...)
+			for _, key := range keys {
+				reply = append(reply, ssh.Marshal(struct {
+					Blob    []byte
+					Comment string
+				}{key.PublicKey().Marshal(), "test"})...)
+			}
+		case agentSignRequest:
+			var sign struct {
+				Key   []byte
+				Data  []byte
+				Flags uint32
+			}
+			ssh.Unmarshal(request[1:], &sign)
+			for _, key := range keys {
+				if bytes.Equal(key.PublicKey().Marshal(), sign.Key) {
+					sig, _ := key.Sign(nil, sign.Data)
+					reply = append([]byte{agentSignResponse}, ssh.Marshal(struct{ Sig []byte }{ssh.Marshal(sig)})...)
+				}
+			}
+		}
+
+		binary.BigEndian.PutUint32(length[:], uint32(len(reply)))
+		conn.Write(append(length[:], reply...))
+	}
+}
+
+func newTestSigner(t *testing.T, keyType string) ssh.Signer {
+	key, err := GenerateKey(keyType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func TestAgentSigner(t *testing.T) {
+	keys := []ssh.Signer{newTestSigner(t, KeyTypeECDSA), newTestSigner(t, KeyTypeEd25519)}
+
+	client, server := net.Pipe()
+	go serveAgent(server, keys)
+
+	agent := NewAgent(client)
+	defer agent.Close()
+
+	signers, err := agent.Signers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 2 {
+		t.Fatal("Expected 2 agent keys, got", len(signers))
+	}
+
+	signer, err := agent.Signer(keys[1].PublicKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sessionID := SessionID(nil, nil, nil, nil, []byte("secret"))
+	signature, err := SignSession(signer, RoleClient, sessionID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = VerifySession(keys[1].PublicKey(), RoleClient, sessionID, signature); err != nil {
+		t.Fatal("Agent signature didn't verify -", err.Error())
+	}
+
+	if signer, err = agent.Signer(nil); err != nil || !bytes.Equal(signer.PublicKey().Marshal(), keys[0].PublicKey().Marshal()) {
+		t.Fatal("Expected the first agent key")
+	}
+
+	if _, err = agent.Signer(newTestSigner(t, KeyTypeEd25519).PublicKey()); err == nil {
+		t.Fatal("Expected an error for a key the agent doesn't hold")
+	}
+}
+
+func TestEmptyAgent(t *testing.T) {
+	client, server := net.Pipe()
+	go serveAgent(server, nil)
+
+	agent := NewAgent(client)
+	defer agent.Close()
+
+	if _, err := agent.Signer(nil); err != ErrNoAgentKeys {
+		t.Fatal("Expected ErrNoAgentKeys, got", err)
+	}
+
+	unknown := &agentSigner{agent: agent, key: newTestSigner(t, KeyTypeEd25519).PublicKey()}
+	if _, err := unknown.Sign(nil, []byte("data")); err != ErrAgentFailure {
+		t.Fatal("Expected ErrAgentFailure, got", err)
+	}
+}
@@ -7,7 +7,8 @@ import (
 	"crypto/md5"
 	"crypto/rand"
 	"crypto/rsa"
-	"crypto/x509"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -27,8 +28,8 @@ const (
 	KeySize     = 4096
 )
 
-// Sets up directory used by UCP
-func InitializeUcpDir(ucpdir string) (e error) {
+// Sets up directory used by UCP, keys of keyType are generated
+func InitializeUcpDir(ucpdir, keyType string) (e error) {
 
 	_, err := os.Stat(ucpdir)
 
@@ -48,21 +49,21 @@ func InitializeUcpDir(ucpdir string) (e error) {
 
 	privateKeyPath := filepath.Join(ucpdir, "private-key.pem")
 	publicKeyPath := filepath.Join(ucpdir, "public-key")
-	e = UcpKeyGenerate(privateKeyPath, publicKeyPath)
+	e = UcpKeyGenerate(privateKeyPath, publicKeyPath, keyType)
 	return
 }
 
-// generates public/private keys and write each to file
-func UcpKeyGenerate(privateKeyPath, publicKeyPath string) (e error) {
-	var privateKey *rsa.PrivateKey
+// generates public/private keys of keyType and write each to file
+func UcpKeyGenerate(privateKeyPath, publicKeyPath, keyType string) (e error) {
+	var privateKey interface{}
 
-	if privateKey, e = rsa.GenerateKey(rand.Reader, KeySize); e != nil {
+	if privateKey, e = GenerateKey(keyType); e != nil {
 		return
 	}
 
-	var pemkey = &pem.Block{
-		Type:  "RSA PRIVATE KEY",
-		Bytes: x509.MarshalPKCS1PrivateKey(privateKey),
+	var pemkey *pem.Block
+	if pemkey, e = MarshalPrivateKey(privateKey); e != nil {
+		return
 	}
 
 	var privateKeyFile *os.File
@@ -78,7 +79,7 @@ func UcpKeyGenerate(privateKeyPath, publicKeyPath string) (e error) {
 	privateKeyFile.Chmod(0600)
 
 	var encodedKeyBuffer []byte
-	if encodedKeyBuffer, e = CreateBase64EncodedPublicKey(privateKey); e != nil {
+	if encodedKeyBuffer, e = CreateBase64EncodedPublicKey(privateKey.(crypto.Signer)); e != nil {
 		return
 	}
 
@@ -92,16 +93,23 @@ func UcpKeyGenerate(privateKeyPath, publicKeyPath string) (e error) {
 
 // CreateBase64EncodedPublicKey returns a textual representation of the pubilc
 // key suitable for authorized_keys files
-func CreateBase64EncodedPublicKey(key *rsa.PrivateKey) (encodedKey []byte, e error) {
+func CreateBase64EncodedPublicKey(key crypto.Signer) (encodedKey []byte, e error) {
 	var publicKey ssh.PublicKey
-	if publicKey, e = ssh.NewPublicKey(&key.PublicKey); e == nil {
+	if publicKey, e = ssh.NewPublicKey(key.Public()); e == nil {
 		encodedKey = ssh.MarshalAuthorizedKey(publicKey)
 	}
 
 	return encodedKey, e
 }
 
-// GetPrivateKey returns a private key
+// KeyFingerprint returns the SHA256 fingerprint of a public key in the same
+// format used by ssh-keygen -l
+func KeyFingerprint(key ssh.PublicKey) string {
+	sum := sha256.Sum256(key.Marshal())
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// GetPrivateKey returns an RSA private key
 func GetPrivateKey(privateKeyPath string) (key *rsa.PrivateKey, e error) {
 
 	var buff []byte
@@ -109,10 +117,14 @@ func GetPrivateKey(privateKeyPath string) (key *rsa.PrivateKey, e error) {
 		return
 	}
 
-	block, _ := pem.Decode(buff)
+	var parsed interface{}
+	if parsed, e = ParsePrivateKey(buff); e != nil {
+		return nil, fmt.Errorf("%s: %s", privateKeyPath, e.Error())
+	}
 
-	if key, e = x509.ParsePKCS1PrivateKey(block.Bytes); e != nil {
-		return
+	var ok bool
+	if key, ok = parsed.(*rsa.PrivateKey); !ok {
+		e = fmt.Errorf("%s: not an RSA private key", privateKeyPath)
 	}
 
 	return
@@ -51,6 +51,20 @@ func TestAESEncryption(t *testing.T) {
 
 }
 
+// BenchmarkAES measures the cipher on its own, without framing
+func BenchmarkAES(b *testing.B) {
+	iv := make([]byte, IVBlockSize)
+	block, _, _ := NewCipherBlock()
+	buffer := make([]byte, 100000)
+
+	b.SetBytes(int64(len(buffer)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		DecryptAES(block, iv, EncryptAES(block, iv, buffer))
+	}
+}
+
 func TestEncryption(t *testing.T) {
 	testdir, err := CreateTestDirectory()
 	if err != nil {
@@ -61,7 +75,7 @@ func TestEncryption(t *testing.T) {
 	publicKeyPath := fmt.Sprint(testdir, "/id_rsa.pub")
 	privateKeyPath := fmt.Sprint(testdir, "/private.pem")
 
-	if err = UcpKeyGenerate(privateKeyPath, publicKeyPath); err != nil {
+	if err = UcpKeyGenerate(privateKeyPath, publicKeyPath, KeyTypeRSA); err != nil {
 		t.Fatal("Key generation failed -", err.Error())
 	}
 
@@ -103,7 +117,7 @@ func TestEncryptionWithMarshalling(t *testing.T) {
 	publicKeyPath := fmt.Sprint(testdir, "/id_rsa.pub")
 	privateKeyPath := fmt.Sprint(testdir, "/private.pem")
 
-	if err = UcpKeyGenerate(privateKeyPath, publicKeyPath); err != nil {
+	if err = UcpKeyGenerate(privateKeyPath, publicKeyPath, KeyTypeRSA); err != nil {
 		t.Fatal("Key generation failed -", err.Error())
 	}
 
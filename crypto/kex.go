@@ -0,0 +1,146 @@
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/ssh"
+)
+
+const kexKeySize = 32
+
+// kexVersion is mixed into the session ID so that signatures made for this
+// handshake can't be reused by any other protocol
+const kexVersion = "ucp-curve25519-sha256-v1"
+
+// Roles sign the session ID with different prefixes so that a signature made
+// by a server can't be replayed as a client signature
+const (
+	RoleServer = "server"
+	RoleClient = "client"
+)
+
+var ErrInvalidKeyExchange = errors.New("Invalid key exchange value")
+
+// KeyExchange holds an ephemeral Curve25519 key pair used to agree on a
+// shared secret with the remote end of a connection
+type KeyExchange struct {
+	private [kexKeySize]byte
+	Public  []byte
+}
+
+// NewKeyExchange generates a new ephemeral key pair
+func NewKeyExchange() (kex *KeyExchange, e error) {
+	kex = &KeyExchange{}
+	if _, e = io.ReadFull(rand.Reader, kex.private[:]); e != nil {
+		return
+	}
+
+	var public [kexKeySize]byte
+	curve25519.ScalarBaseMult(&public, &kex.private)
+	kex.Public = public[:]
+	return
+}
+
+// SharedSecret combines our private key with the public value sent by the
+// remote end
+func (kex *KeyExchange) SharedSecret(remotePublic []byte) (secret []byte, e error) {
+	if len(remotePublic) != kexKeySize {
+		return nil, ErrInvalidKeyExchange
+	}
+
+	var remote, shared [kexKeySize]byte
+	copy(remote[:], remotePublic)
+	curve25519.ScalarMult(&shared, &kex.private, &remote)
+
+	var zero [kexKeySize]byte
+	if subtle.ConstantTimeCompare(shared[:], zero[:]) == 1 {
+		return nil, ErrInvalidKeyExchange
+	}
+
+	return shared[:], nil
+}
+
+// SessionID hashes the values exchanged during the handshake together with
+// the shared secret. Both ends sign the session ID with their identity keys
+// which binds the keys to this connection.
+func SessionID(hostKey, serverKex, clientKey, clientKex, secret []byte) []byte {
+	h := sha256.New()
+	for _, value := range [][]byte{[]byte(kexVersion), hostKey, serverKex, clientKey, clientKex, secret} {
+		writeHashValue(h, value)
+	}
+	return h.Sum(nil)
+}
+
+func writeHashValue(h hash.Hash, value []byte) {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(value)))
+	h.Write(length[:])
+	h.Write(value)
+}
+
+// SessionCiphers derives the AES-GCM ciphers used for the rest of the
+// connection from the shared secret and session ID. Each direction has a
+// key of its own, so nothing one end sends can be passed back to it as
+// though the other end had sent it. seal encrypts what the end playing
+// role sends, open decrypts what it receives.
+func SessionCiphers(secret, sessionID []byte, role string) (seal, open cipher.AEAD, e error) {
+	clientKey := deriveKey("client key", secret, sessionID)
+	serverKey := deriveKey("server key", secret, sessionID)
+	if role == RoleServer {
+		clientKey, serverKey = serverKey, clientKey
+	}
+
+	if seal, e = newGCM(clientKey); e != nil {
+		return
+	}
+	open, e = newGCM(serverKey)
+	return
+}
+
+func newGCM(key []byte) (aead cipher.AEAD, e error) {
+	var block cipher.Block
+	if block, e = aes.NewCipher(key[:AESKeySize]); e != nil {
+		return
+	}
+	return cipher.NewGCM(block)
+}
+
+func deriveKey(label string, secret, sessionID []byte) []byte {
+	h := sha256.New()
+	writeHashValue(h, secret)
+	writeHashValue(h, sessionID)
+	h.Write([]byte(label))
+	return h.Sum(nil)
+}
+
+// SignSession signs the session ID with an identity key for role, the
+// signature is returned in SSH wire format
+func SignSession(signer ssh.Signer, role string, sessionID []byte) (signature []byte, e error) {
+	var sig *ssh.Signature
+	if sig, e = signer.Sign(rand.Reader, signedSessionData(role, sessionID)); e != nil {
+		return
+	}
+	return ssh.Marshal(sig), nil
+}
+
+// VerifySession checks a signature made by SignSession
+func VerifySession(key ssh.PublicKey, role string, sessionID, signature []byte) (e error) {
+	var sig ssh.Signature
+	if e = ssh.Unmarshal(signature, &sig); e != nil {
+		return
+	}
+	return key.Verify(signedSessionData(role, sessionID), &sig)
+}
+
+func signedSessionData(role string, sessionID []byte) []byte {
+	return append([]byte(kexVersion+" "+role+"\x00"), sessionID...)
+}
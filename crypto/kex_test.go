@@ -0,0 +1,99 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeyExchange(t *testing.T) {
+	server, err := NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := NewKeyExchange()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serverSecret, err := server.SharedSecret(client.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSecret, err := client.SharedSecret(server.Public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(serverSecret, clientSecret) {
+		t.Fatal("Shared secrets don't match")
+	}
+
+	if _, err = server.SharedSecret(make([]byte, 32)); err != ErrInvalidKeyExchange {
+		t.Fatal("Expected ErrInvalidKeyExchange for a zero public value, got", err)
+	}
+
+	if _, err = server.SharedSecret([]byte{1, 2, 3}); err != ErrInvalidKeyExchange {
+		t.Fatal("Expected ErrInvalidKeyExchange for a short public value, got", err)
+	}
+}
+
+func TestSessionSignatures(t *testing.T) {
+	for _, keyType := range []string{KeyTypeEd25519, KeyTypeECDSA} {
+		key, err := GenerateKey(keyType)
+		if err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sessionID := SessionID([]byte("host"), []byte("skex"), []byte("client"), []byte("ckex"), []byte("secret"))
+		signature, err := SignSession(signer, RoleClient, sessionID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err = VerifySession(signer.PublicKey(), RoleClient, sessionID, signature); err != nil {
+			t.Fatal(keyType, "signature didn't verify -", err.Error())
+		}
+
+		if err = VerifySession(signer.PublicKey(), RoleServer, sessionID, signature); err == nil {
+			t.Fatal(keyType, "client signature verified as a server signature")
+		}
+
+		otherSession := SessionID([]byte("host"), []byte("skex"), []byte("client"), []byte("ckex"), []byte("other"))
+		if err = VerifySession(signer.PublicKey(), RoleClient, otherSession, signature); err == nil {
+			t.Fatal(keyType, "signature verified for a different session")
+		}
+	}
+}
+
+func TestSessionCiphers(t *testing.T) {
+	sessionID := SessionID([]byte("host"), []byte("skex"), []byte("client"), []byte("ckex"), []byte("secret"))
+	clientSeal, clientOpen, err := SessionCiphers([]byte("secret"), sessionID, RoleClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverSeal, serverOpen, err := SessionCiphers([]byte("secret"), sessionID, RoleServer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nonce := make([]byte, clientSeal.NonceSize())
+	sealed := clientSeal.Seal(nil, nonce, []byte("hello"), nil)
+	if opened, err := serverOpen.Open(nil, nonce, sealed, nil); err != nil || string(opened) != "hello" {
+		t.Fatal("Expected the server to open what the client sealed, got", err)
+	}
+
+	// what the client sends can't be reflected back to it
+	if _, err = clientOpen.Open(nil, nonce, sealed, nil); err == nil {
+		t.Fatal("Expected the client to refuse what it sealed itself")
+	}
+
+	if bytes.Equal(sealed, serverSeal.Seal(nil, nonce, []byte("hello"), nil)) {
+		t.Fatal("Expected each direction to have its own key")
+	}
+}
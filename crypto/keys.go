@@ -0,0 +1,320 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	stded25519 "crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Key types that can be generated
+const (
+	KeyTypeRSA     = "rsa"
+	KeyTypeECDSA   = "ecdsa"
+	KeyTypeEd25519 = "ed25519"
+)
+
+// DefaultKeyType is the type of key generated when none is given
+const DefaultKeyType = KeyTypeEd25519
+
+var ErrNoPEMData = errors.New("File does not contain a PEM encoded private key")
+var ErrEncryptedKey = errors.New("Private key is encrypted")
+var ErrInvalidOpenSSHKey = errors.New("Invalid OpenSSH private key")
+var ErrIncorrectPassphrase = errors.New("Incorrect passphrase for private key")
+
+// openSSHMagic starts every private key in the OpenSSH format
+const openSSHMagic = "openssh-key-v1\x00"
+
+// GenerateKey creates a private key of keyType
+func GenerateKey(keyType string) (key interface{}, e error) {
+	switch keyType {
+	case KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, KeySize)
+	case KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case KeyTypeEd25519:
+		_, key, e = ed25519.GenerateKey(rand.Reader)
+		return
+	}
+	return nil, fmt.Errorf("Unknown key type %q, expected %s, %s or %s", keyType, KeyTypeEd25519, KeyTypeECDSA, KeyTypeRSA)
+}
+
+// MarshalPrivateKey returns key as a PEM block. RSA keys are written as
+// PKCS#1, ECDSA keys in SEC 1 form and Ed25519 keys as PKCS#8.
+func MarshalPrivateKey(key interface{}) (block *pem.Block, e error) {
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}, nil
+	case *ecdsa.PrivateKey:
+		var der []byte
+		if der, e = x509.MarshalECPrivateKey(key); e != nil {
+			return
+		}
+		return &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}, nil
+	case ed25519.PrivateKey:
+		var der []byte
+		if der, e = x509.MarshalPKCS8PrivateKey(stded25519.PrivateKey(key)); e != nil {
+			return
+		}
+		return &pem.Block{Type: "PRIVATE KEY", Bytes: der}, nil
+	}
+	return nil, fmt.Errorf("Unsupported private key type %T", key)
+}
+
+// ParsePrivateKey parses a PEM encoded RSA, ECDSA or Ed25519 private key in
+// PKCS#1, SEC 1, PKCS#8 or OpenSSH format. ErrEncryptedKey is returned if
+// the key is protected by a passphrase.
+func ParsePrivateKey(pemBytes []byte) (key interface{}, e error) {
+	return parsePrivateKey(pemBytes, nil)
+}
+
+// ParsePrivateKeyWithPassphrase parses a private key like ParsePrivateKey,
+// decrypting it with passphrase if it is encrypted. OpenSSH keys encrypted
+// with bcrypt, encrypted PKCS#8 keys and legacy encrypted PEM keys are
+// supported.
+func ParsePrivateKeyWithPassphrase(pemBytes, passphrase []byte) (key interface{}, e error) {
+	if len(passphrase) == 0 {
+		return nil, ErrIncorrectPassphrase
+	}
+	return parsePrivateKey(pemBytes, passphrase)
+}
+
+func parsePrivateKey(pemBytes, passphrase []byte) (key interface{}, e error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, ErrNoPEMData
+	}
+
+	if strings.Contains(block.Headers["Proc-Type"], "ENCRYPTED") {
+		if passphrase == nil {
+			return nil, ErrEncryptedKey
+		}
+		if block, e = decryptPEMBlock(block, passphrase); e != nil {
+			return
+		}
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, e = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, e = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, e = parsePKCS8PrivateKey(block.Bytes)
+	case "ENCRYPTED PRIVATE KEY":
+		if passphrase == nil {
+			return nil, ErrEncryptedKey
+		}
+		key, e = parseEncryptedPKCS8PrivateKey(block.Bytes, passphrase)
+	case "OPENSSH PRIVATE KEY":
+		key, e = parseOpenSSHPrivateKey(block.Bytes, passphrase)
+	default:
+		e = fmt.Errorf("Unsupported private key type %q", block.Type)
+	}
+
+	return
+}
+
+// decryptPEMBlock decrypts a key written with the legacy OpenSSL PEM
+// encryption, ssh-keygen -m PEM writes keys this way
+func decryptPEMBlock(block *pem.Block, passphrase []byte) (decrypted *pem.Block, e error) {
+	var der []byte
+	if der, e = x509.DecryptPEMBlock(block, passphrase); e != nil {
+		if e == x509.IncorrectPasswordError {
+			e = ErrIncorrectPassphrase
+		}
+		return
+	}
+
+	// A wrong passphrase can produce valid padding, so failing to parse the
+	// key is also treated as a wrong passphrase
+	decrypted = &pem.Block{Type: block.Type, Bytes: der}
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		_, e = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		_, e = x509.ParseECPrivateKey(der)
+	}
+	if e != nil {
+		return nil, ErrIncorrectPassphrase
+	}
+	return
+}
+
+func parsePKCS8PrivateKey(der []byte) (key interface{}, e error) {
+	if key, e = x509.ParsePKCS8PrivateKey(der); e != nil {
+		return
+	}
+
+	switch k := key.(type) {
+	case *rsa.PrivateKey, *ecdsa.PrivateKey:
+		return k, nil
+	case stded25519.PrivateKey:
+		return ed25519.PrivateKey(k), nil
+	}
+	return nil, fmt.Errorf("Unsupported PKCS#8 private key type %T", key)
+}
+
+// parseOpenSSHPrivateKey parses the private key format written by
+// ssh-keygen since OpenSSH 7.8. passphrase is only used if the key is
+// encrypted.
+func parseOpenSSHPrivateKey(data, passphrase []byte) (key interface{}, e error) {
+	if !bytes.HasPrefix(data, []byte(openSSHMagic)) {
+		return nil, ErrInvalidOpenSSHKey
+	}
+
+	var container struct {
+		CipherName   string
+		KdfName      string
+		KdfOpts      string
+		NumKeys      uint32
+		PubKey       []byte
+		PrivKeyBlock []byte
+		Rest         []byte `ssh:"rest"`
+	}
+	if e = ssh.Unmarshal(data[len(openSSHMagic):], &container); e != nil {
+		return nil, ErrInvalidOpenSSHKey
+	}
+
+	if container.NumKeys != 1 {
+		return nil, fmt.Errorf("OpenSSH private key file holds %d keys, expected 1", container.NumKeys)
+	}
+
+	block := container.PrivKeyBlock
+	if container.CipherName != "none" || container.KdfName != "none" {
+		if passphrase == nil {
+			return nil, ErrEncryptedKey
+		}
+		if block, e = decryptOpenSSHPrivateKeyBlock(container.CipherName, container.KdfName, container.KdfOpts, passphrase, block, container.Rest); e != nil {
+			return
+		}
+	}
+
+	return parseOpenSSHPrivateKeyBlock(block, passphrase != nil)
+}
+
+// parseOpenSSHPrivateKeyBlock parses the decrypted private section of an
+// OpenSSH private key. If the block was encrypted, mismatched check values
+// mean the passphrase was wrong.
+func parseOpenSSHPrivateKeyBlock(block []byte, decrypted bool) (key interface{}, e error) {
+	var private struct {
+		Check1  uint32
+		Check2  uint32
+		KeyType string
+		Rest    []byte `ssh:"rest"`
+	}
+	if e = ssh.Unmarshal(block, &private); e != nil || private.Check1 != private.Check2 {
+		if decrypted {
+			return nil, ErrIncorrectPassphrase
+		}
+		return nil, ErrInvalidOpenSSHKey
+	}
+
+	switch private.KeyType {
+	case ssh.KeyAlgoRSA:
+		var k struct {
+			N, E, D, Iqmp, P, Q *big.Int
+			Comment             string
+			Pad                 []byte `ssh:"rest"`
+		}
+		if e = ssh.Unmarshal(private.Rest, &k); e != nil {
+			return nil, ErrInvalidOpenSSHKey
+		}
+
+		rsaKey := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: k.N, E: int(k.E.Int64())},
+			D:         k.D,
+			Primes:    []*big.Int{k.P, k.Q},
+		}
+		if e = rsaKey.Validate(); e != nil {
+			return
+		}
+		rsaKey.Precompute()
+		return rsaKey, checkOpenSSHPadding(k.Pad)
+
+	case ssh.KeyAlgoECDSA256, ssh.KeyAlgoECDSA384, ssh.KeyAlgoECDSA521:
+		var k struct {
+			Curve   string
+			Pub     []byte
+			D       *big.Int
+			Comment string
+			Pad     []byte `ssh:"rest"`
+		}
+		if e = ssh.Unmarshal(private.Rest, &k); e != nil {
+			return nil, ErrInvalidOpenSSHKey
+		}
+
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "nistp256":
+			curve = elliptic.P256()
+		case "nistp384":
+			curve = elliptic.P384()
+		case "nistp521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("Unsupported ECDSA curve %q", k.Curve)
+		}
+
+		ecKey := &ecdsa.PrivateKey{D: k.D}
+		ecKey.Curve = curve
+		ecKey.X, ecKey.Y = elliptic.Unmarshal(curve, k.Pub)
+		if ecKey.X == nil {
+			return nil, ErrInvalidOpenSSHKey
+		}
+		if x, y := curve.ScalarBaseMult(k.D.Bytes()); x.Cmp(ecKey.X) != 0 || y.Cmp(ecKey.Y) != 0 {
+			return nil, ErrInvalidOpenSSHKey
+		}
+		return ecKey, checkOpenSSHPadding(k.Pad)
+
+	case ssh.KeyAlgoED25519:
+		var k struct {
+			Pub     []byte
+			Priv    []byte
+			Comment string
+			Pad     []byte `ssh:"rest"`
+		}
+		if e = ssh.Unmarshal(private.Rest, &k); e != nil || len(k.Priv) != ed25519.PrivateKeySize {
+			return nil, ErrInvalidOpenSSHKey
+		}
+		return ed25519.PrivateKey(k.Priv), checkOpenSSHPadding(k.Pad)
+	}
+
+	return nil, fmt.Errorf("Unsupported OpenSSH key type %q", private.KeyType)
+}
+
+func checkOpenSSHPadding(pad []byte) error {
+	for i, b := range pad {
+		if int(b) != i+1 {
+			return ErrInvalidOpenSSHKey
+		}
+	}
+	return nil
+}
+
+// GetSigner reads a private key file and returns a signer for it
+func GetSigner(privateKeyPath string) (signer ssh.Signer, e error) {
+	var contents []byte
+	if contents, e = ioutil.ReadFile(privateKeyPath); e != nil {
+		return
+	}
+
+	var key interface{}
+	if key, e = ParsePrivateKey(contents); e != nil {
+		return nil, fmt.Errorf("%s: %s", privateKeyPath, e.Error())
+	}
+
+	return ssh.NewSignerFromKey(key)
+}
@@ -0,0 +1,176 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestGenerateKeyTypes(t *testing.T) {
+	testdir, err := ioutil.TempDir("", "keys")
+	if err != nil {
+		t.Fatal("Test directory creation failed -", err.Error())
+	}
+	defer os.RemoveAll(testdir)
+
+	for _, keyType := range []string{KeyTypeEd25519, KeyTypeECDSA} {
+		privateKeyPath := filepath.Join(testdir, keyType+".pem")
+		publicKeyPath := filepath.Join(testdir, keyType+".pub")
+
+		if err = UcpKeyGenerate(privateKeyPath, publicKeyPath, keyType); err != nil {
+			t.Fatal("Key generation failed -", keyType, err.Error())
+		}
+
+		var signer ssh.Signer
+		if signer, err = GetSigner(privateKeyPath); err != nil {
+			t.Fatal("Couldn't load generated key -", keyType, err.Error())
+		}
+
+		publicKey, _ := ioutil.ReadFile(publicKeyPath)
+		if !bytes.Equal(publicKey, ssh.MarshalAuthorizedKey(signer.PublicKey())) {
+			t.Fatal("Public key file doesn't match private key -", keyType)
+		}
+	}
+
+	if _, err = GenerateKey("dsa"); err == nil {
+		t.Fatal("Expected an error for an unknown key type")
+	}
+}
+
+func TestParsePrivateKeyFormats(t *testing.T) {
+	files := map[string]interface{}{
+		"openssh_ed25519":   ed25519.PrivateKey{},
+		"openssh_ecdsa":     &ecdsa.PrivateKey{},
+		"openssh_rsa":       &rsa.PrivateKey{},
+		"pkcs8_ed25519.pem": ed25519.PrivateKey{},
+		"pkcs8_ecdsa.pem":   &ecdsa.PrivateKey{},
+		"pkcs8_rsa.pem":     &rsa.PrivateKey{},
+	}
+
+	for file, expected := range files {
+		contents, err := ioutil.ReadFile(filepath.Join("testdata", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key, err := ParsePrivateKey(contents)
+		if err != nil {
+			t.Fatal("Couldn't parse", file, "-", err.Error())
+		}
+
+		switch expected.(type) {
+		case ed25519.PrivateKey:
+			_, ok := key.(ed25519.PrivateKey)
+			if !ok {
+				t.Fatalf("%s: expected an ed25519 key, got %T", file, key)
+			}
+		case *ecdsa.PrivateKey:
+			if _, ok := key.(*ecdsa.PrivateKey); !ok {
+				t.Fatalf("%s: expected an ecdsa key, got %T", file, key)
+			}
+		case *rsa.PrivateKey:
+			if _, ok := key.(*rsa.PrivateKey); !ok {
+				t.Fatalf("%s: expected an rsa key, got %T", file, key)
+			}
+		}
+
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			t.Fatal(file, err.Error())
+		}
+
+		if publicKey, err := ioutil.ReadFile(filepath.Join("testdata", file+".pub")); err == nil {
+			expectedKey, _, _, _, _ := ssh.ParseAuthorizedKey(publicKey)
+			if !bytes.Equal(expectedKey.Marshal(), signer.PublicKey().Marshal()) {
+				t.Fatal(file, "public key doesn't match ssh-keygen")
+			}
+		}
+	}
+}
+
+func TestParseMalformedPrivateKeys(t *testing.T) {
+	if _, err := ParsePrivateKey([]byte("not a key")); err != ErrNoPEMData {
+		t.Fatal("Expected ErrNoPEMData, got", err)
+	}
+
+	unsupported := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte{1, 2, 3}})
+	if _, err := ParsePrivateKey(unsupported); err == nil {
+		t.Fatal("Expected an error for an unsupported PEM type")
+	}
+
+	corrupt := pem.EncodeToMemory(&pem.Block{Type: "OPENSSH PRIVATE KEY", Bytes: []byte("openssh")})
+	if _, err := ParsePrivateKey(corrupt); err != ErrInvalidOpenSSHKey {
+		t.Fatal("Expected ErrInvalidOpenSSHKey, got", err)
+	}
+
+	encrypted := pem.EncodeToMemory(&pem.Block{
+		Type:    "RSA PRIVATE KEY",
+		Headers: map[string]string{"Proc-Type": "4,ENCRYPTED"},
+		Bytes:   []byte{1, 2, 3},
+	})
+	if _, err := ParsePrivateKey(encrypted); err != ErrEncryptedKey {
+		t.Fatal("Expected ErrEncryptedKey, got", err)
+	}
+
+	if _, err := GetPrivateKey(filepath.Join("testdata", "openssh_ed25519.pub")); err == nil {
+		t.Fatal("Expected an error loading a public key as a private key")
+	}
+}
+
+func TestParseEncryptedPrivateKeys(t *testing.T) {
+	files := map[string]string{
+		"openssh_ed25519_encrypted":   "openssh_ed25519_encrypted.pub",
+		"openssh_ecdsa_gcm_encrypted": "openssh_ecdsa_gcm_encrypted.pub",
+		"pem_rsa_encrypted":           "pem_rsa_encrypted.pub",
+		"pkcs8_ecdsa_encrypted.pem":   "pkcs8_ecdsa.pem",
+		"pkcs8_ed25519_encrypted.pem": "pkcs8_ed25519.pem",
+	}
+
+	for file, expected := range files {
+		contents, err := ioutil.ReadFile(filepath.Join("testdata", file))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = ParsePrivateKey(contents); err != ErrEncryptedKey {
+			t.Fatal(file, "expected ErrEncryptedKey, got", err)
+		}
+
+		if _, err = ParsePrivateKeyWithPassphrase(contents, []byte("wrong")); err != ErrIncorrectPassphrase {
+			t.Fatal(file, "expected ErrIncorrectPassphrase, got", err)
+		}
+
+		key, err := ParsePrivateKeyWithPassphrase(contents, []byte("secret"))
+		if err != nil {
+			t.Fatal(file, "couldn't decrypt -", err.Error())
+		}
+		signer, _ := ssh.NewSignerFromKey(key)
+
+		expectedContents, _ := ioutil.ReadFile(filepath.Join("testdata", expected))
+		var expectedKey ssh.PublicKey
+		if filepath.Ext(expected) == ".pub" {
+			expectedKey, _, _, _, _ = ssh.ParseAuthorizedKey(expectedContents)
+		} else {
+			expectedPrivate, _ := ParsePrivateKey(expectedContents)
+			expectedSigner, _ := ssh.NewSignerFromKey(expectedPrivate)
+			expectedKey = expectedSigner.PublicKey()
+		}
+
+		if !bytes.Equal(expectedKey.Marshal(), signer.PublicKey().Marshal()) {
+			t.Fatal(file, "decrypted key doesn't match", expected)
+		}
+	}
+
+	unencrypted, _ := ioutil.ReadFile(filepath.Join("testdata", "openssh_ed25519"))
+	if _, err := ParsePrivateKeyWithPassphrase(unencrypted, []byte("secret")); err != nil {
+		t.Fatal("Passphrase should be ignored for an unencrypted key -", err)
+	}
+}
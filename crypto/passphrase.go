@@ -0,0 +1,208 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH ciphers that can be used to encrypt a private key, with their key
+// and IV sizes
+var openSSHCiphers = map[string]struct {
+	keySize, ivSize int
+	mode            string
+}{
+	"aes128-ctr":             {16, aes.BlockSize, "ctr"},
+	"aes192-ctr":             {24, aes.BlockSize, "ctr"},
+	"aes256-ctr":             {32, aes.BlockSize, "ctr"},
+	"aes128-cbc":             {16, aes.BlockSize, "cbc"},
+	"aes192-cbc":             {24, aes.BlockSize, "cbc"},
+	"aes256-cbc":             {32, aes.BlockSize, "cbc"},
+	"aes128-gcm@openssh.com": {16, 12, "gcm"},
+	"aes256-gcm@openssh.com": {32, 12, "gcm"},
+}
+
+// decryptOpenSSHPrivateKeyBlock decrypts the private section of an OpenSSH
+// key. The key and IV are derived from the passphrase with bcrypt_pbkdf.
+// For GCM ciphers the authentication tag follows the encrypted block.
+func decryptOpenSSHPrivateKeyBlock(cipherName, kdfName, kdfOpts string, passphrase, encrypted, tag []byte) (block []byte, e error) {
+	if kdfName != "bcrypt" {
+		return nil, fmt.Errorf("Unsupported OpenSSH key derivation function %q", kdfName)
+	}
+
+	params, ok := openSSHCiphers[cipherName]
+	if !ok {
+		return nil, fmt.Errorf("Unsupported OpenSSH private key cipher %q", cipherName)
+	}
+
+	var opts struct {
+		Salt   []byte
+		Rounds uint32
+	}
+	if e = ssh.Unmarshal([]byte(kdfOpts), &opts); e != nil {
+		return nil, ErrInvalidOpenSSHKey
+	}
+
+	var derived []byte
+	if derived, e = bcryptPBKDF(passphrase, opts.Salt, int(opts.Rounds), params.keySize+params.ivSize); e != nil {
+		return
+	}
+	key, iv := derived[:params.keySize], derived[params.keySize:]
+
+	var c cipher.Block
+	if c, e = aes.NewCipher(key); e != nil {
+		return
+	}
+
+	switch params.mode {
+	case "gcm":
+		var gcm cipher.AEAD
+		if gcm, e = cipher.NewGCM(c); e != nil {
+			return
+		}
+		if block, e = gcm.Open(nil, iv, append(append([]byte{}, encrypted...), tag...), nil); e != nil {
+			return nil, ErrIncorrectPassphrase
+		}
+	default:
+		if len(encrypted)%aes.BlockSize != 0 {
+			return nil, ErrInvalidOpenSSHKey
+		}
+		block = make([]byte, len(encrypted))
+		if params.mode == "ctr" {
+			cipher.NewCTR(c, iv).XORKeyStream(block, encrypted)
+		} else {
+			cipher.NewCBCDecrypter(c, iv).CryptBlocks(block, encrypted)
+		}
+	}
+
+	return
+}
+
+var (
+	oidPBES2      = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidHMACSHA1   = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 7}
+	oidHMACSHA256 = asn1.ObjectIdentifier{1, 2, 840, 113549, 2, 9}
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+)
+
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+type pbes2Params struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+type pbkdf2Params struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// parseEncryptedPKCS8PrivateKey decrypts a PKCS#8 key encrypted with PBES2,
+// using PBKDF2 and AES-CBC, as written by openssl pkcs8 -topk8
+func parseEncryptedPKCS8PrivateKey(der, passphrase []byte) (key interface{}, e error) {
+	var info encryptedPrivateKeyInfo
+	if _, e = asn1.Unmarshal(der, &info); e != nil {
+		return
+	}
+
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("Unsupported PKCS#8 encryption algorithm %s", info.Algorithm.Algorithm)
+	}
+
+	var params pbes2Params
+	if _, e = asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &params); e != nil {
+		return
+	}
+
+	if !params.KeyDerivationFunc.Algorithm.Equal(oidPBKDF2) {
+		return nil, fmt.Errorf("Unsupported PKCS#8 key derivation function %s", params.KeyDerivationFunc.Algorithm)
+	}
+
+	var kdf pbkdf2Params
+	if _, e = asn1.Unmarshal(params.KeyDerivationFunc.Parameters.FullBytes, &kdf); e != nil {
+		return
+	}
+
+	var prf func() hash.Hash
+	switch {
+	case kdf.PRF.Algorithm == nil, kdf.PRF.Algorithm.Equal(oidHMACSHA1):
+		prf = sha1.New
+	case kdf.PRF.Algorithm.Equal(oidHMACSHA256):
+		prf = sha256.New
+	default:
+		return nil, fmt.Errorf("Unsupported PBKDF2 hash %s", kdf.PRF.Algorithm)
+	}
+
+	var keySize int
+	switch scheme := params.EncryptionScheme.Algorithm; {
+	case scheme.Equal(oidAES128CBC):
+		keySize = 16
+	case scheme.Equal(oidAES192CBC):
+		keySize = 24
+	case scheme.Equal(oidAES256CBC):
+		keySize = 32
+	default:
+		return nil, fmt.Errorf("Unsupported PKCS#8 cipher %s", scheme)
+	}
+
+	var iv []byte
+	if _, e = asn1.Unmarshal(params.EncryptionScheme.Parameters.FullBytes, &iv); e != nil {
+		return
+	}
+
+	if len(iv) != aes.BlockSize || len(info.EncryptedData) == 0 || len(info.EncryptedData)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("Invalid encrypted PKCS#8 private key")
+	}
+
+	var derived []byte
+	if derived, e = pbkdf2.Key(prf, string(passphrase), kdf.Salt, kdf.IterationCount, keySize); e != nil {
+		return
+	}
+
+	var c cipher.Block
+	if c, e = aes.NewCipher(derived); e != nil {
+		return
+	}
+
+	decrypted := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(c, iv).CryptBlocks(decrypted, info.EncryptedData)
+
+	if decrypted, e = removePadding(decrypted); e != nil {
+		return
+	}
+
+	if key, e = parsePKCS8PrivateKey(decrypted); e != nil {
+		return nil, ErrIncorrectPassphrase
+	}
+	return
+}
+
+// removePadding strips PKCS#7 padding, bad padding means the passphrase was
+// wrong
+func removePadding(data []byte) ([]byte, error) {
+	n := int(data[len(data)-1])
+	if n == 0 || n > aes.BlockSize || n > len(data) {
+		return nil, ErrIncorrectPassphrase
+	}
+	if !bytes.Equal(data[len(data)-n:], bytes.Repeat([]byte{byte(n)}, n)) {
+		return nil, ErrIncorrectPassphrase
+	}
+	return data[:len(data)-n], nil
+}
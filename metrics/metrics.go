@@ -0,0 +1,361 @@
+// Package metrics keeps counters, gauges and histograms and writes them in
+// the Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ContentType is the content type of the text exposition format
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets are histogram bucket upper bounds in seconds, suitable for
+// latencies from a millisecond up to a minute
+var DefaultBuckets = []float64{.001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+const (
+	typeCounter   = "counter"
+	typeGauge     = "gauge"
+	typeHistogram = "histogram"
+)
+
+// Registry holds metric families in the order they are written out
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// NewRegistry returns an empty registry
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// family is every series of a metric, one per combination of label values
+type family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+	buckets    []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+
+	mu      sync.Mutex
+	value   float64
+	counts  []uint64
+	sum     float64
+	samples uint64
+}
+
+func (r *Registry) register(name, help, kind string, labelNames []string, buckets []float64) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.families[name]; ok {
+		panic(fmt.Sprintf("metrics: %s registered twice", name))
+	}
+
+	f := &family{
+		name:       name,
+		help:       help,
+		kind:       kind,
+		labelNames: labelNames,
+		buckets:    buckets,
+		series:     make(map[string]*series),
+	}
+	r.families[name] = f
+	return f
+}
+
+func (f *family) with(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		if f.kind == typeHistogram {
+			s.counts = make([]uint64, len(f.buckets))
+		}
+		f.series[key] = s
+	}
+	return s
+}
+
+func (s *series) add(delta float64) {
+	s.mu.Lock()
+	s.value += delta
+	s.mu.Unlock()
+}
+
+func (s *series) set(value float64) {
+	s.mu.Lock()
+	s.value = value
+	s.mu.Unlock()
+}
+
+// Counter is a value that only goes up
+type Counter struct {
+	s *series
+}
+
+// Inc adds one to the counter
+func (c Counter) Inc() {
+	c.s.add(1)
+}
+
+// Add adds delta, which must not be negative, to the counter
+func (c Counter) Add(delta float64) {
+	if delta < 0 {
+		panic("metrics: counters can't decrease")
+	}
+	c.s.add(delta)
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	s *series
+}
+
+// Inc adds one to the gauge
+func (g Gauge) Inc() {
+	g.s.add(1)
+}
+
+// Dec subtracts one from the gauge
+func (g Gauge) Dec() {
+	g.s.add(-1)
+}
+
+// Add adds delta to the gauge
+func (g Gauge) Add(delta float64) {
+	g.s.add(delta)
+}
+
+// Set sets the gauge to value
+func (g Gauge) Set(value float64) {
+	g.s.set(value)
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	s       *series
+	buckets []float64
+}
+
+// Observe records value
+func (h Histogram) Observe(value float64) {
+	h.s.mu.Lock()
+	defer h.s.mu.Unlock()
+
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.s.counts[i]++
+		}
+	}
+	h.s.sum += value
+	h.s.samples++
+}
+
+// CounterVec is a counter partitioned by labels
+type CounterVec struct {
+	f *family
+}
+
+// With returns the counter for the label values, given in the order the
+// labels were registered
+func (v CounterVec) With(labelValues ...string) Counter {
+	return Counter{v.f.with(labelValues)}
+}
+
+// GaugeVec is a gauge partitioned by labels
+type GaugeVec struct {
+	f *family
+}
+
+// With returns the gauge for the label values
+func (v GaugeVec) With(labelValues ...string) Gauge {
+	return Gauge{v.f.with(labelValues)}
+}
+
+// HistogramVec is a histogram partitioned by labels
+type HistogramVec struct {
+	f *family
+}
+
+// With returns the histogram for the label values
+func (v HistogramVec) With(labelValues ...string) Histogram {
+	return Histogram{v.f.with(labelValues), v.f.buckets}
+}
+
+// NewCounter registers a counter without labels
+func (r *Registry) NewCounter(name, help string) Counter {
+	return r.NewCounterVec(name, help).With()
+}
+
+// NewCounterVec registers a counter partitioned by labelNames
+func (r *Registry) NewCounterVec(name, help string, labelNames ...string) CounterVec {
+	return CounterVec{r.register(name, help, typeCounter, labelNames, nil)}
+}
+
+// NewGauge registers a gauge without labels
+func (r *Registry) NewGauge(name, help string) Gauge {
+	return r.NewGaugeVec(name, help).With()
+}
+
+// NewGaugeVec registers a gauge partitioned by labelNames
+func (r *Registry) NewGaugeVec(name, help string, labelNames ...string) GaugeVec {
+	return GaugeVec{r.register(name, help, typeGauge, labelNames, nil)}
+}
+
+// NewHistogram registers a histogram without labels. Buckets are the upper
+// bounds of the buckets in increasing order, DefaultBuckets are used if
+// none are given.
+func (r *Registry) NewHistogram(name, help string, buckets []float64) Histogram {
+	return r.NewHistogramVec(name, help, buckets).With()
+}
+
+// NewHistogramVec registers a histogram partitioned by labelNames
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) HistogramVec {
+	if len(buckets) == 0 {
+		buckets = DefaultBuckets
+	}
+	if !sort.Float64sAreSorted(buckets) {
+		panic(fmt.Sprintf("metrics: %s buckets are not in increasing order", name))
+	}
+	return HistogramVec{r.register(name, help, typeHistogram, labelNames, append([]float64{}, buckets...))}
+}
+
+// WriteTo writes every metric in the text exposition format, families
+// sorted by name and series by label values
+func (r *Registry) WriteTo(w io.Writer) (n int64, e error) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	families := make([]*family, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		families = append(families, r.families[name])
+	}
+	r.mu.Unlock()
+
+	counter := &countingWriter{w: w}
+	out := bufio.NewWriter(counter)
+	for _, f := range families {
+		f.write(out)
+	}
+	e = out.Flush()
+	return counter.n, e
+}
+
+func (f *family) write(out *bufio.Writer) {
+	fmt.Fprintf(out, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(out, "# TYPE %s %s\n", f.name, f.kind)
+
+	f.mu.Lock()
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	all := make([]*series, 0, len(keys))
+	for _, key := range keys {
+		all = append(all, f.series[key])
+	}
+	f.mu.Unlock()
+
+	for _, s := range all {
+		s.mu.Lock()
+		if f.kind == typeHistogram {
+			for i, bound := range f.buckets {
+				fmt.Fprintf(out, "%s_bucket%s %d\n", f.name, f.labels(s, "le", formatFloat(bound)), s.counts[i])
+			}
+			fmt.Fprintf(out, "%s_bucket%s %d\n", f.name, f.labels(s, "le", "+Inf"), s.samples)
+			fmt.Fprintf(out, "%s_sum%s %s\n", f.name, f.labels(s), formatFloat(s.sum))
+			fmt.Fprintf(out, "%s_count%s %d\n", f.name, f.labels(s), s.samples)
+		} else {
+			fmt.Fprintf(out, "%s%s %s\n", f.name, f.labels(s), formatFloat(s.value))
+		}
+		s.mu.Unlock()
+	}
+}
+
+// labels formats the label set of s followed by extra, which holds a name
+// and a value
+func (f *family) labels(s *series, extra ...string) string {
+	if len(f.labelNames) == 0 && len(extra) == 0 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(f.labelNames)+1)
+	for i, name := range f.labelNames {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", name, escapeLabel(s.labelValues[i])))
+	}
+	if len(extra) == 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=\"%s\"", extra[0], extra[1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeHelp(s string) string {
+	return helpEscaper.Replace(s)
+}
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (n int, e error) {
+	n, e = c.w.Write(b)
+	c.n += int64(n)
+	return
+}
+
+// Handler serves the metrics in r
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		r.WriteTo(w)
+	})
+}
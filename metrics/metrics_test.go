@@ -0,0 +1,104 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounterAndGauge(t *testing.T) {
+	r := NewRegistry()
+	requests := r.NewCounterVec("requests_total", "Requests handled.", "method", "outcome")
+	active := r.NewGauge("active", "Active things.")
+
+	requests.With("key", "success").Inc()
+	requests.With("key", "success").Add(2)
+	requests.With("password", "failure").Inc()
+	active.Inc()
+	active.Inc()
+	active.Dec()
+
+	var out bytes.Buffer
+	if _, e := r.WriteTo(&out); e != nil {
+		t.Fatal(e)
+	}
+
+	expected := `# HELP active Active things.
+# TYPE active gauge
+active 1
+# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{method="key",outcome="success"} 3
+requests_total{method="password",outcome="failure"} 1
+`
+	if out.String() != expected {
+		t.Fatalf("unexpected output\n%s", out.String())
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	r := NewRegistry()
+	latency := r.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	var out bytes.Buffer
+	r.WriteTo(&out)
+
+	for _, line := range []string{
+		`latency_seconds_bucket{le="0.1"} 1`,
+		`latency_seconds_bucket{le="1"} 2`,
+		`latency_seconds_bucket{le="+Inf"} 3`,
+		`latency_seconds_sum 5.55`,
+		`latency_seconds_count 3`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Fatalf("missing %q in\n%s", line, out.String())
+		}
+	}
+}
+
+func TestLabelEscaping(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounterVec("paths_total", "Help with \\ and\nnewline.", "path").With("a\"b\\c\nd").Inc()
+
+	var out bytes.Buffer
+	r.WriteTo(&out)
+
+	if !strings.Contains(out.String(), `# HELP paths_total Help with \\ and\nnewline.`) {
+		t.Fatalf("help not escaped\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), `paths_total{path="a\"b\\c\nd"} 1`) {
+		t.Fatalf("label not escaped\n%s", out.String())
+	}
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("dup", "")
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("expected a panic")
+		}
+	}()
+	r.NewGauge("dup", "")
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.NewCounter("hits_total", "Hits.").Inc()
+
+	recorder := httptest.NewRecorder()
+	Handler(r).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	if recorder.Header().Get("Content-Type") != ContentType {
+		t.Fatalf("unexpected content type %q", recorder.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(recorder.Body.String(), "hits_total 1\n") {
+		t.Fatalf("unexpected body\n%s", recorder.Body.String())
+	}
+}
@@ -3,8 +3,8 @@ package net
 import (
 	"bytes"
 	"crypto/cipher"
-	"crypto/md5"
 	"crypto/rsa"
+	"encoding/binary"
 	"encoding/gob"
 	"errors"
 	"io"
@@ -12,10 +12,11 @@ import (
 	"github.com/murphybytes/ucp/crypto"
 )
 
-const readSize = 1500
-
 var ErrInvalidChecksum = errors.New("Invalid checksum")
 var ErrIncompleteWrite = errors.New("Incomplete  write")
+var ErrUnknownFrame = errors.New("Unknown frame type")
+var ErrUnexpectedData = errors.New("Unexpected file data")
+var ErrFrameAuthentication = errors.New("Frame failed authentication")
 
 // Conn io interface for ucp
 type Conn interface {
@@ -23,32 +24,96 @@ type Conn interface {
 	Read(*bytes.Buffer) error
 }
 
+// EncodeConn reads and writes Go typed messages, and file data which is
+// sent as is rather than encoded
 type EncodeConn interface {
 	Write(interface{}) error
 	Read(interface{}) error
+	WriteData([]byte) error
+	ReadData(interface{}) ([]byte, error)
+}
+
+// frameConn is implemented by connections that can move a frame through
+// the stack without copying it. Frames read come from the buffer pool,
+// frames written have headerLen bytes free at the front for the header.
+type frameConn interface {
+	readFrame() ([]byte, error)
+	writeFrame(packet []byte) error
+}
+
+// asFrameConn returns conn as a frameConn, copying frames in and out of
+// it if it can't handle them itself
+func asFrameConn(conn Conn) frameConn {
+	if fc, ok := conn.(frameConn); ok {
+		return fc
+	}
+	return copyingConn{conn}
+}
+
+type copyingConn struct {
+	Conn
+}
+
+func (c copyingConn) readFrame() (frame []byte, e error) {
+	var buff bytes.Buffer
+	if e = c.Read(&buff); e != nil {
+		return
+	}
+
+	frame = GetBuffer(buff.Len())
+	copy(frame, buff.Bytes())
+	return
+}
+
+func (c copyingConn) writeFrame(packet []byte) (e error) {
+	_, e = c.Write(packet[headerLen:])
+	return
 }
 
 // ReaderWriter reads and writes packets of bytes to network
 // bytes are prepended with size and checksum
 type ReaderWriter struct {
-	conn io.ReadWriteCloser
+	conn         io.ReadWriteCloser
+	maxFrameSize int
+	header       [headerLen]byte
 }
 
+// NewReaderWriter creates a ReaderWriter that accepts frames of up to
+// DefaultMaxFrameSize bytes.
 func NewReaderWriter(conn io.ReadWriteCloser) (w *ReaderWriter) {
+	return NewReaderWriterSize(conn, DefaultMaxFrameSize)
+}
+
+// NewReaderWriterSize creates a ReaderWriter that rejects frames larger
+// than maxFrameSize bytes before reading them.
+func NewReaderWriterSize(conn io.ReadWriteCloser, maxFrameSize int) (w *ReaderWriter) {
 	return &ReaderWriter{
-		conn: conn,
+		conn:         conn,
+		maxFrameSize: maxFrameSize,
 	}
 }
 
 // Write writes buffer to network. Returns the number of bytes written
 // if successful, otherwise an error.
 func (w *ReaderWriter) Write(buffer []byte) (n int, e error) {
+	packet := GetBuffer(headerLen + len(buffer))
+	defer PutBuffer(packet)
+	copy(packet[headerLen:], buffer)
 
-	var packet []byte
-	if packet, e = prependHeaderToBuffer(buffer); e != nil {
-		return
+	if e = w.writeFrame(packet); e == nil {
+		n = len(buffer)
 	}
+	return
+}
 
+func (w *ReaderWriter) writeFrame(packet []byte) (e error) {
+	if size := len(packet) - headerLen; size > w.maxFrameSize {
+		return &FrameSizeError{Size: uint64(size), Max: w.maxFrameSize}
+	}
+
+	putHeader(packet)
+
+	var n int
 	if n, e = w.conn.Write(packet); e != nil {
 		return
 	}
@@ -57,58 +122,65 @@ func (w *ReaderWriter) Write(buffer []byte) (n int, e error) {
 		e = ErrIncompleteWrite
 	}
 
-	n -= headerLen
-
 	return
-
 }
 
-// Read reads bytes into bytes.Buffer
+// Read reads exactly one frame and appends its body to out. It returns
+// io.EOF if the connection closes between frames and ErrTruncatedFrame if
+// it closes part way through one.
 func (w *ReaderWriter) Read(out *bytes.Buffer) (e error) {
-	buff := make([]byte, readSize)
-	var read int
-	read, e = w.conn.Read(buff)
-
-	if e != nil && e != io.EOF {
+	var h frameHeader
+	if h, e = w.readHeader(); e != nil {
 		return
 	}
 
-	if read == 0 {
-		return io.EOF
-	}
-
-	var size int
-	if size, e = getBufferSize(buff); e != nil {
+	start := out.Len()
+	out.Grow(h.size)
+	if _, e = io.CopyN(out, w.conn, int64(h.size)); e != nil {
+		if e == io.EOF {
+			e = ErrTruncatedFrame
+		}
 		return
 	}
 
-	var expectedChecksum [checksumHeaderLen]byte
-	copy(expectedChecksum[:], buff[sizeHeaderLen:sizeHeaderLen+checksumHeaderLen])
-
-	out.Write(buff[headerLen:read])
-
-	for out.Len() < size {
+	if createChecksum(out.Bytes()[start:]) != h.checksum {
+		e = ErrInvalidChecksum
+	}
 
-		read, e = w.conn.Read(buff)
-		if e != nil && e != io.EOF {
-			return
-		}
+	return
+}
 
-		out.Write(buff[0:read])
+func (w *ReaderWriter) readFrame() (frame []byte, e error) {
+	var h frameHeader
+	if h, e = w.readHeader(); e != nil {
+		return
+	}
 
-		if e == io.EOF {
-			break
+	frame = GetBuffer(h.size)
+	if _, e = io.ReadFull(w.conn, frame); e != nil {
+		if e == io.EOF || e == io.ErrUnexpectedEOF {
+			e = ErrTruncatedFrame
 		}
-
+	} else if createChecksum(frame) != h.checksum {
+		e = ErrInvalidChecksum
 	}
 
-	actualChecksum := md5.Sum(out.Bytes())
+	if e != nil {
+		PutBuffer(frame)
+		frame = nil
+	}
+	return
+}
 
-	if !bytes.Equal(expectedChecksum[0:], actualChecksum[0:]) {
-		e = ErrInvalidChecksum
+func (w *ReaderWriter) readHeader() (h frameHeader, e error) {
+	if _, e = io.ReadFull(w.conn, w.header[:]); e != nil {
+		if e == io.ErrUnexpectedEOF {
+			e = ErrTruncatedFrame
+		}
+		return
 	}
 
-	return
+	return parseHeader(w.header[:], w.maxFrameSize)
 }
 
 // RSAReaderWriter reads and writes data that is encrypted using RSA
@@ -153,76 +225,180 @@ func (rw *RSAReaderWriter) Write(buff []byte) (n int, e error) {
 }
 
 // CryptoReaderWriter writes and reads bytes from network.  Bytes are
-// encrypted on the wire.
+// encrypted on the wire with an AEAD such as AES-GCM, which each frame
+// carries the tag of. Each direction has its own cipher and numbers its
+// frames, the number is the nonce, so a frame that is altered, dropped,
+// replayed or reflected back fails to open. Frames are encrypted and
+// decrypted in place where they have room for the tag.
 type CryptoReaderWriter struct {
-	readerWriter         Conn
-	block                cipher.Block
-	initializationVector []byte
+	readerWriter frameConn
+	sealer       cipher.AEAD
+	opener       cipher.AEAD
+	sealNonce    []byte
+	openNonce    []byte
+	sealed       uint64
+	opened       uint64
 }
 
-func NewCryptoReaderWriter(block cipher.Block, initializationVector []byte, conn Conn) (rw *CryptoReaderWriter) {
+// NewCryptoReaderWriter creates a CryptoReaderWriter that encrypts what it
+// writes with seal and decrypts what it reads with open
+func NewCryptoReaderWriter(seal, open cipher.AEAD, conn Conn) (rw *CryptoReaderWriter) {
 	return &CryptoReaderWriter{
-		readerWriter:         conn,
-		initializationVector: initializationVector,
-		block:                block,
+		readerWriter: asFrameConn(conn),
+		sealer:       seal,
+		opener:       open,
+		sealNonce:    make([]byte, seal.NonceSize()),
+		openNonce:    make([]byte, open.NonceSize()),
 	}
 }
 
 // Read reads AES encrypted bytes from network, decrypted bytes are
 // returned in buff.
 func (crw *CryptoReaderWriter) Read(buff *bytes.Buffer) (e error) {
-	var encrypted bytes.Buffer
-	if e = crw.readerWriter.Read(&encrypted); e != nil {
+	var frame []byte
+	if frame, e = crw.readFrame(); e != nil {
 		return
 	}
 
-	decrypted := crypto.DecryptAES(crw.block, crw.initializationVector, encrypted.Bytes())
-	buff.Write(decrypted)
+	buff.Write(frame)
+	PutBuffer(frame)
 	return
 }
 
 // Write writes and AES encrypts buff to network
 func (crw *CryptoReaderWriter) Write(buff []byte) (n int, e error) {
-	encrypted := crypto.EncryptAES(crw.block, crw.initializationVector, buff)
-	return crw.readerWriter.Write(encrypted)
+	packet := GetBuffer(headerLen + len(buff) + crw.sealer.Overhead())
+	defer PutBuffer(packet)
+	packet = packet[:headerLen+len(buff)]
+	copy(packet[headerLen:], buff)
+
+	if e = crw.writeFrame(packet); e == nil {
+		n = len(buff)
+	}
+	return
+}
+
+func (crw *CryptoReaderWriter) readFrame() (frame []byte, e error) {
+	if frame, e = crw.readerWriter.readFrame(); e != nil {
+		return
+	}
+
+	putNonce(crw.openNonce, crw.opened)
+	var opened []byte
+	if opened, e = crw.opener.Open(frame[:0], crw.openNonce, frame, nil); e != nil {
+		PutBuffer(frame)
+		return nil, ErrFrameAuthentication
+	}
+
+	crw.opened++
+	return opened, nil
+}
+
+func (crw *CryptoReaderWriter) writeFrame(packet []byte) error {
+	putNonce(crw.sealNonce, crw.sealed)
+	crw.sealed++
+
+	size := len(packet) + crw.sealer.Overhead()
+	if cap(packet) < size {
+		sealed := GetBuffer(size)
+		defer PutBuffer(sealed)
+		copy(sealed[headerLen:], packet[headerLen:])
+		packet = sealed[:len(packet)]
+	}
+
+	body := packet[headerLen:]
+	crw.sealer.Seal(body[:0], crw.sealNonce, body, nil)
+	return crw.readerWriter.writeFrame(packet[:size])
+}
+
+// putNonce writes the number of a frame into the end of nonce
+func putNonce(nonce []byte, n uint64) {
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], n)
 }
 
+// Every frame written by GobEncoderReaderWriter ends with a byte saying
+// whether it holds a gob encoded message or file data
+const (
+	messageFrame byte = iota
+	dataFrame
+)
+
 // GobEncoderReaderWriter reads or writes Go typed data from
 // wire
 type GobEncoderReaderWriter struct {
-	readerWriter Conn
+	readerWriter frameConn
+	encoded      bytes.Buffer
 }
 
 func NewGobEncoderReaderWriter(conn Conn) (rw *GobEncoderReaderWriter) {
 	return &GobEncoderReaderWriter{
-		readerWriter: conn,
+		readerWriter: asFrameConn(conn),
 	}
 }
 
 // Write writes Go types to network
 func (g *GobEncoderReaderWriter) Write(v interface{}) (e error) {
-	var w bytes.Buffer
-	encoder := gob.NewEncoder(&w)
+	g.encoded.Reset()
+	var header [headerLen]byte
+	g.encoded.Write(header[:])
+
+	encoder := gob.NewEncoder(&g.encoded)
 	if e = encoder.Encode(v); e != nil {
 		return
 	}
+	g.encoded.WriteByte(messageFrame)
 
-	_, e = g.readerWriter.Write(w.Bytes())
-
-	return
+	return g.readerWriter.writeFrame(g.encoded.Bytes())
 }
 
 // Read reads Go types from network
 func (g *GobEncoderReaderWriter) Read(v interface{}) (e error) {
-	var r bytes.Buffer
-	if e = g.readerWriter.Read(&r); e != nil {
-		return
+	var data []byte
+	if data, e = g.ReadData(v); data != nil {
+		PutBuffer(data)
+		e = ErrUnexpectedData
 	}
 
-	decoder := gob.NewDecoder(&r)
-	if e = decoder.Decode(v); e != nil {
+	return
+}
+
+// WriteData writes file data to network without encoding it
+func (g *GobEncoderReaderWriter) WriteData(data []byte) error {
+	packet := GetBuffer(headerLen + len(data) + 1)
+	defer PutBuffer(packet)
+
+	copy(packet[headerLen:], data)
+	packet[len(packet)-1] = dataFrame
+
+	return g.readerWriter.writeFrame(packet)
+}
+
+// ReadData reads the next frame from network. If it holds file data the
+// data is returned in a buffer from the pool that the caller should give
+// back with PutBuffer, otherwise the message is decoded into v and data
+// is nil.
+func (g *GobEncoderReaderWriter) ReadData(v interface{}) (data []byte, e error) {
+	var frame []byte
+	if frame, e = g.readerWriter.readFrame(); e != nil {
 		return
 	}
 
+	if len(frame) == 0 {
+		PutBuffer(frame)
+		return nil, ErrUnknownFrame
+	}
+
+	body := frame[:len(frame)-1]
+	switch frame[len(frame)-1] {
+	case dataFrame:
+		return body, nil
+	case messageFrame:
+		decoder := gob.NewDecoder(bytes.NewReader(body))
+		e = decoder.Decode(v)
+	default:
+		e = ErrUnknownFrame
+	}
+
+	PutBuffer(frame)
 	return
 }
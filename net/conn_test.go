@@ -5,9 +5,12 @@ import (
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
+	"io"
 	"testing"
 
 	"github.com/murphybytes/ucp/crypto"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
 )
@@ -79,13 +82,11 @@ func (s *ConnTestSuite) TestWriter() {
 
 func (s *ConnTestSuite) TestReader() {
 	buffer := make([]byte, 3600)
-	readBuffer := make([]byte, readSize)
 
 	var reader bytes.Buffer
 
 	rand.Read(buffer)
 	send := createPacket(buffer)
-	copy(readBuffer, send)
 
 	s.m.On(
 		"Write",
@@ -113,7 +114,7 @@ type mockReaderWriter struct {
 }
 
 func (m *mockReaderWriter) Write(buffer []byte) (n int, e error) {
-	m.buffer = buffer
+	m.buffer = append([]byte{}, buffer...)
 	return len(buffer), nil
 }
 
@@ -129,19 +130,26 @@ func (m *mockReaderWriter) Close() (e error) {
 
 type EncryptorTestSuite struct {
 	suite.Suite
-	m                     *mockReaderWriter
-	encryptedReaderWriter Conn
-	block                 cipher.Block
-	iv                    []byte
+	m      *mockReaderWriter
+	client Conn
+	server Conn
+}
+
+// newSessionCiphers returns the ciphers each end of a session uses
+func newSessionCiphers() (clientSeal, clientOpen, serverSeal, serverOpen cipher.AEAD) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	sessionID := crypto.SessionID(nil, nil, nil, nil, secret)
+	clientSeal, clientOpen, _ = crypto.SessionCiphers(secret, sessionID, crypto.RoleClient)
+	serverSeal, serverOpen, _ = crypto.SessionCiphers(secret, sessionID, crypto.RoleServer)
+	return
 }
 
 func (s *EncryptorTestSuite) SetupTest() {
 	s.m = new(mockReaderWriter)
-	s.iv = make([]byte, crypto.IVBlockSize)
-	rand.Read(s.iv)
-	s.block, _, _ = crypto.NewCipherBlock()
-	s.encryptedReaderWriter = NewCryptoReaderWriter(s.block, s.iv, s.m)
-
+	clientSeal, clientOpen, serverSeal, serverOpen := newSessionCiphers()
+	s.client = NewCryptoReaderWriter(clientSeal, clientOpen, s.m)
+	s.server = NewCryptoReaderWriter(serverSeal, serverOpen, s.m)
 }
 
 func (s *EncryptorTestSuite) TestEncryptedReadAndWrite() {
@@ -149,19 +157,45 @@ func (s *EncryptorTestSuite) TestEncryptedReadAndWrite() {
 
 	var outbuff bytes.Buffer
 
-	n, e := s.encryptedReaderWriter.Write(inbuff)
+	n, e := s.client.Write(inbuff)
 	s.Nil(e)
 	s.Equal(len(inbuff), n)
 
-	expected := crypto.EncryptAES(s.block, s.iv, inbuff)
-	s.Equal(string(expected), string(s.m.buffer))
+	s.Len(s.m.buffer, len(inbuff)+16)
+	s.NotContains(string(s.m.buffer), "some text")
 
-	e = s.encryptedReaderWriter.Read(&outbuff)
+	e = s.server.Read(&outbuff)
 	s.Nil(e)
 	s.Equal("I am some text", string(outbuff.Bytes()))
 
 }
 
+func (s *EncryptorTestSuite) TestReflectedFrameRefused() {
+	_, e := s.client.Write([]byte("I am some text"))
+	s.Nil(e)
+
+	var outbuff bytes.Buffer
+	s.Equal(ErrFrameAuthentication, s.client.Read(&outbuff))
+}
+
+func (s *EncryptorTestSuite) TestAlteredFrameRefused() {
+	_, e := s.client.Write([]byte("I am some text"))
+	s.Nil(e)
+	s.m.buffer[0] ^= 1
+
+	var outbuff bytes.Buffer
+	s.Equal(ErrFrameAuthentication, s.server.Read(&outbuff))
+}
+
+func (s *EncryptorTestSuite) TestReplayedFrameRefused() {
+	_, e := s.client.Write([]byte("I am some text"))
+	s.Nil(e)
+
+	var outbuff bytes.Buffer
+	s.Nil(s.server.Read(&outbuff))
+	s.Equal(ErrFrameAuthentication, s.server.Read(&outbuff))
+}
+
 func (s *EncryptorTestSuite) TestGobEncodedReadAndWrite() {
 	expected := struct {
 		Question string
@@ -171,7 +205,7 @@ func (s *EncryptorTestSuite) TestGobEncodedReadAndWrite() {
 		Answer:   42,
 	}
 
-	rw := NewGobEncoderReaderWriter(s.encryptedReaderWriter)
+	rw := NewGobEncoderReaderWriter(s.client)
 
 	e := rw.Write(expected)
 	s.Nil(e)
@@ -181,7 +215,7 @@ func (s *EncryptorTestSuite) TestGobEncodedReadAndWrite() {
 		Answer   int
 	}{}
 
-	e = rw.Read(&actual)
+	e = NewGobEncoderReaderWriter(s.server).Read(&actual)
 	s.Nil(e)
 	s.Equal(expected.Answer, actual.Answer)
 	s.Equal(expected.Question, actual.Question)
@@ -191,14 +225,14 @@ func (s *EncryptorTestSuite) TestGobEncodedReadAndWrite() {
 func (s *EncryptorTestSuite) TestGobEncodedReadAndWriteWithString() {
 	expected := "Here is a string"
 
-	rw := NewGobEncoderReaderWriter(s.encryptedReaderWriter)
+	rw := NewGobEncoderReaderWriter(s.client)
 
 	e := rw.Write(expected)
 	s.Nil(e)
 
 	actual := ""
 
-	e = rw.Read(&actual)
+	e = NewGobEncoderReaderWriter(s.server).Read(&actual)
 	s.Nil(e)
 	s.Equal(expected, actual)
 
@@ -206,12 +240,12 @@ func (s *EncryptorTestSuite) TestGobEncodedReadAndWriteWithString() {
 
 func (s *EncryptorTestSuite) TestGobEncodedReadAndWriteWithBytes() {
 	expected := []byte("Here are some bytes")
-	rw := NewGobEncoderReaderWriter(s.encryptedReaderWriter)
+	rw := NewGobEncoderReaderWriter(s.client)
 	e := rw.Write(expected)
 	s.Nil(e)
 
 	var actual []byte
-	e = rw.Read(&actual)
+	e = NewGobEncoderReaderWriter(s.server).Read(&actual)
 	s.Nil(e)
 	s.True(bytes.Equal(expected, actual))
 
@@ -250,3 +284,255 @@ func (s *RSAEncryptionTestSuite) TestRSAEncryptedReadWrite() {
 func TestRSAEncryptionTestSuiteTest(t *testing.T) {
 	suite.Run(t, new(RSAEncryptionTestSuite))
 }
+
+// streamConn replays a byte stream, returning at most chunk bytes from each
+// read the way a TCP connection may split or merge frames.
+type streamConn struct {
+	bytes.Buffer
+	chunk int
+}
+
+func (c *streamConn) Read(buffer []byte) (n int, e error) {
+	if c.chunk > 0 && len(buffer) > c.chunk {
+		buffer = buffer[:c.chunk]
+	}
+	return c.Buffer.Read(buffer)
+}
+
+func (c *streamConn) Close() error {
+	return nil
+}
+
+func TestReaderCoalescedFrames(t *testing.T) {
+	for _, chunk := range []int{0, 1, 7, headerLen, 1500} {
+		stream := &streamConn{chunk: chunk}
+		var sent [][]byte
+		for _, size := range []int{0, 10, 3000, 1, 200} {
+			buffer := make([]byte, size)
+			rand.Read(buffer)
+			sent = append(sent, buffer)
+			stream.Write(createPacket(buffer))
+		}
+
+		rw := NewReaderWriter(stream)
+		for _, expected := range sent {
+			var out bytes.Buffer
+			assert.Nil(t, rw.Read(&out), "chunk %d", chunk)
+			assert.True(t, bytes.Equal(expected, out.Bytes()), "chunk %d", chunk)
+		}
+
+		var out bytes.Buffer
+		assert.Equal(t, io.EOF, rw.Read(&out))
+	}
+}
+
+func TestReaderRejectsLargeFrame(t *testing.T) {
+	stream := &streamConn{}
+	stream.Write(createPacket(make([]byte, 101)))
+
+	var out bytes.Buffer
+	e := NewReaderWriterSize(stream, 100).Read(&out)
+	assert.True(t, errors.Is(e, ErrFrameTooLarge))
+	assert.Equal(t, &FrameSizeError{Size: 101, Max: 100}, e)
+	assert.Equal(t, 0, out.Len())
+}
+
+func TestReaderTruncatedFrame(t *testing.T) {
+	packet := createPacket([]byte("some bytes"))
+	for _, length := range []int{1, headerLen - 1, headerLen, len(packet) - 1} {
+		stream := &streamConn{}
+		stream.Write(packet[:length])
+
+		var out bytes.Buffer
+		assert.Equal(t, ErrTruncatedFrame, NewReaderWriter(stream).Read(&out), "length %d", length)
+	}
+}
+
+func TestReaderInvalidChecksum(t *testing.T) {
+	packet := createPacket([]byte("some bytes"))
+	packet[len(packet)-1] ^= 0xFF
+	stream := &streamConn{}
+	stream.Write(packet)
+
+	var out bytes.Buffer
+	assert.Equal(t, ErrInvalidChecksum, NewReaderWriter(stream).Read(&out))
+}
+
+func TestWriterRejectsLargeFrame(t *testing.T) {
+	stream := &streamConn{}
+	_, e := NewReaderWriterSize(stream, 100).Write(make([]byte, 101))
+	assert.True(t, errors.Is(e, ErrFrameTooLarge))
+	assert.Equal(t, 0, stream.Len())
+}
+
+// newStreamPair returns connections for each end of stream that encrypt
+// the way a session does
+func newStreamPair(stream *streamConn) (writer, reader *GobEncoderReaderWriter) {
+	clientSeal, clientOpen, serverSeal, serverOpen := newSessionCiphers()
+	writer = NewGobEncoderReaderWriter(NewCryptoReaderWriter(clientSeal, clientOpen, NewReaderWriter(stream)))
+	reader = NewGobEncoderReaderWriter(NewCryptoReaderWriter(serverSeal, serverOpen, NewReaderWriter(stream)))
+	return
+}
+
+func TestDataFrames(t *testing.T) {
+	stream := &streamConn{chunk: 1000}
+	writer, reader := newStreamPair(stream)
+
+	data := make([]byte, 5000)
+	rand.Read(data)
+
+	assert.Nil(t, writer.Write("before"))
+	assert.Nil(t, writer.WriteData(data))
+	assert.Nil(t, writer.WriteData(nil))
+	assert.Nil(t, writer.Write("after"))
+	assert.Nil(t, writer.WriteData(data))
+
+	var message string
+	received, e := reader.ReadData(&message)
+	assert.Nil(t, e)
+	assert.Nil(t, received)
+	assert.Equal(t, "before", message)
+
+	received, e = reader.ReadData(&message)
+	assert.Nil(t, e)
+	assert.True(t, bytes.Equal(data, received))
+	PutBuffer(received)
+
+	received, e = reader.ReadData(&message)
+	assert.Nil(t, e)
+	assert.NotNil(t, received)
+	assert.Equal(t, 0, len(received))
+	PutBuffer(received)
+
+	assert.Nil(t, reader.Read(&message))
+	assert.Equal(t, "after", message)
+
+	// file data is refused where a message is expected
+	assert.Equal(t, ErrUnexpectedData, reader.Read(&message))
+}
+
+func TestUnknownFrame(t *testing.T) {
+	stream := &streamConn{}
+	rw := NewReaderWriter(stream)
+	rw.Write([]byte{})
+	rw.Write([]byte{0x7F})
+
+	reader := NewGobEncoderReaderWriter(NewReaderWriter(stream))
+	var message string
+	_, e := reader.ReadData(&message)
+	assert.Equal(t, ErrUnknownFrame, e)
+	_, e = reader.ReadData(&message)
+	assert.Equal(t, ErrUnknownFrame, e)
+}
+
+// benchmarkChunkSize is the default size of the buffers a transfer sends
+const benchmarkChunkSize = 100000
+
+// BenchmarkGobChunk sends file data the way it was sent before raw data
+// frames, gob encoded in a struct
+func BenchmarkGobChunk(b *testing.B) {
+	type fileChunk struct {
+		Buffer []byte
+		Error  error
+	}
+
+	stream := &streamConn{}
+	writer, reader := newStreamPair(stream)
+	chunk := fileChunk{Buffer: make([]byte, benchmarkChunkSize)}
+
+	b.SetBytes(benchmarkChunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if e := writer.Write(chunk); e != nil {
+			b.Fatal(e)
+		}
+		var received fileChunk
+		if e := reader.Read(&received); e != nil {
+			b.Fatal(e)
+		}
+	}
+}
+
+func BenchmarkDataFrame(b *testing.B) {
+	stream := &streamConn{}
+	writer, reader := newStreamPair(stream)
+	data := make([]byte, benchmarkChunkSize)
+
+	b.SetBytes(benchmarkChunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if e := writer.WriteData(data); e != nil {
+			b.Fatal(e)
+		}
+		received, e := reader.ReadData(nil)
+		if e != nil {
+			b.Fatal(e)
+		}
+		PutBuffer(received)
+	}
+}
+
+// BenchmarkFraming measures writing and reading a frame with its checksum
+func BenchmarkFraming(b *testing.B) {
+	stream := &streamConn{}
+	rw := NewReaderWriter(stream)
+	buffer := make([]byte, benchmarkChunkSize)
+
+	b.SetBytes(benchmarkChunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, e := rw.Write(buffer); e != nil {
+			b.Fatal(e)
+		}
+		frame, e := rw.readFrame()
+		if e != nil {
+			b.Fatal(e)
+		}
+		PutBuffer(frame)
+	}
+}
+
+// BenchmarkEncryption measures framing with AES encryption
+func BenchmarkEncryption(b *testing.B) {
+	stream := &streamConn{}
+	clientSeal, clientOpen, serverSeal, serverOpen := newSessionCiphers()
+	writer := NewCryptoReaderWriter(clientSeal, clientOpen, NewReaderWriter(stream))
+	reader := NewCryptoReaderWriter(serverSeal, serverOpen, NewReaderWriter(stream))
+	buffer := make([]byte, benchmarkChunkSize)
+
+	b.SetBytes(benchmarkChunkSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, e := writer.Write(buffer); e != nil {
+			b.Fatal(e)
+		}
+		frame, e := reader.readFrame()
+		if e != nil {
+			b.Fatal(e)
+		}
+		PutBuffer(frame)
+	}
+}
+
+// BenchmarkGobMessage measures sending one of the small messages that
+// make up the rest of the protocol
+func BenchmarkGobMessage(b *testing.B) {
+	stream := &streamConn{}
+	writer, reader := newStreamPair(stream)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if e := writer.Write("FILE_TRANSFER_MORE"); e != nil {
+			b.Fatal(e)
+		}
+		var message string
+		if e := reader.Read(&message); e != nil {
+			b.Fatal(e)
+		}
+	}
+}
@@ -1,74 +1,114 @@
 package net
 
 import (
-	"bytes"
 	"crypto/md5"
 	"encoding/binary"
+	"errors"
 	"fmt"
 )
 
-const maxBufferLen = 0x7FFFFFFF
+// DefaultMaxFrameSize is the largest frame body a ReaderWriter accepts
+// unless it is told otherwise.
+const DefaultMaxFrameSize = 16 << 20
+
+// FrameOverhead is the room to leave in the maximum frame size for the
+// encoding around a buffer of file data.
+const FrameOverhead = 1024
 
 const sizeHeaderLen = 8
 const checksumHeaderLen = md5.Size
 const headerLen = sizeHeaderLen + checksumHeaderLen
 
-func prependHeaderToBuffer(buffer []byte) (b []byte, e error) {
-	var sizeHeader []byte
-	if sizeHeader, e = createSizeHeader(buffer); e != nil {
-		return
-	}
+var ErrMalformedHeader = errors.New("Malformed frame header")
+var ErrTruncatedFrame = errors.New("Truncated frame")
+var ErrFrameTooLarge = errors.New("Frame too large")
 
-	checkSum := createChecksum(buffer)
+// FrameSizeError is returned when a frame header announces a body larger
+// than the reader accepts. It matches ErrFrameTooLarge with errors.Is.
+type FrameSizeError struct {
+	Size uint64
+	Max  int
+}
 
-	b = make([]byte, 0, len(buffer)+sizeHeaderLen+md5.Size)
-	b = append(b, sizeHeader...)
-	b = append(b, checkSum[0:]...)
-	b = append(b, buffer...)
+func (e *FrameSizeError) Error() string {
+	return fmt.Sprintf("Frame of %d bytes exceeds maximum of %d bytes", e.Size, e.Max)
+}
 
-	return
+func (e *FrameSizeError) Is(target error) bool {
+	return target == ErrFrameTooLarge
 }
 
-func createSizeHeader(buffer []byte) (h []byte, e error) {
-	var size uint64
-	size = uint64(len(buffer))
-	var buff bytes.Buffer
-	if e = binary.Write(&buff, binary.LittleEndian, size); e != nil {
-		return
-	}
-	h = buff.Bytes()
+// frameHeader is the fixed length prefix of every frame, the size of the
+// body followed by its checksum.
+type frameHeader struct {
+	size     int
+	checksum [checksumHeaderLen]byte
+}
 
+func prependHeaderToBuffer(buffer []byte) (b []byte, e error) {
+	b = make([]byte, headerLen+len(buffer))
+	copy(b[headerLen:], buffer)
+	putHeader(b)
 	return
 }
 
+// putHeader fills in the header reserved at the front of packet for the
+// body that follows it
+func putHeader(packet []byte) {
+	binary.LittleEndian.PutUint64(packet[0:sizeHeaderLen], uint64(len(packet)-headerLen))
+	checksum := createChecksum(packet[headerLen:])
+	copy(packet[sizeHeaderLen:headerLen], checksum[:])
+}
+
 func createChecksum(buffer []byte) (s [md5.Size]byte) {
 	s = md5.Sum(buffer)
 	return
 
 }
 
-func getBufferSize(buffer []byte) (s int, e error) {
-	if len(buffer) < headerLen {
-		e = fmt.Errorf("Malformed header")
+// parseHeader decodes a frame header, rejecting frames whose body would be
+// larger than maxSize.
+func parseHeader(buffer []byte, maxSize int) (h frameHeader, e error) {
+	if len(buffer) != headerLen {
+		e = ErrMalformedHeader
 		return
 	}
-	buf := bytes.NewReader(buffer[0:sizeHeaderLen])
-	var i uint32
-	if e = binary.Read(buf, binary.LittleEndian, &i); e != nil {
+
+	size := binary.LittleEndian.Uint64(buffer[0:sizeHeaderLen])
+	if size > uint64(maxSize) {
+		e = &FrameSizeError{Size: size, Max: maxSize}
 		return
 	}
 
-	s = int(i)
-
+	h.size = int(size)
+	copy(h.checksum[:], buffer[sizeHeaderLen:headerLen])
 	return
 }
 
-func getDataPacket(buffer []byte) (data []byte, e error) {
+// parseFrame splits a complete frame into its body, checking its length and
+// checksum against the header.
+func parseFrame(buffer []byte, maxSize int) (data []byte, e error) {
 	if len(buffer) < headerLen {
-		e = fmt.Errorf("Malformed header")
+		e = ErrMalformedHeader
+		return
+	}
+
+	var h frameHeader
+	if h, e = parseHeader(buffer[0:headerLen], maxSize); e != nil {
 		return
 	}
 
 	data = buffer[headerLen:]
+	if len(data) < h.size {
+		return nil, ErrTruncatedFrame
+	}
+	if len(data) > h.size {
+		return nil, ErrMalformedHeader
+	}
+
+	if createChecksum(data) != h.checksum {
+		return nil, ErrInvalidChecksum
+	}
+
 	return
 }
@@ -3,6 +3,7 @@ package net
 import (
 	"bytes"
 	"crypto/rand"
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -16,11 +17,109 @@ func TestPacketValidation(t *testing.T) {
 	assert.Nil(t, e)
 	assert.Equal(t, len(testData)+headerLen, len(packet))
 
-	size, _ := getBufferSize(packet)
-	assert.Equal(t, 1000, size)
+	h, _ := parseHeader(packet[:headerLen], DefaultMaxFrameSize)
+	assert.Equal(t, 1000, h.size)
 
-	data, _ := getDataPacket(packet)
+	data, _ := parseFrame(packet, DefaultMaxFrameSize)
 	comp := bytes.Compare(data, testData)
 	assert.Equal(t, 0, comp)
 
 }
+
+func TestParseFrameErrors(t *testing.T) {
+	packet := createPacket([]byte("some bytes"))
+
+	_, e := parseFrame(packet[:headerLen-1], DefaultMaxFrameSize)
+	assert.Equal(t, ErrMalformedHeader, e)
+
+	_, e = parseFrame(packet[:len(packet)-1], DefaultMaxFrameSize)
+	assert.Equal(t, ErrTruncatedFrame, e)
+
+	_, e = parseFrame(append(packet, 0), DefaultMaxFrameSize)
+	assert.Equal(t, ErrMalformedHeader, e)
+
+	_, e = parseFrame(packet, 9)
+	assert.True(t, errors.Is(e, ErrFrameTooLarge))
+
+	// sizes that would overflow an int must not slip past the limit
+	huge := append([]byte{}, packet...)
+	copy(huge, []byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
+	_, e = parseFrame(huge, DefaultMaxFrameSize)
+	assert.True(t, errors.Is(e, ErrFrameTooLarge))
+
+	corrupt := append([]byte{}, packet...)
+	corrupt[headerLen] ^= 0xFF
+	_, e = parseFrame(corrupt, DefaultMaxFrameSize)
+	assert.Equal(t, ErrInvalidChecksum, e)
+}
+
+func FuzzFrameRoundTrip(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte("I am some text"))
+	f.Add(make([]byte, 1500))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		packet, e := prependHeaderToBuffer(data)
+		if e != nil {
+			t.Fatal(e)
+		}
+
+		parsed, e := parseFrame(packet, len(data))
+		if e != nil {
+			t.Fatal(e)
+		}
+		if !bytes.Equal(data, parsed) {
+			t.Fatalf("round trip changed %x to %x", data, parsed)
+		}
+
+		stream := &streamConn{chunk: 7}
+		stream.Write(packet)
+		stream.Write(packet)
+		rw := NewReaderWriterSize(stream, len(data))
+		for i := 0; i < 2; i++ {
+			var out bytes.Buffer
+			if e = rw.Read(&out); e != nil {
+				t.Fatal(e)
+			}
+			if !bytes.Equal(data, out.Bytes()) {
+				t.Fatalf("frame %d read as %x, wanted %x", i, out.Bytes(), data)
+			}
+		}
+	})
+}
+
+func FuzzParseFrame(f *testing.F) {
+	f.Add(createPacket([]byte("I am some text")))
+	f.Add(createPacket(nil))
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
+	f.Add(make([]byte, headerLen))
+
+	f.Fuzz(func(t *testing.T, packet []byte) {
+		const maxSize = 1 << 16
+		data, e := parseFrame(packet, maxSize)
+		if e == nil {
+			if len(data) > maxSize {
+				t.Fatalf("accepted %d byte frame", len(data))
+			}
+			if !bytes.Equal(createPacket(data), packet) {
+				t.Fatalf("accepted frame %x does not re-encode", packet)
+			}
+		}
+
+		// the streaming reader must agree with parseFrame and never read
+		// past the end of the frame
+		stream := &streamConn{chunk: 5}
+		stream.Write(packet)
+		var out bytes.Buffer
+		readErr := NewReaderWriterSize(stream, maxSize).Read(&out)
+		if e == nil && (readErr != nil || !bytes.Equal(data, out.Bytes())) {
+			t.Fatalf("reader returned %v for a frame parseFrame accepted", readErr)
+		}
+		if e == ErrInvalidChecksum && readErr != ErrInvalidChecksum {
+			t.Fatalf("reader returned %v for a corrupt frame", readErr)
+		}
+		if errors.Is(e, ErrFrameTooLarge) && !errors.Is(readErr, ErrFrameTooLarge) {
+			t.Fatalf("reader returned %v for an oversized frame", readErr)
+		}
+	})
+}
@@ -0,0 +1,291 @@
+// Package impair wraps a net.Conn so that what is written to it arrives
+// late, slowly, out of order, damaged or not at all. It lets tests see how
+// the protocol copes with a poor network without needing one.
+package impair
+
+import (
+	"errors"
+	"math/rand"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// FaultKind is the damage done by a Fault
+type FaultKind int
+
+const (
+	// Drop discards the write containing the offset
+	Drop FaultKind = iota
+	// Truncate discards the write from the offset on
+	Truncate
+	// Corrupt flips the bits of the byte at the offset
+	Corrupt
+	// Disconnect delivers the bytes before the offset then closes the
+	// connection
+	Disconnect
+)
+
+// Fault damages the stream written to a connection at Offset, counted in
+// bytes from the first byte written
+type Fault struct {
+	Offset int64
+	Kind   FaultKind
+}
+
+// Config describes the impairments applied to bytes written to a
+// connection. The zero value passes writes through unchanged, apart from
+// delivering them from another goroutine.
+type Config struct {
+	// Latency delays every write, Jitter adds a random delay of up to
+	// Jitter on top
+	Latency time.Duration
+	Jitter  time.Duration
+	// Bandwidth caps delivery in bytes per second, zero is unlimited
+	Bandwidth int64
+	// Reorder delivers writes as soon as their delay is over instead of in
+	// the order they were written, so with jitter they can overtake each
+	// other
+	Reorder bool
+	// DropRate, TruncateRate and CorruptRate are the chances of each write
+	// being dropped, cut short at a random point or having a random byte
+	// corrupted
+	DropRate     float64
+	TruncateRate float64
+	CorruptRate  float64
+	// Faults are applied at exact offsets, in addition to the rates
+	Faults []Fault
+	// Seed seeds the random choices so failures can be reproduced
+	Seed int64
+}
+
+var ErrDisconnected = errors.New("Connection closed by impairment")
+
+type delivery struct {
+	data       []byte
+	at         time.Time
+	disconnect bool
+}
+
+// Conn is a net.Conn whose writes are impaired. Reads are passed through,
+// wrap both ends of a connection to impair both directions.
+type Conn struct {
+	net.Conn
+	config Config
+
+	mu           sync.Mutex
+	random       *rand.Rand
+	written      int64
+	nextFree     time.Time
+	queue        []delivery
+	closed       bool
+	disconnected bool
+	wake         chan struct{}
+	done         chan struct{}
+	closeOnce    sync.Once
+}
+
+// NewConn wraps conn, impairing what is written to it as config describes
+func NewConn(conn net.Conn, config Config) *Conn {
+	faults := append([]Fault{}, config.Faults...)
+	sort.Slice(faults, func(i, j int) bool { return faults[i].Offset < faults[j].Offset })
+	config.Faults = faults
+
+	c := &Conn{
+		Conn:   conn,
+		config: config,
+		random: rand.New(rand.NewSource(config.Seed)),
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	go c.deliver()
+	return c
+}
+
+// Pipe returns both ends of an in-memory connection with the writes of
+// each end impaired by its config
+func Pipe(a, b Config) (*Conn, *Conn) {
+	left, right := net.Pipe()
+	return NewConn(left, a), NewConn(right, b)
+}
+
+// Write queues b for delivery and returns without waiting for it to
+// arrive, as writing to a socket buffer would
+func (c *Conn) Write(b []byte) (n int, e error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed || c.disconnected {
+		return 0, ErrDisconnected
+	}
+
+	start := c.written
+	c.written += int64(len(b))
+	data, disconnect := c.impair(append([]byte{}, b...), start)
+
+	now := time.Now()
+	at := now.Add(c.config.Latency)
+	if c.config.Jitter > 0 {
+		at = at.Add(time.Duration(c.random.Int63n(int64(c.config.Jitter))))
+	}
+
+	if c.config.Bandwidth > 0 {
+		if c.nextFree.Before(now) {
+			c.nextFree = now
+		}
+		c.nextFree = c.nextFree.Add(time.Duration(int64(len(data)) * int64(time.Second) / c.config.Bandwidth))
+		if at.Before(c.nextFree) {
+			at = c.nextFree
+		}
+	}
+
+	if data != nil || disconnect {
+		c.queue = append(c.queue, delivery{data: data, at: at, disconnect: disconnect})
+		if c.config.Reorder {
+			sort.SliceStable(c.queue, func(i, j int) bool { return c.queue[i].at.Before(c.queue[j].at) })
+		}
+	}
+
+	if disconnect {
+		c.disconnected = true
+	}
+
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+
+	return len(b), nil
+}
+
+// impair applies the faults and random damage that fall within the write
+// of data starting at offset. A nil result means the write is dropped.
+func (c *Conn) impair(data []byte, offset int64) (out []byte, disconnect bool) {
+	end := offset + int64(len(data))
+
+	for _, fault := range c.config.Faults {
+		if fault.Offset < offset || fault.Offset >= end {
+			continue
+		}
+
+		at := fault.Offset - offset
+		switch fault.Kind {
+		case Drop:
+			return nil, false
+		case Truncate:
+			return data[:at], false
+		case Corrupt:
+			data[at] ^= 0xff
+		case Disconnect:
+			return data[:at], true
+		}
+	}
+
+	if len(data) == 0 {
+		return data, false
+	}
+
+	if c.chance(c.config.DropRate) {
+		return nil, false
+	}
+
+	if c.chance(c.config.TruncateRate) {
+		data = data[:c.random.Intn(len(data))]
+	}
+
+	if len(data) > 0 && c.chance(c.config.CorruptRate) {
+		data[c.random.Intn(len(data))] ^= 0xff
+	}
+
+	return data, false
+}
+
+func (c *Conn) chance(rate float64) bool {
+	return rate > 0 && c.random.Float64() < rate
+}
+
+// deliver writes queued data to the underlying connection once its delay
+// is over
+func (c *Conn) deliver() {
+	defer close(c.done)
+
+	for {
+		c.mu.Lock()
+		if len(c.queue) == 0 {
+			closed := c.closed
+			c.mu.Unlock()
+			if closed {
+				c.Conn.Close()
+				return
+			}
+			<-c.wake
+			continue
+		}
+
+		next := c.queue[0]
+		if wait := time.Until(next.at); wait > 0 {
+			c.mu.Unlock()
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-c.wake:
+				// with reordering a later write may now be due first
+				timer.Stop()
+			}
+			continue
+		}
+		c.queue = c.queue[1:]
+		c.mu.Unlock()
+
+		if len(next.data) > 0 {
+			if _, err := c.Conn.Write(next.data); err != nil {
+				c.Conn.Close()
+				c.discard()
+				return
+			}
+		}
+
+		if next.disconnect {
+			c.Conn.Close()
+			c.discard()
+			return
+		}
+	}
+}
+
+func (c *Conn) discard() {
+	c.mu.Lock()
+	c.queue = nil
+	c.disconnected = true
+	c.mu.Unlock()
+}
+
+// Close closes the connection once the data already written has been
+// delivered, as closing a socket does
+func (c *Conn) Close() error {
+	c.closeOnce.Do(func() {
+		c.mu.Lock()
+		c.closed = true
+		c.mu.Unlock()
+
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	})
+	return nil
+}
+
+// Wait blocks until queued data has been delivered and the underlying
+// connection closed after Close is called or a disconnect fault
+func (c *Conn) Wait() {
+	<-c.done
+}
+
+// Written returns the bytes written so far, before impairment
+func (c *Conn) Written() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.written
+}
@@ -0,0 +1,126 @@
+package impair
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	unet "github.com/murphybytes/ucp/net"
+	"github.com/stretchr/testify/suite"
+)
+
+type ImpairSuite struct {
+	suite.Suite
+}
+
+// send writes each message to an impaired end of a pipe, closes it and
+// returns everything the other end reads
+func (s *ImpairSuite) send(config Config, messages ...[]byte) []byte {
+	writer, reader := net.Pipe()
+	conn := NewConn(writer, config)
+
+	for _, message := range messages {
+		n, e := conn.Write(message)
+		s.Require().Nil(e)
+		s.Equal(len(message), n)
+	}
+	conn.Close()
+
+	received, _ := ioutil.ReadAll(reader)
+	conn.Wait()
+	return received
+}
+
+func (s *ImpairSuite) TestPassThrough() {
+	s.Equal("hello world", string(s.send(Config{}, []byte("hello "), []byte("world"))))
+}
+
+func (s *ImpairSuite) TestLatency() {
+	started := time.Now()
+	s.Equal("hello", string(s.send(Config{Latency: 50 * time.Millisecond}, []byte("hello"))))
+	s.True(time.Since(started) >= 50*time.Millisecond)
+}
+
+func (s *ImpairSuite) TestBandwidth() {
+	started := time.Now()
+	received := s.send(Config{Bandwidth: 100000}, make([]byte, 5000), make([]byte, 5000))
+	s.Len(received, 10000)
+	s.True(time.Since(started) >= 100*time.Millisecond)
+}
+
+func (s *ImpairSuite) TestJitterKeepsOrder() {
+	var messages [][]byte
+	for i := byte(0); i < 10; i++ {
+		messages = append(messages, []byte{'0' + i})
+	}
+	s.Equal("0123456789", string(s.send(Config{Jitter: 30 * time.Millisecond, Seed: 1}, messages...)))
+}
+
+func (s *ImpairSuite) TestReorder() {
+	var messages [][]byte
+	for i := byte(0); i < 10; i++ {
+		messages = append(messages, []byte{'0' + i})
+	}
+	received := s.send(Config{Jitter: 30 * time.Millisecond, Reorder: true, Seed: 1}, messages...)
+	s.Len(received, 10)
+	s.NotEqual("0123456789", string(received))
+}
+
+func (s *ImpairSuite) TestFaults() {
+	message := []byte("0123456789")
+
+	s.Equal("abc", string(s.send(Config{Faults: []Fault{{Offset: 12, Kind: Drop}}}, []byte("abc"), message)))
+	s.Equal("abc01", string(s.send(Config{Faults: []Fault{{Offset: 5, Kind: Truncate}}}, []byte("abc"), message)))
+	s.Equal("abc012", string(s.send(Config{Faults: []Fault{{Offset: 6, Kind: Disconnect}}}, []byte("abc"), message)))
+
+	corrupted := s.send(Config{Faults: []Fault{{Offset: 4, Kind: Corrupt}}}, message)
+	s.Equal(byte('4')^0xff, corrupted[4])
+}
+
+func (s *ImpairSuite) TestWriteAfterDisconnect() {
+	writer, reader := net.Pipe()
+	defer reader.Close()
+	conn := NewConn(writer, Config{Faults: []Fault{{Offset: 0, Kind: Disconnect}}})
+
+	conn.Write([]byte("gone"))
+	_, e := conn.Write([]byte("too late"))
+	s.Equal(ErrDisconnected, e)
+
+	_, e = reader.Read(make([]byte, 10))
+	s.Equal(io.EOF, e)
+}
+
+func (s *ImpairSuite) TestRates() {
+	config := Config{DropRate: 0.3, CorruptRate: 0.3, Seed: 7}
+	var messages [][]byte
+	var sent int
+	for i := 0; i < 50; i++ {
+		messages = append(messages, []byte("0123456789"))
+		sent += 10
+	}
+
+	received := s.send(config, messages...)
+	s.True(len(received) < sent)
+	s.False(bytes.Equal(received, bytes.Repeat([]byte("0123456789"), len(received)/10)))
+
+	// the same seed damages the stream the same way
+	s.Equal(received, s.send(config, messages...))
+}
+
+func (s *ImpairSuite) TestCorruptFrame() {
+	left, right := Pipe(Config{Faults: []Fault{{Offset: 30, Kind: Corrupt}}}, Config{})
+	defer left.Close()
+	defer right.Close()
+
+	go unet.NewReaderWriter(left).Write([]byte("a frame long enough to be damaged"))
+
+	var out bytes.Buffer
+	s.Equal(unet.ErrInvalidChecksum, unet.NewReaderWriter(right).Read(&out))
+}
+
+func TestImpair(t *testing.T) {
+	suite.Run(t, new(ImpairSuite))
+}
@@ -0,0 +1,458 @@
+package net
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"io"
+	"sync"
+)
+
+var ErrChannelClosed = errors.New("Channel is closed")
+var ErrUnknownChannel = errors.New("Frame for a channel that was never opened")
+var ErrTooManyChannels = errors.New("Too many channels open")
+var ErrUnexpectedMessage = errors.New("Unexpected message on a multiplexed connection")
+var ErrChannelOverflow = errors.New("Frame sent to a channel without credit")
+
+// Channels are carried in data frames of the connection underneath. Each
+// frame ends with the number of the channel it belongs to and a byte
+// saying what kind of frame it is.
+const muxTrailerLen = 5
+
+const (
+	muxOpen byte = iota
+	muxClose
+	muxMessage
+	muxData
+	muxCredit
+)
+
+// muxQueueLength is the number of frames that may wait to be read on a
+// channel. A channel starts with that many credits, each frame written
+// spends one and the other side hands them back in credit frames as its
+// frames are read, so a channel nobody reads never holds up the others.
+const muxQueueLength = 16
+
+// muxCreditBatch is the number of frames read before their credits are
+// handed back
+const muxCreditBatch = muxQueueLength / 2
+
+// Mux runs several channels over one EncodeConn. Each Channel is an
+// EncodeConn itself, so a conversation written for a connection can run on
+// a channel unchanged, alongside others. One side opens channels with Open
+// and the other receives them with Accept. The mux reads the connection
+// until it fails or is closed, the owner of the connection closes it once
+// the channels are done with.
+type Mux struct {
+	conn  EncodeConn
+	limit int
+
+	writeMu sync.Mutex
+
+	mu       sync.Mutex
+	channels map[uint32]*Channel
+	last     uint32
+	accepted chan *Channel
+	done     chan struct{}
+	err      error
+}
+
+// NewMux starts reading channels from conn. accept is the number of
+// channels the other side may have open at once, zero if it may not open
+// any.
+func NewMux(conn EncodeConn, accept int) (m *Mux) {
+	m = &Mux{
+		conn:     conn,
+		limit:    accept,
+		channels: make(map[uint32]*Channel),
+		accepted: make(chan *Channel, accept),
+		done:     make(chan struct{}),
+	}
+	go m.readLoop()
+	return
+}
+
+// Open opens a new channel to the other side
+func (m *Mux) Open() (c *Channel, e error) {
+	m.mu.Lock()
+	if m.err != nil {
+		e = m.err
+		m.mu.Unlock()
+		return
+	}
+	m.last++
+	c = newChannel(m, m.last)
+	m.channels[c.id] = c
+	m.mu.Unlock()
+
+	if e = m.write(c.trailer(nil, muxOpen)); e != nil {
+		c.Close()
+		return nil, e
+	}
+	return
+}
+
+// Accept waits for the other side to open a channel. It returns the error
+// that ended the connection once there are no more channels to accept.
+func (m *Mux) Accept() (c *Channel, e error) {
+	select {
+	case c = <-m.accepted:
+		return
+	case <-m.done:
+	}
+
+	select {
+	case c = <-m.accepted:
+		return
+	default:
+		return nil, m.err
+	}
+}
+
+// Done is closed once the connection has ended, Err then returns the error
+// that ended it
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+func (m *Mux) write(frame []byte) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	return m.conn.WriteData(frame)
+}
+
+func (m *Mux) readLoop() {
+	var e error
+	for e == nil {
+		e = m.readFrame()
+	}
+
+	m.mu.Lock()
+	m.err = e
+	m.mu.Unlock()
+	close(m.done)
+}
+
+func (m *Mux) readFrame() (e error) {
+	var data []byte
+	if data, e = m.conn.ReadData(new(struct{})); e != nil {
+		return
+	}
+
+	if data == nil {
+		return ErrUnexpectedMessage
+	}
+
+	if len(data) < muxTrailerLen {
+		PutBuffer(data)
+		return ErrUnknownFrame
+	}
+
+	id := binary.BigEndian.Uint32(data[len(data)-muxTrailerLen:])
+	switch data[len(data)-1] {
+	case muxOpen:
+		PutBuffer(data)
+		return m.accept(id)
+	case muxClose:
+		PutBuffer(data)
+		return m.closed(id)
+	case muxMessage, muxData:
+		return m.deliver(id, data)
+	case muxCredit:
+		defer PutBuffer(data)
+		if len(data) != 4+muxTrailerLen {
+			return ErrUnknownFrame
+		}
+		return m.credit(id, binary.BigEndian.Uint32(data))
+	}
+
+	PutBuffer(data)
+	return ErrUnknownFrame
+}
+
+func (m *Mux) accept(id uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// channel numbers are never reused
+	if id <= m.last {
+		return ErrUnknownChannel
+	}
+	if len(m.channels) >= m.limit {
+		return ErrTooManyChannels
+	}
+
+	m.last = id
+	c := newChannel(m, id)
+	m.channels[id] = c
+	m.accepted <- c
+	return nil
+}
+
+// lookup returns the open channel id. Frames for channels that have been
+// closed at this end are dropped, a channel that was never opened is an
+// error.
+func (m *Mux) lookup(id uint32) (c *Channel, e error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if c = m.channels[id]; c == nil && id > m.last {
+		e = ErrUnknownChannel
+	}
+	return
+}
+
+func (m *Mux) deliver(id uint32, frame []byte) (e error) {
+	var c *Channel
+	if c, e = m.lookup(id); c == nil {
+		PutBuffer(frame)
+		return
+	}
+
+	// the read loop never waits on a channel, the other side may only send
+	// as many frames as there is room for
+	select {
+	case c.frames <- frame:
+	case <-c.closed:
+		PutBuffer(frame)
+	default:
+		PutBuffer(frame)
+		e = ErrChannelOverflow
+	}
+	return
+}
+
+// credit hands n credits back to channel id
+func (m *Mux) credit(id uint32, n uint32) (e error) {
+	var c *Channel
+	if c, e = m.lookup(id); c == nil {
+		return
+	}
+
+	for ; n > 0; n-- {
+		select {
+		case c.credits <- struct{}{}:
+		default:
+			return ErrChannelOverflow
+		}
+	}
+	return
+}
+
+// closed ends channel id once the frames that arrived before it have been
+// read
+func (m *Mux) closed(id uint32) (e error) {
+	var c *Channel
+	if c, e = m.lookup(id); c != nil {
+		m.remove(c)
+		close(c.ended)
+	}
+	return
+}
+
+func (m *Mux) remove(c *Channel) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.channels, c.id)
+}
+
+// Channel is a conversation carried over a Mux. Reads return io.EOF once
+// the other side has closed the channel.
+type Channel struct {
+	mux       *Mux
+	id        uint32
+	frames    chan []byte
+	credits   chan struct{}
+	read      int
+	ended     chan struct{}
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newChannel(m *Mux, id uint32) (c *Channel) {
+	c = &Channel{
+		mux:     m,
+		id:      id,
+		frames:  make(chan []byte, muxQueueLength),
+		credits: make(chan struct{}, muxQueueLength),
+		ended:   make(chan struct{}),
+		closed:  make(chan struct{}),
+	}
+	for i := 0; i < muxQueueLength; i++ {
+		c.credits <- struct{}{}
+	}
+	return
+}
+
+// trailer appends the channel's trailer for a frame of kind to frame
+func (c *Channel) trailer(frame []byte, kind byte) []byte {
+	var trailer [muxTrailerLen]byte
+	binary.BigEndian.PutUint32(trailer[:], c.id)
+	trailer[muxTrailerLen-1] = kind
+	return append(frame, trailer[:]...)
+}
+
+func (c *Channel) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// send writes frame once the other side has room for it
+func (c *Channel) send(frame []byte) error {
+	select {
+	case <-c.credits:
+		return c.mux.write(frame)
+	default:
+	}
+
+	select {
+	case <-c.credits:
+		return c.mux.write(frame)
+	case <-c.closed:
+		return ErrChannelClosed
+	case <-c.ended:
+		// the other side has closed the channel and would drop the frame
+		return nil
+	case <-c.mux.done:
+		return c.mux.err
+	}
+}
+
+// Write writes Go types to the channel
+func (c *Channel) Write(v interface{}) (e error) {
+	if c.isClosed() {
+		return ErrChannelClosed
+	}
+
+	var encoded bytes.Buffer
+	if e = gob.NewEncoder(&encoded).Encode(v); e != nil {
+		return
+	}
+
+	return c.send(c.trailer(encoded.Bytes(), muxMessage))
+}
+
+// Read reads Go types from the channel
+func (c *Channel) Read(v interface{}) (e error) {
+	var data []byte
+	if data, e = c.ReadData(v); data != nil {
+		PutBuffer(data)
+		e = ErrUnexpectedData
+	}
+
+	return
+}
+
+// WriteData writes file data to the channel without encoding it
+func (c *Channel) WriteData(data []byte) error {
+	if c.isClosed() {
+		return ErrChannelClosed
+	}
+
+	frame := GetBuffer(len(data) + muxTrailerLen)
+	defer PutBuffer(frame)
+
+	copy(frame, data)
+	c.trailer(frame[:len(data)], muxData)
+
+	return c.send(frame)
+}
+
+// ReadData reads the next frame from the channel, like
+// GobEncoderReaderWriter.ReadData
+func (c *Channel) ReadData(v interface{}) (data []byte, e error) {
+	var frame []byte
+	if frame, e = c.next(); e != nil {
+		return
+	}
+
+	body := frame[:len(frame)-muxTrailerLen]
+	if frame[len(frame)-1] == muxData {
+		return body, nil
+	}
+
+	decoder := gob.NewDecoder(bytes.NewReader(body))
+	e = decoder.Decode(v)
+	PutBuffer(frame)
+	return
+}
+
+// next returns the next frame, frames that arrived before the channel or
+// the connection ended are still returned
+func (c *Channel) next() (frame []byte, e error) {
+	select {
+	case frame = <-c.frames:
+		c.taken()
+		return
+	case <-c.closed:
+		return nil, ErrChannelClosed
+	case <-c.ended:
+	case <-c.mux.done:
+	}
+
+	// frames queued before the channel ended are still read first
+	select {
+	case frame = <-c.frames:
+		c.taken()
+		return
+	default:
+	}
+
+	select {
+	case <-c.ended:
+		return nil, io.EOF
+	default:
+		return nil, c.mux.err
+	}
+}
+
+// taken counts a frame read from the channel and hands the credits for
+// what has been read back to the other side once there are enough of them
+func (c *Channel) taken() {
+	if c.read++; c.read < muxCreditBatch {
+		return
+	}
+
+	var count [4]byte
+	binary.BigEndian.PutUint32(count[:], uint32(c.read))
+	c.read = 0
+	// a failed write ends the connection, which next reports
+	c.mux.write(c.trailer(count[:], muxCredit))
+}
+
+// Close closes the channel at both ends. Frames still to be read are
+// dropped.
+func (c *Channel) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.mux.remove(c)
+
+		select {
+		case <-c.ended:
+		case <-c.mux.done:
+		default:
+			c.mux.write(c.trailer(nil, muxClose))
+		}
+
+		for {
+			select {
+			case frame := <-c.frames:
+				PutBuffer(frame)
+			default:
+				return
+			}
+		}
+	})
+	return nil
+}
@@ -0,0 +1,247 @@
+package net
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// pipeEnd is one end of a duplex in memory connection
+type pipeEnd struct {
+	io.Reader
+	io.Writer
+	closers []io.Closer
+}
+
+func (p *pipeEnd) Close() error {
+	for _, c := range p.closers {
+		c.Close()
+	}
+	return nil
+}
+
+func newPipe() (a, b *pipeEnd) {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	a = &pipeEnd{Reader: ar, Writer: aw, closers: []io.Closer{ar, aw}}
+	b = &pipeEnd{Reader: br, Writer: bw, closers: []io.Closer{br, bw}}
+	return
+}
+
+type MuxTestSuite struct {
+	suite.Suite
+	clientEnd, serverEnd *pipeEnd
+	client, server       *Mux
+}
+
+func (s *MuxTestSuite) SetupTest() {
+	s.clientEnd, s.serverEnd = newPipe()
+	s.client = NewMux(NewGobEncoderReaderWriter(NewReaderWriter(s.clientEnd)), 0)
+	s.server = NewMux(NewGobEncoderReaderWriter(NewReaderWriter(s.serverEnd)), 2)
+}
+
+func (s *MuxTestSuite) TearDownTest() {
+	s.clientEnd.Close()
+	s.serverEnd.Close()
+	<-s.client.Done()
+	<-s.server.Done()
+}
+
+func (s *MuxTestSuite) open() (client, server *Channel) {
+	var err error
+	client, err = s.client.Open()
+	s.Require().Nil(err)
+	server, err = s.server.Accept()
+	s.Require().Nil(err)
+	return
+}
+
+func (s *MuxTestSuite) TestMessagesAndData() {
+	client, server := s.open()
+
+	data := make([]byte, 5000)
+	rand.Read(data)
+
+	s.Nil(client.Write("before"))
+	s.Nil(client.WriteData(data))
+	s.Nil(client.Write("after"))
+
+	var message string
+	s.Nil(server.Read(&message))
+	s.Equal("before", message)
+
+	received, err := server.ReadData(&message)
+	s.Nil(err)
+	s.True(bytes.Equal(data, received))
+	PutBuffer(received)
+
+	s.Nil(server.Read(&message))
+	s.Equal("after", message)
+
+	s.Nil(server.Write("reply"))
+	s.Nil(client.Read(&message))
+	s.Equal("reply", message)
+}
+
+func (s *MuxTestSuite) TestChannelsRunAtOnce() {
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		client, server := s.open()
+		wg.Add(2)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				s.Nil(client.Write(fmt.Sprintf("%d-%d", n, j)))
+			}
+			client.Close()
+		}(i)
+		go func(n int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				var message string
+				s.Nil(server.Read(&message))
+				s.Equal(fmt.Sprintf("%d-%d", n, j), message)
+			}
+			// the channel ends once everything sent has been read
+			var message string
+			s.Equal(io.EOF, server.Read(&message))
+			server.Close()
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (s *MuxTestSuite) TestUnreadChannel() {
+	stalled, _ := s.open()
+	written := make(chan error, 1)
+	go func() {
+		for j := 0; j < 100; j++ {
+			if err := stalled.Write(j); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+
+	// a channel nobody reads doesn't hold up the others
+	client, server := s.open()
+	var message string
+	s.Nil(client.Write("ping"))
+	s.Nil(server.Read(&message))
+	s.Nil(server.Write("pong"))
+	s.Nil(client.Read(&message))
+	s.Equal("pong", message)
+
+	select {
+	case err := <-written:
+		s.Fail("writer ran past its credit", "%v", err)
+	default:
+	}
+	s.Nil(s.client.Err())
+	s.Nil(s.server.Err())
+}
+
+func (s *MuxTestSuite) TestCreditsReturned() {
+	client, server := s.open()
+	written := make(chan error, 1)
+	go func() {
+		for j := 0; j < 100; j++ {
+			if err := client.Write(j); err != nil {
+				written <- err
+				return
+			}
+		}
+		written <- nil
+	}()
+
+	for j := 0; j < 100; j++ {
+		var n int
+		s.Nil(server.Read(&n))
+		s.Equal(j, n)
+	}
+	s.Nil(<-written)
+}
+
+func (s *MuxTestSuite) TestChannelOverflow() {
+	// a peer that ignores credits ends the connection
+	conn := NewGobEncoderReaderWriter(NewReaderWriter(s.clientEnd))
+	frame := func(kind byte) []byte {
+		return (&Channel{id: 1}).trailer(nil, kind)
+	}
+	go func() {
+		conn.WriteData(frame(muxOpen))
+		for j := 0; j <= muxQueueLength; j++ {
+			conn.WriteData(frame(muxData))
+		}
+	}()
+
+	select {
+	case <-s.server.Done():
+		s.Equal(ErrChannelOverflow, s.server.Err())
+	case <-time.After(5 * time.Second):
+		s.Fail("mux still running")
+	}
+	s.clientEnd.Close()
+}
+
+func (s *MuxTestSuite) TestClosedChannel() {
+	client, server := s.open()
+	s.Nil(server.Close())
+
+	var message string
+	s.Equal(ErrChannelClosed, server.Read(&message))
+	s.Equal(ErrChannelClosed, server.Write("late"))
+
+	// frames the other side sends after the close are dropped
+	s.Nil(client.Write("dropped"))
+	s.Equal(io.EOF, client.Read(&message))
+
+	client, server = s.open()
+	s.Nil(client.Write("next"))
+	s.Nil(server.Read(&message))
+	s.Equal("next", message)
+}
+
+func (s *MuxTestSuite) TestTooManyChannels() {
+	s.open()
+	s.open()
+	_, err := s.client.Open()
+	s.Nil(err)
+
+	_, err = s.server.Accept()
+	s.Equal(ErrTooManyChannels, err)
+}
+
+func (s *MuxTestSuite) TestConnectionEnds() {
+	client, server := s.open()
+	s.Nil(client.Write("last"))
+	s.clientEnd.Close()
+
+	// what arrived before the connection ended can still be read
+	var message string
+	s.Nil(server.Read(&message))
+	s.Equal("last", message)
+	s.Equal(io.EOF, server.Read(&message))
+
+	_, err := s.server.Accept()
+	s.Equal(io.EOF, err)
+
+	select {
+	case <-s.client.Done():
+	case <-time.After(5 * time.Second):
+		s.Fail("mux still running")
+	}
+	_, err = s.client.Open()
+	s.NotNil(err)
+}
+
+func TestMuxTestSuite(t *testing.T) {
+	suite.Run(t, new(MuxTestSuite))
+}
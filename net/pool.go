@@ -0,0 +1,62 @@
+package net
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Buffers are pooled in size classes of powers of two, from 1 KB up to
+// a class that holds the largest frame a ReaderWriter accepts by default.
+// Larger buffers are allocated and left to the garbage collector.
+const minBufferClass = 10
+const maxBufferClass = 25
+
+var bufferPools [maxBufferClass - minBufferClass + 1]sync.Pool
+
+// slices holds the *[]byte headers that carry buffers through the pools,
+// so putting a buffer back does not allocate a new one
+var slices sync.Pool
+
+// bufferClass returns the smallest class that holds size bytes
+func bufferClass(size int) int {
+	if size <= 1<<minBufferClass {
+		return minBufferClass
+	}
+	return bits.Len(uint(size - 1))
+}
+
+// GetBuffer returns a buffer of length size. Buffers are taken from a pool
+// when one of the right class is free, callers should hand them back with
+// PutBuffer when they are done with them.
+func GetBuffer(size int) []byte {
+	class := bufferClass(size)
+	if class > maxBufferClass {
+		return make([]byte, size)
+	}
+
+	if p, ok := bufferPools[class-minBufferClass].Get().(*[]byte); ok {
+		b := (*p)[:size]
+		*p = nil
+		slices.Put(p)
+		return b
+	}
+
+	return make([]byte, size, 1<<uint(class))
+}
+
+// PutBuffer returns a buffer from GetBuffer to the pool. The buffer must
+// not be used afterwards. Buffers that did not come from a pool are
+// ignored.
+func PutBuffer(b []byte) {
+	class := bufferClass(cap(b))
+	if class > maxBufferClass || cap(b) != 1<<uint(class) {
+		return
+	}
+
+	p, ok := slices.Get().(*[]byte)
+	if !ok {
+		p = new([]byte)
+	}
+	*p = b[:cap(b)]
+	bufferPools[class-minBufferClass].Put(p)
+}
@@ -0,0 +1,40 @@
+package net
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBufferClasses(t *testing.T) {
+	b := GetBuffer(1)
+	assert.Equal(t, 1, len(b))
+	assert.Equal(t, 1024, cap(b))
+
+	b = GetBuffer(1025)
+	assert.Equal(t, 1025, len(b))
+	assert.Equal(t, 2048, cap(b))
+
+	b = GetBuffer(100000 + headerLen + 1)
+	assert.Equal(t, 1<<17, cap(b))
+
+	// too large to pool
+	b = GetBuffer(1<<maxBufferClass + 1)
+	assert.Equal(t, 1<<maxBufferClass+1, cap(b))
+	PutBuffer(b)
+}
+
+func TestBufferReuse(t *testing.T) {
+	b := GetBuffer(3000)
+	b[0] = 42
+	PutBuffer(b)
+
+	// buffers that didn't come from the pool are left alone
+	PutBuffer(make([]byte, 3000))
+	PutBuffer(nil)
+
+	b = GetBuffer(2100)
+	assert.Equal(t, 2100, len(b))
+	assert.Equal(t, 4096, cap(b))
+	PutBuffer(b)
+}
@@ -24,7 +24,7 @@ int conv_func(int msgs, const struct pam_message **msg, struct pam_response **re
   return PAM_SUCCESS;
 }
 
-int authorize_user(const char* user, const char* pwd ) {
+int authorize_user(const char* service, const char* user, const char* pwd ) {
 
   struct pam_conv pamc;
   pamc.conv = &conv_func;
@@ -33,7 +33,7 @@ int authorize_user(const char* user, const char* pwd ) {
   pam_handle_t *pamh=NULL;
   int retval;
 
-  retval = pam_start("chkpasswd", user, &pamc, &pamh);
+  retval = pam_start(service, user, &pamc, &pamh);
 
   if( retval == PAM_SUCCESS ) {
     retval = pam_authenticate(pamh, 0);
@@ -4,7 +4,7 @@ package pam
 // #include <stdio.h>
 // #include <stdlib.h>
 // #include <security/pam_constants.h>
-// int authorize_user(const char*, const char*);
+// int authorize_user(const char*, const char*, const char*);
 import "C"
 
 import (
@@ -16,14 +16,24 @@ var ErrUnknownUser = errors.New("Unknown user")
 var ErrIncorrectPassword = errors.New("Incorrect password")
 var ErrAuthFailed = errors.New("Authorization failed")
 
+// DefaultService is the PAM service used by AuthorizeUser
+const DefaultService = "chkpasswd"
+
 func AuthorizeUser(user, password string) error {
+	return AuthorizeServiceUser(DefaultService, user, password)
+}
+
+// AuthorizeServiceUser checks a user's password using the named PAM service
+func AuthorizeServiceUser(service, user, password string) error {
+	cService := C.CString(service)
+	defer C.free(unsafe.Pointer(cService))
 	cUser := C.CString(user)
 	defer C.free(unsafe.Pointer(cUser))
 	cPassword := C.CString(password)
 	defer C.free(unsafe.Pointer(cPassword))
 
 	var ret C.int
-	ret = C.authorize_user(cUser, cPassword)
+	ret = C.authorize_user(cService, cUser, cPassword)
 
 	if ret == C.PAM_SUCCESS {
 		return nil
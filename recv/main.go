@@ -5,19 +5,17 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"path/filepath"
 
 	"github.com/murphybytes/ucp/client"
 	"github.com/murphybytes/ucp/crypto"
 	unet "github.com/murphybytes/ucp/net"
-	"github.com/murphybytes/ucp/wire"
 	"github.com/murphybytes/udt.go/udt"
 )
 
 // reads from remote file, writes local
 func main() {
 	var localFilePath, remoteFilePath string
-	flag.StringVar(&localFilePath, "local-file", "", "File where recieved data will be written")
+	flag.StringVar(&localFilePath, "local-file", "", "File where recieved data will be written, - for standard output")
 	flag.StringVar(&remoteFilePath, "remote-file", "", "File where data will be read from")
 	flag.Parse()
 
@@ -29,14 +27,16 @@ func main() {
 	if client.GenerateKeys {
 		fmt.Println("Creating UCP keys and files in ", client.UCPDirectory)
 
-		if err := crypto.InitializeUcpDir(client.UCPDirectory); err != nil {
+		if err := crypto.InitializeUcpDir(client.UCPDirectory, client.KeyType); err != nil {
 			fmt.Println(err)
 			os.Exit(client.ErrorCode)
 		}
 		os.Exit(client.SuccessCode)
 	}
 
-	var err error
+	command, err := client.ParseCommand()
+	client.ExitOnError(err)
+
 	err = udt.Startup()
 	client.ExitOnError(err, "Could not initialize UDT library")
 	defer udt.Cleanup()
@@ -47,87 +47,26 @@ func main() {
 	conn, err = udt.Dial(networkEndpoint)
 	client.ExitOnError(err, "Could not connect to", networkEndpoint)
 
-	privateKey, err := crypto.GetPrivateKey(filepath.Join(client.UCPDirectory, "private-key.pem"))
-	if err != nil {
-		fmt.Println(err)
-		os.Exit(client.ErrorCode)
-	}
-
-	var asymmEncryptedConn *unet.GobEncoderReaderWriter
-	asymmEncryptedConn, err = client.CreateRSAEncryptedConnection(privateKey, conn)
-	client.ExitOnError(err)
-
-	fmt.Println("async connected")
+	signer, err := client.LoadSigner(&client.Prompt{})
+	client.ExitOnError(err, "Could not load private key")
 
 	var aesEncryptedConn unet.EncodeConn
-	aesEncryptedConn, err = client.CreateAESEncryptedConnection(conn, asymmEncryptedConn)
+	aesEncryptedConn, err = client.CreateEncryptedConnection(signer, conn)
 	client.ExitOnError(err, "Failed to establish aes encrypted connection")
 
-	fmt.Println("aes connection established")
+	fmt.Fprintln(os.Stderr, "aes connection established")
 
 	var prompt client.Prompt
 	err = client.HandleUserAuthorization(aesEncryptedConn, &prompt)
 	client.ExitOnError(err, "User authorization failed")
 
-	err = receiveFileFromServer(localFilePath, remoteFilePath, aesEncryptedConn)
-	client.ExitOnError(err, "File transfer failed")
-
-}
-
-func receiveFileFromServer(localPath, remotePath string, conn unet.EncodeConn) (e error) {
-	var request wire.Conversation
-	if e = conn.Read(&request); e != nil {
-		return
-	}
-
-	if request != wire.FileTransferInformationRequest {
-		return client.ErrBadRequest
-	}
-
-	transferInfo := wire.FileTransferInformation{
-		FileTransferType: wire.FileSend,
-		FileName:         remotePath,
-	}
-
-	if e = conn.Write(transferInfo); e != nil {
-		return
+	if command != nil {
+		code, err := command(aesEncryptedConn)
+		client.ExitOnError(err)
+		os.Exit(code)
 	}
 
-	if e = conn.Read(&transferInfo); e != nil {
-		return
-	}
-
-	var localFile *os.File
-	if localFile, e = os.Create(localPath); e != nil {
-		conn.Write(wire.FileTransferAbort)
-		return
-	}
-	defer localFile.Close()
-
-	if e = conn.Write(wire.FileTransferStart); e != nil {
-		return
-	}
-
-	for totalRead := int64(0); totalRead < transferInfo.FileSize; {
-		var buffer []byte
-		if e = conn.Read(&buffer); e != nil {
-			return
-		}
-
-		totalRead += int64(len(buffer))
-
-		fmt.Printf("Total read %d of expected %d\n", totalRead, transferInfo.FileSize)
-
-		if _, e = localFile.Write(buffer); e != nil {
-			conn.Write(wire.FileTransferFail)
-			return
-		}
-
-		if e = conn.Write(wire.FileTransferMore); e != nil {
-			return
-		}
-
-	}
+	err = client.ReceiveFile(localFilePath, remoteFilePath, aesEncryptedConn)
+	client.ExitOnError(err, "File transfer failed")
 
-	return
 }
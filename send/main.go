@@ -5,15 +5,20 @@ import (
 	"fmt"
 	"net"
 	"os"
-	"path/filepath"
 
 	"github.com/murphybytes/ucp/client"
 	"github.com/murphybytes/ucp/crypto"
 	"github.com/murphybytes/udt.go/udt"
 )
 
+// reads local file, writes remote
 func main() {
-	fmt.Println("Starting")
+	var localFilePath, remoteFilePath string
+	var options client.UploadOptions
+	flag.StringVar(&localFilePath, "local-file", "", "File where data will be read from, - for standard input")
+	flag.StringVar(&remoteFilePath, "remote-file", "", "File on the server where data will be written")
+	flag.BoolVar(&options.NoClobber, "no-clobber", false, "Fail rather than replace the remote file if it exists")
+	flag.StringVar(&options.BackupSuffix, "backup", "", "Keep the remote file being replaced, with this suffix added to its name")
 	flag.Parse()
 
 	if client.ShowHelp {
@@ -21,17 +26,25 @@ func main() {
 		os.Exit(client.ErrorCode)
 	}
 
+	if options.NoClobber && options.BackupSuffix != "" {
+		fmt.Println("-no-clobber and -backup can't be used together")
+		os.Exit(client.ErrorCode)
+	}
+
 	if client.GenerateKeys {
 		fmt.Println("Creating UCP keys and files in ", client.UCPDirectory)
 
-		if err := crypto.InitializeUcpDir(client.UCPDirectory); err != nil {
+		if err := crypto.InitializeUcpDir(client.UCPDirectory, client.KeyType); err != nil {
 			fmt.Println(err)
 			os.Exit(client.ErrorCode)
 		}
 		os.Exit(client.SuccessCode)
 	}
 
-	if err := udt.Startup(); err != nil {
+	command, err := client.ParseCommand()
+	client.ExitOnError(err)
+
+	if err = udt.Startup(); err != nil {
 		fmt.Println("Unable to initialize UDT Library: ", err)
 		os.Exit(client.ErrorCode)
 	}
@@ -46,13 +59,13 @@ func main() {
 		conn = c
 	}
 
-	privateKey, err := crypto.GetPrivateKey(filepath.Join(client.UCPDirectory, "private-key.pem"))
+	signer, err := client.LoadSigner(&client.Prompt{})
 	if err != nil {
 		fmt.Println(err)
-		os.Exit(client.ErrorCode)
+		os.Exit(client.ExitCode(err))
 	}
 
-	asyncConn, err := client.CreateRSAEncryptedConnection(privateKey, conn)
+	asyncConn, err := client.CreateEncryptedConnection(signer, conn)
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(client.ErrorCode)
@@ -60,9 +73,18 @@ func main() {
 
 	if err = client.HandleUserAuthorization(asyncConn, &client.Prompt{}); err != nil {
 		fmt.Println("User authorization failed: ", err)
-		os.Exit(client.ErrorCode)
+		os.Exit(client.ExitCode(err))
+	}
+
+	if command != nil {
+		code, err := command(asyncConn)
+		client.ExitOnError(err)
+		os.Exit(code)
 	}
 
+	err = client.SendFile(localFilePath, remoteFilePath, options, asyncConn)
+	client.ExitOnError(err, "File transfer failed")
+
 	os.Exit(client.SuccessCode)
 
 }
@@ -0,0 +1,210 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"os"
+	"os/user"
+	"strconv"
+	"time"
+)
+
+// DefaultAdminSocket is where ucpctl looks for the admin socket
+const DefaultAdminSocket = "/var/run/ucp/admin.sock"
+
+// adminService is the name the server registers its admin RPC service under
+const adminService = "Admin"
+
+var ErrAdminDenied = errors.New("Admin access requires root or membership of the admin group")
+var ErrNoSuchSession = errors.New("No such session")
+var ErrAdminSocketInUse = errors.New("Admin socket is in use by another server")
+
+// AdminSession describes an active session. List fills in the summary
+// fields, Dump fills in everything.
+type AdminSession struct {
+	ID            string
+	RemoteAddress string
+	User          string
+	State         string
+	Path          string
+	Direction     string
+	Bytes         int64
+	Rate          float64
+	Started       time.Time
+	Age           time.Duration
+
+	AuthMethod        string
+	KeyFingerprint    string
+	CertificateID     string
+	CertificateSerial uint64
+	WorkerPID         int
+	TransferStarted   time.Time
+	Aborted           bool
+}
+
+// AdminArgs and the types below are the arguments and replies of the admin
+// RPC methods
+type AdminArgs struct{}
+
+type AdminSessionArgs struct {
+	ID string
+}
+
+type AdminReply struct{}
+
+type AdminListReply struct {
+	Sessions []AdminSession
+}
+
+// ListenAdmin creates the admin socket at path. The socket is only
+// accessible to its owner and, if group is set, members of group. A stale
+// socket left by a server that exited is replaced.
+func ListenAdmin(path, group string) (listener net.Listener, e error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, ErrAdminSocketInUse
+		}
+		os.Remove(path)
+	}
+
+	if listener, e = net.Listen("unix", path); e != nil {
+		return
+	}
+
+	mode := os.FileMode(0600)
+	if group != "" {
+		var gid int
+		if gid, e = lookupGroupID(group); e == nil {
+			e = os.Chown(path, -1, gid)
+		}
+		if e != nil {
+			listener.Close()
+			return nil, e
+		}
+		mode = 0660
+	}
+
+	if e = os.Chmod(path, mode); e != nil {
+		listener.Close()
+		return nil, e
+	}
+	return
+}
+
+// CheckAdminPeer returns the name of the user at the other end of conn if
+// it is root, the user the server runs as, or a member of group
+func CheckAdminPeer(conn net.Conn, group string) (name string, e error) {
+	var uid int
+	if uid, e = peerUID(conn); e != nil {
+		return
+	}
+
+	name = strconv.Itoa(uid)
+	peer, err := user.LookupId(name)
+	if err == nil {
+		name = peer.Username
+	}
+
+	if uid == 0 || uid == os.Getuid() {
+		return
+	}
+
+	if group == "" || err != nil {
+		return name, ErrAdminDenied
+	}
+
+	var gid int
+	if gid, e = lookupGroupID(group); e != nil {
+		return
+	}
+
+	var ids []string
+	if ids, e = peer.GroupIds(); e != nil {
+		return
+	}
+
+	for _, id := range ids {
+		if id == strconv.Itoa(gid) {
+			return
+		}
+	}
+	return name, ErrAdminDenied
+}
+
+func lookupGroupID(name string) (gid int, e error) {
+	var group *user.Group
+	if group, e = user.LookupGroup(name); e != nil {
+		return
+	}
+	return strconv.Atoi(group.Gid)
+}
+
+// ServeAdmin serves the admin RPC service on conn until it is closed. The
+// service must implement the methods called by AdminClient.
+func ServeAdmin(service interface{}, conn net.Conn) (e error) {
+	server := rpc.NewServer()
+	if e = server.RegisterName(adminService, service); e != nil {
+		return
+	}
+	server.ServeConn(conn)
+	return
+}
+
+// AdminClient calls the server's admin RPC methods
+type AdminClient struct {
+	client *rpc.Client
+}
+
+// DialAdmin connects to the admin socket at path
+func DialAdmin(path string) (c *AdminClient, e error) {
+	var conn net.Conn
+	if conn, e = net.Dial("unix", path); e != nil {
+		return
+	}
+	return &AdminClient{client: rpc.NewClient(conn)}, nil
+}
+
+// List returns every active session
+func (c *AdminClient) List() (sessions []AdminSession, e error) {
+	var reply AdminListReply
+	e = c.call("List", AdminArgs{}, &reply)
+	return reply.Sessions, e
+}
+
+// Dump returns everything the server knows about a session
+func (c *AdminClient) Dump(id string) (session AdminSession, e error) {
+	e = c.call("Dump", AdminSessionArgs{ID: id}, &session)
+	return
+}
+
+// Kill closes a session's connection and stops its worker
+func (c *AdminClient) Kill(id string) error {
+	return c.call("Kill", AdminSessionArgs{ID: id}, &AdminReply{})
+}
+
+// Drain stops the server accepting connections and shuts it down once
+// active sessions finish
+func (c *AdminClient) Drain() error {
+	return c.call("Drain", AdminArgs{}, &AdminReply{})
+}
+
+// Reload reloads the server configuration
+func (c *AdminClient) Reload() error {
+	return c.call("Reload", AdminArgs{}, &AdminReply{})
+}
+
+// Close closes the connection to the server
+func (c *AdminClient) Close() error {
+	return c.client.Close()
+}
+
+func (c *AdminClient) call(method string, args interface{}, reply interface{}) (e error) {
+	if e = c.client.Call(adminService+"."+method, args, reply); e != nil {
+		if serverError, ok := e.(rpc.ServerError); ok {
+			e = errors.New(string(serverError))
+		}
+	}
+	return
+}
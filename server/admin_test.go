@@ -0,0 +1,132 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AdminSuite struct {
+	suite.Suite
+	dir  string
+	path string
+}
+
+func (s *AdminSuite) SetupTest() {
+	var e error
+	s.dir, e = ioutil.TempDir("", "admin")
+	s.Require().Nil(e)
+	s.path = filepath.Join(s.dir, "admin.sock")
+}
+
+func (s *AdminSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *AdminSuite) TestSocketPermissions() {
+	listener, e := ListenAdmin(s.path, "")
+	s.Require().Nil(e)
+	defer listener.Close()
+
+	info, e := os.Stat(s.path)
+	s.Require().Nil(e)
+	s.Equal(os.FileMode(0600), info.Mode().Perm())
+}
+
+func (s *AdminSuite) TestSocketInUse() {
+	listener, e := ListenAdmin(s.path, "")
+	s.Require().Nil(e)
+	defer listener.Close()
+
+	_, e = ListenAdmin(s.path, "")
+	s.Equal(ErrAdminSocketInUse, e)
+}
+
+func (s *AdminSuite) TestStaleSocketReplaced() {
+	listener, e := net.Listen("unix", s.path)
+	s.Require().Nil(e)
+	// leave the socket file behind as a crashed server would
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+
+	listener, e = ListenAdmin(s.path, "")
+	s.Require().Nil(e)
+	listener.Close()
+}
+
+func (s *AdminSuite) TestPeerIsServerUser() {
+	listener, e := ListenAdmin(s.path, "")
+	s.Require().Nil(e)
+	defer listener.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+
+	client, e := net.Dial("unix", s.path)
+	s.Require().Nil(e)
+	defer client.Close()
+
+	conn := <-accepted
+	s.Require().NotNil(conn)
+	defer conn.Close()
+
+	_, e = CheckAdminPeer(conn, "")
+	s.Nil(e)
+}
+
+type fakeAdmin struct {
+	killed string
+}
+
+func (f *fakeAdmin) List(args AdminArgs, reply *AdminListReply) error {
+	reply.Sessions = []AdminSession{{ID: "one"}, {ID: "two"}}
+	return nil
+}
+
+func (f *fakeAdmin) Dump(args AdminSessionArgs, reply *AdminSession) error {
+	return ErrNoSuchSession
+}
+
+func (f *fakeAdmin) Kill(args AdminSessionArgs, reply *AdminReply) error {
+	f.killed = args.ID
+	return nil
+}
+
+func (s *AdminSuite) TestClient() {
+	listener, e := ListenAdmin(s.path, "")
+	s.Require().Nil(e)
+	defer listener.Close()
+
+	service := &fakeAdmin{}
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			ServeAdmin(service, conn)
+		}
+	}()
+
+	client, e := DialAdmin(s.path)
+	s.Require().Nil(e)
+	defer client.Close()
+
+	sessions, e := client.List()
+	s.Nil(e)
+	s.Len(sessions, 2)
+
+	_, e = client.Dump("missing")
+	s.Require().NotNil(e)
+	s.Equal(ErrNoSuchSession.Error(), e.Error())
+
+	s.Nil(client.Kill("one"))
+	s.Equal("one", service.killed)
+}
+
+func TestAdmin(t *testing.T) {
+	suite.Run(t, new(AdminSuite))
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+// openat opens name in the directory dir without following a symbolic link
+// at name
+func openat(dir *os.File, name string, flag int, perm os.FileMode) (f *os.File, e error) {
+	var fd int
+	if fd, e = syscall.Openat(int(dir.Fd()), name, flag|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, uint32(perm.Perm())); e != nil {
+		return
+	}
+	return os.NewFile(uintptr(fd), filepath.Join(dir.Name(), name)), nil
+}
+
+// unlinkat removes name from the directory dir
+func unlinkat(dir *os.File, name string) error {
+	return syscall.Unlinkat(int(dir.Fd()), name)
+}
+
+// renameat renames oldName to newName within the directory dir, replacing
+// newName if it exists
+func renameat(dir *os.File, oldName, newName string) error {
+	dirfd := int(dir.Fd())
+	return syscall.Renameat(dirfd, oldName, dirfd, newName)
+}
+
+// linkat creates newName in the directory dir as a hard link to oldName. It
+// fails with EEXIST rather than replacing newName.
+func linkat(dir *os.File, oldName, newName string) (e error) {
+	var oldPath, newPath *byte
+	if oldPath, e = syscall.BytePtrFromString(oldName); e != nil {
+		return
+	}
+	if newPath, e = syscall.BytePtrFromString(newName); e != nil {
+		return
+	}
+
+	dirfd := uintptr(dir.Fd())
+	_, _, errno := syscall.Syscall6(syscall.SYS_LINKAT, dirfd, uintptr(unsafe.Pointer(oldPath)),
+		dirfd, uintptr(unsafe.Pointer(newPath)), 0, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// Elsewhere the *at calls are made with the directory's path. Each
+// component is still opened without following symbolic links, but a
+// directory that is renamed while a path is resolved isn't detected as it
+// is on Linux.
+
+// openat opens name in the directory dir without following a symbolic link
+// at name
+func openat(dir *os.File, name string, flag int, perm os.FileMode) (f *os.File, e error) {
+	path := filepath.Join(dir.Name(), name)
+
+	var fd int
+	if fd, e = syscall.Open(path, flag|syscall.O_NOFOLLOW|syscall.O_CLOEXEC, uint32(perm.Perm())); e != nil {
+		return
+	}
+	return os.NewFile(uintptr(fd), path), nil
+}
+
+// unlinkat removes name from the directory dir
+func unlinkat(dir *os.File, name string) error {
+	return syscall.Unlink(filepath.Join(dir.Name(), name))
+}
+
+// renameat renames oldName to newName within the directory dir, replacing
+// newName if it exists
+func renameat(dir *os.File, oldName, newName string) error {
+	return syscall.Rename(filepath.Join(dir.Name(), oldName), filepath.Join(dir.Name(), newName))
+}
+
+// linkat creates newName in the directory dir as a hard link to oldName. It
+// fails with EEXIST rather than replacing newName.
+func linkat(dir *os.File, oldName, newName string) error {
+	return syscall.Link(filepath.Join(dir.Name(), oldName), filepath.Join(dir.Name(), newName))
+}
@@ -0,0 +1,203 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Audit event names written to the audit log
+const (
+	AuditConnectionAccepted = "connection_accepted"
+	AuditConnectionRejected = "connection_rejected"
+	AuditConnectionClosed   = "connection_closed"
+	AuditAuthSuccess        = "auth_success"
+	AuditAuthFailure        = "auth_failure"
+	AuditAuthLockout        = "auth_lockout"
+	AuditTransferStart      = "transfer_start"
+	AuditTransferEnd        = "transfer_end"
+	AuditAdminCommand       = "admin_command"
+	AuditHookFailure        = "hook_failure"
+)
+
+// Authentication methods recorded in the audit log
+const (
+	AuthMethodKey         = "publickey"
+	AuthMethodPassword    = "password"
+	AuthMethodCertificate = "certificate"
+)
+
+// Transfer outcomes recorded in the audit log
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// DefaultAuditLogMaxSize is the size in bytes an audit log may grow
+// to before it is rotated
+const DefaultAuditLogMaxSize = 100 * 1024 * 1024
+
+// DefaultAuditLogBackups is the number of rotated audit logs that are kept
+const DefaultAuditLogBackups = 10
+
+// AuditEvent is a single record in the audit log. Each event is written as
+// one line of JSON so the log can be consumed by a SIEM.
+type AuditEvent struct {
+	Time              time.Time `json:"time"`
+	Event             string    `json:"event"`
+	SessionID         string    `json:"session_id,omitempty"`
+	RemoteAddress     string    `json:"remote_address,omitempty"`
+	User              string    `json:"user,omitempty"`
+	AuthMethod        string    `json:"auth_method,omitempty"`
+	KeyFingerprint    string    `json:"key_fingerprint,omitempty"`
+	CertificateID     string    `json:"certificate_id,omitempty"`
+	CertificateSerial uint64    `json:"certificate_serial,omitempty"`
+	Path              string    `json:"path,omitempty"`
+	Direction         string    `json:"direction,omitempty"`
+	Bytes             int64     `json:"bytes,omitempty"`
+	DurationMillis    int64     `json:"duration_ms,omitempty"`
+	Hash              string    `json:"sha256,omitempty"`
+	Outcome           string    `json:"outcome,omitempty"`
+	Command           string    `json:"command,omitempty"`
+	Hook              string    `json:"hook,omitempty"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// AuditLog is an append only log of audit events that is rotated once it
+// reaches a maximum size. A nil *AuditLog discards all events.
+type AuditLog struct {
+	mu         sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewAuditLog opens or creates the audit log at path. When the log grows past
+// maxSize bytes it is renamed to path.1, path.1 to path.2 and so on, keeping at
+// most maxBackups old logs.
+func NewAuditLog(path string, maxSize int64, maxBackups int) (a *AuditLog, e error) {
+	a = &AuditLog{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if e = a.open(); e != nil {
+		a = nil
+	}
+
+	return
+}
+
+func (a *AuditLog) open() (e error) {
+	if a.file, e = os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); e != nil {
+		return
+	}
+
+	var info os.FileInfo
+	if info, e = a.file.Stat(); e != nil {
+		a.file.Close()
+		return
+	}
+
+	a.size = info.Size()
+	return
+}
+
+func (a *AuditLog) rotate() (e error) {
+	if e = a.file.Close(); e != nil {
+		return
+	}
+
+	for i := a.maxBackups - 1; i > 0; i-- {
+		os.Rename(backupName(a.path, i), backupName(a.path, i+1))
+	}
+
+	if a.maxBackups > 0 {
+		if e = os.Rename(a.path, backupName(a.path, 1)); e != nil {
+			return
+		}
+	} else if e = os.Remove(a.path); e != nil {
+		return
+	}
+
+	return a.open()
+}
+
+func backupName(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// Log writes event to the audit log. If the event time is not set the
+// current time is used.
+func (a *AuditLog) Log(event AuditEvent) (e error) {
+	if a == nil {
+		return
+	}
+
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Time = event.Time.UTC()
+
+	var line []byte
+	if line, e = json.Marshal(event); e != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.maxSize > 0 && a.size > 0 && a.size+int64(len(line)) > a.maxSize {
+		if e = a.rotate(); e != nil {
+			return
+		}
+	}
+
+	var n int
+	n, e = a.file.Write(line)
+	a.size += int64(n)
+
+	return
+}
+
+// Reopen switches the audit log to new settings. If the new log can't be
+// opened the current log stays in use.
+func (a *AuditLog) Reopen(path string, maxSize int64, maxBackups int) (e error) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	file, previousPath, size := a.file, a.path, a.size
+	a.path = path
+	if e = a.open(); e != nil {
+		a.file, a.path, a.size = file, previousPath, size
+		return
+	}
+	file.Close()
+
+	a.maxSize = maxSize
+	a.maxBackups = maxBackups
+
+	return
+}
+
+// Close closes the audit log
+func (a *AuditLog) Close() (e error) {
+	if a == nil {
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.file.Close()
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type AuditLogSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (s *AuditLogSuite) SetupTest() {
+	s.dir, _ = ioutil.TempDir("", "audit")
+}
+
+func (s *AuditLogSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *AuditLogSuite) readEvents(path string) (events []AuditEvent) {
+	f, err := os.Open(path)
+	s.Require().Nil(err)
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event AuditEvent
+		s.Require().Nil(json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	return
+}
+
+func (s *AuditLogSuite) TestLogWritesJSONLines() {
+	path := filepath.Join(s.dir, "audit.log")
+	a, err := NewAuditLog(path, DefaultAuditLogMaxSize, DefaultAuditLogBackups)
+	s.Require().Nil(err)
+
+	s.Nil(a.Log(AuditEvent{Event: AuditAuthSuccess, User: "bob", AuthMethod: AuthMethodKey}))
+	s.Nil(a.Log(AuditEvent{Event: AuditTransferEnd, User: "bob", Bytes: 42, Outcome: OutcomeSuccess}))
+	s.Nil(a.Close())
+
+	events := s.readEvents(path)
+	s.Require().Len(events, 2)
+	s.Equal(AuditAuthSuccess, events[0].Event)
+	s.Equal(AuthMethodKey, events[0].AuthMethod)
+	s.False(events[0].Time.IsZero())
+	s.Equal(int64(42), events[1].Bytes)
+
+	info, err := os.Stat(path)
+	s.Nil(err)
+	s.Equal(os.FileMode(0600), info.Mode().Perm())
+}
+
+func (s *AuditLogSuite) TestLogAppendsToExistingLog() {
+	path := filepath.Join(s.dir, "audit.log")
+	for i := 0; i < 2; i++ {
+		a, err := NewAuditLog(path, DefaultAuditLogMaxSize, DefaultAuditLogBackups)
+		s.Require().Nil(err)
+		s.Nil(a.Log(AuditEvent{Event: AuditConnectionAccepted}))
+		a.Close()
+	}
+
+	s.Len(s.readEvents(path), 2)
+}
+
+func (s *AuditLogSuite) TestLogRotatesBySize() {
+	path := filepath.Join(s.dir, "audit.log")
+	a, err := NewAuditLog(path, 200, 2)
+	s.Require().Nil(err)
+
+	for i := 0; i < 10; i++ {
+		s.Nil(a.Log(AuditEvent{Event: AuditConnectionAccepted, SessionID: "0123456789abcdef"}))
+	}
+	a.Close()
+
+	_, err = os.Stat(backupName(path, 1))
+	s.Nil(err)
+	_, err = os.Stat(backupName(path, 2))
+	s.Nil(err)
+	_, err = os.Stat(backupName(path, 3))
+	s.True(os.IsNotExist(err))
+
+	info, err := os.Stat(path)
+	s.Nil(err)
+	s.True(info.Size() <= 200)
+}
+
+func (s *AuditLogSuite) TestNilLogDiscardsEvents() {
+	var a *AuditLog
+	s.Nil(a.Log(AuditEvent{Event: AuditConnectionAccepted}))
+	s.Nil(a.Close())
+}
+
+func TestAuditLogSuite(t *testing.T) {
+	suite.Run(t, new(AuditLogSuite))
+}
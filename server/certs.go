@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrNotCertificate = errors.New("Key is not a certificate")
+var ErrCertificateKeyMismatch = errors.New("Certificate is not for the key used by the connection")
+var ErrNoPrincipals = errors.New("Certificate has no principals")
+
+// sourceAddressOption is the certificate critical option that limits the
+// addresses a certificate may be used from
+const sourceAddressOption = "source-address"
+
+// CertificateAuthority checks certificates against a set of trusted CA keys
+// and a revocation list
+type CertificateAuthority struct {
+	keys    [][]byte
+	revoked *RevocationList
+	now     func() time.Time
+}
+
+// NewCertificateAuthority returns a CertificateAuthority that trusts keys.
+// revoked may be nil.
+func NewCertificateAuthority(keys []ssh.PublicKey, revoked *RevocationList) *CertificateAuthority {
+	ca := &CertificateAuthority{
+		revoked: revoked,
+		now:     time.Now,
+	}
+	for _, key := range keys {
+		ca.keys = append(ca.keys, key.Marshal())
+	}
+	return ca
+}
+
+// LoadPublicKeys reads every public key from a file in authorized_keys
+// format, options, comments and lines that can't be parsed are ignored
+func LoadPublicKeys(path string) (keys []ssh.PublicKey, e error) {
+	var rest []byte
+	if rest, e = ioutil.ReadFile(path); e != nil {
+		return
+	}
+
+	for len(rest) > 0 {
+		var key ssh.PublicKey
+		var err error
+		if key, _, _, rest, err = ssh.ParseAuthorizedKey(rest); err != nil {
+			break
+		}
+		keys = append(keys, key)
+	}
+
+	return
+}
+
+// IsAuthority returns true if key is a trusted CA key
+func (ca *CertificateAuthority) IsAuthority(key ssh.PublicKey) bool {
+	marshaled := key.Marshal()
+	for _, trusted := range ca.keys {
+		if bytes.Equal(trusted, marshaled) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckUserCertificate checks that cert is a valid user certificate for key
+// that names userName as a principal. The certificate's source-address
+// critical option is returned as KeyOptions.From to be checked against the
+// client address.
+func (ca *CertificateAuthority) CheckUserCertificate(cert *ssh.Certificate, key ssh.PublicKey, userName string) (options KeyOptions, e error) {
+	if cert.CertType != ssh.UserCert {
+		return options, fmt.Errorf("Certificate has type %d, expected a user certificate", cert.CertType)
+	}
+
+	if e = ca.check(cert, key, userName, []string{sourceAddressOption}); e != nil {
+		return
+	}
+
+	if sourceAddress, ok := cert.CriticalOptions[sourceAddressOption]; ok {
+		if options.From = splitList(sourceAddress); options.From == nil {
+			options.From = []string{}
+		}
+	}
+
+	return
+}
+
+// CheckHostCertificate checks that cert is a valid host certificate for key
+// that names host as a principal
+func (ca *CertificateAuthority) CheckHostCertificate(cert *ssh.Certificate, key ssh.PublicKey, host string) error {
+	if cert.CertType != ssh.HostCert {
+		return fmt.Errorf("Certificate has type %d, expected a host certificate", cert.CertType)
+	}
+
+	return ca.check(cert, key, host, nil)
+}
+
+func (ca *CertificateAuthority) check(cert *ssh.Certificate, key ssh.PublicKey, principal string, supportedOptions []string) error {
+	if !bytes.Equal(cert.Key.Marshal(), key.Marshal()) {
+		return ErrCertificateKeyMismatch
+	}
+
+	if len(cert.ValidPrincipals) == 0 {
+		return ErrNoPrincipals
+	}
+
+	checker := ssh.CertChecker{
+		SupportedCriticalOptions: supportedOptions,
+		IsAuthority:              ca.IsAuthority,
+		IsRevoked:                func(cert *ssh.Certificate) bool { return ca.revoked.IsRevoked(cert) },
+		Clock:                    ca.now,
+	}
+	return checker.CheckCert(principal, cert)
+}
+
+// ParseCertificate parses a certificate in SSH wire format
+func ParseCertificate(encoded []byte) (cert *ssh.Certificate, e error) {
+	var key ssh.PublicKey
+	if key, e = ssh.ParsePublicKey(encoded); e != nil {
+		return
+	}
+
+	var ok bool
+	if cert, ok = key.(*ssh.Certificate); !ok {
+		e = ErrNotCertificate
+	}
+	return
+}
+
+// LoadCertificate reads a certificate in the format written by ssh-keygen
+// and returns it in SSH wire format
+func LoadCertificate(path string) (encoded []byte, e error) {
+	var contents []byte
+	if contents, e = ioutil.ReadFile(path); e != nil {
+		return
+	}
+
+	var key ssh.PublicKey
+	if key, _, _, _, e = ssh.ParseAuthorizedKey(contents); e != nil {
+		return nil, fmt.Errorf("%s: %s", path, e.Error())
+	}
+
+	if _, ok := key.(*ssh.Certificate); !ok {
+		return nil, fmt.Errorf("%s: %s", path, ErrNotCertificate.Error())
+	}
+
+	return key.Marshal(), nil
+}
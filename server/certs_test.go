@@ -0,0 +1,141 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ssh"
+)
+
+type CertsSuite struct {
+	suite.Suite
+	ca      ssh.Signer
+	userKey ssh.PublicKey
+	now     time.Time
+}
+
+func newTestSigner(s *suite.Suite) ssh.Signer {
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	s.Require().Nil(err)
+	signer, err := ssh.NewSignerFromKey(key)
+	s.Require().Nil(err)
+	return signer
+}
+
+func (s *CertsSuite) SetupTest() {
+	s.ca = newTestSigner(&s.Suite)
+	s.userKey = newTestSigner(&s.Suite).PublicKey()
+	s.now = time.Date(2016, time.October, 1, 0, 0, 0, 0, time.UTC)
+}
+
+func (s *CertsSuite) newCertificate(certType uint32, principals ...string) *ssh.Certificate {
+	cert := &ssh.Certificate{
+		Key:             s.userKey,
+		Serial:          42,
+		CertType:        certType,
+		KeyId:           "bob@example.com",
+		ValidPrincipals: principals,
+		ValidAfter:      uint64(s.now.Add(-time.Hour).Unix()),
+		ValidBefore:     uint64(s.now.Add(time.Hour).Unix()),
+		Permissions: ssh.Permissions{
+			CriticalOptions: map[string]string{},
+		},
+	}
+	s.sign(cert, s.ca)
+	return cert
+}
+
+func (s *CertsSuite) sign(cert *ssh.Certificate, ca ssh.Signer) {
+	s.Require().Nil(cert.SignCert(rand.Reader, ca))
+}
+
+func (s *CertsSuite) authority(revoked *RevocationList) *CertificateAuthority {
+	ca := NewCertificateAuthority([]ssh.PublicKey{s.ca.PublicKey()}, revoked)
+	ca.now = func() time.Time { return s.now }
+	return ca
+}
+
+func (s *CertsSuite) TestValidUserCertificate() {
+	cert := s.newCertificate(ssh.UserCert, "bob")
+	options, e := s.authority(nil).CheckUserCertificate(cert, s.userKey, "bob")
+	s.Nil(e)
+	s.Nil(options.From)
+
+	parsed, e := ParseCertificate(cert.Marshal())
+	s.Require().Nil(e)
+	s.Equal(cert.KeyId, parsed.KeyId)
+}
+
+func (s *CertsSuite) TestRejectedUserCertificates() {
+	ca := s.authority(nil)
+
+	_, e := ca.CheckUserCertificate(s.newCertificate(ssh.UserCert, "alice"), s.userKey, "bob")
+	s.NotNil(e)
+
+	_, e = ca.CheckUserCertificate(s.newCertificate(ssh.UserCert), s.userKey, "bob")
+	s.Equal(ErrNoPrincipals, e)
+
+	_, e = ca.CheckUserCertificate(s.newCertificate(ssh.HostCert, "bob"), s.userKey, "bob")
+	s.NotNil(e)
+
+	_, e = ca.CheckUserCertificate(s.newCertificate(ssh.UserCert, "bob"), newTestSigner(&s.Suite).PublicKey(), "bob")
+	s.Equal(ErrCertificateKeyMismatch, e)
+
+	cert := s.newCertificate(ssh.UserCert, "bob")
+	s.sign(cert, newTestSigner(&s.Suite))
+	_, e = ca.CheckUserCertificate(cert, s.userKey, "bob")
+	s.NotNil(e)
+
+	cert = s.newCertificate(ssh.UserCert, "bob")
+	cert.CriticalOptions["force-command"] = "/bin/true"
+	s.sign(cert, s.ca)
+	_, e = ca.CheckUserCertificate(cert, s.userKey, "bob")
+	s.NotNil(e)
+
+	cert = s.newCertificate(ssh.UserCert, "bob")
+	s.now = s.now.Add(2 * time.Hour)
+	_, e = ca.CheckUserCertificate(cert, s.userKey, "bob")
+	s.NotNil(e)
+}
+
+func (s *CertsSuite) TestSourceAddress() {
+	cert := s.newCertificate(ssh.UserCert, "bob")
+	cert.CriticalOptions[sourceAddressOption] = "10.0.0.0/8,192.168.1.1"
+	s.sign(cert, s.ca)
+
+	options, e := s.authority(nil).CheckUserCertificate(cert, s.userKey, "bob")
+	s.Require().Nil(e)
+	s.Equal([]string{"10.0.0.0/8", "192.168.1.1"}, options.From)
+	s.Nil(options.Permits("10.1.1.1:4000", s.now))
+	s.Equal(ErrKeySourceDenied, options.Permits("172.16.0.1:4000", s.now))
+}
+
+func (s *CertsSuite) TestRevokedCertificate() {
+	cert := s.newCertificate(ssh.UserCert, "bob")
+
+	for _, entry := range []string{"serial: 40-50", "id: bob@example.com", "key: " + string(ssh.MarshalAuthorizedKey(s.userKey))} {
+		revoked, e := ParseRevocationList([]byte(entry))
+		s.Require().Nil(e)
+		_, e = s.authority(revoked).CheckUserCertificate(cert, s.userKey, "bob")
+		s.NotNil(e, entry)
+	}
+
+	revoked, e := ParseRevocationList([]byte("serial: 1\nid: alice@example.com\n"))
+	s.Require().Nil(e)
+	_, e = s.authority(revoked).CheckUserCertificate(cert, s.userKey, "bob")
+	s.Nil(e)
+}
+
+func (s *CertsSuite) TestHostCertificate() {
+	ca := s.authority(nil)
+	s.Nil(ca.CheckHostCertificate(s.newCertificate(ssh.HostCert, "files.example.com"), s.userKey, "files.example.com"))
+	s.NotNil(ca.CheckHostCertificate(s.newCertificate(ssh.HostCert, "files.example.com"), s.userKey, "other.example.com"))
+	s.NotNil(ca.CheckHostCertificate(s.newCertificate(ssh.UserCert, "files.example.com"), s.userKey, "files.example.com"))
+}
+
+func TestCertsSuite(t *testing.T) {
+	suite.Run(t, new(CertsSuite))
+}
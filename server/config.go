@@ -0,0 +1,441 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	unet "github.com/murphybytes/ucp/net"
+)
+
+// DefaultPamService is the PAM service used to check passwords
+const DefaultPamService = "chkpasswd"
+
+// DefaultAuthorizedKeysFile is the location of a user's authorized keys.
+// %h is replaced by the user's home directory and %u by the user name.
+const DefaultAuthorizedKeysFile = "%h/.ucp/authorized_keys"
+
+// DefaultProxyPath is the program started to read files as the requesting
+// user. It must be an absolute path so the program isn't looked up in $PATH.
+const DefaultProxyPath = "/usr/local/bin/uproxy"
+
+// DefaultWorkerUmask is the umask of the process that handles a session's
+// files
+const DefaultWorkerUmask = "0022"
+
+// DefaultDrainTimeout is how long active transfers are given to finish when
+// the server shuts down
+const DefaultDrainTimeout = 30 * time.Second
+
+// Default connection limits and timeouts
+const (
+	DefaultMaxConnections        = 1024
+	DefaultMaxSessionsPerUser    = 16
+	DefaultMaxSessionsPerAddress = 32
+	DefaultMaxBatchTransfers     = 8
+	DefaultHandshakeTimeout      = 30 * time.Second
+	DefaultAuthTimeout           = 2 * time.Minute
+	DefaultIdleTimeout           = 5 * time.Minute
+)
+
+// Default password lockout settings
+const (
+	DefaultMaxPasswordFailures = 5
+	DefaultLockoutDuration     = 15 * time.Minute
+	DefaultFailureDelay        = time.Second
+	DefaultMaxFailureDelay     = 30 * time.Second
+)
+
+var ErrNoListeners = errors.New("At least one listener is required")
+var ErrNoAuthMethods = errors.New("At least one authentication method must be enabled")
+
+// Config holds the userve settings that can be read from a configuration
+// file.
+type Config struct {
+	Listeners          []string `json:"listeners"`
+	Directory          string   `json:"directory"`
+	PrivateKeyFile     string   `json:"private_key_file"`
+	HostCertificate    string   `json:"host_certificate"`
+	AuthorizedKeysFile string   `json:"authorized_keys_file"`
+	ProxyPath          string   `json:"proxy_path"`
+	WorkerUmask        string   `json:"worker_umask"`
+	AllowBenchmarks    bool     `json:"allow_benchmarks"`
+	// KeepFailedUploads leaves the hidden temporary file an upload is
+	// written to in place if the upload fails, rather than removing it.
+	// Kept files count against quotas.
+	KeepFailedUploads bool              `json:"keep_failed_uploads"`
+	Auth              AuthConfig        `json:"auth"`
+	Limits            LimitsConfig      `json:"limits"`
+	Logging           LoggingConfig     `json:"logging"`
+	PathPolicy        PathPolicy        `json:"path_policy"`
+	Confinement       []ConfinementRule `json:"confinement"`
+	Metrics           MetricsConfig     `json:"metrics"`
+	Admin             AdminConfig       `json:"admin"`
+	Hooks             []HookConfig      `json:"hooks"`
+}
+
+// AuthConfig controls which authentication methods are accepted. If
+// user_ca_keys is set clients may authenticate with user certificates signed
+// by one of the CA keys it holds. Keys and certificates listed in
+// revoked_keys are refused.
+type AuthConfig struct {
+	PublicKey   bool          `json:"public_key"`
+	Password    bool          `json:"password"`
+	PamService  string        `json:"pam_service"`
+	UserCAKeys  string        `json:"user_ca_keys"`
+	RevokedKeys string        `json:"revoked_keys"`
+	Lockout     LockoutConfig `json:"lockout"`
+}
+
+// LockoutConfig controls how failed password attempts are throttled. After
+// each failure the response is delayed by failure_delay, doubling with each
+// further failure up to max_failure_delay. Once a user or source address
+// reaches max_failures within lockout_duration password authentication is
+// refused for lockout_duration. Clients from trusted_networks, given as
+// CIDR blocks or addresses, are never throttled.
+type LockoutConfig struct {
+	MaxFailures     int      `json:"max_failures"`
+	LockoutDuration Duration `json:"lockout_duration"`
+	FailureDelay    Duration `json:"failure_delay"`
+	MaxFailureDelay Duration `json:"max_failure_delay"`
+	TrustedNetworks []string `json:"trusted_networks"`
+}
+
+// IsTrusted returns true if host is part of a trusted network
+func (l *LockoutConfig) IsTrusted(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	for _, network := range l.TrustedNetworks {
+		if ipNet, err := parseNetwork(network); err == nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNetwork parses a CIDR block, a single address is treated as a
+// network containing only that address
+func parseNetwork(network string) (ipNet *net.IPNet, e error) {
+	if ip := net.ParseIP(network); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+
+	_, ipNet, e = net.ParseCIDR(network)
+	return
+}
+
+// LimitsConfig holds sizes and limits used while serving clients. Limits
+// and timeouts set to zero are not enforced. MaxFileSize is the largest
+// file that may be uploaded and UserQuota what each user may store.
+// MaxBatchTransfers is the number of transfers a batch may run at once, a
+// batch runs one at a time if it is zero. It can't be more than the files a
+// session's worker may hold open.
+type LimitsConfig struct {
+	PipeBufferSize        int       `json:"pipe_buffer_size"`
+	MaxFrameSize          int       `json:"max_frame_size"`
+	MaxFileSize           int64     `json:"max_file_size"`
+	UserQuota             UserQuota `json:"user_quota"`
+	DrainTimeout          Duration  `json:"drain_timeout"`
+	MaxConnections        int       `json:"max_connections"`
+	MaxSessionsPerUser    int       `json:"max_sessions_per_user"`
+	MaxSessionsPerAddress int       `json:"max_sessions_per_address"`
+	MaxBatchTransfers     int       `json:"max_batch_transfers"`
+	HandshakeTimeout      Duration  `json:"handshake_timeout"`
+	AuthTimeout           Duration  `json:"auth_timeout"`
+	IdleTimeout           Duration  `json:"idle_timeout"`
+}
+
+// LoggingConfig holds audit log settings
+type LoggingConfig struct {
+	AuditLog        string `json:"audit_log"`
+	AuditLogMaxSize int64  `json:"audit_log_max_size"`
+	AuditLogBackups int    `json:"audit_log_backups"`
+}
+
+// MetricsConfig holds the settings of the HTTP listener that serves metrics
+// and health checks. It is disabled unless Listen is set, changing it
+// requires a restart.
+type MetricsConfig struct {
+	Listen string `json:"listen"`
+}
+
+// AdminConfig holds the settings of the admin socket used by ucpctl. It is
+// disabled unless Socket is set. Besides root and the user the server runs
+// as, members of Group may use it. Changing it requires a restart.
+type AdminConfig struct {
+	Socket string `json:"socket"`
+	Group  string `json:"group"`
+}
+
+// PathPolicy holds glob patterns that decide which files may be
+// transferred. Deny patterns take precedence over allow patterns, an empty
+// allow list permits every path that is not denied.
+type PathPolicy struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// NewConfig returns a configuration populated with default values
+func NewConfig() *Config {
+	return &Config{
+		Listeners:          []string{fmt.Sprintf("localhost:%d", DefaultPort)},
+		AuthorizedKeysFile: DefaultAuthorizedKeysFile,
+		ProxyPath:          DefaultProxyPath,
+		WorkerUmask:        DefaultWorkerUmask,
+		AllowBenchmarks:    true,
+		Auth: AuthConfig{
+			PublicKey:  true,
+			Password:   true,
+			PamService: DefaultPamService,
+			Lockout: LockoutConfig{
+				MaxFailures:     DefaultMaxPasswordFailures,
+				LockoutDuration: Duration{DefaultLockoutDuration},
+				FailureDelay:    Duration{DefaultFailureDelay},
+				MaxFailureDelay: Duration{DefaultMaxFailureDelay},
+			},
+		},
+		Limits: LimitsConfig{
+			PipeBufferSize:        PipeBufferSize,
+			MaxFrameSize:          unet.DefaultMaxFrameSize,
+			DrainTimeout:          Duration{DefaultDrainTimeout},
+			MaxConnections:        DefaultMaxConnections,
+			MaxSessionsPerUser:    DefaultMaxSessionsPerUser,
+			MaxSessionsPerAddress: DefaultMaxSessionsPerAddress,
+			MaxBatchTransfers:     DefaultMaxBatchTransfers,
+			HandshakeTimeout:      Duration{DefaultHandshakeTimeout},
+			AuthTimeout:           Duration{DefaultAuthTimeout},
+			IdleTimeout:           Duration{DefaultIdleTimeout},
+		},
+		Logging: LoggingConfig{
+			AuditLogMaxSize: DefaultAuditLogMaxSize,
+			AuditLogBackups: DefaultAuditLogBackups,
+		},
+	}
+}
+
+// Load reads a JSON configuration file. Settings that are missing from the
+// file keep their current values.
+func (c *Config) Load(path string) (e error) {
+	var f *os.File
+	if f, e = os.Open(path); e != nil {
+		return
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if e = decoder.Decode(c); e != nil {
+		e = fmt.Errorf("%s: %s", path, e.Error())
+	}
+
+	return
+}
+
+// PrivateKeyPath returns the path to the server private key
+func (c *Config) PrivateKeyPath() string {
+	if c.PrivateKeyFile != "" {
+		return c.PrivateKeyFile
+	}
+	return filepath.Join(c.Directory, "private-key.pem")
+}
+
+// AuditLogPath returns the path to the audit log
+func (c *Config) AuditLogPath() string {
+	if c.Logging.AuditLog != "" {
+		return c.Logging.AuditLog
+	}
+	return filepath.Join(c.Directory, "audit.log")
+}
+
+// Umask returns the worker umask
+func (c *Config) Umask() (umask uint32, e error) {
+	var value uint64
+	if value, e = strconv.ParseUint(c.WorkerUmask, 8, 32); e != nil || value > 0777 {
+		return 0, fmt.Errorf("Invalid worker_umask %q, expected an octal value such as 0022", c.WorkerUmask)
+	}
+	return uint32(value), nil
+}
+
+// Validate checks that the configuration is complete and consistent
+func (c *Config) Validate() (e error) {
+	if len(c.Listeners) == 0 {
+		return ErrNoListeners
+	}
+
+	for _, listener := range c.Listeners {
+		if _, _, e = net.SplitHostPort(listener); e != nil {
+			return fmt.Errorf("Invalid listener %q: %s", listener, e.Error())
+		}
+	}
+
+	if c.PrivateKeyFile == "" && c.Directory == "" {
+		return errors.New("Either directory or private_key_file must be set")
+	}
+
+	if c.AuthorizedKeysFile == "" {
+		return errors.New("authorized_keys_file must be set")
+	}
+
+	if !filepath.IsAbs(c.ProxyPath) {
+		return errors.New("proxy_path must be an absolute path")
+	}
+
+	if _, e = c.Umask(); e != nil {
+		return
+	}
+
+	if !c.Auth.PublicKey && !c.Auth.Password {
+		return ErrNoAuthMethods
+	}
+
+	if c.Auth.Password && c.Auth.PamService == "" {
+		return errors.New("pam_service must be set when password authentication is enabled")
+	}
+
+	if e = c.Auth.Lockout.validate(); e != nil {
+		return
+	}
+
+	if c.Limits.PipeBufferSize <= 0 {
+		return errors.New("pipe_buffer_size must be greater than zero")
+	}
+
+	if c.Limits.MaxFrameSize < c.Limits.PipeBufferSize+unet.FrameOverhead {
+		return fmt.Errorf("max_frame_size must be at least %d bytes larger than pipe_buffer_size", unet.FrameOverhead)
+	}
+
+	if c.Limits.MaxConnections < 0 || c.Limits.MaxSessionsPerUser < 0 || c.Limits.MaxSessionsPerAddress < 0 || c.Limits.MaxBatchTransfers < 0 {
+		return errors.New("Connection, session and batch limits must not be negative")
+	}
+
+	// each transfer in a batch holds a file open in the session's worker
+	if c.Limits.MaxBatchTransfers > maxWorkerFiles {
+		return fmt.Errorf("max_batch_transfers must not be more than %d", maxWorkerFiles)
+	}
+
+	if c.Limits.MaxFileSize < 0 {
+		return errors.New("max_file_size must not be negative")
+	}
+
+	if e = c.Limits.UserQuota.validate(); e != nil {
+		return
+	}
+
+	for _, timeout := range []Duration{c.Limits.DrainTimeout, c.Limits.HandshakeTimeout, c.Limits.AuthTimeout, c.Limits.IdleTimeout} {
+		if timeout.Duration < 0 {
+			return errors.New("Timeouts must not be negative")
+		}
+	}
+
+	if c.Logging.AuditLogMaxSize < 0 || c.Logging.AuditLogBackups < 0 {
+		return errors.New("Audit log size and backups must not be negative")
+	}
+
+	if c.Metrics.Listen != "" {
+		if _, _, e = net.SplitHostPort(c.Metrics.Listen); e != nil {
+			return fmt.Errorf("Invalid metrics listener %q: %s", c.Metrics.Listen, e.Error())
+		}
+	}
+
+	if c.Admin.Socket != "" && !filepath.IsAbs(c.Admin.Socket) {
+		return errors.New("admin socket must be an absolute path")
+	}
+
+	for i := range c.Confinement {
+		if e = c.Confinement[i].validate(); e != nil {
+			return fmt.Errorf("confinement rule %d: %s", i+1, e.Error())
+		}
+	}
+
+	for i := range c.Hooks {
+		if e = c.Hooks[i].validate(); e != nil {
+			return fmt.Errorf("hook %d: %s", i+1, e.Error())
+		}
+	}
+
+	return c.PathPolicy.validate()
+}
+
+func (l *LockoutConfig) validate() (e error) {
+	if l.MaxFailures < 0 || l.LockoutDuration.Duration < 0 || l.FailureDelay.Duration < 0 || l.MaxFailureDelay.Duration < 0 {
+		return errors.New("Lockout settings must not be negative")
+	}
+
+	for _, network := range l.TrustedNetworks {
+		if _, e = parseNetwork(network); e != nil {
+			return fmt.Errorf("Invalid trusted network %q: %s", network, e.Error())
+		}
+	}
+	return
+}
+
+func (p *PathPolicy) validate() (e error) {
+	for _, pattern := range append(append([]string{}, p.Allow...), p.Deny...) {
+		if _, e = filepath.Match(pattern, ""); e != nil {
+			return fmt.Errorf("Invalid path pattern %q: %s", pattern, e.Error())
+		}
+	}
+	return
+}
+
+// Permits returns true if path may be transferred
+func (p *PathPolicy) Permits(path string) bool {
+	path = filepath.Clean(path)
+
+	if matchesAny(p.Deny, path) {
+		return false
+	}
+
+	return len(p.Allow) == 0 || matchesAny(p.Allow, path)
+}
+
+func matchesAny(patterns []string, path string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, path); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Duration is a time.Duration that is written in configuration files as a
+// string such as "30s" or "5m"
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) (e error) {
+	var s string
+	if e = json.Unmarshal(b, &s); e != nil {
+		return
+	}
+
+	d.Duration, e = time.ParseDuration(s)
+	return
+}
+
+// ExpandUserPath replaces %h in path with the home directory of u, %u with
+// the user name and %% with a literal percent sign
+func ExpandUserPath(path string, u *user.User) string {
+	replacer := strings.NewReplacer("%%", "%", "%h", u.HomeDir, "%u", u.Username)
+	return replacer.Replace(path)
+}
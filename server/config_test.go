@@ -0,0 +1,216 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ConfigSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (s *ConfigSuite) SetupTest() {
+	s.dir, _ = ioutil.TempDir("", "config")
+}
+
+func (s *ConfigSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *ConfigSuite) writeConfig(contents string) string {
+	path := filepath.Join(s.dir, "userve.conf")
+	s.Require().Nil(ioutil.WriteFile(path, []byte(contents), 0600))
+	return path
+}
+
+func (s *ConfigSuite) TestDefaultsAreValid() {
+	cfg := NewConfig()
+	cfg.Directory = s.dir
+	s.Nil(cfg.Validate())
+	s.Equal(filepath.Join(s.dir, "private-key.pem"), cfg.PrivateKeyPath())
+	s.Equal(filepath.Join(s.dir, "audit.log"), cfg.AuditLogPath())
+	umask, e := cfg.Umask()
+	s.Nil(e)
+	s.Equal(uint32(0022), umask)
+}
+
+func (s *ConfigSuite) TestLoadKeepsUnsetValues() {
+	cfg := NewConfig()
+	cfg.Directory = s.dir
+	path := s.writeConfig(`{
+		"listeners": ["0.0.0.0:9000", "[::1]:9000"],
+		"auth": {"password": false},
+		"path_policy": {"deny": ["/etc/*"]}
+	}`)
+
+	s.Require().Nil(cfg.Load(path))
+	s.Nil(cfg.Validate())
+	s.Equal([]string{"0.0.0.0:9000", "[::1]:9000"}, cfg.Listeners)
+	s.True(cfg.Auth.PublicKey)
+	s.False(cfg.Auth.Password)
+	s.Equal(DefaultPamService, cfg.Auth.PamService)
+	s.Equal(PipeBufferSize, cfg.Limits.PipeBufferSize)
+	s.Equal(s.dir, cfg.Directory)
+}
+
+func (s *ConfigSuite) TestLoadRejectsUnknownSettings() {
+	cfg := NewConfig()
+	path := s.writeConfig(`{"listener": "0.0.0.0:9000"}`)
+	s.NotNil(cfg.Load(path))
+}
+
+func (s *ConfigSuite) TestValidate() {
+	cfg := NewConfig()
+	cfg.Directory = s.dir
+	cfg.Listeners = nil
+	s.Equal(ErrNoListeners, cfg.Validate())
+
+	cfg = NewConfig()
+	cfg.Directory = s.dir
+	cfg.Listeners = []string{"localhost"}
+	s.NotNil(cfg.Validate())
+
+	cfg = NewConfig()
+	cfg.Directory = s.dir
+	cfg.Auth.PublicKey = false
+	cfg.Auth.Password = false
+	s.Equal(ErrNoAuthMethods, cfg.Validate())
+
+	cfg = NewConfig()
+	cfg.Directory = s.dir
+	cfg.PathPolicy.Allow = []string{"/data/["}
+	s.NotNil(cfg.Validate())
+
+	cfg = NewConfig()
+	cfg.Directory = s.dir
+	cfg.Auth.Lockout.TrustedNetworks = []string{"10.0.0.0/33"}
+	s.NotNil(cfg.Validate())
+
+	cfg = NewConfig()
+	cfg.Directory = s.dir
+	cfg.ProxyPath = "uproxy"
+	s.NotNil(cfg.Validate())
+
+	cfg = NewConfig()
+	cfg.Directory = s.dir
+	cfg.WorkerUmask = "0999"
+	s.NotNil(cfg.Validate())
+
+	cfg = NewConfig()
+	cfg.Directory = s.dir
+	cfg.WorkerUmask = "01000"
+	s.NotNil(cfg.Validate())
+
+	cfg = NewConfig()
+	cfg.Directory = s.dir
+	cfg.Metrics.Listen = "localhost"
+	s.NotNil(cfg.Validate())
+
+	cfg = NewConfig()
+	cfg.Directory = s.dir
+	cfg.Admin.Socket = "admin.sock"
+	s.NotNil(cfg.Validate())
+
+	cfg = NewConfig()
+	cfg.Directory = s.dir
+	cfg.Limits.MaxFrameSize = cfg.Limits.PipeBufferSize
+	s.NotNil(cfg.Validate())
+
+	cfg = NewConfig()
+	cfg.Directory = s.dir
+	cfg.Limits.MaxFileSize = -1
+	s.NotNil(cfg.Validate())
+
+	cfg = NewConfig()
+	cfg.Directory = s.dir
+	cfg.Limits.MaxBatchTransfers = -1
+	s.NotNil(cfg.Validate())
+
+	cfg.Limits.MaxBatchTransfers = maxWorkerFiles + 1
+	s.NotNil(cfg.Validate())
+	cfg.Limits.MaxBatchTransfers = maxWorkerFiles
+	s.Nil(cfg.Validate())
+
+	cfg = NewConfig()
+	s.NotNil(cfg.Validate())
+}
+
+func (s *ConfigSuite) TestTrustedNetworks() {
+	lockout := LockoutConfig{TrustedNetworks: []string{"10.0.0.0/8", "192.168.1.10", "::1"}}
+	s.True(lockout.IsTrusted("10.1.2.3"))
+	s.True(lockout.IsTrusted("192.168.1.10"))
+	s.True(lockout.IsTrusted("::1"))
+	s.False(lockout.IsTrusted("192.168.1.11"))
+	s.False(lockout.IsTrusted(""))
+}
+
+func (s *ConfigSuite) TestPathPolicy() {
+	policy := PathPolicy{}
+	s.True(policy.Permits("/etc/passwd"))
+
+	policy.Deny = []string{"/etc/*"}
+	s.False(policy.Permits("/etc/passwd"))
+	s.False(policy.Permits("/data/../etc/passwd"))
+	s.True(policy.Permits("/data/file"))
+
+	policy.Allow = []string{"/data/*"}
+	s.True(policy.Permits("/data/file"))
+	s.False(policy.Permits("/home/bob/file"))
+}
+
+func (s *ConfigSuite) TestHooks() {
+	valid := []HookConfig{
+		{Command: []string{"/usr/local/bin/ingest", "-q"}},
+		{URL: "http://127.0.0.1:9980/transfers", Directions: []string{HookUpload}, Outcomes: []string{OutcomeSuccess}},
+	}
+	invalid := []HookConfig{
+		{},
+		{Command: []string{"/bin/true"}, URL: "http://localhost/"},
+		{Command: []string{"ingest"}},
+		{URL: "ftp://localhost/"},
+		{URL: "http:///transfers"},
+		{Command: []string{"/bin/true"}, Directions: []string{"sideways"}},
+		{Command: []string{"/bin/true"}, Outcomes: []string{"maybe"}},
+		{Command: []string{"/bin/true"}, Timeout: Duration{Duration: -1}},
+	}
+
+	for _, hook := range valid {
+		cfg := NewConfig()
+		cfg.Directory = s.dir
+		cfg.Hooks = []HookConfig{hook}
+		s.Nil(cfg.Validate(), "%+v", hook)
+	}
+
+	for _, hook := range invalid {
+		cfg := NewConfig()
+		cfg.Directory = s.dir
+		cfg.Hooks = []HookConfig{hook}
+		s.NotNil(cfg.Validate(), "%+v", hook)
+	}
+
+	s.True(valid[0].Matches(HookDownload, OutcomeFailure))
+	s.False(valid[0].Matches("benchmark", OutcomeSuccess))
+	s.True(valid[1].Matches(HookUpload, OutcomeSuccess))
+	s.False(valid[1].Matches(HookUpload, OutcomeFailure))
+	s.False(valid[1].Matches(HookDownload, OutcomeSuccess))
+
+	s.Equal(DefaultHookTimeout, valid[0].TimeoutOrDefault())
+	s.Equal("/usr/local/bin/ingest -q", valid[0].Name())
+}
+
+func (s *ConfigSuite) TestExpandUserPath() {
+	u := &user.User{Username: "bob", HomeDir: "/home/bob"}
+	s.Equal("/home/bob/.ucp/authorized_keys", ExpandUserPath(DefaultAuthorizedKeysFile, u))
+	s.Equal("/etc/ucp/keys/bob", ExpandUserPath("/etc/ucp/keys/%u", u))
+	s.Equal("/etc/%u", ExpandUserPath("/etc/%%u", u))
+}
+
+func TestConfigSuite(t *testing.T) {
+	suite.Run(t, new(ConfigSuite))
+}
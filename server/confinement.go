@@ -0,0 +1,224 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var ErrNoRoot = errors.New("No root is configured for user")
+var ErrOutsideRoots = errors.New("Path is outside of the user's roots")
+var ErrSymlinkInPath = errors.New("Path contains a symbolic link")
+
+// matchAll in a rule's users or groups matches everyone
+const matchAll = "*"
+
+// ConfinementRule confines the users and members of groups it lists to a
+// set of virtual roots. Clients name files by their virtual path, which is
+// resolved against the root with the longest matching mount point, so
+// /shared/report.csv is read from /srv/shared/report.csv given the root
+// {"mount": "/shared", "directory": "/srv/shared"}. Read and Write hold
+// glob patterns matched against the virtual path for downloads and uploads.
+// Quota limits the files each user the rule matches owns across its roots.
+// The first rule that matches a user applies. If any rules are configured,
+// users that none of them match may not transfer files.
+type ConfinementRule struct {
+	Users  []string      `json:"users"`
+	Groups []string      `json:"groups"`
+	Roots  []VirtualRoot `json:"roots"`
+	Read   PathPolicy    `json:"read"`
+	Write  PathPolicy    `json:"write"`
+	Quota  Quota         `json:"quota"`
+}
+
+// VirtualRoot maps the virtual directory Mount onto Directory. %h in
+// Directory is replaced by the user's home directory and %u by the user
+// name. Quota limits what may be stored under Directory by everyone who
+// uploads to it.
+type VirtualRoot struct {
+	Mount     string `json:"mount"`
+	Directory string `json:"directory"`
+	Quota     Quota  `json:"quota"`
+}
+
+// Matches returns true if the rule applies to userName or one of groups
+func (r *ConfinementRule) Matches(userName string, groups []string) bool {
+	for _, name := range r.Users {
+		if name == matchAll || name == userName {
+			return true
+		}
+	}
+
+	for _, name := range r.Groups {
+		for _, group := range groups {
+			if name == matchAll || name == group {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Resolve maps the virtual path requested by u to the directory of the root
+// it falls under and the path relative to that directory. ".." can't climb
+// above the virtual root. upload selects the write patterns rather than
+// the read patterns.
+func (r *ConfinementRule) Resolve(u *user.User, virtualPath string, upload bool) (directory, relative string, e error) {
+	virtualPath = path.Clean("/" + virtualPath)
+
+	policy := r.Read
+	if upload {
+		policy = r.Write
+	}
+
+	if !policy.Permits(virtualPath) {
+		return "", "", fmt.Errorf("Access to '%s' is not permitted", virtualPath)
+	}
+
+	root := r.RootFor(virtualPath)
+	if root == nil {
+		return "", "", ErrOutsideRoots
+	}
+
+	directory = ExpandUserPath(root.Directory, u)
+	relative = strings.TrimPrefix(strings.TrimPrefix(virtualPath, root.Mount), "/")
+	return
+}
+
+// RootFor returns the root with the longest mount point that virtualPath
+// falls under, or nil if there isn't one
+func (r *ConfinementRule) RootFor(virtualPath string) (root *VirtualRoot) {
+	virtualPath = path.Clean("/" + virtualPath)
+
+	for i := range r.Roots {
+		mount := r.Roots[i].Mount
+		if mount == "/" || virtualPath == mount || strings.HasPrefix(virtualPath, mount+"/") {
+			if root == nil || len(mount) > len(root.Mount) {
+				root = &r.Roots[i]
+			}
+		}
+	}
+	return
+}
+
+func (r *ConfinementRule) validate() (e error) {
+	if len(r.Users) == 0 && len(r.Groups) == 0 {
+		return errors.New("Confinement rules must list users or groups")
+	}
+
+	if len(r.Roots) == 0 {
+		return errors.New("Confinement rules must have at least one root")
+	}
+
+	mounts := make(map[string]bool)
+	for _, root := range r.Roots {
+		if !path.IsAbs(root.Mount) || path.Clean(root.Mount) != root.Mount {
+			return fmt.Errorf("Invalid mount %q, mounts must be clean absolute paths", root.Mount)
+		}
+
+		if mounts[root.Mount] {
+			return fmt.Errorf("Mount %q is listed twice", root.Mount)
+		}
+		mounts[root.Mount] = true
+
+		if !filepath.IsAbs(root.Directory) && !strings.HasPrefix(root.Directory, "%h") {
+			return fmt.Errorf("Root directory %q must be an absolute path", root.Directory)
+		}
+
+		if e = root.Quota.validate(); e != nil {
+			return
+		}
+	}
+
+	if e = r.Quota.validate(); e != nil {
+		return
+	}
+
+	if e = r.Read.validate(); e != nil {
+		return
+	}
+	return r.Write.validate()
+}
+
+// ConfinementFor returns the first confinement rule that applies to
+// userName or one of groups, nil if none does
+func (c *Config) ConfinementFor(userName string, groups []string) *ConfinementRule {
+	for i := range c.Confinement {
+		if c.Confinement[i].Matches(userName, groups) {
+			return &c.Confinement[i]
+		}
+	}
+	return nil
+}
+
+// UserGroups returns the names of the groups u belongs to
+func UserGroups(u *user.User) (groups []string, e error) {
+	var ids []string
+	if ids, e = u.GroupIds(); e != nil {
+		return
+	}
+
+	for _, id := range ids {
+		if group, err := user.LookupGroupId(id); err == nil {
+			groups = append(groups, group.Name)
+		}
+	}
+	return
+}
+
+// OpenInRoot opens name relative to the directory root one component at a
+// time with openat. Symbolic links are never followed, so a link inside the
+// root can't lead outside of it, and ".." is refused.
+func OpenInRoot(root, name string, flag int, perm os.FileMode) (f *os.File, e error) {
+	var components []string
+	for _, component := range strings.Split(filepath.ToSlash(name), "/") {
+		switch component {
+		case "", ".":
+		case "..":
+			return nil, &os.PathError{Op: "open", Path: name, Err: ErrOutsideRoots}
+		default:
+			components = append(components, component)
+		}
+	}
+
+	var dir *os.File
+	if dir, e = os.OpenFile(root, syscall.O_RDONLY|syscall.O_DIRECTORY, 0); e != nil {
+		return
+	}
+
+	if len(components) == 0 {
+		return dir, nil
+	}
+
+	for _, component := range components[:len(components)-1] {
+		var next *os.File
+		next, e = openat(dir, component, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		dir.Close()
+		if e != nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: symlinkError(e)}
+		}
+		dir = next
+	}
+	defer dir.Close()
+
+	if f, e = openat(dir, components[len(components)-1], flag, perm); e != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: symlinkError(e)}
+	}
+	return
+}
+
+// symlinkError reports the error returned by O_NOFOLLOW for a symbolic link
+// as ErrSymlinkInPath. Directories opened with O_DIRECTORY fail with ENOTDIR
+// instead, which is left as it is.
+func symlinkError(e error) error {
+	if e == syscall.ELOOP {
+		return ErrSymlinkInPath
+	}
+	return e
+}
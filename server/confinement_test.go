@@ -0,0 +1,150 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ConfinementSuite struct {
+	suite.Suite
+	dir  string
+	user *user.User
+	rule ConfinementRule
+}
+
+func (s *ConfinementSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "confinement")
+	s.Require().Nil(err)
+
+	s.user = &user.User{Username: "bob", HomeDir: "/home/bob"}
+	s.rule = ConfinementRule{
+		Users: []string{"bob"},
+		Roots: []VirtualRoot{
+			{Mount: "/", Directory: "%h"},
+			{Mount: "/shared", Directory: "/srv/shared"},
+		},
+		Read:  PathPolicy{Deny: []string{"/.ssh/*"}},
+		Write: PathPolicy{Allow: []string{"/uploads/*"}},
+	}
+}
+
+func (s *ConfinementSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *ConfinementSuite) TestMatches() {
+	s.True(s.rule.Matches("bob", nil))
+	s.False(s.rule.Matches("alice", []string{"staff"}))
+
+	rule := ConfinementRule{Groups: []string{"staff"}}
+	s.True(rule.Matches("alice", []string{"wheel", "staff"}))
+	s.False(rule.Matches("alice", []string{"wheel"}))
+
+	rule = ConfinementRule{Users: []string{"*"}}
+	s.True(rule.Matches("anyone", nil))
+
+	cfg := NewConfig()
+	cfg.Confinement = []ConfinementRule{rule, s.rule}
+	s.Equal(&cfg.Confinement[0], cfg.ConfinementFor("bob", nil))
+}
+
+func (s *ConfinementSuite) TestResolve() {
+	directory, relative, e := s.rule.Resolve(s.user, "docs/report.txt", false)
+	s.Nil(e)
+	s.Equal("/home/bob", directory)
+	s.Equal("docs/report.txt", relative)
+
+	directory, relative, e = s.rule.Resolve(s.user, "/shared/data.csv", false)
+	s.Nil(e)
+	s.Equal("/srv/shared", directory)
+	s.Equal("data.csv", relative)
+
+	// .. can't climb above the virtual root
+	directory, relative, e = s.rule.Resolve(s.user, "/../../etc/passwd", false)
+	s.Nil(e)
+	s.Equal("/home/bob", directory)
+	s.Equal("etc/passwd", relative)
+
+	directory, relative, e = s.rule.Resolve(s.user, "/shared/../sharedx/a", false)
+	s.Nil(e)
+	s.Equal("/home/bob", directory)
+	s.Equal("sharedx/a", relative)
+}
+
+func (s *ConfinementSuite) TestResolvePolicies() {
+	_, _, e := s.rule.Resolve(s.user, "/.ssh/id_rsa", false)
+	s.NotNil(e)
+
+	_, _, e = s.rule.Resolve(s.user, "/docs/report.txt", true)
+	s.NotNil(e)
+
+	_, _, e = s.rule.Resolve(s.user, "/uploads/report.txt", true)
+	s.Nil(e)
+
+	rule := ConfinementRule{Users: []string{"bob"}, Roots: []VirtualRoot{{Mount: "/data", Directory: "/srv/data"}}}
+	_, _, e = rule.Resolve(s.user, "/etc/passwd", false)
+	s.Equal(ErrOutsideRoots, e)
+}
+
+func (s *ConfinementSuite) TestValidate() {
+	s.Nil(s.rule.validate())
+
+	invalid := []ConfinementRule{
+		{Roots: []VirtualRoot{{Mount: "/", Directory: "/srv"}}},
+		{Users: []string{"bob"}},
+		{Users: []string{"bob"}, Roots: []VirtualRoot{{Mount: "data", Directory: "/srv"}}},
+		{Users: []string{"bob"}, Roots: []VirtualRoot{{Mount: "/data/", Directory: "/srv"}}},
+		{Users: []string{"bob"}, Roots: []VirtualRoot{{Mount: "/", Directory: "/a"}, {Mount: "/", Directory: "/b"}}},
+		{Users: []string{"bob"}, Roots: []VirtualRoot{{Mount: "/", Directory: "relative"}}},
+		{Users: []string{"bob"}, Roots: []VirtualRoot{{Mount: "/", Directory: "/srv"}}, Write: PathPolicy{Deny: []string{"["}}},
+	}
+	for _, rule := range invalid {
+		s.NotNil(rule.validate(), "%+v", rule)
+	}
+
+	cfg := NewConfig()
+	cfg.Directory = "/etc/ucp"
+	cfg.Confinement = invalid[:1]
+	s.NotNil(cfg.Validate())
+}
+
+func (s *ConfinementSuite) TestOpenInRoot() {
+	root := filepath.Join(s.dir, "root")
+	s.Require().Nil(os.MkdirAll(filepath.Join(root, "docs"), 0755))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(root, "docs", "report.txt"), []byte("report"), 0644))
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(s.dir, "secret"), []byte("secret"), 0644))
+	s.Require().Nil(os.Symlink(filepath.Join(s.dir, "secret"), filepath.Join(root, "escape")))
+	s.Require().Nil(os.Symlink(s.dir, filepath.Join(root, "outside")))
+
+	f, e := OpenInRoot(root, "/docs/./report.txt", os.O_RDONLY, 0)
+	s.Require().Nil(e)
+	contents, _ := ioutil.ReadAll(f)
+	f.Close()
+	s.Equal("report", string(contents))
+
+	_, e = OpenInRoot(root, "escape", os.O_RDONLY, 0)
+	s.Require().NotNil(e)
+	s.Equal(ErrSymlinkInPath, e.(*os.PathError).Err)
+
+	_, e = OpenInRoot(root, "outside/secret", os.O_RDONLY, 0)
+	s.NotNil(e)
+
+	_, e = OpenInRoot(root, "docs/../../secret", os.O_RDONLY, 0)
+	s.NotNil(e)
+
+	f, e = OpenInRoot(root, "docs/new.txt", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	s.Require().Nil(e)
+	f.Close()
+	_, e = os.Stat(filepath.Join(root, "docs", "new.txt"))
+	s.Nil(e)
+}
+
+func TestConfinement(t *testing.T) {
+	suite.Run(t, new(ConfinementSuite))
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// DefaultHookTimeout bounds a hook that doesn't set its own timeout
+const DefaultHookTimeout = 30 * time.Second
+
+// Transfer directions hooks may be limited to
+const (
+	HookUpload   = "upload"
+	HookDownload = "download"
+)
+
+// HookConfig describes a hook run after each upload or download finishes,
+// whether it succeeded or not. A hook either runs Command, with its
+// arguments, as the user that owns the transferred file, or POSTs to URL.
+// Either way it receives a HookEvent as JSON. Directions and Outcomes
+// limit the transfers a hook runs for, empty lists match every transfer.
+// A hook that runs longer than Timeout is stopped and counts as failed.
+type HookConfig struct {
+	Command    []string `json:"command"`
+	URL        string   `json:"url"`
+	Directions []string `json:"directions"`
+	Outcomes   []string `json:"outcomes"`
+	Timeout    Duration `json:"timeout"`
+}
+
+// Name identifies the hook in the audit log
+func (h *HookConfig) Name() string {
+	if h.URL != "" {
+		return h.URL
+	}
+	return strings.Join(h.Command, " ")
+}
+
+// Matches returns true if the hook runs for a transfer in direction that
+// ended with outcome
+func (h *HookConfig) Matches(direction, outcome string) bool {
+	if direction != HookUpload && direction != HookDownload {
+		return false
+	}
+	return matchesList(h.Directions, direction) && matchesList(h.Outcomes, outcome)
+}
+
+// TimeoutOrDefault returns how long the hook may run
+func (h *HookConfig) TimeoutOrDefault() time.Duration {
+	if h.Timeout.Duration > 0 {
+		return h.Timeout.Duration
+	}
+	return DefaultHookTimeout
+}
+
+func (h *HookConfig) validate() (e error) {
+	if (len(h.Command) == 0) == (h.URL == "") {
+		return errors.New("Hooks must have either a command or a url")
+	}
+
+	if len(h.Command) > 0 && !filepath.IsAbs(h.Command[0]) {
+		return errors.New("Hook commands must be absolute paths")
+	}
+
+	if h.URL != "" {
+		var u *url.URL
+		if u, e = url.Parse(h.URL); e != nil {
+			return
+		}
+		if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("Invalid hook url %q", h.URL)
+		}
+	}
+
+	for _, direction := range h.Directions {
+		if direction != HookUpload && direction != HookDownload {
+			return fmt.Errorf("Invalid hook direction %q", direction)
+		}
+	}
+
+	for _, outcome := range h.Outcomes {
+		if outcome != OutcomeSuccess && outcome != OutcomeFailure {
+			return fmt.Errorf("Invalid hook outcome %q", outcome)
+		}
+	}
+
+	if h.Timeout.Duration < 0 {
+		return errors.New("Timeouts must not be negative")
+	}
+	return
+}
+
+func matchesList(list []string, value string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// HookEvent is what a hook is told about a transfer. Path is the path the
+// client asked for, LocalPath is where the file is on the server, which
+// differs when the user is confined to virtual roots. LocalPath is empty if
+// the transfer was refused before the file was resolved.
+type HookEvent struct {
+	Time           time.Time `json:"time"`
+	SessionID      string    `json:"session_id"`
+	User           string    `json:"user"`
+	Path           string    `json:"path"`
+	LocalPath      string    `json:"local_path,omitempty"`
+	Direction      string    `json:"direction"`
+	Bytes          int64     `json:"bytes"`
+	Hash           string    `json:"sha256"`
+	DurationMillis int64     `json:"duration_ms"`
+	Outcome        string    `json:"outcome"`
+	Error          string    `json:"error,omitempty"`
+}
+
+// NewHookEvent returns the hook event for the audit event that ended a
+// transfer
+func NewHookEvent(event AuditEvent, localPath string) HookEvent {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	return HookEvent{
+		Time:           event.Time.UTC(),
+		SessionID:      event.SessionID,
+		User:           event.User,
+		Path:           event.Path,
+		LocalPath:      localPath,
+		Direction:      event.Direction,
+		Bytes:          event.Bytes,
+		Hash:           event.Hash,
+		DurationMillis: event.DurationMillis,
+		Outcome:        event.Outcome,
+		Error:          event.Error,
+	}
+}
@@ -0,0 +1,195 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrKeyExpired = errors.New("Key has expired")
+var ErrKeySourceDenied = errors.New("Key is not permitted from this address")
+
+// expiryTimeLayouts are the formats accepted by the expiry-time option,
+// interpreted in the server's local time zone as OpenSSH does
+var expiryTimeLayouts = []string{"20060102", "200601021504", "20060102150405"}
+
+// openSSHOptions are OpenSSH options that don't apply to file transfers and
+// are ignored. restrict only turns off forwarding, ptys and the like, which
+// ucp never offers, so it doesn't limit transfers.
+var openSSHOptions = map[string]bool{
+	"agent-forwarding":    true,
+	"no-agent-forwarding": true,
+	"no-port-forwarding":  true,
+	"no-pty":              true,
+	"no-user-rc":          true,
+	"no-x11-forwarding":   true,
+	"port-forwarding":     true,
+	"pty":                 true,
+	"restrict":            true,
+	"user-rc":             true,
+	"x11-forwarding":      true,
+}
+
+// KeyOptions are the restrictions placed on a key by the options field of
+// its authorized_keys entry
+type KeyOptions struct {
+	// From holds the patterns from from="..." the client address must match
+	From []string
+	// Expires is when the key stops being accepted, zero if it doesn't
+	Expires time.Time
+	// PermitPaths holds glob patterns from permit-paths="..." that limit
+	// which files may be transferred
+	PermitPaths []string
+	// ReadOnly is set by no-upload or read-only and prevents files being
+	// written
+	ReadOnly bool
+}
+
+// ParseKeyOptions parses the options of an authorized_keys entry, options
+// are given as returned by ssh.ParseAuthorizedKey. Options that would grant
+// access ucp can't honour, such as command=, are rejected rather than
+// ignored.
+func ParseKeyOptions(options []string) (keyOptions KeyOptions, e error) {
+	for _, option := range options {
+		name, value, hasValue := splitOption(option)
+
+		switch name {
+		case "from":
+			if !hasValue {
+				return keyOptions, fmt.Errorf("Option %q requires a value", name)
+			}
+			keyOptions.From = splitList(value)
+		case "expiry-time":
+			if !hasValue {
+				return keyOptions, fmt.Errorf("Option %q requires a value", name)
+			}
+			if keyOptions.Expires, e = parseExpiryTime(value); e != nil {
+				return
+			}
+		case "permit-paths":
+			if !hasValue {
+				return keyOptions, fmt.Errorf("Option %q requires a value", name)
+			}
+			keyOptions.PermitPaths = splitList(value)
+			for _, pattern := range keyOptions.PermitPaths {
+				if _, e = filepath.Match(pattern, ""); e != nil {
+					return keyOptions, fmt.Errorf("Invalid path pattern %q: %s", pattern, e.Error())
+				}
+			}
+		case "no-upload", "read-only":
+			keyOptions.ReadOnly = true
+		default:
+			if hasValue || !openSSHOptions[name] {
+				return keyOptions, fmt.Errorf("Unsupported key option %q", name)
+			}
+		}
+	}
+
+	return
+}
+
+// splitOption splits name="value" returning the option name in lower case
+// and the unquoted value
+func splitOption(option string) (name, value string, hasValue bool) {
+	i := strings.IndexByte(option, '=')
+	if i == -1 {
+		return strings.ToLower(option), "", false
+	}
+
+	name = strings.ToLower(option[:i])
+	value = option[i+1:]
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = strings.Replace(value[1:len(value)-1], `\"`, `"`, -1)
+	}
+	return name, value, true
+}
+
+func splitList(value string) (items []string) {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return
+}
+
+func parseExpiryTime(value string) (t time.Time, e error) {
+	for _, layout := range expiryTimeLayouts {
+		if len(layout) == len(value) {
+			if t, e = time.ParseInLocation(layout, value, time.Local); e == nil {
+				return
+			}
+		}
+	}
+	return t, fmt.Errorf("Invalid expiry-time %q", value)
+}
+
+// Permits checks that a key may be used from address at time now
+func (o *KeyOptions) Permits(address string, now time.Time) error {
+	if !o.Expires.IsZero() && !now.Before(o.Expires) {
+		return ErrKeyExpired
+	}
+
+	if o.From != nil && !matchesFrom(o.From, address) {
+		return ErrKeySourceDenied
+	}
+
+	return nil
+}
+
+// PermitsPath returns true if the key may be used to transfer path. upload
+// is true if the file is being written.
+func (o *KeyOptions) PermitsPath(path string, upload bool) bool {
+	if upload && o.ReadOnly {
+		return false
+	}
+
+	return o.PermitPaths == nil || matchesAny(o.PermitPaths, filepath.Clean(path))
+}
+
+// matchesFrom matches an address against a from= pattern list. Patterns may
+// be addresses, CIDR blocks or host globs, a pattern starting with ! denies
+// the address even if another pattern matches.
+func matchesFrom(patterns []string, address string) bool {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		if matchesHost(pattern, host, ip) {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+func matchesHost(pattern, host string, ip net.IP) bool {
+	if strings.Contains(pattern, "/") {
+		if _, ipNet, err := net.ParseCIDR(pattern); err == nil {
+			return ipNet.Contains(ip)
+		}
+		return false
+	}
+
+	if patternIP := net.ParseIP(pattern); patternIP != nil {
+		return patternIP.Equal(ip)
+	}
+
+	matched, _ := filepath.Match(pattern, host)
+	return matched
+}
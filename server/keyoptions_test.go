@@ -0,0 +1,76 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type KeyOptionsSuite struct {
+	suite.Suite
+}
+
+func (s *KeyOptionsSuite) TestParseKeyOptions() {
+	options, e := ParseKeyOptions([]string{
+		`from="10.0.0.0/8,!10.0.0.1"`,
+		`expiry-time="20161231"`,
+		`permit-paths="/data/*, /srv/*"`,
+		"no-pty",
+		"read-only",
+	})
+	s.Require().Nil(e)
+	s.Equal([]string{"10.0.0.0/8", "!10.0.0.1"}, options.From)
+	s.Equal(time.Date(2016, time.December, 31, 0, 0, 0, 0, time.Local), options.Expires)
+	s.Equal([]string{"/data/*", "/srv/*"}, options.PermitPaths)
+	s.True(options.ReadOnly)
+
+	options, e = ParseKeyOptions([]string{`expiry-time="201612311530"`})
+	s.Require().Nil(e)
+	s.Equal(time.Date(2016, time.December, 31, 15, 30, 0, 0, time.Local), options.Expires)
+
+	// restrict turns off OpenSSH features, it doesn't stop uploads
+	options, e = ParseKeyOptions([]string{"restrict"})
+	s.Require().Nil(e)
+	s.False(options.ReadOnly)
+}
+
+func (s *KeyOptionsSuite) TestParseKeyOptionsErrors() {
+	for _, option := range []string{`command="/bin/sh"`, "from", `expiry-time="tomorrow"`, `permit-paths="/data/["`, "bogus"} {
+		_, e := ParseKeyOptions([]string{option})
+		s.NotNil(e, option)
+	}
+}
+
+func (s *KeyOptionsSuite) TestPermits() {
+	now := time.Date(2016, time.October, 1, 0, 0, 0, 0, time.Local)
+	options := KeyOptions{}
+	s.Nil(options.Permits(unknownHost, now))
+
+	options.From = []string{"10.0.0.0/8", "!10.0.0.1", "192.168.1.*"}
+	s.Nil(options.Permits("10.1.2.3:4000", now))
+	s.Nil(options.Permits("192.168.1.20:4000", now))
+	s.Equal(ErrKeySourceDenied, options.Permits("10.0.0.1:4000", now))
+	s.Equal(ErrKeySourceDenied, options.Permits("172.16.0.1:4000", now))
+	s.Equal(ErrKeySourceDenied, options.Permits(unknownHost, now))
+
+	options = KeyOptions{Expires: now.Add(time.Hour)}
+	s.Nil(options.Permits(unknownHost, now))
+	s.Equal(ErrKeyExpired, options.Permits(unknownHost, now.Add(time.Hour)))
+}
+
+func (s *KeyOptionsSuite) TestPermitsPath() {
+	options := KeyOptions{}
+	s.True(options.PermitsPath("/etc/passwd", true))
+
+	options = KeyOptions{PermitPaths: []string{"/data/*"}, ReadOnly: true}
+	s.True(options.PermitsPath("/data/file", false))
+	s.False(options.PermitsPath("/data/file", true))
+	s.False(options.PermitsPath("/data/../etc/passwd", false))
+}
+
+const unknownHost = "unknown"
+
+func TestKeyOptionsSuite(t *testing.T) {
+	suite.Run(t, new(KeyOptionsSuite))
+}
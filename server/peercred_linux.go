@@ -0,0 +1,33 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// peerUID returns the user id of the process at the other end of a unix
+// socket
+func peerUID(conn net.Conn) (uid int, e error) {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return -1, errors.New("Peer credentials need a unix socket")
+	}
+
+	var raw syscall.RawConn
+	if raw, e = unixConn.SyscallConn(); e != nil {
+		return -1, e
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	if e = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); e != nil {
+		return -1, e
+	}
+	if credErr != nil {
+		return -1, credErr
+	}
+	return int(cred.Uid), nil
+}
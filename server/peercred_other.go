@@ -0,0 +1,15 @@
+//go:build !linux
+// +build !linux
+
+package server
+
+import (
+	"errors"
+	"net"
+)
+
+// peerUID is only implemented on Linux, elsewhere admin connections are
+// refused
+func peerUID(conn net.Conn) (uid int, e error) {
+	return -1, errors.New("Peer credentials are not supported on this platform")
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+)
+
+// ProxyFD is the descriptor the proxy process inherits its end of the
+// socket pair on, the first of exec.Cmd.ExtraFiles
+const ProxyFD = 3
+
+// ProxyNonceVariable names the environment variable that passes the
+// handshake nonce to the proxy process
+const ProxyNonceVariable = "UCP_PROXY_NONCE"
+
+// proxyNonceSize is the number of random bytes in a handshake nonce
+const proxyNonceSize = 32
+
+var ErrProxyHandshake = errors.New("Proxy process failed the handshake")
+
+// NewProxySocketPair creates a connected pair of unix sockets. The parent
+// keeps conn and passes child to the proxy process in ExtraFiles, so unlike
+// a named socket no other process can connect to it.
+func NewProxySocketPair() (conn net.Conn, child *os.File, e error) {
+	// hold the fork lock until both ends are close on exec so they don't
+	// leak into a process started meanwhile, SOCK_CLOEXEC isn't available
+	// everywhere
+	var fds [2]int
+	syscall.ForkLock.RLock()
+	fds, e = syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if e == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if e != nil {
+		return
+	}
+
+	parent := os.NewFile(uintptr(fds[0]), "proxy-parent")
+	defer parent.Close()
+
+	if conn, e = net.FileConn(parent); e != nil {
+		syscall.Close(fds[1])
+		return
+	}
+
+	return conn, os.NewFile(uintptr(fds[1]), "proxy-child"), nil
+}
+
+// InheritedProxyConn returns the proxy process's end of the socket pair
+// created by NewProxySocketPair
+func InheritedProxyConn() (conn net.Conn, e error) {
+	f := os.NewFile(ProxyFD, "proxy-socket")
+	defer f.Close()
+	return net.FileConn(f)
+}
+
+// NewProxyNonce returns a random nonce the proxy process must send back as
+// its first message
+func NewProxyNonce() (nonce string, e error) {
+	buffer := make([]byte, proxyNonceSize)
+	if _, e = rand.Read(buffer); e != nil {
+		return
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+// CheckProxyNonce compares the nonce sent by the proxy process with the one
+// it was given
+func CheckProxyNonce(expected, received string) error {
+	if len(expected) == 0 || subtle.ConstantTimeCompare([]byte(expected), []byte(received)) != 1 {
+		return ErrProxyHandshake
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ProxySuite struct {
+	suite.Suite
+}
+
+func (s *ProxySuite) TestSocketPair() {
+	conn, child, e := NewProxySocketPair()
+	s.Require().Nil(e)
+	defer conn.Close()
+
+	_, e = child.Write([]byte("hello"))
+	s.Nil(e)
+	child.Close()
+
+	// the pair is closed once the child end is, so the read sees EOF
+	received, e := ioutil.ReadAll(conn)
+	s.Nil(e)
+	s.Equal("hello", string(received))
+}
+
+func (s *ProxySuite) TestNonce() {
+	nonce, e := NewProxyNonce()
+	s.Require().Nil(e)
+	s.Len(nonce, 2*proxyNonceSize)
+
+	other, _ := NewProxyNonce()
+	s.NotEqual(nonce, other)
+
+	s.Nil(CheckProxyNonce(nonce, nonce))
+	s.Equal(ErrProxyHandshake, CheckProxyNonce(nonce, other))
+	s.Equal(ErrProxyHandshake, CheckProxyNonce("", ""))
+}
+
+func TestProxy(t *testing.T) {
+	suite.Run(t, new(ProxySuite))
+}
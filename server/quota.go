@@ -0,0 +1,207 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// Names of the quotas an upload may count against
+const (
+	QuotaUser = "user"
+	QuotaRoot = "root"
+)
+
+// Quota limits the bytes and number of files stored under a set of
+// directories. Limits set to zero are not enforced.
+type Quota struct {
+	MaxBytes int64 `json:"max_bytes"`
+	MaxFiles int64 `json:"max_files"`
+}
+
+// IsSet returns true if the quota has any limits
+func (q Quota) IsSet() bool {
+	return q.MaxBytes > 0 || q.MaxFiles > 0
+}
+
+func (q Quota) validate() error {
+	if q.MaxBytes < 0 || q.MaxFiles < 0 {
+		return errors.New("Quotas must not be negative")
+	}
+	return nil
+}
+
+// Usage is what is stored under the directories a quota applies to
+type Usage struct {
+	Bytes int64
+	Files int64
+}
+
+// Add returns the sum of two usages
+func (u Usage) Add(other Usage) Usage {
+	return Usage{Bytes: u.Bytes + other.Bytes, Files: u.Files + other.Files}
+}
+
+// Sub returns u less other
+func (u Usage) Sub(other Usage) Usage {
+	return Usage{Bytes: u.Bytes - other.Bytes, Files: u.Files - other.Files}
+}
+
+// Check returns an error if adding a file of size bytes, which may be
+// unknown, to usage would exceed the quota. name describes the quota in the
+// error.
+func (q Quota) Check(name string, usage Usage, size int64) error {
+	if q.MaxFiles > 0 && usage.Files+1 > q.MaxFiles {
+		return fmt.Errorf("Upload would exceed the %s quota of %d files", name, q.MaxFiles)
+	}
+
+	return q.CheckBytes(name, usage, size)
+}
+
+// CheckBytes is Check for size more bytes that don't add a file
+func (q Quota) CheckBytes(name string, usage Usage, size int64) error {
+	if size < 0 {
+		size = 0
+	}
+	if q.MaxBytes > 0 && usage.Bytes+size > q.MaxBytes {
+		return fmt.Errorf("Upload would exceed the %s quota of %d bytes", name, q.MaxBytes)
+	}
+	return nil
+}
+
+// UserQuota limits what each user may store under Directories, counting
+// only the files the user owns. %h and %u in Directories are replaced as
+// they are in the directories of virtual roots. It applies to every user,
+// confined or not, on top of the quota of a confinement rule.
+type UserQuota struct {
+	Quota
+	Directories []string `json:"directories"`
+}
+
+func (q *UserQuota) validate() (e error) {
+	if e = q.Quota.validate(); e != nil {
+		return
+	}
+
+	if q.IsSet() && len(q.Directories) == 0 {
+		return errors.New("user_quota must list the directories it applies to")
+	}
+
+	for _, directory := range q.Directories {
+		if !filepath.IsAbs(directory) && !strings.HasPrefix(directory, "%h") {
+			return fmt.Errorf("Quota directory %q must be an absolute path", directory)
+		}
+	}
+	return
+}
+
+// ScopeFor returns the scope of the quota for an upload by u to
+// destination, the path of the file on the server. ok is false if
+// destination isn't under any of the quota's directories.
+func (q *UserQuota) ScopeFor(u *user.User, destination string) (scope QuotaScope, ok bool) {
+	var directories []string
+	for _, directory := range q.Directories {
+		directories = append(directories, ExpandUserPath(directory, u))
+	}
+
+	scope = QuotaScope{
+		Name:        QuotaUser,
+		Quota:       q.Quota,
+		Directories: outermost(directories),
+		Owned:       true,
+	}
+
+	destination = filepath.Clean(destination)
+	for _, directory := range scope.Directories {
+		if directory == "/" || strings.HasPrefix(destination, directory+"/") {
+			ok = true
+		}
+	}
+	return
+}
+
+// QuotaScope is a quota along with the directories whose contents count
+// against it. If Owned is set only files owned by the uploading user count.
+type QuotaScope struct {
+	Name        string
+	Quota       Quota
+	Directories []string
+	Owned       bool
+}
+
+// QuotasFor returns the quotas an upload by u to virtualPath counts
+// against. The user quota covers the files u owns under every root of the
+// rule, the root quota everything under the root virtualPath falls in.
+func (r *ConfinementRule) QuotasFor(u *user.User, virtualPath string) (scopes []QuotaScope) {
+	if r.Quota.IsSet() {
+		var directories []string
+		for _, root := range r.Roots {
+			directories = append(directories, ExpandUserPath(root.Directory, u))
+		}
+		scopes = append(scopes, QuotaScope{
+			Name:        QuotaUser,
+			Quota:       r.Quota,
+			Directories: outermost(directories),
+			Owned:       true,
+		})
+	}
+
+	if root := r.RootFor(virtualPath); root != nil && root.Quota.IsSet() {
+		scopes = append(scopes, QuotaScope{
+			Name:        QuotaRoot,
+			Quota:       root.Quota,
+			Directories: []string{ExpandUserPath(root.Directory, u)},
+		})
+	}
+	return
+}
+
+// outermost drops the directories that are inside another of directories,
+// so nothing is counted twice
+func outermost(directories []string) (result []string) {
+	for i, directory := range directories {
+		directory = filepath.Clean(directory)
+		nested := false
+		for j, other := range directories {
+			other = filepath.Clean(other)
+			if i != j && (strings.HasPrefix(directory, other+"/") || (directory == other && j < i)) {
+				nested = true
+				break
+			}
+		}
+		if !nested {
+			result = append(result, directory)
+		}
+	}
+	return
+}
+
+// DirectoryUsage adds up the regular files under directories, leaving out
+// the paths in exclude. If uid isn't negative only files owned by uid are
+// counted. Directories that don't exist, or can't be read, count as empty.
+func DirectoryUsage(directories []string, exclude []string, uid int) (usage Usage) {
+	excluded := make(map[string]bool)
+	for _, path := range exclude {
+		excluded[filepath.Clean(path)] = true
+	}
+
+	for _, directory := range directories {
+		// a trailing separator follows a root that is a symbolic link
+		filepath.Walk(filepath.Clean(directory)+string(filepath.Separator), func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.Mode().IsRegular() || excluded[path] {
+				return nil
+			}
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok && uid >= 0 && int(stat.Uid) != uid {
+				return nil
+			}
+			usage.Bytes += info.Size()
+			usage.Files++
+			return nil
+		})
+	}
+	return
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type QuotaSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (s *QuotaSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "quota")
+	s.Require().Nil(err)
+}
+
+func (s *QuotaSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *QuotaSuite) write(name string, size int) string {
+	path := filepath.Join(s.dir, name)
+	s.Require().Nil(os.MkdirAll(filepath.Dir(path), 0700))
+	s.Require().Nil(ioutil.WriteFile(path, make([]byte, size), 0600))
+	return path
+}
+
+func (s *QuotaSuite) TestCheck() {
+	quota := Quota{MaxBytes: 100, MaxFiles: 3}
+	s.Nil(quota.Check(QuotaRoot, Usage{Bytes: 50, Files: 2}, 50))
+	s.NotNil(quota.Check(QuotaRoot, Usage{Bytes: 50, Files: 2}, 51))
+	s.NotNil(quota.Check(QuotaRoot, Usage{Bytes: 50, Files: 3}, 0))
+
+	// an upload of unknown size only needs room for another file
+	s.Nil(quota.Check(QuotaRoot, Usage{Bytes: 100, Files: 2}, -1))
+	s.Nil(Quota{}.Check(QuotaUser, Usage{Bytes: 1 << 40, Files: 1 << 20}, 1<<40))
+
+	// more bytes for a file already counted need no room for another file
+	s.Nil(quota.CheckBytes(QuotaRoot, Usage{Bytes: 50, Files: 3}, 50))
+	s.NotNil(quota.CheckBytes(QuotaRoot, Usage{Bytes: 50, Files: 3}, 51))
+}
+
+func (s *QuotaSuite) TestDirectoryUsage() {
+	s.write("a", 10)
+	s.write("sub/b", 20)
+	exclude := s.write("sub/c", 40)
+	s.Require().Nil(os.Symlink(filepath.Join(s.dir, "a"), filepath.Join(s.dir, "link")))
+
+	// a temporary file is only left out when it is given, it may be a
+	// failed upload that was kept
+	temp := s.write("sub/.d"+tempInfix+"0011223344556677", 80)
+
+	s.Equal(Usage{Bytes: 30, Files: 2}, DirectoryUsage([]string{s.dir}, []string{exclude, temp}, -1))
+	s.Equal(Usage{Bytes: 110, Files: 3}, DirectoryUsage([]string{s.dir}, []string{exclude}, -1))
+	s.Equal(Usage{Bytes: 150, Files: 4}, DirectoryUsage([]string{s.dir}, nil, os.Getuid()))
+	s.Equal(Usage{}, DirectoryUsage([]string{s.dir}, nil, os.Getuid()+1))
+	s.Equal(Usage{}, DirectoryUsage([]string{filepath.Join(s.dir, "missing")}, nil, -1))
+
+	// a root that is a symbolic link is followed
+	linked := filepath.Join(s.dir, "linked")
+	s.Require().Nil(os.Symlink(filepath.Join(s.dir, "sub"), linked))
+	s.Equal(Usage{Bytes: 140, Files: 3}, DirectoryUsage([]string{linked}, nil, -1))
+}
+
+func (s *QuotaSuite) TestQuotasFor() {
+	u := &user.User{Username: "bob", HomeDir: "/home/bob"}
+	rule := ConfinementRule{
+		Users: []string{"bob"},
+		Roots: []VirtualRoot{
+			{Mount: "/", Directory: "%h"},
+			{Mount: "/docs", Directory: "%h/docs"},
+			{Mount: "/shared", Directory: "/srv/shared", Quota: Quota{MaxBytes: 1000}},
+		},
+		Quota: Quota{MaxFiles: 10},
+	}
+
+	scopes := rule.QuotasFor(u, "/shared/report.csv")
+	s.Require().Len(scopes, 2)
+	s.Equal(QuotaScope{Name: QuotaUser, Quota: rule.Quota, Directories: []string{"/home/bob", "/srv/shared"}, Owned: true}, scopes[0])
+	s.Equal(QuotaScope{Name: QuotaRoot, Quota: Quota{MaxBytes: 1000}, Directories: []string{"/srv/shared"}}, scopes[1])
+
+	scopes = rule.QuotasFor(u, "/docs/report.csv")
+	s.Require().Len(scopes, 1)
+	s.Equal(QuotaUser, scopes[0].Name)
+
+	rule.Quota = Quota{}
+	s.Empty(rule.QuotasFor(u, "/report.csv"))
+}
+
+func (s *QuotaSuite) TestUserQuota() {
+	u := &user.User{Username: "bob", HomeDir: "/home/bob"}
+	quota := UserQuota{Quota: Quota{MaxBytes: 1000}, Directories: []string{"%h", "/srv/uploads/%u", "%h/docs"}}
+	s.Nil(quota.validate())
+
+	scope, ok := quota.ScopeFor(u, "/srv/uploads/bob/report.csv")
+	s.True(ok)
+	s.Equal(QuotaScope{Name: QuotaUser, Quota: quota.Quota, Directories: []string{"/home/bob", "/srv/uploads/bob"}, Owned: true}, scope)
+
+	_, ok = quota.ScopeFor(u, "/srv/uploads/alice/report.csv")
+	s.False(ok)
+
+	quota.Directories = nil
+	s.NotNil(quota.validate())
+
+	quota.Directories = []string{"uploads"}
+	s.NotNil(quota.validate())
+
+	// directories only matter once there is a limit
+	s.Nil((&UserQuota{}).validate())
+}
+
+func (s *QuotaSuite) TestValidate() {
+	rule := ConfinementRule{
+		Users: []string{"bob"},
+		Roots: []VirtualRoot{{Mount: "/", Directory: "%h", Quota: Quota{MaxBytes: -1}}},
+	}
+	s.NotNil(rule.validate())
+
+	rule.Roots[0].Quota = Quota{}
+	rule.Quota = Quota{MaxFiles: -1}
+	s.NotNil(rule.validate())
+
+	rule.Quota = Quota{MaxFiles: 1}
+	s.Nil(rule.validate())
+}
+
+func TestQuotaSuite(t *testing.T) {
+	suite.Run(t, new(QuotaSuite))
+}
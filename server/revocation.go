@@ -0,0 +1,161 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/murphybytes/ucp/crypto"
+	"golang.org/x/crypto/ssh"
+)
+
+var ErrBinaryKRL = errors.New("Binary KRL files are not supported, use the ssh-keygen -k text format")
+
+// serialRange is an inclusive range of certificate serial numbers
+type serialRange struct {
+	first, last uint64
+}
+
+// RevocationList holds revoked keys and certificates. It is read from the
+// text format accepted by ssh-keygen -k, one entry per line:
+//
+//	serial: 1234        revokes a certificate serial number
+//	serial: 1000-2000   revokes a range of serial numbers
+//	id: backup-key      revokes certificates by key ID
+//	key: ssh-rsa AAA... revokes a key or certificate
+//	sha256: SHA256:...  revokes a key by fingerprint
+//
+// Plain public keys are also accepted and blank lines or lines starting with
+// # are ignored. A nil *RevocationList revokes nothing.
+type RevocationList struct {
+	serials      []serialRange
+	ids          map[string]bool
+	keys         map[string]bool
+	fingerprints map[string]bool
+}
+
+// LoadRevocationList reads a revocation list file
+func LoadRevocationList(path string) (list *RevocationList, e error) {
+	var contents []byte
+	if contents, e = ioutil.ReadFile(path); e != nil {
+		return
+	}
+
+	if list, e = ParseRevocationList(contents); e != nil {
+		e = fmt.Errorf("%s: %s", path, e.Error())
+	}
+	return
+}
+
+// ParseRevocationList parses the contents of a revocation list
+func ParseRevocationList(contents []byte) (list *RevocationList, e error) {
+	if bytes.HasPrefix(contents, []byte("SSHKRL\n")) {
+		return nil, ErrBinaryKRL
+	}
+
+	list = &RevocationList{
+		ids:          make(map[string]bool),
+		keys:         make(map[string]bool),
+		fingerprints: make(map[string]bool),
+	}
+
+	for number, line := range strings.Split(string(contents), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if e = list.add(line); e != nil {
+			return nil, fmt.Errorf("line %d: %s", number+1, e.Error())
+		}
+	}
+
+	return
+}
+
+func (r *RevocationList) add(line string) (e error) {
+	directive, value := "key", line
+	if i := strings.Index(line, ":"); i != -1 && !strings.ContainsAny(line[:i], " \t") {
+		directive = strings.ToLower(line[:i])
+		value = strings.TrimSpace(line[i+1:])
+	}
+
+	switch directive {
+	case "serial":
+		var serials serialRange
+		if serials, e = parseSerialRange(value); e == nil {
+			r.serials = append(r.serials, serials)
+		}
+	case "id":
+		r.ids[value] = true
+	case "key":
+		var key ssh.PublicKey
+		if key, _, _, _, e = ssh.ParseAuthorizedKey([]byte(value)); e == nil {
+			r.keys[string(key.Marshal())] = true
+		}
+	case "sha256":
+		if !strings.HasPrefix(value, "SHA256:") {
+			value = "SHA256:" + value
+		}
+		r.fingerprints[value] = true
+	default:
+		e = fmt.Errorf("Unknown revocation entry %q", directive)
+	}
+
+	return
+}
+
+func parseSerialRange(value string) (serials serialRange, e error) {
+	first, last := value, value
+	if i := strings.Index(value, "-"); i != -1 {
+		first, last = strings.TrimSpace(value[:i]), strings.TrimSpace(value[i+1:])
+	}
+
+	if serials.first, e = strconv.ParseUint(first, 0, 64); e != nil {
+		return
+	}
+	if serials.last, e = strconv.ParseUint(last, 0, 64); e != nil {
+		return
+	}
+
+	if serials.first > serials.last {
+		e = fmt.Errorf("Invalid serial range %q", value)
+	}
+	return
+}
+
+// IsRevoked returns true if key has been revoked. For certificates the
+// serial number, key ID, certified key and signing key are all checked.
+func (r *RevocationList) IsRevoked(key ssh.PublicKey) bool {
+	if r == nil {
+		return false
+	}
+
+	if r.isKeyRevoked(key) {
+		return true
+	}
+
+	cert, ok := key.(*ssh.Certificate)
+	if !ok {
+		return false
+	}
+
+	if r.ids[cert.KeyId] || r.isKeyRevoked(cert.Key) || r.isKeyRevoked(cert.SignatureKey) {
+		return true
+	}
+
+	for _, serials := range r.serials {
+		if cert.Serial >= serials.first && cert.Serial <= serials.last {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (r *RevocationList) isKeyRevoked(key ssh.PublicKey) bool {
+	return r.keys[string(key.Marshal())] || r.fingerprints[crypto.KeyFingerprint(key)]
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"github.com/murphybytes/ucp/crypto"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ssh"
+)
+
+type RevocationSuite struct {
+	suite.Suite
+	key ssh.PublicKey
+}
+
+func (s *RevocationSuite) SetupSuite() {
+	private, err := rsa.GenerateKey(rand.Reader, 1024)
+	s.Require().Nil(err)
+	s.key, err = ssh.NewPublicKey(&private.PublicKey)
+	s.Require().Nil(err)
+}
+
+func (s *RevocationSuite) TestNilListRevokesNothing() {
+	var list *RevocationList
+	s.False(list.IsRevoked(s.key))
+}
+
+func (s *RevocationSuite) TestRevokedKeys() {
+	for _, contents := range []string{
+		string(ssh.MarshalAuthorizedKey(s.key)),
+		"key: " + string(ssh.MarshalAuthorizedKey(s.key)),
+		"# revoked laptop key\nsha256: " + crypto.KeyFingerprint(s.key),
+	} {
+		list, e := ParseRevocationList([]byte(contents))
+		s.Require().Nil(e, contents)
+		s.True(list.IsRevoked(s.key), contents)
+	}
+
+	list, e := ParseRevocationList([]byte("serial: 10\n"))
+	s.Require().Nil(e)
+	s.False(list.IsRevoked(s.key))
+}
+
+func (s *RevocationSuite) TestParseErrors() {
+	for _, contents := range []string{"SSHKRL\n\x00\x00", "serial: 10-1", "serial: ten", "colour: red"} {
+		_, e := ParseRevocationList([]byte(contents))
+		s.NotNil(e, contents)
+	}
+}
+
+func TestRevocationSuite(t *testing.T) {
+	suite.Run(t, new(RevocationSuite))
+}
@@ -8,7 +8,7 @@ const DefaultPort = 8978
 const Success = 0
 const Error = 1
 
-// ErrSocket - Unable to connect to parent process with unix socket
+// ErrSocket - Unable to use the socket inherited from the parent process
 const ErrSocket = 2
 
 const PipeBufferSize = 100000
@@ -0,0 +1,224 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+var ErrDestinationExists = errors.New("Destination file exists")
+var ErrUploadOptions = errors.New("No clobber and backup can't be used together")
+var ErrBackupSuffix = errors.New("Backup suffix must not contain a slash or .ucp-")
+var ErrTempName = errors.New("Hidden names containing .ucp- are kept for the temporary files of uploads")
+
+// tempPrefix and tempInfix make up the names of upload temporary files,
+// which look like .report.csv.ucp-1f2e3d4c5b6a7988
+const (
+	tempPrefix = "."
+	tempInfix  = ".ucp-"
+)
+
+// maxNameLength is the longest file name most file systems accept
+const maxNameLength = 255
+
+// UploadOptions control how an upload is put in place once it has been
+// written. NoClobber refuses to replace an existing file. BackupSuffix, if
+// set, keeps the file being replaced under its name with the suffix added.
+// KeepPartial leaves the temporary file of a failed upload in place rather
+// than removing it. TempName, if set, is the name of the temporary file,
+// which must be one returned by TempName, so the server can tell it apart
+// while the upload is in flight.
+type UploadOptions struct {
+	NoClobber    bool
+	BackupSuffix string
+	KeepPartial  bool
+	TempName     string
+}
+
+// Validate returns an error if the options can't be used together, name
+// a backup outside of the destination's directory or one that looks like
+// a temporary file, or give a temporary file name TempName wouldn't
+func (o UploadOptions) Validate() error {
+	if o.TempName != "" && (!IsTempName(o.TempName) || strings.Contains(o.TempName, "/")) {
+		return ErrTempName
+	}
+	if o.BackupSuffix == "" {
+		return nil
+	}
+	if o.NoClobber {
+		return ErrUploadOptions
+	}
+	if strings.Contains(o.BackupSuffix, "/") || strings.Contains(o.BackupSuffix, tempInfix) {
+		return ErrBackupSuffix
+	}
+	return nil
+}
+
+// upload is a file being written to a temporary file in the directory of
+// its destination, name, which it replaces once it is committed
+type upload struct {
+	dir     *os.File
+	temp    string
+	name    string
+	options UploadOptions
+}
+
+// createUpload opens the directory path is to be written to, relative to
+// root if root is set, and creates a temporary file in it that is renamed
+// to path when the upload is committed. path may not look like a temporary
+// file itself.
+func createUpload(root, path string, mode os.FileMode, options UploadOptions) (f *os.File, u *upload, e error) {
+	if e = options.Validate(); e != nil {
+		return
+	}
+
+	dirName, name := filepath.Split(path)
+	if name == "" || name == "." || name == ".." {
+		return nil, nil, &os.PathError{Op: "open", Path: path, Err: errors.New("is a directory")}
+	}
+	if IsTempName(name) {
+		return nil, nil, &os.PathError{Op: "open", Path: path, Err: ErrTempName}
+	}
+
+	var dir *os.File
+	if root != "" {
+		dir, e = OpenInRoot(root, dirName, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	} else {
+		if dirName == "" {
+			dirName = "."
+		}
+		dir, e = os.OpenFile(dirName, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	}
+	if e != nil {
+		return
+	}
+
+	u = &upload{dir: dir, name: name, options: options}
+	if f, e = u.create(root != "", mode); e != nil {
+		dir.Close()
+		if e != ErrDestinationExists {
+			e = &os.PathError{Op: "open", Path: path, Err: e}
+		}
+		return nil, nil, e
+	}
+	return
+}
+
+// create checks the destination and creates the temporary file. The check
+// for an existing file only saves sending an upload that will be refused,
+// it is repeated when the upload is committed. An existing file's
+// permissions are kept, as they were when uploads truncated it.
+func (u *upload) create(confined bool, mode os.FileMode) (f *os.File, e error) {
+	var keepMode bool
+	if existing, err := os.Lstat(filepath.Join(u.dir.Name(), u.name)); err == nil {
+		switch {
+		case existing.IsDir():
+			return nil, errors.New("is a directory")
+		case existing.Mode()&os.ModeSymlink != 0 && confined:
+			return nil, ErrSymlinkInPath
+		case u.options.NoClobber:
+			return nil, ErrDestinationExists
+		case existing.Mode().IsRegular():
+			mode, keepMode = existing.Mode().Perm(), true
+		}
+	}
+
+	if u.temp = u.options.TempName; u.temp == "" {
+		u.temp = TempName(u.name)
+	}
+	if f, e = openat(u.dir, u.temp, syscall.O_WRONLY|syscall.O_CREAT|syscall.O_EXCL, mode); e != nil {
+		return
+	}
+
+	if keepMode {
+		// the mode of the file being replaced isn't subject to the umask
+		if e = f.Chmod(mode); e != nil {
+			f.Close()
+			u.remove()
+			return nil, e
+		}
+	}
+	return
+}
+
+// commit syncs and closes f, the temporary file, and installs it under its
+// destination name. The directory is synced so the rename survives a crash.
+func (u *upload) commit(f *os.File) (e error) {
+	defer u.dir.Close()
+
+	if e = f.Sync(); e != nil {
+		f.Close()
+		u.abort()
+		return
+	}
+	if e = f.Close(); e != nil {
+		u.abort()
+		return
+	}
+
+	if e = u.install(); e != nil {
+		u.abort()
+		return
+	}
+	return u.dir.Sync()
+}
+
+func (u *upload) install() (e error) {
+	if u.options.NoClobber {
+		// a link fails if the destination has appeared since the upload
+		// started, unlike a rename
+		if e = linkat(u.dir, u.temp, u.name); e == syscall.EEXIST {
+			return ErrDestinationExists
+		} else if e != nil {
+			return
+		}
+		return u.remove()
+	}
+
+	if u.options.BackupSuffix != "" {
+		backup := u.name + u.options.BackupSuffix
+		if e = unlinkat(u.dir, backup); e != nil && e != syscall.ENOENT {
+			return
+		}
+		if e = linkat(u.dir, u.name, backup); e != nil && e != syscall.ENOENT {
+			return
+		}
+	}
+
+	return renameat(u.dir, u.temp, u.name)
+}
+
+// abort gives up on an upload, its temporary file is removed unless the
+// options ask for it to be kept
+func (u *upload) abort() {
+	if !u.options.KeepPartial {
+		u.remove()
+	}
+}
+
+func (u *upload) remove() error {
+	return unlinkat(u.dir, u.temp)
+}
+
+// IsTempName returns true if name looks like that of an upload's temporary
+// file
+func IsTempName(name string) bool {
+	return strings.HasPrefix(name, tempPrefix) && strings.Contains(name, tempInfix)
+}
+
+// TempName returns a hidden name for the temporary file of an upload to
+// name, shortening name if need be so the result is a valid file name
+func TempName(name string) string {
+	buffer := make([]byte, 8)
+	rand.Read(buffer)
+	suffix := tempInfix + hex.EncodeToString(buffer)
+
+	if max := maxNameLength - len(tempPrefix) - len(suffix); len(name) > max {
+		name = name[:max]
+	}
+	return tempPrefix + name + suffix
+}
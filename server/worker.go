@@ -0,0 +1,393 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/rpc"
+	"os"
+	"sync"
+
+	"github.com/murphybytes/ucp/wire"
+)
+
+// workerService is the name the worker registers its RPC service under
+const workerService = "Worker"
+
+var ErrUnknownHandle = errors.New("Unknown file handle")
+var ErrTooManyFiles = errors.New("Too many open files")
+var ErrNotUpload = errors.New("File was not opened for writing")
+
+// workerErrors are the errors that callers of the worker may need to tell
+// apart, the RPC package only carries their text
+var workerErrors = []error{ErrUnknownHandle, ErrTooManyFiles, ErrNotUpload, ErrDestinationExists}
+
+// maxWorkerFiles limits the files a session may hold open in its worker
+const maxWorkerFiles = 16
+
+// maxWorkerRead limits the bytes returned by a single Read call
+const maxWorkerRead = 1 << 20
+
+// HelloArgs and the types below are the arguments and replies of the worker
+// RPC methods
+type HelloArgs struct{}
+
+type HelloReply struct {
+	Nonce string
+}
+
+// OpenArgs opens Path, relative to Root if Root is set. Files opened for
+// writing are written to a temporary file, created with Mode before the
+// worker's umask is applied, that replaces Path when it is committed.
+type OpenArgs struct {
+	Root  string
+	Path  string
+	Write bool
+	Mode  os.FileMode
+	UploadOptions
+}
+
+// OpenReply holds the handle of an opened file and its size, which is
+// wire.UnknownSize for pipes and devices
+type OpenReply struct {
+	Handle int
+	Size   int64
+}
+
+type ReadArgs struct {
+	Handle int
+	Size   int
+}
+
+// ReadReply holds the bytes read, EOF is set once the end of the file has
+// been reached
+type ReadReply struct {
+	Data []byte
+	EOF  bool
+}
+
+type WriteArgs struct {
+	Handle int
+	Data   []byte
+}
+
+type WriteReply struct{}
+
+type CloseArgs struct {
+	Handle int
+}
+
+type CloseReply struct{}
+
+// UsageArgs asks for the usage of Directories, leaving out the paths in
+// Exclude. Owned only counts the files owned by the worker's user.
+type UsageArgs struct {
+	Directories []string
+	Exclude     []string
+	Owned       bool
+}
+
+type UsageReply struct {
+	Usage Usage
+}
+
+type CommitArgs struct {
+	Handle int
+}
+
+type CommitReply struct{}
+
+// Worker performs file operations for a session. It runs in a process that
+// has dropped privileges to those of the authenticated user, so the network
+// facing server never opens user files itself.
+type Worker struct {
+	nonce string
+
+	mu      sync.Mutex
+	files   map[int]*os.File
+	uploads map[int]*upload
+	handles int
+}
+
+// NewWorker returns a worker that answers Hello with nonce
+func NewWorker(nonce string) *Worker {
+	return &Worker{
+		nonce:   nonce,
+		files:   make(map[int]*os.File),
+		uploads: make(map[int]*upload),
+	}
+}
+
+// ServeWorker serves worker RPC requests on conn until it is closed, then
+// closes any files left open
+func ServeWorker(worker *Worker, conn io.ReadWriteCloser) (e error) {
+	server := rpc.NewServer()
+	if e = server.RegisterName(workerService, worker); e != nil {
+		return
+	}
+	server.ServeConn(conn)
+	worker.closeAll()
+	return
+}
+
+// Hello returns the nonce the worker was started with so the parent knows
+// it is talking to the process it started
+func (w *Worker) Hello(args HelloArgs, reply *HelloReply) error {
+	reply.Nonce = w.nonce
+	return nil
+}
+
+// Open opens a file and returns a handle for it along with its size. A
+// file opened for writing is a new temporary file, so its size is zero.
+func (w *Worker) Open(args OpenArgs, reply *OpenReply) (e error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.files) >= maxWorkerFiles {
+		return ErrTooManyFiles
+	}
+
+	var f *os.File
+	var u *upload
+	switch {
+	case args.Write:
+		f, u, e = createUpload(args.Root, args.Path, args.Mode, args.UploadOptions)
+	case args.Root != "":
+		f, e = OpenInRoot(args.Root, args.Path, os.O_RDONLY, 0)
+	default:
+		f, e = os.Open(args.Path)
+	}
+	if e != nil {
+		return
+	}
+
+	var info os.FileInfo
+	if info, e = f.Stat(); e != nil {
+		f.Close()
+		if u != nil {
+			u.abort()
+			u.dir.Close()
+		}
+		return
+	}
+
+	if info.IsDir() {
+		f.Close()
+		return &os.PathError{Op: "open", Path: args.Path, Err: errors.New("is a directory")}
+	}
+
+	w.handles++
+	w.files[w.handles] = f
+	if u != nil {
+		w.uploads[w.handles] = u
+	}
+	reply.Handle, reply.Size = w.handles, info.Size()
+	if !info.Mode().IsRegular() {
+		reply.Size = wire.UnknownSize
+	}
+	return
+}
+
+// Read reads up to Size bytes from an open file
+func (w *Worker) Read(args ReadArgs, reply *ReadReply) (e error) {
+	var f *os.File
+	if f, e = w.file(args.Handle); e != nil {
+		return
+	}
+
+	size := args.Size
+	if size <= 0 || size > maxWorkerRead {
+		size = maxWorkerRead
+	}
+
+	buffer := make([]byte, size)
+	var read int
+	read, e = io.ReadFull(f, buffer)
+	if e == io.EOF || e == io.ErrUnexpectedEOF {
+		reply.EOF, e = true, nil
+	}
+	reply.Data = buffer[:read]
+	return
+}
+
+// Write writes Data to an open file
+func (w *Worker) Write(args WriteArgs, reply *WriteReply) (e error) {
+	var f *os.File
+	if f, e = w.file(args.Handle); e != nil {
+		return
+	}
+	_, e = f.Write(args.Data)
+	return
+}
+
+// Close closes an open file. Closing a file opened for writing abandons
+// the upload, leaving the destination as it was.
+func (w *Worker) Close(args CloseArgs, reply *CloseReply) (e error) {
+	f, u, ok := w.remove(args.Handle)
+	if !ok {
+		return ErrUnknownHandle
+	}
+
+	e = f.Close()
+	if u != nil {
+		u.abort()
+		u.dir.Close()
+	}
+	return
+}
+
+// Commit closes a file opened for writing and puts it in place of the file
+// it was opened for. The data is synced first so a successful Commit means
+// it is on disk.
+func (w *Worker) Commit(args CommitArgs, reply *CommitReply) (e error) {
+	f, u, ok := w.remove(args.Handle)
+	if !ok {
+		return ErrUnknownHandle
+	}
+
+	if u == nil {
+		f.Close()
+		return ErrNotUpload
+	}
+	return u.commit(f)
+}
+
+// Usage adds up the files under a set of directories so quotas can be
+// checked
+func (w *Worker) Usage(args UsageArgs, reply *UsageReply) error {
+	uid := -1
+	if args.Owned {
+		uid = os.Getuid()
+	}
+	reply.Usage = DirectoryUsage(args.Directories, args.Exclude, uid)
+	return nil
+}
+
+// remove forgets handle, returning its file and the upload it belongs to if
+// it was opened for writing
+func (w *Worker) remove(handle int) (f *os.File, u *upload, ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if f, ok = w.files[handle]; ok {
+		u = w.uploads[handle]
+		delete(w.files, handle)
+		delete(w.uploads, handle)
+	}
+	return
+}
+
+func (w *Worker) file(handle int) (f *os.File, e error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var ok bool
+	if f, ok = w.files[handle]; !ok {
+		e = ErrUnknownHandle
+	}
+	return
+}
+
+func (w *Worker) closeAll() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for handle, f := range w.files {
+		f.Close()
+		if u, ok := w.uploads[handle]; ok {
+			u.abort()
+			u.dir.Close()
+		}
+		delete(w.files, handle)
+		delete(w.uploads, handle)
+	}
+}
+
+// WorkerClient calls the RPC methods of a session's worker
+type WorkerClient struct {
+	client *rpc.Client
+}
+
+// NewWorkerClient returns a client for the worker at the other end of conn
+func NewWorkerClient(conn io.ReadWriteCloser) *WorkerClient {
+	return &WorkerClient{client: rpc.NewClient(conn)}
+}
+
+// Hello returns the nonce the worker was started with
+func (c *WorkerClient) Hello() (nonce string, e error) {
+	var reply HelloReply
+	e = c.call("Hello", HelloArgs{}, &reply)
+	return reply.Nonce, e
+}
+
+// OpenRead opens path, relative to root if root is set, for reading
+func (c *WorkerClient) OpenRead(root, path string) (handle int, size int64, e error) {
+	var reply OpenReply
+	e = c.call("Open", OpenArgs{Root: root, Path: path}, &reply)
+	return reply.Handle, reply.Size, e
+}
+
+// OpenWrite starts an upload to path, relative to root if root is set. The
+// file isn't written until it is committed.
+func (c *WorkerClient) OpenWrite(root, path string, mode os.FileMode, options UploadOptions) (handle int, e error) {
+	var reply OpenReply
+	args := OpenArgs{Root: root, Path: path, Write: true, Mode: mode, UploadOptions: options}
+	e = c.call("Open", args, &reply)
+	return reply.Handle, e
+}
+
+// Read reads up to size bytes, eof is set once the end of the file is
+// reached
+func (c *WorkerClient) Read(handle, size int) (data []byte, eof bool, e error) {
+	var reply ReadReply
+	e = c.call("Read", ReadArgs{Handle: handle, Size: size}, &reply)
+	return reply.Data, reply.EOF, e
+}
+
+// Write writes data to an open file
+func (c *WorkerClient) Write(handle int, data []byte) error {
+	return c.call("Write", WriteArgs{Handle: handle, Data: data}, &WriteReply{})
+}
+
+// CloseFile closes an open file, abandoning it if it was opened for writing
+func (c *WorkerClient) CloseFile(handle int) error {
+	return c.call("Close", CloseArgs{Handle: handle}, &CloseReply{})
+}
+
+// Commit closes a file opened for writing and puts it in place
+func (c *WorkerClient) Commit(handle int) error {
+	return c.call("Commit", CommitArgs{Handle: handle}, &CommitReply{})
+}
+
+// Usage adds up the files under directories, leaving out the paths in
+// exclude. owned only counts the files owned by the worker's user.
+func (c *WorkerClient) Usage(directories []string, exclude []string, owned bool) (usage Usage, e error) {
+	var reply UsageReply
+	e = c.call("Usage", UsageArgs{Directories: directories, Exclude: exclude, Owned: owned}, &reply)
+	return reply.Usage, e
+}
+
+// Close closes the connection to the worker, which then exits
+func (c *WorkerClient) Close() error {
+	return c.client.Close()
+}
+
+func (c *WorkerClient) call(method string, args interface{}, reply interface{}) (e error) {
+	if e = c.client.Call(workerService+"."+method, args, reply); e != nil {
+		// errors from the worker arrive as text
+		if serverError, ok := e.(rpc.ServerError); ok {
+			e = workerError(string(serverError))
+		}
+	}
+	return
+}
+
+// workerError returns the error the worker sent as text, which is one of
+// workerErrors if it matches
+func workerError(text string) error {
+	for _, e := range workerErrors {
+		if e.Error() == text {
+			return e
+		}
+	}
+	return errors.New(text)
+}
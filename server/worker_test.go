@@ -0,0 +1,262 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type WorkerSuite struct {
+	suite.Suite
+	dir    string
+	client *WorkerClient
+	done   chan error
+}
+
+func (s *WorkerSuite) SetupTest() {
+	var e error
+	s.dir, e = ioutil.TempDir("", "worker")
+	s.Require().Nil(e)
+
+	parent, child := net.Pipe()
+	s.done = make(chan error, 1)
+	go func() {
+		s.done <- ServeWorker(NewWorker("nonce"), child)
+	}()
+	s.client = NewWorkerClient(parent)
+}
+
+func (s *WorkerSuite) TearDownTest() {
+	s.client.Close()
+	s.Nil(<-s.done)
+	os.RemoveAll(s.dir)
+}
+
+func (s *WorkerSuite) TestHello() {
+	nonce, e := s.client.Hello()
+	s.Nil(e)
+	s.Equal("nonce", nonce)
+}
+
+func (s *WorkerSuite) TestWriteThenRead() {
+	handle, e := s.client.OpenWrite(s.dir, "file", 0640, UploadOptions{})
+	s.Require().Nil(e)
+	s.Nil(s.client.Write(handle, []byte("some file ")))
+	s.Nil(s.client.Write(handle, []byte("contents")))
+	s.Nil(s.client.Commit(handle))
+
+	info, e := os.Stat(filepath.Join(s.dir, "file"))
+	s.Require().Nil(e)
+	s.Equal(os.FileMode(0640), info.Mode().Perm()&0640)
+
+	handle, size, e := s.client.OpenRead(s.dir, "file")
+	s.Require().Nil(e)
+	s.Equal(int64(len("some file contents")), size)
+
+	data, eof, e := s.client.Read(handle, 10)
+	s.Nil(e)
+	s.False(eof)
+	s.Equal("some file ", string(data))
+
+	data, eof, e = s.client.Read(handle, 10)
+	s.Nil(e)
+	s.True(eof)
+	s.Equal("contents", string(data))
+	s.Nil(s.client.CloseFile(handle))
+}
+
+func (s *WorkerSuite) TestOpenOutsideRoot() {
+	_, _, e := s.client.OpenRead(s.dir, "../etc/passwd")
+	s.NotNil(e)
+}
+
+func (s *WorkerSuite) TestOpenDirectory() {
+	_, _, e := s.client.OpenRead("", s.dir)
+	s.NotNil(e)
+}
+
+func (s *WorkerSuite) TestUnknownHandle() {
+	e := s.client.Write(42, []byte("data"))
+	s.Require().NotNil(e)
+	s.Equal(ErrUnknownHandle.Error(), e.Error())
+	s.NotNil(s.client.CloseFile(42))
+}
+
+func (s *WorkerSuite) TestTooManyFiles() {
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(s.dir, "file"), []byte("x"), 0600))
+	for i := 0; i < maxWorkerFiles; i++ {
+		_, _, e := s.client.OpenRead(s.dir, "file")
+		s.Require().Nil(e)
+	}
+	_, _, e := s.client.OpenRead(s.dir, "file")
+	s.Require().NotNil(e)
+	s.Equal(ErrTooManyFiles.Error(), e.Error())
+}
+
+// upload writes contents to name in s.dir with options and commits it
+func (s *WorkerSuite) upload(name, contents string, options UploadOptions) error {
+	handle, e := s.client.OpenWrite(s.dir, name, 0600, options)
+	if e != nil {
+		return e
+	}
+	s.Nil(s.client.Write(handle, []byte(contents)))
+	return s.client.Commit(handle)
+}
+
+// dirNames returns the names of the files in s.dir
+func (s *WorkerSuite) dirNames() (names []string) {
+	entries, e := ioutil.ReadDir(s.dir)
+	s.Require().Nil(e)
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	return
+}
+
+func (s *WorkerSuite) TestUploadNotVisibleUntilCommitted() {
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(s.dir, "file"), []byte("old"), 0640))
+
+	handle, e := s.client.OpenWrite(s.dir, "file", 0600, UploadOptions{})
+	s.Require().Nil(e)
+	s.Nil(s.client.Write(handle, []byte("new contents")))
+
+	contents, e := ioutil.ReadFile(filepath.Join(s.dir, "file"))
+	s.Nil(e)
+	s.Equal("old", string(contents))
+	s.Len(s.dirNames(), 2)
+
+	s.Nil(s.client.Commit(handle))
+	contents, e = ioutil.ReadFile(filepath.Join(s.dir, "file"))
+	s.Nil(e)
+	s.Equal("new contents", string(contents))
+	s.Equal([]string{"file"}, s.dirNames())
+
+	// the replaced file's permissions are kept
+	info, e := os.Stat(filepath.Join(s.dir, "file"))
+	s.Require().Nil(e)
+	s.Equal(os.FileMode(0640), info.Mode().Perm())
+}
+
+func (s *WorkerSuite) TestAbandonedUploadRemoved() {
+	handle, e := s.client.OpenWrite(s.dir, "file", 0600, UploadOptions{})
+	s.Require().Nil(e)
+	s.Nil(s.client.Write(handle, []byte("partial")))
+	s.Nil(s.client.CloseFile(handle))
+	s.Empty(s.dirNames())
+}
+
+func (s *WorkerSuite) TestAbandonedUploadKept() {
+	handle, e := s.client.OpenWrite(s.dir, "file", 0600, UploadOptions{KeepPartial: true})
+	s.Require().Nil(e)
+	s.Nil(s.client.Write(handle, []byte("partial")))
+	s.Nil(s.client.CloseFile(handle))
+
+	names := s.dirNames()
+	s.Require().Len(names, 1)
+	s.True(strings.HasPrefix(names[0], ".file.ucp-"))
+	contents, e := ioutil.ReadFile(filepath.Join(s.dir, names[0]))
+	s.Nil(e)
+	s.Equal("partial", string(contents))
+}
+
+func (s *WorkerSuite) TestUploadsAbandonedWhenWorkerExits() {
+	handle, e := s.client.OpenWrite(s.dir, "file", 0600, UploadOptions{})
+	s.Require().Nil(e)
+	s.Nil(s.client.Write(handle, []byte("partial")))
+
+	s.client.Close()
+	s.Nil(<-s.done)
+	s.Empty(s.dirNames())
+
+	// TearDownTest expects a worker to stop
+	s.done <- nil
+}
+
+func (s *WorkerSuite) TestNoClobber() {
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(s.dir, "file"), []byte("old"), 0600))
+	s.Equal(ErrDestinationExists, s.upload("file", "new", UploadOptions{NoClobber: true}))
+	s.Nil(s.upload("other", "new", UploadOptions{NoClobber: true}))
+
+	// the destination may appear while the upload is written
+	handle, e := s.client.OpenWrite(s.dir, "late", 0600, UploadOptions{NoClobber: true})
+	s.Require().Nil(e)
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(s.dir, "late"), []byte("old"), 0600))
+	s.Equal(ErrDestinationExists, s.client.Commit(handle))
+
+	contents, e := ioutil.ReadFile(filepath.Join(s.dir, "late"))
+	s.Nil(e)
+	s.Equal("old", string(contents))
+	s.Equal([]string{"file", "late", "other"}, s.dirNames())
+}
+
+func (s *WorkerSuite) TestBackup() {
+	s.Nil(s.upload("file", "first", UploadOptions{BackupSuffix: "~"}))
+	s.Equal([]string{"file"}, s.dirNames())
+
+	s.Nil(s.upload("file", "second", UploadOptions{BackupSuffix: "~"}))
+	s.Nil(s.upload("file", "third", UploadOptions{BackupSuffix: "~"}))
+
+	contents, e := ioutil.ReadFile(filepath.Join(s.dir, "file"))
+	s.Nil(e)
+	s.Equal("third", string(contents))
+	contents, e = ioutil.ReadFile(filepath.Join(s.dir, "file~"))
+	s.Nil(e)
+	s.Equal("second", string(contents))
+}
+
+func (s *WorkerSuite) TestInvalidUploadOptions() {
+	s.NotNil(s.upload("file", "data", UploadOptions{BackupSuffix: "/../x"}))
+	s.NotNil(s.upload("file", "data", UploadOptions{BackupSuffix: "~", NoClobber: true}))
+	s.NotNil(s.upload("file", "data", UploadOptions{BackupSuffix: tempInfix + "1"}))
+	s.NotNil(s.upload("file", "data", UploadOptions{TempName: "file.tmp"}))
+	s.NotNil(s.upload("file", "data", UploadOptions{TempName: "sub/.file" + tempInfix + "1"}))
+	s.Empty(s.dirNames())
+}
+
+func (s *WorkerSuite) TestUploadToDirectory() {
+	s.Require().Nil(os.Mkdir(filepath.Join(s.dir, "sub"), 0700))
+	s.NotNil(s.upload("sub", "data", UploadOptions{}))
+	s.NotNil(s.upload("sub/", "data", UploadOptions{}))
+	s.Nil(s.upload("sub/file", "data", UploadOptions{}))
+}
+
+func (s *WorkerSuite) TestUploadToTempName() {
+	s.NotNil(s.upload(".file"+tempInfix+"1", "data", UploadOptions{}))
+	s.Nil(s.upload("file"+tempInfix+"1", "data", UploadOptions{}))
+}
+
+func (s *WorkerSuite) TestGivenTempName() {
+	temp := TempName("file")
+	handle, e := s.client.OpenWrite(s.dir, "file", 0600, UploadOptions{TempName: temp})
+	s.Require().Nil(e)
+	s.Equal([]string{temp}, s.dirNames())
+
+	s.Nil(s.client.Commit(handle))
+	s.Equal([]string{"file"}, s.dirNames())
+}
+
+func (s *WorkerSuite) TestCommitReadFile() {
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(s.dir, "file"), []byte("x"), 0600))
+	handle, _, e := s.client.OpenRead(s.dir, "file")
+	s.Require().Nil(e)
+	s.Equal(ErrNotUpload, s.client.Commit(handle))
+}
+
+func TestTempName(t *testing.T) {
+	name := TempName(strings.Repeat("x", maxNameLength))
+	if len(name) != maxNameLength {
+		t.Errorf("Expected a name of %d bytes, got %d", maxNameLength, len(name))
+	}
+	if TempName("file") == TempName("file") {
+		t.Error("Expected temporary names to differ")
+	}
+}
+
+func TestWorker(t *testing.T) {
+	suite.Run(t, new(WorkerSuite))
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/murphybytes/ucp/server"
+)
+
+const errorCode = 1
+const successCode = 0
+const usageCode = 2
+
+var socketPath string
+
+func init() {
+	flag.StringVar(&socketPath, "socket", server.DefaultAdminSocket, "Path to the server's admin socket")
+	flag.Usage = usage
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s [-socket path] command
+
+Commands:
+  list          List active sessions
+  dump ID       Show everything known about a session
+  kill ID       Close a session and stop its transfer
+  drain         Stop accepting connections and shut down once sessions finish
+  reload        Reload the server configuration
+
+`, os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Parse()
+	args := flag.Args()
+
+	if len(args) == 0 {
+		usage()
+		os.Exit(usageCode)
+	}
+
+	command, args := args[0], args[1:]
+	expected := 0
+	if command == "dump" || command == "kill" {
+		expected = 1
+	}
+	if len(args) != expected {
+		usage()
+		os.Exit(usageCode)
+	}
+
+	client, err := server.DialAdmin(socketPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to connect to server: ", err)
+		os.Exit(errorCode)
+	}
+
+	err = run(client, os.Stdout, command, args)
+	client.Close()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(errorCode)
+	}
+
+	os.Exit(successCode)
+}
+
+// admin is the part of the admin client used by ucpctl
+type admin interface {
+	List() ([]server.AdminSession, error)
+	Dump(id string) (server.AdminSession, error)
+	Kill(id string) error
+	Drain() error
+	Reload() error
+}
+
+func run(client admin, out io.Writer, command string, args []string) (e error) {
+	switch command {
+	case "list":
+		var sessions []server.AdminSession
+		if sessions, e = client.List(); e == nil {
+			printSessions(out, sessions)
+		}
+	case "dump":
+		var session server.AdminSession
+		if session, e = client.Dump(args[0]); e == nil {
+			encoder := json.NewEncoder(out)
+			encoder.SetIndent("", "  ")
+			e = encoder.Encode(session)
+		}
+	case "kill":
+		if e = client.Kill(args[0]); e == nil {
+			fmt.Fprintln(out, "Killed session", args[0])
+		}
+	case "drain":
+		if e = client.Drain(); e == nil {
+			fmt.Fprintln(out, "Server is draining")
+		}
+	case "reload":
+		if e = client.Reload(); e == nil {
+			fmt.Fprintln(out, "Configuration reloaded")
+		}
+	default:
+		e = fmt.Errorf("Unknown command %q", command)
+	}
+	return
+}
+
+func printSessions(out io.Writer, sessions []server.AdminSession) {
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSER\tREMOTE\tSTATE\tPATH\tBYTES\tRATE\tAGE")
+	for _, s := range sessions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			s.ID, orDash(s.User), s.RemoteAddress, s.State, orDash(s.Path), s.Bytes, formatRate(s.Rate), s.Age.Truncate(time.Second))
+	}
+	w.Flush()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// formatRate formats a rate in bytes per second
+func formatRate(rate float64) string {
+	if rate == 0 {
+		return "-"
+	}
+
+	units := []string{"B/s", "KB/s", "MB/s", "GB/s"}
+	unit := 0
+	for rate >= 1024 && unit < len(units)-1 {
+		rate /= 1024
+		unit++
+	}
+	return fmt.Sprintf("%.1f %s", rate, units[unit])
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/murphybytes/ucp/server"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type MockAdmin struct {
+	mock.Mock
+}
+
+func (m *MockAdmin) List() ([]server.AdminSession, error) {
+	args := m.Called()
+	return args.Get(0).([]server.AdminSession), args.Error(1)
+}
+
+func (m *MockAdmin) Dump(id string) (server.AdminSession, error) {
+	args := m.Called(id)
+	return args.Get(0).(server.AdminSession), args.Error(1)
+}
+
+func (m *MockAdmin) Kill(id string) error {
+	return m.Called(id).Error(0)
+}
+
+func (m *MockAdmin) Drain() error {
+	return m.Called().Error(0)
+}
+
+func (m *MockAdmin) Reload() error {
+	return m.Called().Error(0)
+}
+
+type CtlTestSuite struct {
+	suite.Suite
+	admin *MockAdmin
+	out   bytes.Buffer
+}
+
+func (s *CtlTestSuite) SetupTest() {
+	s.admin = new(MockAdmin)
+	s.out.Reset()
+}
+
+func (s *CtlTestSuite) TestList() {
+	s.admin.On("List").Return([]server.AdminSession{{
+		ID:            "abc123",
+		User:          "bob",
+		RemoteAddress: "10.0.0.1:5000",
+		State:         "transferring",
+		Path:          "/data/file",
+		Bytes:         2048,
+		Rate:          2048,
+		Age:           90 * time.Second,
+	}}, nil)
+
+	s.Nil(run(s.admin, &s.out, "list", nil))
+	lines := strings.Split(strings.TrimSpace(s.out.String()), "\n")
+	s.Require().Len(lines, 2)
+	s.True(strings.HasPrefix(lines[0], "ID"))
+	s.Equal([]string{"abc123", "bob", "10.0.0.1:5000", "transferring", "/data/file", "2048", "2.0", "KB/s", "1m30s"}, strings.Fields(lines[1]))
+}
+
+func (s *CtlTestSuite) TestKill() {
+	s.admin.On("Kill", "abc123").Return(nil)
+	s.Nil(run(s.admin, &s.out, "kill", []string{"abc123"}))
+	s.admin.AssertExpectations(s.T())
+}
+
+func (s *CtlTestSuite) TestDump() {
+	s.admin.On("Dump", "abc123").Return(server.AdminSession{ID: "abc123", WorkerPID: 42}, nil)
+	s.Nil(run(s.admin, &s.out, "dump", []string{"abc123"}))
+	s.Contains(s.out.String(), `"WorkerPID": 42`)
+}
+
+func (s *CtlTestSuite) TestUnknownCommand() {
+	s.NotNil(run(s.admin, &s.out, "restart", nil))
+}
+
+func TestCtlTestSuite(t *testing.T) {
+	suite.Run(t, new(CtlTestSuite))
+}
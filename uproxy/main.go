@@ -2,54 +2,47 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"syscall"
 
-	unet "github.com/murphybytes/ucp/net"
 	"github.com/murphybytes/ucp/server"
-	"github.com/murphybytes/ucp/wire"
 )
 
+// uproxy is started by the server once a user has authenticated. It runs
+// with the user's credentials and performs every file operation for the
+// session, requested over the socket pair it inherits, until the server
+// closes its end.
 func main() {
-	fmt.Println("child started")
-	var socketPath string
-	flag.StringVar(&socketPath, "socket-path", "", "Path to unix socket")
+	var umask, home string
+	flag.StringVar(&umask, "umask", server.DefaultWorkerUmask, "Octal umask applied to files the session creates")
+	flag.StringVar(&home, "home", "", "Working directory, the user's home directory")
 	flag.Parse()
 
-	var conn net.Conn
-	var err error
-	if conn, err = net.Dial("unix", socketPath); err != nil {
-		os.Exit(server.ErrSocket)
-	}
+	nonce := os.Getenv(server.ProxyNonceVariable)
+	os.Unsetenv(server.ProxyNonceVariable)
 
-	if err = handleConnection(conn); err != nil {
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil {
 		os.Exit(server.Error)
 	}
+	syscall.Umask(int(mask))
 
-	os.Exit(server.Success)
-
-}
-
-func handleConnection(conn net.Conn) (e error) {
-	defer conn.Close()
-	rw := unet.NewReaderWriter(conn)
-	encoderConn := unet.NewGobEncoderReaderWriter(rw)
-
-	var transferInfo wire.FileTransferInformation
-
-	if e = encoderConn.Read(&transferInfo); e != nil {
-		return
+	// relative names are resolved against the user's home directory
+	if home == "" || os.Chdir(home) != nil {
+		os.Chdir("/")
 	}
 
-	fmt.Printf("child read txfer %+v\n", transferInfo)
-
-	if transferInfo.FileTransferType == wire.FileSend {
-		f := newOsFile()
-		return fileSend(encoderConn, transferInfo, f)
+	// the parent passes its end of a socket pair as the first extra file
+	var conn net.Conn
+	if conn, err = server.InheritedProxyConn(); err != nil {
+		os.Exit(server.ErrSocket)
 	}
 
-	// TODO: handle recieving file from parent process
+	if err = server.ServeWorker(server.NewWorker(nonce), conn); err != nil {
+		os.Exit(server.Error)
+	}
 
-	return
+	os.Exit(server.Success)
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log"
+	"net"
+
+	"github.com/murphybytes/ucp/server"
+)
+
+// adminService implements the RPC methods of the admin socket. Each
+// connection gets its own instance so commands can be audited with the
+// name of the admin that ran them.
+type adminService struct {
+	service *osService
+	admin   string
+}
+
+// serveAdmin accepts admin connections until the listener is closed
+func serveAdmin(listener net.Listener, service *osService, group string) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			admin, err := server.CheckAdminPeer(conn, group)
+			if err != nil {
+				log.Println("Refused admin connection from ", admin, ": ", err)
+				return
+			}
+
+			if err = server.ServeAdmin(&adminService{service: service, admin: admin}, conn); err != nil {
+				log.Println("Admin connection failed: ", err)
+			}
+		}()
+	}
+}
+
+// List returns a summary of every active session
+func (a *adminService) List(args server.AdminArgs, reply *server.AdminListReply) error {
+	for _, s := range sessions.active() {
+		reply.Sessions = append(reply.Sessions, s.snapshot(false))
+	}
+	return nil
+}
+
+// Dump returns everything known about a session
+func (a *adminService) Dump(args server.AdminSessionArgs, reply *server.AdminSession) error {
+	s := sessions.find(args.ID)
+	if s == nil {
+		return server.ErrNoSuchSession
+	}
+	*reply = s.snapshot(true)
+	return nil
+}
+
+// Kill closes a session's connection and stops its worker
+func (a *adminService) Kill(args server.AdminSessionArgs, reply *server.AdminReply) (e error) {
+	s := sessions.find(args.ID)
+	if s == nil {
+		e = server.ErrNoSuchSession
+	} else {
+		s.terminate()
+	}
+	a.audit("kill", args.ID, e)
+	return
+}
+
+// Drain stops accepting connections and shuts the server down once active
+// sessions finish
+func (a *adminService) Drain(args server.AdminArgs, reply *server.AdminReply) error {
+	a.audit("drain", "", nil)
+	requestDrain()
+	return nil
+}
+
+// Reload reloads the configuration
+func (a *adminService) Reload(args server.AdminArgs, reply *server.AdminReply) (e error) {
+	e = reloadConfig(a.service)
+	a.audit("reload", "", e)
+	return
+}
+
+func (a *adminService) audit(command, sessionID string, e error) {
+	event := server.AuditEvent{
+		Event:     server.AuditAdminCommand,
+		Command:   command,
+		User:      a.admin,
+		SessionID: sessionID,
+		Outcome:   server.OutcomeSuccess,
+	}
+	if e != nil {
+		event.Outcome = server.OutcomeFailure
+		event.Error = e.Error()
+	}
+
+	if err := auditLog.Log(event); err != nil {
+		log.Println("Unable to write audit log: ", err)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/murphybytes/ucp/server"
+	"github.com/stretchr/testify/suite"
+)
+
+type AdminTestSuite struct {
+	suite.Suite
+	sess  *session
+	admin *adminService
+}
+
+func (s *AdminTestSuite) SetupTest() {
+	s.sess = &session{
+		id:            newSessionID(),
+		remoteAddress: "10.0.0.1:5000",
+		config:        server.NewConfig(),
+		aborted:       make(chan struct{}),
+		terminated:    make(chan struct{}),
+		status:        sessionStatus{state: stateHandshake},
+	}
+	s.Require().Nil(sessions.add(s.sess))
+	s.admin = &adminService{admin: "root"}
+}
+
+func (s *AdminTestSuite) TearDownTest() {
+	sessions.remove(s.sess)
+}
+
+func (s *AdminTestSuite) TestList() {
+	s.sess.user = "bob"
+	s.sess.authMethod = server.AuthMethodKey
+	s.sess.authenticated()
+
+	digest := newTransferDigest()
+	s.sess.startTransfer("/data/file", "download", digest)
+	digest.Write([]byte("some bytes"))
+
+	var reply server.AdminListReply
+	s.Nil(s.admin.List(server.AdminArgs{}, &reply))
+	s.Require().Len(reply.Sessions, 1)
+
+	info := reply.Sessions[0]
+	s.Equal(s.sess.id, info.ID)
+	s.Equal("bob", info.User)
+	s.Equal(stateTransferring, info.State)
+	s.Equal("/data/file", info.Path)
+	s.Equal(int64(10), info.Bytes)
+	s.Empty(info.AuthMethod)
+}
+
+func (s *AdminTestSuite) TestIdleOnceBatchTransfersEnd() {
+	s.sess.authenticated()
+	s.sess.startTransfer("/data/first", "download", newTransferDigest())
+	s.sess.startTransfer("/data/second", "upload", newTransferDigest())
+
+	s.sess.endTransfer()
+	info := s.sess.snapshot(false)
+	s.Equal(stateTransferring, info.State)
+	s.Equal("/data/second", info.Path)
+
+	s.sess.endTransfer()
+	s.Equal(stateIdle, s.sess.snapshot(false).State)
+}
+
+func (s *AdminTestSuite) TestDump() {
+	s.sess.authMethod = server.AuthMethodPassword
+	s.sess.authenticated()
+	s.sess.setWorkerPID(42)
+
+	var info server.AdminSession
+	s.Nil(s.admin.Dump(server.AdminSessionArgs{ID: s.sess.id}, &info))
+	s.Equal(server.AuthMethodPassword, info.AuthMethod)
+	s.Equal(42, info.WorkerPID)
+	s.Equal(stateIdle, info.State)
+
+	s.Equal(server.ErrNoSuchSession, s.admin.Dump(server.AdminSessionArgs{ID: "missing"}, &info))
+}
+
+func (s *AdminTestSuite) TestKill() {
+	s.Equal(server.ErrNoSuchSession, s.admin.Kill(server.AdminSessionArgs{ID: "missing"}, &server.AdminReply{}))
+
+	s.Nil(s.admin.Kill(server.AdminSessionArgs{ID: s.sess.id}, &server.AdminReply{}))
+	s.True(s.sess.isAborted())
+	select {
+	case <-s.sess.terminated:
+	default:
+		s.Fail("session was not terminated")
+	}
+}
+
+func TestAdminTestSuite(t *testing.T) {
+	suite.Run(t, new(AdminTestSuite))
+}
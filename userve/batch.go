@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os/user"
+	"sync"
+
+	unet "github.com/murphybytes/ucp/net"
+	"github.com/murphybytes/ucp/server"
+	"github.com/murphybytes/ucp/wire"
+)
+
+// serveBatch runs a batch of transfers. Once the server has told the client
+// how many transfers it may run at once the connection carries channels,
+// each running one transfer the way a session without a batch does. The
+// batch ends once the client closes the connection and the transfers have
+// finished.
+func serveBatch(sess *session, s servicable, agent *user.User, worker fileWorker, conn unet.EncodeConn, transferInfo wire.FileTransferInformation) (e error) {
+	transferInfo.Concurrency = batchTransfers(sess.config.Limits, transferInfo.Concurrency)
+	if e = conn.Write(transferInfo); e != nil {
+		return
+	}
+
+	mux := unet.NewMux(conn, transferInfo.Concurrency)
+	var transfers sync.WaitGroup
+	for {
+		var channel *unet.Channel
+		if channel, e = mux.Accept(); e != nil {
+			break
+		}
+
+		transfers.Add(1)
+		go func() {
+			defer transfers.Done()
+			defer channel.Close()
+			if err := serveChannel(sess, s, agent, worker, channel); err != nil {
+				log.Println("File transfer failed. ", err.Error())
+			}
+		}()
+	}
+	transfers.Wait()
+
+	if e == io.EOF {
+		e = nil
+	}
+	return
+}
+
+// serveChannel performs the transfer the client asks for on a channel of a
+// batch
+func serveChannel(sess *session, s servicable, agent *user.User, worker fileWorker, channel unet.EncodeConn) (e error) {
+	if notifyShutdown(sess, channel) {
+		return
+	}
+
+	var transferInfo wire.FileTransferInformation
+	if transferInfo, e = requestTransfer(channel); e != nil {
+		return
+	}
+
+	if transferInfo.FileTransferType == wire.Batch {
+		e = wire.NewError(wire.UnknownError, "A batch can't be run within a batch")
+		transferInfo.Error = e
+		channel.Write(transferInfo)
+		return
+	}
+
+	return performTransfer(sess, s, agent, worker, channel, transferInfo)
+}
+
+// batchTransfers returns the number of transfers a batch may run at once
+// when the client asks for requested
+func batchTransfers(limits server.LimitsConfig, requested int) int {
+	allowed := limits.MaxBatchTransfers
+	if allowed < 1 {
+		allowed = 1
+	}
+
+	if requested > 0 && requested < allowed {
+		return requested
+	}
+	return allowed
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"os"
+	"time"
+
+	unet "github.com/murphybytes/ucp/net"
+	"github.com/murphybytes/ucp/server"
+	"github.com/murphybytes/ucp/wire"
+)
+
+var ErrBenchmarkSize = errors.New("Benchmark size must not be negative")
+
+// benchmarkData stands in for the session worker during a benchmark. It
+// generates the bytes of a file that is never read from disk, so a
+// benchmark measures the network and the protocol and nothing else.
+type benchmarkData struct {
+	size      int64
+	remaining int64
+	pattern   wire.BenchmarkPattern
+	random    *rand.Rand
+	buffer    []byte
+}
+
+func newBenchmarkData(size int64, pattern wire.BenchmarkPattern) *benchmarkData {
+	return &benchmarkData{
+		size:      size,
+		remaining: size,
+		pattern:   pattern,
+		random:    rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (b *benchmarkData) OpenRead(root, path string) (handle int, size int64, e error) {
+	if b.size < 0 {
+		return 0, 0, ErrBenchmarkSize
+	}
+	return 0, b.size, nil
+}
+
+func (b *benchmarkData) OpenWrite(root, path string, mode os.FileMode, options server.UploadOptions) (handle int, e error) {
+	return 0, os.ErrPermission
+}
+
+// Read returns the next size bytes of the pattern. Zeros are generated
+// once, random data is generated afresh for every buffer.
+func (b *benchmarkData) Read(handle, size int) (data []byte, eof bool, e error) {
+	if int64(size) >= b.remaining {
+		size = int(b.remaining)
+		eof = true
+	}
+	b.remaining -= int64(size)
+
+	if len(b.buffer) < size {
+		b.buffer = make([]byte, size)
+	}
+	data = b.buffer[:size]
+
+	if b.pattern == wire.RandomPattern {
+		b.random.Read(data)
+	}
+	return
+}
+
+func (b *benchmarkData) Write(handle int, data []byte) error {
+	return os.ErrPermission
+}
+
+func (b *benchmarkData) CloseFile(handle int) error {
+	return nil
+}
+
+func (b *benchmarkData) Commit(handle int) error {
+	return os.ErrPermission
+}
+
+func (b *benchmarkData) Usage(directories []string, exclude []string, owned bool) (usage server.Usage, e error) {
+	return
+}
+
+// sendBenchmarkData sends generated data to the remote the same way a
+// file is downloaded, unless benchmarks have been turned off
+func sendBenchmarkData(sess *session, conn unet.EncodeConn, transferInfo wire.FileTransferInformation, digest *transferDigest) (e error) {
+	if !sess.config.AllowBenchmarks {
+		e = wire.NewError(wire.BenchmarksDisabled, "Benchmarks are not allowed by this server")
+		transferInfo.Error = e
+		conn.Write(transferInfo)
+		return
+	}
+
+	return sendFileToRemote(sess, newBenchmarkData(transferInfo.FileSize, transferInfo.Pattern), conn, transferInfo, "", "", digest)
+}
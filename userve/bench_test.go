@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/murphybytes/ucp/client"
+	unet "github.com/murphybytes/ucp/net"
+	"github.com/murphybytes/ucp/server"
+	"github.com/murphybytes/ucp/wire"
+)
+
+// newBenchmarkEnvironment sets up a server and client for b with the
+// default buffer size
+func newBenchmarkEnvironment(b *testing.B) *endToEnd {
+	env, err := newEndToEnd()
+	if err != nil {
+		b.Fatal(err)
+	}
+	if err = env.authorizeKey(); err != nil {
+		env.close()
+		b.Fatal(err)
+	}
+
+	env.cfg.Limits.PipeBufferSize = server.PipeBufferSize
+	return env
+}
+
+// BenchmarkHandshake measures setting up and authenticating a session
+func BenchmarkHandshake(b *testing.B) {
+	env := newBenchmarkEnvironment(b)
+	defer env.close()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := env.connect("", func(unet.EncodeConn) error { return nil }); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkSessionGenerated measures a whole session sending generated
+// data, every layer but the disks
+func BenchmarkSessionGenerated(b *testing.B) {
+	env := newBenchmarkEnvironment(b)
+	defer env.close()
+
+	size := int64(b.N) * server.PipeBufferSize
+	b.SetBytes(server.PipeBufferSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	err := env.connect("", func(conn unet.EncodeConn) error {
+		_, e := client.Benchmark(size, wire.ZeroPattern, conn)
+		return e
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+}
+
+// BenchmarkSessionDownload measures a whole session downloading a file
+// through the session worker
+func BenchmarkSessionDownload(b *testing.B) {
+	env := newBenchmarkEnvironment(b)
+	defer env.close()
+
+	const fileSize = 10 * server.PipeBufferSize
+	remote := filepath.Join(env.dataDir, "remote")
+	if err := ioutil.WriteFile(remote, make([]byte, fileSize), 0600); err != nil {
+		b.Fatal(err)
+	}
+	local := filepath.Join(env.clientDir, "local")
+
+	b.SetBytes(fileSize)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := env.connect("", func(conn unet.EncodeConn) error {
+			return client.ReceiveFile(local, remote, conn)
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		os.Remove(local)
+	}
+}
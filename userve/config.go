@@ -0,0 +1,127 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/murphybytes/ucp/server"
+)
+
+var configPath string
+var checkConfig bool
+var noPasswordAuth bool
+
+var configMutex sync.RWMutex
+var currentConfig *server.Config
+
+func registerConfigFlags() {
+	flag.StringVar(&configPath, "config", os.Getenv("UCP_SERVER_CONFIG"), "Path to JSON configuration file")
+	flag.BoolVar(&checkConfig, "check-config", false, "Validate configuration and exit.")
+	flag.BoolVar(&noPasswordAuth, "no-password-auth", false, "Only accept public key authentication")
+}
+
+func getConfig() *server.Config {
+	configMutex.RLock()
+	defer configMutex.RUnlock()
+	return currentConfig
+}
+
+func setConfig(cfg *server.Config) {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+	currentConfig = cfg
+}
+
+// loadConfig builds the server configuration. Values given on the command
+// line take precedence over the configuration file which in turn takes
+// precedence over the environment and built in defaults.
+func loadConfig() (cfg *server.Config, e error) {
+	cfg = server.NewConfig()
+	cfg.Directory = ucpDirectory
+	cfg.Listeners = []string{hostInterface}
+	cfg.Logging.AuditLog = auditLogPath
+	cfg.Logging.AuditLogMaxSize = auditLogMaxSize
+	cfg.Logging.AuditLogBackups = auditLogBackups
+
+	if configPath != "" {
+		if e = cfg.Load(configPath); e != nil {
+			return
+		}
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "ucp-directory":
+			cfg.Directory = ucpDirectory
+		case "host-interface":
+			cfg.Listeners = []string{hostInterface}
+		case "audit-log":
+			cfg.Logging.AuditLog = auditLogPath
+		case "audit-log-max-size":
+			cfg.Logging.AuditLogMaxSize = auditLogMaxSize
+		case "audit-log-backups":
+			cfg.Logging.AuditLogBackups = auditLogBackups
+		case "no-password-auth":
+			cfg.Auth.Password = !noPasswordAuth
+		}
+	})
+
+	e = cfg.Validate()
+	return
+}
+
+// handleReloadSignal reloads the configuration each time the process
+// receives SIGHUP. Sessions that are already running keep the configuration
+// they started with.
+func handleReloadSignal(service *osService) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		reloadConfig(service)
+	}
+}
+
+// reloadConfig loads the configuration again and applies it to new
+// sessions. If the configuration is invalid the current one is kept and the
+// error returned.
+func reloadConfig(service *osService) (e error) {
+	log.Println("Reloading configuration")
+
+	var cfg *server.Config
+	if cfg, e = loadConfig(); e != nil {
+		log.Println("Configuration reload failed, keeping current configuration: ", e)
+		return
+	}
+
+	if e = service.reload(cfg); e != nil {
+		log.Println("Configuration reload failed, keeping current configuration: ", e)
+		return
+	}
+
+	previous := getConfig()
+	if !reflect.DeepEqual(previous.Listeners, cfg.Listeners) {
+		log.Println("Listener changes take effect after restart")
+		cfg.Listeners = previous.Listeners
+	}
+
+	if previous.Metrics != cfg.Metrics || previous.Admin != cfg.Admin {
+		log.Println("Metrics and admin socket changes take effect after restart")
+		cfg.Metrics, cfg.Admin = previous.Metrics, previous.Admin
+	}
+
+	if !reflect.DeepEqual(previous.Logging, cfg.Logging) {
+		if err := auditLog.Reopen(cfg.AuditLogPath(), cfg.Logging.AuditLogMaxSize, cfg.Logging.AuditLogBackups); err != nil {
+			log.Println("Unable to reopen audit log: ", err)
+		}
+	}
+
+	setConfig(cfg)
+	log.Println("Configuration reloaded")
+	return
+}
@@ -0,0 +1,810 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/murphybytes/ucp/client"
+	"github.com/murphybytes/ucp/crypto"
+	unet "github.com/murphybytes/ucp/net"
+	"github.com/murphybytes/ucp/net/impair"
+	"github.com/murphybytes/ucp/server"
+	"github.com/murphybytes/ucp/wire"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ssh"
+)
+
+// fakeService stands in for the operating system. Users, authorized keys
+// and passwords are held in memory and the session worker runs in process,
+// so the whole server can be driven over a pipe without root or PAM.
+type fakeService struct {
+	hostKey        ssh.Signer
+	users          map[string]*user.User
+	authorizedKeys []byte
+	passwords      map[string]string
+}
+
+func (f *fakeService) getHostKey() ssh.Signer {
+	return f.hostKey
+}
+
+func (f *fakeService) getHostCertificate() []byte {
+	return nil
+}
+
+func (f *fakeService) isKeyAuthorized(u *user.User, key []byte, _ func() []byte) (bool, server.KeyOptions, error) {
+	return (&osService{}).isKeyAuthorized(u, key, func() []byte { return f.authorizedKeys })
+}
+
+func (f *fakeService) checkUserCertificate(*user.User, *ssh.Certificate, ssh.PublicKey) (server.KeyOptions, error) {
+	return server.KeyOptions{}, ErrCertificatesNotAccepted
+}
+
+func (f *fakeService) lookupUser(name string) (*user.User, error) {
+	if u, ok := f.users[name]; ok {
+		return u, nil
+	}
+	return nil, user.UnknownUserError(name)
+}
+
+// validatePassword plays the part of PAM
+func (f *fakeService) validatePassword(u *user.User, password string) error {
+	if expected, ok := f.passwords[u.Username]; ok && expected == password {
+		return nil
+	}
+	return errors.New("Authentication failure")
+}
+
+func (f *fakeService) startWorker(sess *session, agent *user.User) (*server.WorkerClient, func(), error) {
+	parent, child := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		server.ServeWorker(server.NewWorker(""), child)
+		close(done)
+	}()
+
+	worker := server.NewWorkerClient(parent)
+	return worker, func() {
+		worker.Close()
+		<-done
+	}, nil
+}
+
+// hookCredential runs hook commands as the test's own user
+func (f *fakeService) hookCredential(*user.User) (*syscall.Credential, error) {
+	return nil, nil
+}
+
+type fakePrompt struct {
+	password string
+}
+
+func (p *fakePrompt) GetPassword() (string, error) {
+	return p.password, nil
+}
+
+func (p *fakePrompt) GetPassphrase(string) (string, error) {
+	return "", client.ErrInteractiveAuthRequired
+}
+
+// endToEnd holds a server and a client that talk to each other over
+// in-memory pipes, with their keys and the server's data in a temporary
+// directory
+type endToEnd struct {
+	dir       string
+	clientDir string
+	dataDir   string
+	service   *fakeService
+	cfg       *server.Config
+	previous  *server.Config
+
+	// impairments applied to what each end writes, if set
+	clientImpairment *impair.Config
+	serverImpairment *impair.Config
+}
+
+func newEndToEnd() (env *endToEnd, e error) {
+	env = &endToEnd{}
+	if env.dir, e = ioutil.TempDir("", "e2e"); e != nil {
+		return
+	}
+	defer func() {
+		if e != nil {
+			os.RemoveAll(env.dir)
+		}
+	}()
+
+	serverDir := filepath.Join(env.dir, "server")
+	env.clientDir = filepath.Join(env.dir, "client")
+	env.dataDir = filepath.Join(env.dir, "data")
+	for _, dir := range []string{serverDir, env.clientDir, env.dataDir} {
+		if e = os.Mkdir(dir, 0700); e != nil {
+			return
+		}
+	}
+
+	if e = crypto.UcpKeyGenerate(filepath.Join(serverDir, "private-key.pem"), filepath.Join(serverDir, "public-key"), crypto.KeyTypeEd25519); e != nil {
+		return
+	}
+	if e = crypto.UcpKeyGenerate(filepath.Join(env.clientDir, "private-key.pem"), filepath.Join(env.clientDir, "public-key"), crypto.KeyTypeEd25519); e != nil {
+		return
+	}
+
+	var hostKey ssh.Signer
+	if hostKey, e = crypto.GetSigner(filepath.Join(serverDir, "private-key.pem")); e != nil {
+		return
+	}
+
+	env.service = &fakeService{
+		hostKey:   hostKey,
+		users:     map[string]*user.User{"alice": {Username: "alice", Uid: "1000", Gid: "1000", HomeDir: env.dataDir}},
+		passwords: map[string]string{"alice": "secret"},
+	}
+
+	// the client reads its keys and known_hosts from its ucp directory
+	knownHost := append([]byte("localhost "), ssh.MarshalAuthorizedKey(hostKey.PublicKey())...)
+	if e = ioutil.WriteFile(filepath.Join(env.clientDir, "known_hosts"), knownHost, 0600); e != nil {
+		return
+	}
+	client.UCPDirectory = env.clientDir
+	client.Host = "localhost"
+	client.Port = server.DefaultPort
+	client.RemoteUser = "alice"
+	client.NoAgent = true
+
+	env.cfg = server.NewConfig()
+	env.cfg.Directory = serverDir
+	env.cfg.Limits.PipeBufferSize = 1000
+	env.cfg.Auth.Lockout.FailureDelay = server.Duration{}
+	env.cfg.Auth.Lockout.MaxFailures = 0
+	env.previous = getConfig()
+	setConfig(env.cfg)
+	return
+}
+
+func (env *endToEnd) close() {
+	setConfig(env.previous)
+	os.RemoveAll(env.dir)
+}
+
+// authorizeKey adds the client's public key to the authorized keys
+func (env *endToEnd) authorizeKey() (e error) {
+	env.service.authorizedKeys, e = ioutil.ReadFile(filepath.Join(env.clientDir, "public-key"))
+	return
+}
+
+// connect runs the server's connection handler and the client flows at
+// either end of a pipe. transfer runs once the client is authorized, the
+// first error from the client is returned after the server has finished
+// with the connection.
+func (env *endToEnd) connect(password string, transfer func(conn unet.EncodeConn) error) (e error) {
+	var clientConn, serverConn net.Conn
+	clientConn, serverConn = net.Pipe()
+	if env.clientImpairment != nil {
+		clientConn = impair.NewConn(clientConn, *env.clientImpairment)
+	}
+	if env.serverImpairment != nil {
+		serverConn = impair.NewConn(serverConn, *env.serverImpairment)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		handleConnection(serverConn, env.service)
+		close(done)
+	}()
+
+	defer func() {
+		clientConn.Close()
+		<-done
+	}()
+
+	var signer ssh.Signer
+	if signer, e = client.LoadSigner(&fakePrompt{}); e != nil {
+		return
+	}
+
+	var conn unet.EncodeConn
+	if conn, e = client.CreateEncryptedConnection(signer, clientConn); e != nil {
+		return
+	}
+
+	if e = client.HandleUserAuthorization(conn, &fakePrompt{password: password}); e != nil {
+		return
+	}
+
+	return transfer(conn)
+}
+
+// EndToEndTestSuite runs the client against the server's connection
+// handler over an in-memory pipe
+type EndToEndTestSuite struct {
+	suite.Suite
+	*endToEnd
+}
+
+func (s *EndToEndTestSuite) SetupTest() {
+	var err error
+	s.endToEnd, err = newEndToEnd()
+	s.Require().Nil(err)
+}
+
+func (s *EndToEndTestSuite) TearDownTest() {
+	s.close()
+}
+
+func (s *EndToEndTestSuite) authorizeClientKey() {
+	s.Require().Nil(s.authorizeKey())
+}
+
+func (s *EndToEndTestSuite) writeData(name string, size int) []byte {
+	contents := make([]byte, size)
+	rand.Read(contents)
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(s.dataDir, name), contents, 0600))
+	return contents
+}
+
+func (s *EndToEndTestSuite) TestKeyAuthDownload() {
+	s.authorizeClientKey()
+	contents := s.writeData("remote", 10500)
+	local := filepath.Join(s.clientDir, "local")
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.ReceiveFile(local, filepath.Join(s.dataDir, "remote"), conn)
+	})
+	s.Require().Nil(err)
+
+	received, err := ioutil.ReadFile(local)
+	s.Nil(err)
+	s.True(bytes.Equal(contents, received))
+}
+
+func (s *EndToEndTestSuite) TestPasswordAuthUpload() {
+	contents := make([]byte, 2500)
+	rand.Read(contents)
+	local := filepath.Join(s.clientDir, "local")
+	s.Require().Nil(ioutil.WriteFile(local, contents, 0600))
+
+	err := s.connect("secret", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, filepath.Join(s.dataDir, "uploaded"), client.UploadOptions{}, conn)
+	})
+	s.Require().Nil(err)
+
+	received, err := ioutil.ReadFile(filepath.Join(s.dataDir, "uploaded"))
+	s.Nil(err)
+	s.True(bytes.Equal(contents, received))
+}
+
+func (s *EndToEndTestSuite) TestUploadWholeBuffers() {
+	s.authorizeClientKey()
+	// a file that fills its last buffer is ended by the end of the stream
+	contents := make([]byte, 3*s.cfg.Limits.PipeBufferSize)
+	rand.Read(contents)
+	local := filepath.Join(s.clientDir, "local")
+	s.Require().Nil(ioutil.WriteFile(local, contents, 0600))
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, filepath.Join(s.dataDir, "uploaded"), client.UploadOptions{}, conn)
+	})
+	s.Require().Nil(err)
+
+	received, err := ioutil.ReadFile(filepath.Join(s.dataDir, "uploaded"))
+	s.Nil(err)
+	s.True(bytes.Equal(contents, received))
+}
+
+func (s *EndToEndTestSuite) TestUploadNoClobber() {
+	s.authorizeClientKey()
+	remote := filepath.Join(s.dataDir, "uploaded")
+	s.Require().Nil(ioutil.WriteFile(remote, []byte("existing"), 0600))
+	local := filepath.Join(s.clientDir, "local")
+	s.Require().Nil(ioutil.WriteFile(local, []byte("replacement"), 0600))
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, remote, client.UploadOptions{NoClobber: true}, conn)
+	})
+	s.Require().NotNil(err)
+	wireErr, ok := err.(*wire.Error)
+	s.Require().True(ok)
+	s.Equal(wire.FileExists, wireErr.Code)
+
+	received, err := ioutil.ReadFile(remote)
+	s.Nil(err)
+	s.Equal("existing", string(received))
+}
+
+func (s *EndToEndTestSuite) TestUploadBackup() {
+	s.authorizeClientKey()
+	remote := filepath.Join(s.dataDir, "uploaded")
+	s.Require().Nil(ioutil.WriteFile(remote, []byte("existing"), 0600))
+	local := filepath.Join(s.clientDir, "local")
+	s.Require().Nil(ioutil.WriteFile(local, []byte("replacement"), 0600))
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, remote, client.UploadOptions{BackupSuffix: ".orig"}, conn)
+	})
+	s.Require().Nil(err)
+
+	received, err := ioutil.ReadFile(remote)
+	s.Nil(err)
+	s.Equal("replacement", string(received))
+	received, err = ioutil.ReadFile(remote + ".orig")
+	s.Nil(err)
+	s.Equal("existing", string(received))
+}
+
+func (s *EndToEndTestSuite) TestUploadBackupOutsidePolicy() {
+	s.authorizeClientKey()
+	s.cfg.PathPolicy = server.PathPolicy{Allow: []string{filepath.Join(s.dataDir, "uploaded")}}
+	local := filepath.Join(s.clientDir, "local")
+	s.Require().Nil(ioutil.WriteFile(local, []byte("replacement"), 0600))
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, filepath.Join(s.dataDir, "uploaded"), client.UploadOptions{BackupSuffix: ".orig"}, conn)
+	})
+	s.Require().NotNil(err)
+	wireErr, ok := err.(*wire.Error)
+	s.Require().True(ok)
+	s.Equal(wire.PathDenied, wireErr.Code)
+	_, err = os.Stat(filepath.Join(s.dataDir, "uploaded"))
+	s.True(os.IsNotExist(err))
+}
+
+func (s *EndToEndTestSuite) TestUploadRunsHooks() {
+	s.authorizeClientKey()
+	events := make(chan server.HookEvent, 1)
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event server.HookEvent
+		json.NewDecoder(r.Body).Decode(&event)
+		events <- event
+	}))
+	defer endpoint.Close()
+	s.cfg.Hooks = []server.HookConfig{{URL: endpoint.URL, Directions: []string{server.HookUpload}}}
+
+	contents := []byte("some file contents")
+	local := filepath.Join(s.clientDir, "local")
+	s.Require().Nil(ioutil.WriteFile(local, contents, 0600))
+	remote := filepath.Join(s.dataDir, "uploaded")
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, remote, client.UploadOptions{}, conn)
+	})
+	s.Require().Nil(err)
+
+	// the hook runs once the file is in place
+	event := <-events
+	s.Equal("alice", event.User)
+	s.Equal(remote, event.Path)
+	s.Equal(remote, event.LocalPath)
+	s.Equal(int64(len(contents)), event.Bytes)
+	s.Equal(server.OutcomeSuccess, event.Outcome)
+	hash := sha256.Sum256(contents)
+	s.Equal(hex.EncodeToString(hash[:]), event.Hash)
+}
+
+// expectQuotaExceeded checks that err is a QuotaExceeded error and that
+// nothing was left in the data directory
+func (s *EndToEndTestSuite) expectQuotaExceeded(err error) {
+	s.Require().NotNil(err)
+	wireErr, ok := err.(*wire.Error)
+	s.Require().True(ok, err.Error())
+	s.Equal(wire.QuotaExceeded, wireErr.Code)
+
+	entries, err := ioutil.ReadDir(s.dataDir)
+	s.Nil(err)
+	for _, entry := range entries {
+		s.Equal("existing", entry.Name())
+	}
+}
+
+func (s *EndToEndTestSuite) TestUploadMaxFileSize() {
+	s.authorizeClientKey()
+	s.cfg.Limits.MaxFileSize = 1000
+	local := filepath.Join(s.clientDir, "local")
+	s.Require().Nil(ioutil.WriteFile(local, make([]byte, 1001), 0600))
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, filepath.Join(s.dataDir, "uploaded"), client.UploadOptions{}, conn)
+	})
+	s.expectQuotaExceeded(err)
+}
+
+// confineWithQuotas confines alice to the data directory with the quotas
+// given
+func (s *EndToEndTestSuite) confineWithQuotas(userQuota, rootQuota server.Quota) {
+	s.cfg.Confinement = []server.ConfinementRule{{
+		Users: []string{"alice"},
+		Roots: []server.VirtualRoot{{Mount: "/", Directory: s.dataDir, Quota: rootQuota}},
+		Quota: userQuota,
+	}}
+}
+
+func (s *EndToEndTestSuite) TestUploadRootQuota() {
+	s.authorizeClientKey()
+	s.confineWithQuotas(server.Quota{}, server.Quota{MaxBytes: 3000})
+	s.writeData("existing", 2000)
+	local := filepath.Join(s.clientDir, "local")
+	s.Require().Nil(ioutil.WriteFile(local, make([]byte, 1001), 0600))
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, "/uploaded", client.UploadOptions{}, conn)
+	})
+	s.expectQuotaExceeded(err)
+
+	// replacing a file only counts the difference
+	err = s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, "/existing", client.UploadOptions{}, conn)
+	})
+	s.Nil(err)
+}
+
+func (s *EndToEndTestSuite) TestKeptUploadCountsAgainstQuota() {
+	s.authorizeClientKey()
+	s.cfg.KeepFailedUploads = true
+	s.confineWithQuotas(server.Quota{}, server.Quota{MaxBytes: 3000})
+	s.writeData(".uploaded.ucp-0011223344556677", 2000)
+	local := filepath.Join(s.clientDir, "local")
+	s.Require().Nil(ioutil.WriteFile(local, make([]byte, 1001), 0600))
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, "/uploaded", client.UploadOptions{}, conn)
+	})
+	s.Require().NotNil(err)
+	wireErr, ok := err.(*wire.Error)
+	s.Require().True(ok, err.Error())
+	s.Equal(wire.QuotaExceeded, wireErr.Code)
+}
+
+func (s *EndToEndTestSuite) TestUploadToTempName() {
+	s.authorizeClientKey()
+	local := filepath.Join(s.clientDir, "local")
+	s.Require().Nil(ioutil.WriteFile(local, []byte("data"), 0600))
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, filepath.Join(s.dataDir, ".uploaded.ucp-1"), client.UploadOptions{}, conn)
+	})
+	s.Require().NotNil(err)
+	wireErr, ok := err.(*wire.Error)
+	s.Require().True(ok, err.Error())
+	s.Equal(wire.PathDenied, wireErr.Code)
+
+	err = s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, filepath.Join(s.dataDir, "uploaded"), client.UploadOptions{BackupSuffix: ".ucp-1"}, conn)
+	})
+	s.NotNil(err)
+
+	entries, err := ioutil.ReadDir(s.dataDir)
+	s.Nil(err)
+	s.Empty(entries)
+}
+
+func (s *EndToEndTestSuite) TestUploadUserFileQuota() {
+	s.authorizeClientKey()
+	s.confineWithQuotas(server.Quota{MaxFiles: 1}, server.Quota{})
+	s.writeData("existing", 10)
+	local := filepath.Join(s.clientDir, "local")
+	s.Require().Nil(ioutil.WriteFile(local, []byte("data"), 0600))
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, "/uploaded", client.UploadOptions{}, conn)
+	})
+	s.expectQuotaExceeded(err)
+}
+
+func (s *EndToEndTestSuite) TestUploadUserQuotaWithoutConfinement() {
+	s.authorizeClientKey()
+	s.cfg.Limits.UserQuota = server.UserQuota{Quota: server.Quota{MaxBytes: 3000}, Directories: []string{s.dataDir}}
+	s.writeData("existing", 2000)
+	local := filepath.Join(s.clientDir, "local")
+	s.Require().Nil(ioutil.WriteFile(local, make([]byte, 1001), 0600))
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, filepath.Join(s.dataDir, "uploaded"), client.UploadOptions{}, conn)
+	})
+	s.expectQuotaExceeded(err)
+
+	// uploads outside the quota's directories don't count against it
+	err = s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, filepath.Join(s.clientDir, "uploaded"), client.UploadOptions{}, conn)
+	})
+	s.Nil(err)
+}
+
+func (s *EndToEndTestSuite) TestStreamedUploadOverQuota() {
+	s.authorizeClientKey()
+	s.confineWithQuotas(server.Quota{MaxBytes: 5000}, server.Quota{})
+	stream := bytes.NewReader(make([]byte, 1<<20))
+	client.Stdin = stream
+	defer func() { client.Stdin = os.Stdin }()
+
+	// the size isn't known until the stream ends, so the quota is
+	// enforced as the data arrives
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(client.StdioPath, "/uploaded", client.UploadOptions{}, conn)
+	})
+	s.expectQuotaExceeded(err)
+
+	// the upload stops once it passes the quota rather than at the end
+	// of the stream
+	s.NotZero(stream.Len())
+}
+
+func (s *EndToEndTestSuite) TestEmptyFiles() {
+	s.authorizeClientKey()
+	s.writeData("empty", 0)
+	local := filepath.Join(s.clientDir, "local")
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.ReceiveFile(local, filepath.Join(s.dataDir, "empty"), conn)
+	})
+	s.Require().Nil(err)
+
+	info, err := os.Stat(local)
+	s.Require().Nil(err)
+	s.Zero(info.Size())
+}
+
+func (s *EndToEndTestSuite) TestWrongPassword() {
+	err := s.connect("guess", func(conn unet.EncodeConn) error {
+		s.Fail("transfer should not run")
+		return nil
+	})
+	s.NotNil(err)
+}
+
+func (s *EndToEndTestSuite) TestUnknownUser() {
+	client.RemoteUser = "mallory"
+	err := s.connect("secret", func(conn unet.EncodeConn) error {
+		s.Fail("transfer should not run")
+		return nil
+	})
+	s.NotNil(err)
+}
+
+func (s *EndToEndTestSuite) TestPasswordDisabled() {
+	s.cfg.Auth.Password = false
+	err := s.connect("secret", func(conn unet.EncodeConn) error {
+		s.Fail("transfer should not run")
+		return nil
+	})
+	s.NotNil(err)
+}
+
+func (s *EndToEndTestSuite) TestHostKeyMismatch() {
+	otherKey, _ := crypto.GenerateKey(crypto.KeyTypeEd25519)
+	otherSigner, _ := ssh.NewSignerFromKey(otherKey)
+	s.service.hostKey = otherSigner
+
+	err := s.connect("secret", func(conn unet.EncodeConn) error {
+		s.Fail("transfer should not run")
+		return nil
+	})
+	s.Equal(client.ErrHostKeyMismatch, err)
+}
+
+func (s *EndToEndTestSuite) TestDownloadMissingFile() {
+	s.authorizeClientKey()
+	local := filepath.Join(s.clientDir, "local")
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.ReceiveFile(local, filepath.Join(s.dataDir, "missing"), conn)
+	})
+	s.NotNil(err)
+
+	_, err = os.Stat(local)
+	s.True(os.IsNotExist(err))
+}
+
+func (s *EndToEndTestSuite) TestPathDenied() {
+	s.authorizeClientKey()
+	s.cfg.PathPolicy.Deny = []string{filepath.Join(s.dataDir, "*")}
+	local := filepath.Join(s.clientDir, "local")
+	s.Require().Nil(ioutil.WriteFile(local, []byte("contents"), 0600))
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, filepath.Join(s.dataDir, "uploaded"), client.UploadOptions{}, conn)
+	})
+	wireErr, ok := err.(*wire.Error)
+	s.Require().True(ok)
+	s.Equal(wire.PathDenied, wireErr.Code)
+
+	_, err = os.Stat(filepath.Join(s.dataDir, "uploaded"))
+	s.True(os.IsNotExist(err))
+}
+
+func TestEndToEndTestSuite(t *testing.T) {
+	suite.Run(t, new(EndToEndTestSuite))
+}
+
+func (s *EndToEndTestSuite) TestBenchmark() {
+	s.authorizeClientKey()
+	size := int64(5*s.cfg.Limits.PipeBufferSize + 10)
+
+	for _, pattern := range []wire.BenchmarkPattern{wire.ZeroPattern, wire.RandomPattern} {
+		var result client.BenchmarkResult
+		err := s.connect("", func(conn unet.EncodeConn) (e error) {
+			result, e = client.Benchmark(size, pattern, conn)
+			return
+		})
+		s.Require().Nil(err)
+		s.Equal(size, result.Bytes)
+		s.Len(result.RoundTrips, 6)
+		s.True(result.Duration > 0)
+	}
+}
+
+func (s *EndToEndTestSuite) TestBenchmarksDisabled() {
+	s.authorizeClientKey()
+	s.cfg.AllowBenchmarks = false
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		_, e := client.Benchmark(1000, wire.ZeroPattern, conn)
+		return e
+	})
+	wireErr, ok := err.(*wire.Error)
+	s.Require().True(ok)
+	s.Equal(wire.BenchmarksDisabled, wireErr.Code)
+}
+
+func (s *EndToEndTestSuite) TestUploadFromStdin() {
+	s.authorizeClientKey()
+	contents := make([]byte, 3*s.cfg.Limits.PipeBufferSize+1)
+	rand.Read(contents)
+	client.Stdin = bytes.NewReader(contents)
+	defer func() { client.Stdin = os.Stdin }()
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(client.StdioPath, filepath.Join(s.dataDir, "uploaded"), client.UploadOptions{}, conn)
+	})
+	s.Require().Nil(err)
+
+	received, err := ioutil.ReadFile(filepath.Join(s.dataDir, "uploaded"))
+	s.Nil(err)
+	s.True(bytes.Equal(contents, received))
+}
+
+func (s *EndToEndTestSuite) TestDownloadToStdout() {
+	s.authorizeClientKey()
+	contents := s.writeData("remote", 2*s.cfg.Limits.PipeBufferSize)
+	var out bytes.Buffer
+	client.Stdout = &out
+	defer func() { client.Stdout = os.Stdout }()
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.ReceiveFile(client.StdioPath, filepath.Join(s.dataDir, "remote"), conn)
+	})
+	s.Require().Nil(err)
+	s.True(bytes.Equal(contents, out.Bytes()))
+}
+
+func (s *EndToEndTestSuite) TestDownloadFromPipe() {
+	s.authorizeClientKey()
+	// a pipe's size can't be known until it has been read to the end
+	pipe := filepath.Join(s.dataDir, "pipe")
+	s.Require().Nil(syscall.Mkfifo(pipe, 0600))
+	contents := make([]byte, 2500)
+	rand.Read(contents)
+	go func() {
+		if f, err := os.OpenFile(pipe, os.O_WRONLY, 0); err == nil {
+			f.Write(contents)
+			f.Close()
+		}
+	}()
+
+	var out bytes.Buffer
+	client.Stdout = &out
+	defer func() { client.Stdout = os.Stdout }()
+
+	err := s.connect("", func(conn unet.EncodeConn) error {
+		return client.ReceiveFile(client.StdioPath, pipe, conn)
+	})
+	s.Require().Nil(err)
+	s.True(bytes.Equal(contents, out.Bytes()))
+}
+
+// runManifest runs entries as a batch and returns the results
+func (s *EndToEndTestSuite) runManifest(entries []client.ManifestEntry, concurrency int, continueOnError bool) (results []client.ManifestResult) {
+	err := s.connect("", func(conn unet.EncodeConn) (e error) {
+		results, e = client.RunManifest(entries, concurrency, continueOnError, conn)
+		return
+	})
+	s.Require().Nil(err)
+	s.Require().Len(results, len(entries))
+	return
+}
+
+func (s *EndToEndTestSuite) TestBatch() {
+	s.authorizeClientKey()
+	s.cfg.Limits.MaxBatchTransfers = 2
+
+	var entries []client.ManifestEntry
+	sent := make(map[string][]byte)
+	for i := 0; i < 6; i++ {
+		name := fmt.Sprintf("file%d", i)
+		if i%2 == 0 {
+			contents := make([]byte, 1500*(i+1))
+			rand.Read(contents)
+			sent[name] = contents
+			local := filepath.Join(s.clientDir, name)
+			s.Require().Nil(ioutil.WriteFile(local, contents, 0600))
+			entries = append(entries, client.ManifestEntry{Source: local, Destination: client.RemotePrefix + filepath.Join(s.dataDir, name)})
+		} else {
+			sent[name] = s.writeData(name, 1500*(i+1))
+			entries = append(entries, client.ManifestEntry{Source: client.RemotePrefix + filepath.Join(s.dataDir, name), Destination: filepath.Join(s.clientDir, name)})
+		}
+	}
+
+	results := s.runManifest(entries, 4, false)
+	for i, result := range results {
+		name := fmt.Sprintf("file%d", i)
+		s.Equal(client.ManifestSucceeded, result.Status, result.Error)
+		s.Equal(int64(len(sent[name])), result.Bytes)
+
+		for _, dir := range []string{s.clientDir, s.dataDir} {
+			received, err := ioutil.ReadFile(filepath.Join(dir, name))
+			s.Nil(err)
+			s.True(bytes.Equal(sent[name], received), name)
+		}
+	}
+	s.Equal(client.SuccessCode, client.ManifestExitCode(results))
+}
+
+// failingManifest returns a manifest whose second entry fails
+func (s *EndToEndTestSuite) failingManifest() []client.ManifestEntry {
+	s.writeData("remote", 100)
+	var entries []client.ManifestEntry
+	for _, name := range []string{"remote", "missing", "remote"} {
+		entries = append(entries, client.ManifestEntry{
+			Source:      client.RemotePrefix + filepath.Join(s.dataDir, name),
+			Destination: filepath.Join(s.clientDir, name),
+		})
+	}
+	return entries
+}
+
+func (s *EndToEndTestSuite) TestBatchStopsAtFailure() {
+	s.authorizeClientKey()
+
+	results := s.runManifest(s.failingManifest(), 1, false)
+	s.Equal(client.ManifestSucceeded, results[0].Status)
+	s.Equal(client.ManifestFailed, results[1].Status)
+	s.NotEmpty(results[1].Error)
+	s.Equal(client.ManifestSkipped, results[2].Status)
+	s.Equal(client.PartialFailureCode, client.ManifestExitCode(results))
+}
+
+func (s *EndToEndTestSuite) TestBatchContinueOnError() {
+	s.authorizeClientKey()
+
+	results := s.runManifest(s.failingManifest(), 1, true)
+	s.Equal(client.ManifestSucceeded, results[0].Status)
+	s.Equal(client.ManifestFailed, results[1].Status)
+	s.Equal(client.ManifestSucceeded, results[2].Status)
+	s.Equal(client.PartialFailureCode, client.ManifestExitCode(results))
+}
+
+func (s *EndToEndTestSuite) TestBatchPathDenied() {
+	s.authorizeClientKey()
+	s.cfg.PathPolicy.Deny = []string{filepath.Join(s.dataDir, "secret")}
+	s.writeData("secret", 100)
+
+	results := s.runManifest([]client.ManifestEntry{{
+		Source:      client.RemotePrefix + filepath.Join(s.dataDir, "secret"),
+		Destination: filepath.Join(s.clientDir, "secret"),
+	}}, 2, false)
+	s.Equal(client.ManifestFailed, results[0].Status)
+	s.Equal(client.ErrorCode, client.ManifestExitCode(results))
+}
@@ -2,30 +2,47 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"time"
 
 	"github.com/murphybytes/ucp/net"
+	"github.com/murphybytes/ucp/server"
 	"github.com/murphybytes/ucp/wire"
 )
 
-func readFromChildProcessAndSendToRemote(childProcessConn net.EncodeConn, remoteConn net.EncodeConn, transferInfo wire.FileTransferInformation) (e error) {
-	defer childProcessConn.Write(wire.FileTransferComplete)
-	fmt.Printf("read from child process %+v\n", transferInfo)
-
-	// Tell child process we want to send file
-	if e = childProcessConn.Write(&transferInfo); e != nil {
-		return
-	}
+// uploadMode is the mode uploaded files are created with, before the
+// worker's umask is applied
+const uploadMode os.FileMode = 0666
+
+// fileWorker is the part of the session worker's interface used to move
+// file contents
+type fileWorker interface {
+	OpenRead(root, path string) (handle int, size int64, e error)
+	OpenWrite(root, path string, mode os.FileMode, options server.UploadOptions) (handle int, e error)
+	Read(handle, size int) (data []byte, eof bool, e error)
+	Write(handle int, data []byte) error
+	CloseFile(handle int) error
+	Commit(handle int) error
+	Usage(directories []string, exclude []string, owned bool) (usage server.Usage, e error)
+}
 
-	// Read file size from child process
-	if e = childProcessConn.Read(&transferInfo); e != nil {
+// noLimit is the upload limit when no maximum file size applies
+const noLimit int64 = -1
+
+// sendFileToRemote has the session worker read localName, the name of the
+// file the remote requested after confinement, and relays its contents to
+// the remote until the worker reaches the end of the file. The data is
+// followed by the end of stream, so files whose size isn't known up front
+// can be sent too.
+func sendFileToRemote(sess *session, worker fileWorker, remoteConn net.EncodeConn, transferInfo wire.FileTransferInformation, root, localName string, digest *transferDigest) (e error) {
+	var handle int
+	if handle, transferInfo.FileSize, e = worker.OpenRead(root, localName); e != nil {
+		e = wire.NewError(wire.UnknownError, e.Error())
+		transferInfo.Error = e
+		remoteConn.Write(transferInfo)
 		return
 	}
-
-	fmt.Printf("Got transfer info %+v\n", transferInfo)
-
-	if transferInfo.Error != nil {
-		return transferInfo.Error
-	}
+	defer worker.CloseFile(handle)
 
 	// Send file size to remote client so it will know how many bytes to expect
 	if e = remoteConn.Write(transferInfo); e != nil {
@@ -37,50 +54,168 @@ func readFromChildProcessAndSendToRemote(childProcessConn net.EncodeConn, remote
 		return
 	}
 
-	fmt.Println("Remote is ready to get data")
-
 	if remoteClientMessage != wire.FileTransferStart {
 		return ErrClientFileTxferAbort
 	}
 
-	for totalRead := int64(0); totalRead < transferInfo.FileSize; {
-		fmt.Println("Read loop")
-		var chunk wire.FileChunk
+	for eof := false; !eof; {
+		var buffer []byte
+		buffer, eof, e = worker.Read(handle, sess.config.Limits.PipeBufferSize)
+		if e == nil && eof && transferInfo.FileSize != wire.UnknownSize && digest.count()+int64(len(buffer)) < transferInfo.FileSize {
+			e = fmt.Errorf("'%s' was truncated during the transfer", transferInfo.FileName)
+		}
 
-		if e = childProcessConn.Read(&chunk); e != nil {
+		if e != nil {
+			e = wire.NewError(wire.UnknownError, e.Error())
+			remoteConn.Write(wire.FileChunk{Error: e})
 			return
 		}
 
-		fmt.Printf("Read chunk Err %+v\n", chunk.Error)
-
-		if chunk.Error != nil {
-			return chunk.Error
+		if len(buffer) == 0 {
+			continue
 		}
 
-		totalRead += int64(len(chunk.Buffer))
-
-		fmt.Printf("Read %d of %d\n", totalRead, transferInfo.FileSize)
+		select {
+		case <-sess.aborted:
+			// server is shutting down, let the remote client know why the transfer stopped
+			remoteConn.Write(wire.FileChunk{
+				Error: wire.NewError(wire.ShuttingDown, wire.ErrServerShutdown.Error()),
+			})
+			return wire.ErrServerShutdown
+		default:
+		}
 
-		if e = remoteConn.Write(chunk.Buffer); e != nil {
+		sent := time.Now()
+		if e = remoteConn.WriteData(buffer); e != nil {
 			return
 		}
 
+		digest.Write(buffer)
+
 		if e = remoteConn.Read(&remoteClientMessage); e != nil {
 			return
 		}
+		chunkRoundTrip.Observe(sinceSeconds(sent))
 
 		if remoteClientMessage != wire.FileTransferMore {
 			return fmt.Errorf("Connection prematurely terminated by remote client")
 		}
+	}
+
+	return remoteConn.Write(wire.FileChunk{
+		End: &wire.EndOfStream{Size: digest.count(), Hash: digest.sum()},
+	})
+}
 
-		fmt.Println("remote client requests more")
+// receiveFileFromRemote reads file bytes from the remote client and has the
+// session worker write them to a temporary file until the remote ends the
+// stream. Only an upload that arrives intact is committed, replacing
+// localName, so nobody sees a partly written file. The remote is told when
+// to start and, once the file is in place, whether it was written. An
+// upload that passes limit bytes, unless limit is noLimit, or outgrows the
+// room reservation has for it in its quotas is stopped and the remote told
+// why straight away.
+func receiveFileFromRemote(sess *session, worker fileWorker, conn net.EncodeConn, transferInfo wire.FileTransferInformation, root, localName string, limit int64, reservation *quotaReservation, digest *transferDigest) (e error) {
+	options := server.UploadOptions{
+		NoClobber:    transferInfo.NoClobber,
+		BackupSuffix: transferInfo.BackupSuffix,
+		KeepPartial:  sess.config.KeepFailedUploads,
+		TempName:     reservation.tempName(),
+	}
 
-		if e = childProcessConn.Write(wire.FileTransferMore); e != nil {
-			// TODO: tell remote we're fucked
-			return
+	var handle int
+	if handle, e = worker.OpenWrite(root, localName, uploadMode, options); e != nil {
+		e = uploadError(e)
+		transferInfo.Error = e
+		conn.Write(transferInfo)
+		return
+	}
+
+	transferInfo.ChunkSize = sess.config.Limits.PipeBufferSize
+	if e = conn.Write(transferInfo); e != nil {
+		worker.CloseFile(handle)
+		return
+	}
+
+	for {
+		if sess.isAborted() {
+			e = wire.ErrServerShutdown
+			break
 		}
 
+		var buffer []byte
+		var chunk wire.FileChunk
+		if buffer, e = conn.ReadData(&chunk); e != nil {
+			break
+		}
+
+		if buffer == nil {
+			e = endOfUpload(chunk, digest)
+			break
+		}
+
+		if limit != noLimit && digest.count()+int64(len(buffer)) > limit {
+			net.PutBuffer(buffer)
+			e = wire.NewError(wire.QuotaExceeded, fmt.Sprintf("'%s' is larger than the maximum file size of %d bytes", transferInfo.FileName, limit))
+			break
+		}
+
+		if e = reservation.wrote(int64(len(buffer))); e != nil {
+			net.PutBuffer(buffer)
+			break
+		}
+
+		if e = worker.Write(handle, buffer); e == nil {
+			digest.Write(buffer)
+		}
+		net.PutBuffer(buffer)
+		if e != nil {
+			break
+		}
+	}
+
+	// the file is synced when it is committed, so the upload has only
+	// succeeded if the commit does
+	if e == nil {
+		e = worker.Commit(handle)
+	} else {
+		worker.CloseFile(handle)
+	}
+
+	transferInfo.FileSize = digest.count()
+	if e != nil {
+		transferInfo.Error = uploadError(e)
 	}
 
+	if err := conn.Write(transferInfo); e == nil {
+		e = err
+	}
 	return
 }
+
+// uploadError returns the error sent to the remote when an upload fails
+func uploadError(e error) *wire.Error {
+	if wireErr, ok := e.(*wire.Error); ok {
+		return wireErr
+	}
+
+	switch e {
+	case wire.ErrServerShutdown:
+		return wire.NewError(wire.ShuttingDown, e.Error())
+	case server.ErrDestinationExists:
+		return wire.NewError(wire.FileExists, e.Error())
+	}
+	return wire.NewError(wire.UnknownError, e.Error())
+}
+
+// endOfUpload returns why an upload stopped at chunk, which is nil if the
+// remote ended the stream and everything it sent arrived
+func endOfUpload(chunk wire.FileChunk, digest *transferDigest) error {
+	switch {
+	case chunk.Error != nil:
+		return chunk.Error
+	case chunk.End == nil:
+		return ErrClientFileData
+	}
+	return chunk.End.Check(digest.count(), digest.sum())
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/murphybytes/ucp/server"
+	"github.com/murphybytes/ucp/wire"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/suite"
+)
+
+type FileIOTestSuite struct {
+	suite.Suite
+	dir    string
+	conn   *MockEncodeConn
+	sess   *session
+	worker *server.WorkerClient
+	done   chan error
+}
+
+func (s *FileIOTestSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "fileio")
+	s.Require().Nil(err)
+
+	s.conn = new(MockEncodeConn)
+	cfg := server.NewConfig()
+	cfg.Limits.PipeBufferSize = 4
+	s.sess = &session{config: cfg, aborted: make(chan struct{}), terminated: make(chan struct{})}
+
+	// run the worker in process, the server talks to it the same way it
+	// talks to the worker process
+	parent, child := net.Pipe()
+	s.done = make(chan error, 1)
+	go func() {
+		s.done <- server.ServeWorker(server.NewWorker("nonce"), child)
+	}()
+	s.worker = server.NewWorkerClient(parent)
+}
+
+func (s *FileIOTestSuite) TearDownTest() {
+	s.worker.Close()
+	<-s.done
+	os.RemoveAll(s.dir)
+}
+
+func (s *FileIOTestSuite) TestSendFileToRemote() {
+	contents := []byte("some file contents")
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(s.dir, "file"), contents, 0600))
+
+	transferInfo := wire.FileTransferInformation{FileTransferType: wire.FileSend, FileName: "/file"}
+	expected := transferInfo
+	expected.FileSize = int64(len(contents))
+
+	var received []byte
+	var end wire.FileChunk
+	s.conn.On("Write", expected).Return(nil).Once()
+	s.conn.On("Write", mock.AnythingOfType("wire.FileChunk")).Return(nil).Once().Run(func(args mock.Arguments) {
+		end = args.Get(0).(wire.FileChunk)
+	})
+	s.conn.On("Read", mock.AnythingOfType("*wire.Conversation")).Return(nil).Once().Run(func(args mock.Arguments) {
+		*args.Get(0).(*wire.Conversation) = wire.FileTransferStart
+	})
+	s.conn.On("WriteData", mock.AnythingOfType("[]uint8")).Return(nil).Run(func(args mock.Arguments) {
+		received = append(received, args.Get(0).([]byte)...)
+	})
+	s.conn.On("Read", mock.AnythingOfType("*wire.Conversation")).Return(nil).Run(func(args mock.Arguments) {
+		*args.Get(0).(*wire.Conversation) = wire.FileTransferMore
+	})
+
+	digest := newTransferDigest()
+	s.Nil(sendFileToRemote(s.sess, s.worker, s.conn, transferInfo, s.dir, "file", digest))
+	s.Equal(contents, received)
+	s.Equal(int64(len(contents)), digest.count())
+
+	// the data is followed by the end of the stream
+	s.Require().NotNil(end.End)
+	s.Nil(end.Error)
+	s.Equal(int64(len(contents)), end.End.Size)
+	s.Equal(digest.sum(), end.End.Hash)
+}
+
+func (s *FileIOTestSuite) TestSendMissingFile() {
+	transferInfo := wire.FileTransferInformation{FileTransferType: wire.FileSend, FileName: "/missing"}
+
+	var reply wire.FileTransferInformation
+	s.conn.On("Write", mock.AnythingOfType("wire.FileTransferInformation")).Return(nil).Run(func(args mock.Arguments) {
+		reply = args.Get(0).(wire.FileTransferInformation)
+	})
+
+	err := sendFileToRemote(s.sess, s.worker, s.conn, transferInfo, s.dir, "missing", newTransferDigest())
+	s.NotNil(err)
+	s.NotNil(reply.Error)
+}
+
+// expectUpload has the mock remote send chunks followed by end
+func (s *FileIOTestSuite) expectUpload(chunks [][]byte, end *wire.EndOfStream) {
+	for _, buffer := range chunks {
+		s.conn.On("ReadData", mock.AnythingOfType("*wire.FileChunk")).Return(buffer, nil).Once()
+	}
+	s.conn.On("ReadData", mock.AnythingOfType("*wire.FileChunk")).Return(nil, nil).Once().Run(func(args mock.Arguments) {
+		args.Get(0).(*wire.FileChunk).End = end
+	})
+}
+
+func (s *FileIOTestSuite) TestReceiveFileFromRemote() {
+	// buffers may be shorter than the chunk size, only the end of the
+	// stream ends the upload
+	chunks := [][]byte{[]byte("so"), []byte("me f"), []byte("ile")}
+	digest := newTransferDigest()
+	digest.Write(bytes.Join(chunks, nil))
+	s.expectUpload(chunks, &wire.EndOfStream{Size: digest.count(), Hash: digest.sum()})
+
+	var replies []wire.FileTransferInformation
+	s.conn.On("Write", mock.AnythingOfType("wire.FileTransferInformation")).Return(nil).Run(func(args mock.Arguments) {
+		replies = append(replies, args.Get(0).(wire.FileTransferInformation))
+	})
+
+	transferInfo := wire.FileTransferInformation{FileTransferType: wire.FileReceive, FileName: "/file"}
+	s.Nil(receiveFileFromRemote(s.sess, s.worker, s.conn, transferInfo, s.dir, "file", noLimit, nil, newTransferDigest()))
+
+	contents, err := ioutil.ReadFile(filepath.Join(s.dir, "file"))
+	s.Nil(err)
+	s.Equal(bytes.Join(chunks, nil), contents)
+
+	// the remote is told the buffer size before it starts and how much
+	// arrived once the file is written
+	s.Require().Len(replies, 2)
+	s.Equal(4, replies[0].ChunkSize)
+	s.Equal(int64(len(contents)), replies[1].FileSize)
+	s.Nil(replies[1].Error)
+}
+
+// receiveWithEnd runs an upload of "some file" ended by end and returns
+// the reply sent once the file is closed
+func (s *FileIOTestSuite) receiveWithEnd(end *wire.EndOfStream) (reply wire.FileTransferInformation, e error) {
+	s.expectUpload([][]byte{[]byte("some"), []byte(" file")}, end)
+	s.conn.On("Write", mock.AnythingOfType("wire.FileTransferInformation")).Return(nil).Run(func(args mock.Arguments) {
+		reply = args.Get(0).(wire.FileTransferInformation)
+	})
+
+	transferInfo := wire.FileTransferInformation{FileTransferType: wire.FileReceive, FileName: "/file"}
+	e = receiveFileFromRemote(s.sess, s.worker, s.conn, transferInfo, s.dir, "file", noLimit, nil, newTransferDigest())
+	return
+}
+
+func (s *FileIOTestSuite) TestReceiveIncompleteUpload() {
+	reply, err := s.receiveWithEnd(&wire.EndOfStream{Size: 20})
+	s.NotNil(err)
+	s.NotNil(reply.Error)
+	s.Equal(int64(9), reply.FileSize)
+
+	// nothing is left behind by a failed upload
+	entries, err := ioutil.ReadDir(s.dir)
+	s.Nil(err)
+	s.Empty(entries)
+}
+
+func (s *FileIOTestSuite) TestReceiveIncompleteUploadKept() {
+	s.sess.config.KeepFailedUploads = true
+	_, err := s.receiveWithEnd(&wire.EndOfStream{Size: 20})
+	s.NotNil(err)
+
+	// the partial upload is kept under a hidden name
+	entries, err := ioutil.ReadDir(s.dir)
+	s.Nil(err)
+	s.Require().Len(entries, 1)
+	s.NotEqual("file", entries[0].Name())
+	s.Equal(int64(9), entries[0].Size())
+}
+
+func (s *FileIOTestSuite) TestReceiveNoClobber() {
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(s.dir, "file"), []byte("old"), 0600))
+
+	var reply wire.FileTransferInformation
+	s.conn.On("Write", mock.AnythingOfType("wire.FileTransferInformation")).Return(nil).Run(func(args mock.Arguments) {
+		reply = args.Get(0).(wire.FileTransferInformation)
+	})
+
+	transferInfo := wire.FileTransferInformation{FileTransferType: wire.FileReceive, FileName: "/file", NoClobber: true}
+	s.NotNil(receiveFileFromRemote(s.sess, s.worker, s.conn, transferInfo, s.dir, "file", noLimit, nil, newTransferDigest()))
+	s.Require().NotNil(reply.Error)
+	s.Equal(wire.FileExists, reply.Error.(*wire.Error).Code)
+}
+
+func (s *FileIOTestSuite) TestReceiveCorruptUpload() {
+	reply, err := s.receiveWithEnd(&wire.EndOfStream{Size: 9, Hash: "0000"})
+	s.Equal(wire.ErrStreamHash, err)
+	s.NotNil(reply.Error)
+}
+
+func (s *FileIOTestSuite) TestReceiveOverLimit() {
+	// the upload stops with the chunk that passes the limit
+	s.conn.On("ReadData", mock.AnythingOfType("*wire.FileChunk")).Return([]byte("some"), nil).Once()
+	s.conn.On("ReadData", mock.AnythingOfType("*wire.FileChunk")).Return([]byte(" file"), nil).Once()
+
+	var reply wire.FileTransferInformation
+	s.conn.On("Write", mock.AnythingOfType("wire.FileTransferInformation")).Return(nil).Run(func(args mock.Arguments) {
+		reply = args.Get(0).(wire.FileTransferInformation)
+	})
+
+	transferInfo := wire.FileTransferInformation{FileTransferType: wire.FileReceive, FileName: "/file", FileSize: wire.UnknownSize}
+	err := receiveFileFromRemote(s.sess, s.worker, s.conn, transferInfo, s.dir, "file", 5, nil, newTransferDigest())
+	s.Require().NotNil(err)
+	s.Equal(wire.QuotaExceeded, err.(*wire.Error).Code)
+	s.Require().NotNil(reply.Error)
+	s.Equal(wire.QuotaExceeded, reply.Error.(*wire.Error).Code)
+	s.Equal(int64(4), reply.FileSize)
+	s.conn.AssertExpectations(s.T())
+
+	entries, err := ioutil.ReadDir(s.dir)
+	s.Nil(err)
+	s.Empty(entries)
+}
+
+func (s *FileIOTestSuite) TestReceiveOutsideRoot() {
+	var reply wire.FileTransferInformation
+	s.conn.On("Write", mock.AnythingOfType("wire.FileTransferInformation")).Return(nil).Run(func(args mock.Arguments) {
+		reply = args.Get(0).(wire.FileTransferInformation)
+	})
+
+	transferInfo := wire.FileTransferInformation{FileTransferType: wire.FileReceive, FileName: "/../file"}
+	s.NotNil(receiveFileFromRemote(s.sess, s.worker, s.conn, transferInfo, s.dir, "../file", noLimit, nil, newTransferDigest()))
+	s.NotNil(reply.Error)
+}
+
+func TestFileIOTestSuite(t *testing.T) {
+	suite.Run(t, new(FileIOTestSuite))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/murphybytes/ucp/server"
+)
+
+// maxHookOutput limits how much of a hook's error output or response is
+// kept for the audit log
+const maxHookOutput = 512
+
+// hookPath is the PATH hook commands run with
+const hookPath = "/usr/local/bin:/usr/bin:/bin"
+
+// hookClient posts to URL hooks. It ignores proxy settings, hooks are
+// expected to be local services.
+var hookClient = &http.Client{Transport: &http.Transport{}}
+
+// runHooks runs the hooks that match a finished transfer, one at a time in
+// the order they are configured. Each hook has finished, or been stopped,
+// before the next one starts and before the session ends, so a draining
+// server waits for them. Failed hooks are recorded in the audit log.
+func runHooks(sess *session, s servicable, agent *user.User, event server.AuditEvent, localPath string) {
+	hookEvent := server.NewHookEvent(event, localPath)
+	var payload []byte
+
+	for i := range sess.config.Hooks {
+		hook := &sess.config.Hooks[i]
+		if !hook.Matches(event.Direction, event.Outcome) {
+			continue
+		}
+
+		if payload == nil {
+			payload, _ = json.Marshal(hookEvent)
+		}
+
+		started := time.Now()
+		if err := runHook(sess, s, agent, hook, hookEvent, payload); err != nil {
+			failure := sess.auditEvent(server.AuditHookFailure)
+			failure.Path = event.Path
+			failure.Direction = event.Direction
+			failure.Hook = hook.Name()
+			failure.DurationMillis = durationMillis(started)
+			failure.Error = err.Error()
+			sess.audit(failure)
+		}
+	}
+}
+
+// runHook runs a single hook, stopping it if it outlasts its timeout or the
+// session is terminated
+func runHook(sess *session, s servicable, agent *user.User, hook *server.HookConfig, event server.HookEvent, payload []byte) (e error) {
+	timeout := hook.TimeoutOrDefault()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	defer sess.whenTerminated(cancel)()
+
+	if hook.URL != "" {
+		e = postHook(ctx, hook.URL, payload)
+	} else {
+		e = execHook(ctx, s, agent, hook.Command, event, payload)
+	}
+
+	if e != nil && ctx.Err() == context.DeadlineExceeded {
+		e = fmt.Errorf("Hook timed out after %s", timeout)
+	}
+	return
+}
+
+// postHook POSTs payload to url, any status other than 2xx is a failure
+func postHook(ctx context.Context, url string, payload []byte) (e error) {
+	var request *http.Request
+	if request, e = http.NewRequest(http.MethodPost, url, bytes.NewReader(payload)); e != nil {
+		return
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	var response *http.Response
+	if response, e = hookClient.Do(request.WithContext(ctx)); e != nil {
+		return
+	}
+	defer response.Body.Close()
+
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxHookOutput))
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return hookFailure(fmt.Errorf("Hook returned %s", response.Status), body)
+	}
+	return
+}
+
+// execHook runs command as agent, the owner of the transferred file, in
+// agent's home directory. payload is written to its standard input and the
+// event is repeated in UCP_ environment variables for simple scripts. The
+// command runs in a process group of its own so anything it starts is
+// stopped with it.
+func execHook(ctx context.Context, s servicable, agent *user.User, command []string, event server.HookEvent, payload []byte) (e error) {
+	var credential *syscall.Credential
+	if credential, e = s.hookCredential(agent); e != nil {
+		return
+	}
+
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Dir = agent.HomeDir
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = []string{
+		"PATH=" + hookPath,
+		"HOME=" + agent.HomeDir,
+		"USER=" + agent.Username,
+		"LOGNAME=" + agent.Username,
+		"UCP_SESSION_ID=" + event.SessionID,
+		"UCP_USER=" + event.User,
+		"UCP_PATH=" + event.Path,
+		"UCP_LOCAL_PATH=" + event.LocalPath,
+		"UCP_DIRECTION=" + event.Direction,
+		"UCP_BYTES=" + strconv.FormatInt(event.Bytes, 10),
+		"UCP_SHA256=" + event.Hash,
+		"UCP_DURATION_MS=" + strconv.FormatInt(event.DurationMillis, 10),
+		"UCP_OUTCOME=" + event.Outcome,
+		"UCP_ERROR=" + event.Error,
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: credential}
+
+	var stderr cappedBuffer
+	cmd.Stderr = &stderr
+
+	if e = cmd.Start(); e != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+
+	e = cmd.Wait()
+	close(done)
+	if e != nil {
+		return hookFailure(e, stderr.Bytes())
+	}
+	return
+}
+
+// hookFailure adds what a hook said about its failure to e
+func hookFailure(e error, output []byte) error {
+	if message := strings.TrimSpace(string(output)); message != "" {
+		return fmt.Errorf("%s: %s", e.Error(), message)
+	}
+	return e
+}
+
+// cappedBuffer keeps the first maxHookOutput bytes written to it and
+// discards the rest
+type cappedBuffer struct {
+	bytes.Buffer
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if room := maxHookOutput - b.Len(); room > 0 {
+		if len(p) > room {
+			b.Buffer.Write(p[:room])
+		} else {
+			b.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
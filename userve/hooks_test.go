@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/murphybytes/ucp/server"
+	"github.com/stretchr/testify/suite"
+)
+
+type HooksTestSuite struct {
+	suite.Suite
+	dir      string
+	sess     *session
+	agent    *user.User
+	previous *server.AuditLog
+}
+
+func (s *HooksTestSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "hooks")
+	s.Require().Nil(err)
+
+	s.sess = &session{
+		id:         "session",
+		user:       "alice",
+		config:     server.NewConfig(),
+		aborted:    make(chan struct{}),
+		terminated: make(chan struct{}),
+	}
+	s.agent = &user.User{Username: "alice", HomeDir: s.dir}
+
+	s.previous = auditLog
+	auditLog, err = server.NewAuditLog(filepath.Join(s.dir, "audit.log"), server.DefaultAuditLogMaxSize, 0)
+	s.Require().Nil(err)
+}
+
+func (s *HooksTestSuite) TearDownTest() {
+	auditLog.Close()
+	auditLog = s.previous
+	os.RemoveAll(s.dir)
+}
+
+// script writes an executable shell script to the test directory
+func (s *HooksTestSuite) script(name, body string) string {
+	path := filepath.Join(s.dir, name)
+	s.Require().Nil(ioutil.WriteFile(path, []byte("#!/bin/sh\n"+body+"\n"), 0700))
+	return path
+}
+
+// transferEnd returns the audit event of a finished transfer
+func (s *HooksTestSuite) transferEnd(direction, outcome string) server.AuditEvent {
+	event := s.sess.auditEvent(server.AuditTransferEnd)
+	event.Path = "/incoming/report.csv"
+	event.Direction = direction
+	event.Bytes = 42
+	event.Hash = "abcd"
+	event.DurationMillis = 7
+	event.Outcome = outcome
+	return event
+}
+
+// auditEvents returns the events written to the audit log
+func (s *HooksTestSuite) auditEvents() (events []server.AuditEvent) {
+	f, err := os.Open(filepath.Join(s.dir, "audit.log"))
+	s.Require().Nil(err)
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var event server.AuditEvent
+		s.Require().Nil(json.Unmarshal(scanner.Bytes(), &event))
+		events = append(events, event)
+	}
+	return
+}
+
+func (s *HooksTestSuite) TestExecHook() {
+	output := filepath.Join(s.dir, "output")
+	command := s.script("hook", `cat > "`+output+`.json"; echo "$UCP_USER $UCP_PATH $UCP_LOCAL_PATH $UCP_BYTES $UCP_OUTCOME" > "`+output+`.env"`)
+	s.sess.config.Hooks = []server.HookConfig{{Command: []string{command}}}
+
+	runHooks(s.sess, &fakeService{}, s.agent, s.transferEnd(server.HookUpload, server.OutcomeSuccess), "/srv/incoming/report.csv")
+
+	payload, err := ioutil.ReadFile(output + ".json")
+	s.Require().Nil(err)
+	var event server.HookEvent
+	s.Require().Nil(json.Unmarshal(payload, &event))
+	s.Equal("session", event.SessionID)
+	s.Equal("alice", event.User)
+	s.Equal("/incoming/report.csv", event.Path)
+	s.Equal("/srv/incoming/report.csv", event.LocalPath)
+	s.Equal(server.HookUpload, event.Direction)
+	s.Equal(int64(42), event.Bytes)
+	s.Equal("abcd", event.Hash)
+	s.Equal(int64(7), event.DurationMillis)
+	s.Equal(server.OutcomeSuccess, event.Outcome)
+	s.False(event.Time.IsZero())
+
+	env, err := ioutil.ReadFile(output + ".env")
+	s.Nil(err)
+	s.Equal("alice /incoming/report.csv /srv/incoming/report.csv 42 success\n", string(env))
+	s.Empty(s.auditEvents())
+}
+
+func (s *HooksTestSuite) TestPostHook() {
+	var received server.HookEvent
+	var contentType string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+		json.NewDecoder(r.Body).Decode(&received)
+	}))
+	defer endpoint.Close()
+	s.sess.config.Hooks = []server.HookConfig{{URL: endpoint.URL}}
+
+	runHooks(s.sess, &fakeService{}, s.agent, s.transferEnd(server.HookDownload, server.OutcomeFailure), "")
+
+	s.Equal("application/json", contentType)
+	s.Equal("/incoming/report.csv", received.Path)
+	s.Equal(server.HookDownload, received.Direction)
+	s.Equal(server.OutcomeFailure, received.Outcome)
+	s.Empty(s.auditEvents())
+}
+
+func (s *HooksTestSuite) TestHooksRunInOrder() {
+	log := filepath.Join(s.dir, "log")
+	s.sess.config.Hooks = []server.HookConfig{
+		{Command: []string{s.script("first", `sleep 0.1; echo first >> "`+log+`"`)}},
+		{Command: []string{s.script("skipped", `echo skipped >> "`+log+`"`)}, Directions: []string{server.HookDownload}},
+		{Command: []string{s.script("second", `echo second >> "`+log+`"`)}},
+	}
+
+	runHooks(s.sess, &fakeService{}, s.agent, s.transferEnd(server.HookUpload, server.OutcomeSuccess), "")
+
+	contents, err := ioutil.ReadFile(log)
+	s.Nil(err)
+	s.Equal("first\nsecond\n", string(contents))
+}
+
+func (s *HooksTestSuite) TestNoHooksForBenchmarks() {
+	log := filepath.Join(s.dir, "log")
+	s.sess.config.Hooks = []server.HookConfig{{Command: []string{s.script("hook", `echo ran >> "`+log+`"`)}}}
+
+	runHooks(s.sess, &fakeService{}, s.agent, s.transferEnd("benchmark", server.OutcomeSuccess), "")
+
+	_, err := os.Stat(log)
+	s.True(os.IsNotExist(err))
+}
+
+func (s *HooksTestSuite) TestFailedHooksAudited() {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "ingest unavailable", http.StatusServiceUnavailable)
+	}))
+	defer endpoint.Close()
+	command := s.script("hook", "echo broken >&2; exit 3")
+	s.sess.config.Hooks = []server.HookConfig{{Command: []string{command}}, {URL: endpoint.URL}}
+
+	runHooks(s.sess, &fakeService{}, s.agent, s.transferEnd(server.HookUpload, server.OutcomeSuccess), "")
+
+	events := s.auditEvents()
+	s.Require().Len(events, 2)
+	for _, event := range events {
+		s.Equal(server.AuditHookFailure, event.Event)
+		s.Equal("session", event.SessionID)
+		s.Equal("/incoming/report.csv", event.Path)
+		s.Equal(server.HookUpload, event.Direction)
+	}
+	s.Equal(command, events[0].Hook)
+	s.True(strings.Contains(events[0].Error, "exit status 3"), events[0].Error)
+	s.True(strings.Contains(events[0].Error, "broken"), events[0].Error)
+	s.Equal(endpoint.URL, events[1].Hook)
+	s.True(strings.Contains(events[1].Error, "503"), events[1].Error)
+	s.True(strings.Contains(events[1].Error, "ingest unavailable"), events[1].Error)
+}
+
+func (s *HooksTestSuite) TestHookTimeout() {
+	// the hook's children are stopped along with it
+	command := s.script("hook", "sleep 10 & sleep 10")
+	s.sess.config.Hooks = []server.HookConfig{{Command: []string{command}, Timeout: server.Duration{Duration: 100 * time.Millisecond}}}
+
+	started := time.Now()
+	runHooks(s.sess, &fakeService{}, s.agent, s.transferEnd(server.HookUpload, server.OutcomeSuccess), "")
+	s.True(time.Since(started) < 5*time.Second)
+
+	events := s.auditEvents()
+	s.Require().Len(events, 1)
+	s.True(strings.Contains(events[0].Error, "timed out"), events[0].Error)
+}
+
+func (s *HooksTestSuite) TestHookStoppedWhenSessionTerminated() {
+	command := s.script("hook", "sleep 10")
+	s.sess.config.Hooks = []server.HookConfig{{Command: []string{command}}}
+
+	time.AfterFunc(100*time.Millisecond, s.sess.terminate)
+	started := time.Now()
+	runHooks(s.sess, &fakeService{}, s.agent, s.transferEnd(server.HookUpload, server.OutcomeSuccess), "")
+	s.True(time.Since(started) < 5*time.Second)
+	s.Len(s.auditEvents(), 1)
+}
+
+func TestHooksTestSuite(t *testing.T) {
+	suite.Run(t, new(HooksTestSuite))
+}
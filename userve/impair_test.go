@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/murphybytes/ucp/client"
+	unet "github.com/murphybytes/ucp/net"
+	"github.com/murphybytes/ucp/net/impair"
+	"github.com/murphybytes/ucp/server"
+)
+
+// The tests below run sessions over an impaired network. A slow network
+// must still deliver files intact, damage must make the transfer fail
+// rather than corrupt the file, and lost data must end the session through
+// the idle timeout rather than leave it hanging.
+
+// sessionTimeout bounds how long a session that has lost data may take to
+// be torn down
+const sessionTimeout = 5 * time.Second
+
+func (s *EndToEndTestSuite) download(contents []byte) (received []byte, e error) {
+	s.Require().Nil(ioutil.WriteFile(filepath.Join(s.dataDir, "remote"), contents, 0600))
+	local := filepath.Join(s.clientDir, "local")
+
+	e = s.connect("", func(conn unet.EncodeConn) error {
+		return client.ReceiveFile(local, filepath.Join(s.dataDir, "remote"), conn)
+	})
+	received, _ = ioutil.ReadFile(local)
+	return
+}
+
+func (s *EndToEndTestSuite) upload(contents []byte) (e error) {
+	local := filepath.Join(s.clientDir, "local")
+	s.Require().Nil(ioutil.WriteFile(local, contents, 0600))
+
+	return s.connect("", func(conn unet.EncodeConn) error {
+		return client.SendFile(local, filepath.Join(s.dataDir, "uploaded"), client.UploadOptions{}, conn)
+	})
+}
+
+func randomContents(size int) []byte {
+	contents := make([]byte, size)
+	for i := range contents {
+		contents[i] = byte(i * 7)
+	}
+	return contents
+}
+
+func (s *EndToEndTestSuite) TestSlowNetwork() {
+	s.authorizeClientKey()
+	slow := impair.Config{Latency: 2 * time.Millisecond, Jitter: 3 * time.Millisecond, Bandwidth: 1 << 20, Seed: 1}
+	s.clientImpairment, s.serverImpairment = &slow, &slow
+
+	contents := randomContents(10500)
+	received, err := s.download(contents)
+	s.Require().Nil(err)
+	s.True(bytes.Equal(contents, received))
+
+	s.Require().Nil(s.upload(contents))
+	uploaded, err := ioutil.ReadFile(filepath.Join(s.dataDir, "uploaded"))
+	s.Nil(err)
+	s.True(bytes.Equal(contents, uploaded))
+}
+
+func (s *EndToEndTestSuite) TestCorruptedDownloadFails() {
+	s.authorizeClientKey()
+	s.serverImpairment = &impair.Config{Faults: []impair.Fault{{Offset: 8000, Kind: impair.Corrupt}}}
+
+	contents := randomContents(10500)
+	received, err := s.download(contents)
+	s.NotNil(err)
+	s.False(bytes.Equal(contents, received))
+}
+
+func (s *EndToEndTestSuite) TestCorruptedUploadFails() {
+	s.authorizeClientKey()
+	s.clientImpairment = &impair.Config{Faults: []impair.Fault{{Offset: 4000, Kind: impair.Corrupt}}}
+	s.cfg.Limits.IdleTimeout = server.Duration{Duration: 200 * time.Millisecond}
+
+	s.NotNil(s.upload(randomContents(10500)))
+}
+
+func (s *EndToEndTestSuite) TestLostDataTimesOut() {
+	s.authorizeClientKey()
+	s.cfg.Limits.IdleTimeout = server.Duration{Duration: 200 * time.Millisecond}
+
+	for _, kind := range []impair.FaultKind{impair.Drop, impair.Truncate} {
+		s.serverImpairment = &impair.Config{Faults: []impair.Fault{{Offset: 8000, Kind: kind}}}
+
+		started := time.Now()
+		_, err := s.download(randomContents(10500))
+		s.NotNil(err)
+		s.True(time.Since(started) < sessionTimeout)
+	}
+}
+
+func (s *EndToEndTestSuite) TestDisconnectDuringUpload() {
+	s.authorizeClientKey()
+	s.clientImpairment = &impair.Config{Faults: []impair.Fault{{Offset: 4000, Kind: impair.Disconnect}}}
+
+	s.NotNil(s.upload(randomContents(10500)))
+}
+
+func (s *EndToEndTestSuite) TestDisconnectDuringDownload() {
+	s.authorizeClientKey()
+	s.serverImpairment = &impair.Config{Faults: []impair.Fault{{Offset: 8000, Kind: impair.Disconnect}}}
+
+	contents := randomContents(10500)
+	received, err := s.download(contents)
+	s.NotNil(err)
+	s.True(len(received) < len(contents))
+}
+
+func (s *EndToEndTestSuite) TestReorderingNeverCorrupts() {
+	s.authorizeClientKey()
+	s.cfg.Limits.IdleTimeout = server.Duration{Duration: 200 * time.Millisecond}
+
+	contents := randomContents(10500)
+	for seed := int64(1); seed <= 3; seed++ {
+		reorder := impair.Config{Jitter: 5 * time.Millisecond, Reorder: true, Seed: seed}
+		s.clientImpairment, s.serverImpairment = &reorder, &reorder
+
+		// frames may happen to arrive in order, but if they don't the
+		// transfer has to fail
+		received, err := s.download(contents)
+		if err == nil {
+			s.True(bytes.Equal(contents, received))
+		}
+		os.Remove(filepath.Join(s.clientDir, "local"))
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/murphybytes/ucp/server"
+)
+
+// failureRecord tracks failed password attempts for a user or address
+type failureRecord struct {
+	failures    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// authThrottle slows down and eventually locks out password guessing. Failed
+// attempts are counted per user name and per source address so spreading
+// guesses across accounts or addresses doesn't avoid the lockout.
+type authThrottle struct {
+	mu        sync.Mutex
+	users     map[string]*failureRecord
+	addresses map[string]*failureRecord
+	now       func() time.Time
+}
+
+var throttle = newAuthThrottle()
+
+func newAuthThrottle() *authThrottle {
+	return &authThrottle{
+		users:     make(map[string]*failureRecord),
+		addresses: make(map[string]*failureRecord),
+		now:       time.Now,
+	}
+}
+
+// isLocked returns true if password authentication is currently refused for
+// the user or the address
+func (t *authThrottle) isLocked(cfg *server.LockoutConfig, userName, address string) bool {
+	host := addressHost(address)
+	if cfg.IsTrusted(host) {
+		return false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	return t.record(t.users, userName, cfg, now).lockedUntil.After(now) ||
+		t.record(t.addresses, host, cfg, now).lockedUntil.After(now)
+}
+
+// recordFailure counts a failed attempt. It returns how long to wait before
+// answering the client and whether the attempt started a lockout.
+func (t *authThrottle) recordFailure(cfg *server.LockoutConfig, userName, address string) (delay time.Duration, lockedOut bool) {
+	host := addressHost(address)
+	if cfg.IsTrusted(host) {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.now()
+	t.prune(cfg, now)
+
+	failures := 0
+	for _, record := range []*failureRecord{t.add(t.users, userName, cfg, now), t.add(t.addresses, host, cfg, now)} {
+		if record == nil {
+			continue
+		}
+
+		record.failures++
+		record.lastFailure = now
+		if cfg.MaxFailures > 0 && record.failures >= cfg.MaxFailures && !record.lockedUntil.After(now) {
+			record.lockedUntil = now.Add(cfg.LockoutDuration.Duration)
+			lockedOut = true
+		}
+
+		if record.failures > failures {
+			failures = record.failures
+		}
+	}
+
+	delay = failureDelay(cfg, failures)
+	return
+}
+
+// recordSuccess clears failed attempts for a user. Failures from the address
+// are kept so a valid account can't be used to reset guessing at others.
+func (t *authThrottle) recordSuccess(userName string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.users, userName)
+}
+
+// record returns the current record for key, records that have expired are
+// reset. An empty record is returned if there is none.
+func (t *authThrottle) record(records map[string]*failureRecord, key string, cfg *server.LockoutConfig, now time.Time) *failureRecord {
+	record, ok := records[key]
+	if !ok || key == "" {
+		return &failureRecord{}
+	}
+
+	if expired(record, cfg, now) {
+		delete(records, key)
+		return &failureRecord{}
+	}
+	return record
+}
+
+// add returns the record for key creating it if necessary. Keys that are
+// empty, such as addresses that aren't known, are not tracked.
+func (t *authThrottle) add(records map[string]*failureRecord, key string, cfg *server.LockoutConfig, now time.Time) *failureRecord {
+	if key == "" {
+		return nil
+	}
+
+	if record, ok := records[key]; ok && !expired(record, cfg, now) {
+		return record
+	}
+
+	record := &failureRecord{}
+	records[key] = record
+	return record
+}
+
+func (t *authThrottle) prune(cfg *server.LockoutConfig, now time.Time) {
+	for _, records := range []map[string]*failureRecord{t.users, t.addresses} {
+		for key, record := range records {
+			if expired(record, cfg, now) {
+				delete(records, key)
+			}
+		}
+	}
+}
+
+// expired returns true once a record is no longer locked and its last
+// failure is older than the lockout duration
+func expired(record *failureRecord, cfg *server.LockoutConfig, now time.Time) bool {
+	if record.lockedUntil.After(now) {
+		return false
+	}
+
+	if !record.lockedUntil.IsZero() {
+		return true
+	}
+
+	return now.Sub(record.lastFailure) >= cfg.LockoutDuration.Duration
+}
+
+// failureDelay doubles the configured delay with each failure up to the
+// configured maximum
+func failureDelay(cfg *server.LockoutConfig, failures int) (delay time.Duration) {
+	if failures <= 0 || cfg.FailureDelay.Duration <= 0 {
+		return
+	}
+
+	delay = cfg.FailureDelay.Duration
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if cfg.MaxFailureDelay.Duration > 0 && delay >= cfg.MaxFailureDelay.Duration {
+			return cfg.MaxFailureDelay.Duration
+		}
+	}
+
+	if cfg.MaxFailureDelay.Duration > 0 && delay > cfg.MaxFailureDelay.Duration {
+		delay = cfg.MaxFailureDelay.Duration
+	}
+	return
+}
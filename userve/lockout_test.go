@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/murphybytes/ucp/server"
+	"github.com/stretchr/testify/suite"
+)
+
+type LockoutTestSuite struct {
+	suite.Suite
+	throttle *authThrottle
+	cfg      *server.LockoutConfig
+	now      time.Time
+}
+
+func (s *LockoutTestSuite) SetupTest() {
+	s.now = time.Date(2016, time.October, 1, 0, 0, 0, 0, time.UTC)
+	s.throttle = newAuthThrottle()
+	s.throttle.now = func() time.Time { return s.now }
+	s.cfg = &server.NewConfig().Auth.Lockout
+}
+
+func (s *LockoutTestSuite) TestBackoffDoubles() {
+	var delays []time.Duration
+	for i := 0; i < 4; i++ {
+		delay, _ := s.throttle.recordFailure(s.cfg, "bob", "10.0.0.1:9000")
+		delays = append(delays, delay)
+	}
+	s.Equal([]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}, delays)
+
+	s.cfg.MaxFailureDelay = server.Duration{Duration: 5 * time.Second}
+	s.Equal(5*time.Second, failureDelay(s.cfg, 10))
+}
+
+func (s *LockoutTestSuite) TestUserLockout() {
+	for i := 1; i < s.cfg.MaxFailures; i++ {
+		_, lockedOut := s.throttle.recordFailure(s.cfg, "bob", "10.0.0.1:9000")
+		s.False(lockedOut)
+	}
+	s.False(s.throttle.isLocked(s.cfg, "bob", "10.0.0.2:9000"))
+
+	_, lockedOut := s.throttle.recordFailure(s.cfg, "bob", "10.0.0.1:9000")
+	s.True(lockedOut)
+	s.True(s.throttle.isLocked(s.cfg, "bob", "10.0.0.2:9000"))
+	s.True(s.throttle.isLocked(s.cfg, "alice", "10.0.0.1:9000"))
+	s.False(s.throttle.isLocked(s.cfg, "alice", "10.0.0.2:9000"))
+
+	s.now = s.now.Add(s.cfg.LockoutDuration.Duration)
+	s.False(s.throttle.isLocked(s.cfg, "bob", "10.0.0.1:9000"))
+}
+
+func (s *LockoutTestSuite) TestAddressLockoutAcrossUsers() {
+	users := []string{"alice", "bob", "carol", "dave", "eve"}
+	for _, userName := range users {
+		s.throttle.recordFailure(s.cfg, userName, "10.0.0.1:9000")
+	}
+	s.True(s.throttle.isLocked(s.cfg, "frank", "10.0.0.1:9000"))
+	s.False(s.throttle.isLocked(s.cfg, "alice", "10.0.0.2:9000"))
+}
+
+func (s *LockoutTestSuite) TestSuccessResetsUser() {
+	for i := 1; i < s.cfg.MaxFailures; i++ {
+		s.throttle.recordFailure(s.cfg, "bob", unknownAddress)
+	}
+	s.throttle.recordSuccess("bob")
+
+	delay, lockedOut := s.throttle.recordFailure(s.cfg, "bob", unknownAddress)
+	s.False(lockedOut)
+	s.Equal(time.Second, delay)
+}
+
+func (s *LockoutTestSuite) TestFailuresExpire() {
+	s.throttle.recordFailure(s.cfg, "bob", "10.0.0.1:9000")
+	s.now = s.now.Add(s.cfg.LockoutDuration.Duration)
+
+	delay, _ := s.throttle.recordFailure(s.cfg, "bob", "10.0.0.1:9000")
+	s.Equal(time.Second, delay)
+	s.Len(s.throttle.users, 1)
+}
+
+func (s *LockoutTestSuite) TestTrustedNetworksAreExempt() {
+	s.cfg.TrustedNetworks = []string{"10.0.0.0/8"}
+	for i := 0; i < s.cfg.MaxFailures; i++ {
+		delay, lockedOut := s.throttle.recordFailure(s.cfg, "bob", "10.0.0.1:9000")
+		s.Zero(delay)
+		s.False(lockedOut)
+	}
+	s.False(s.throttle.isLocked(s.cfg, "bob", "10.0.0.1:9000"))
+}
+
+func TestLockoutTestSuite(t *testing.T) {
+	suite.Run(t, new(LockoutTestSuite))
+}
@@ -2,8 +2,6 @@ package main
 
 import (
 	"crypto/cipher"
-	"crypto/rand"
-	"crypto/rsa"
 	"errors"
 	"flag"
 	"fmt"
@@ -12,11 +10,10 @@ import (
 	"log"
 	"net"
 	"os"
-	"os/exec"
 	"os/user"
 	"path/filepath"
 	"strconv"
-	"syscall"
+	"time"
 
 	_ "github.com/joho/godotenv/autoload"
 	"github.com/murphybytes/ucp/crypto"
@@ -32,34 +29,73 @@ const successCode = 0
 const defaultInterface = "localhost"
 
 var generateKeys bool
+var keyType string
 var ucpDirectory string
 var hostInterface string
+var auditLogPath string
+var auditLogMaxSize int64
+var auditLogBackups int
 
-var ErrClientAESKeyAck = errors.New("Client didn't acknowledge receipt of AES keys")
+var auditLog *server.AuditLog
+
+var ErrClientSignature = errors.New("Client could not prove it holds its private key")
 var ErrClientFileTxferAbort = errors.New("File transfer aborted by client")
 var ErrClientFileTxferFail = errors.New("Client error during file transfer")
+var ErrClientPublicKey = errors.New("Client didn't send a public key")
+var ErrClientFileData = errors.New("Client sent a message instead of file data")
 
-func init() {
+// registerFlags defines the command line flags. It is called from main
+// rather than init so tests can link in packages that define flags of their
+// own, such as the client.
+func registerFlags() {
+	registerConfigFlags()
 
-	flag.BoolVar(&generateKeys, "generate-keys", false, "Generate rsa keys and exit.")
+	flag.BoolVar(&generateKeys, "generate-keys", false, "Generate keys and exit.")
+	flag.StringVar(&keyType, "type", crypto.DefaultKeyType, "Type of key to generate: ed25519, ecdsa or rsa")
 	flag.StringVar(&ucpDirectory, "ucp-directory", os.Getenv("UCP_SERVER_DIRECTORY"), "Directory where keys and other application files are stored")
 	flag.StringVar(&hostInterface, "host-interface", fmt.Sprintf("localhost:%d", server.DefaultPort), "Interface that server will listen on")
+	flag.StringVar(&auditLogPath, "audit-log", "", "Path to audit log, defaults to audit.log in the ucp directory")
+	flag.Int64Var(&auditLogMaxSize, "audit-log-max-size", server.DefaultAuditLogMaxSize, "Size in bytes at which the audit log is rotated")
+	flag.IntVar(&auditLogBackups, "audit-log-backups", server.DefaultAuditLogBackups, "Number of rotated audit logs to keep")
 }
 
 func main() {
 	var err error
+	registerFlags()
 	flag.Parse()
 
+	var cfg *server.Config
+	cfg, err = loadConfig()
+
+	if checkConfig {
+		if err == nil {
+			_, err = newOsService(cfg)
+		}
+		if err != nil {
+			fmt.Println("Configuration error: ", err)
+			os.Exit(errorCode)
+		}
+		fmt.Println("Configuration OK")
+		os.Exit(successCode)
+	}
+
+	if err != nil {
+		log.Println("Configuration error: ", err)
+		os.Exit(errorCode)
+	}
+
 	if generateKeys {
-		fmt.Println("Creating UCP keys and files in ", ucpDirectory)
+		fmt.Println("Creating UCP keys and files in ", cfg.Directory)
 
-		if err = crypto.InitializeUcpDir(ucpDirectory); err != nil {
+		if err = crypto.InitializeUcpDir(cfg.Directory, keyType); err != nil {
 			fmt.Println(err)
 			os.Exit(errorCode)
 		}
 		os.Exit(successCode)
 	}
 
+	setConfig(cfg)
+
 	if err = udt.Startup(); err != nil {
 		log.Printf("Init failed with error %s\n", err.Error())
 		os.Exit(errorCode)
@@ -67,243 +103,469 @@ func main() {
 
 	defer udt.Cleanup()
 
+	if auditLog, err = server.NewAuditLog(cfg.AuditLogPath(), cfg.Logging.AuditLogMaxSize, cfg.Logging.AuditLogBackups); err != nil {
+		log.Println("Unable to open audit log: ", err)
+		os.Exit(errorCode)
+	}
+	defer auditLog.Close()
+
 	var service *osService
-	if service, err = newOsService(); err != nil {
+	if service, err = newOsService(cfg); err != nil {
 		log.Println("Service initialization failed: ", err)
 		os.Exit(errorCode)
 	}
 
-	if listener, err := udt.Listen(hostInterface); err == nil {
-		defer listener.Close()
+	go handleReloadSignal(service)
 
-		for {
-			var conn net.Conn
-			if conn, err = listener.Accept(); err == nil {
-				// TODO: handle connection
-				go handleConnection(conn, service)
-			} else {
-				log.Println("Error accepting connection ", err)
-			}
+	if cfg.Metrics.Listen != "" {
+		if err = serveMetrics(cfg.Metrics.Listen); err != nil {
+			log.Println("Unable to start metrics listener: ", err)
+			os.Exit(errorCode)
 		}
-	} else {
-		log.Println("Error establishing server interface. ", err)
 	}
 
+	if cfg.Admin.Socket != "" {
+		var adminListener net.Listener
+		if adminListener, err = server.ListenAdmin(cfg.Admin.Socket, cfg.Admin.Group); err != nil {
+			log.Println("Unable to create admin socket: ", err)
+			os.Exit(errorCode)
+		}
+		defer adminListener.Close()
+		go serveAdmin(adminListener, service, cfg.Admin.Group)
+	}
+
+	var listeners []net.Listener
+	for _, address := range cfg.Listeners {
+		var listener net.Listener
+		if listener, err = udt.Listen(address); err != nil {
+			log.Println("Error establishing server interface. ", err)
+			closeListeners(listeners)
+			return
+		}
+		listeners = append(listeners, listener)
+		go serve(listener, service)
+	}
+	setServing(true)
+
+	force := waitForShutdownSignal()
+
+	// stop accepting new connections and let active transfers finish
+	closeListeners(listeners)
+	sessions.drain(getConfig().Limits.DrainTimeout.Duration, force)
+	log.Println("Shutdown complete")
 }
 
-func handleConnection(conn net.Conn, s servicable) {
-	defer conn.Close()
-	privateKey := s.getPrivateKey()
-	var err error
-	var async *unet.GobEncoderReaderWriter
-	var clientPublicKey *rsa.PublicKey
+// serve accepts connections until the listener is closed
+func serve(listener net.Listener, service servicable) {
+	for {
+		conn, err := listener.Accept()
+		if err == nil {
+			go handleConnection(conn, service)
+		} else if sessions.isDraining() {
+			return
+		} else {
+			log.Println("Error accepting connection ", err)
+		}
+	}
+}
 
-	if async, clientPublicKey, err = createEncryptedConnection(privateKey, conn); err != nil {
-		log.Println("ERROR: ", err)
+func closeListeners(listeners []net.Listener) {
+	for _, listener := range listeners {
+		listener.Close()
 	}
+}
 
-	// use AES encryption from here on out
+// notifyShutdown tells the client that the server is going away if the
+// session has been aborted or the server is draining. It returns true if
+// the client was notified.
+func notifyShutdown(sess *session, conn unet.EncodeConn) bool {
+	if !sess.isAborted() && !sessions.isDraining() {
+		return false
+	}
+
+	conn.Write(wire.ServerShutdown)
+	return true
+}
+
+// rejectConnection tells the client why the server won't accept the
+// connection
+func rejectConnection(sess *session, conn net.Conn, reason error) {
+	event := sess.auditEvent(server.AuditConnectionRejected)
+	event.Error = reason.Error()
+	sess.audit(event)
+
+	rw := unet.NewGobEncoderReaderWriter(unet.NewReaderWriter(conn))
+	rw.Write(wire.ServerHello{Error: reason})
+}
+
+func handleConnection(netConn net.Conn, s servicable) {
+	conn := newTimeoutConn(meteredConn{netConn})
+	defer conn.Close()
+	sess := newSession(conn)
+	if err := sessions.add(sess); err != nil {
+		rejectConnection(sess, conn, err)
+		return
+	}
+	defer sessions.remove(sess)
+
+	activeSessions.Inc()
+	defer activeSessions.Dec()
+
+	sess.audit(sess.auditEvent(server.AuditConnectionAccepted))
+	defer func() {
+		event := sess.auditEvent(server.AuditConnectionClosed)
+		event.DurationMillis = durationMillis(sess.started)
+		if conn.isTimedOut() {
+			event.Error = wire.ErrTimeout.Error()
+		}
+		sess.audit(event)
+	}()
+	defer sess.whenTerminated(func() { conn.Close() })()
+
+	limits := sess.config.Limits
+	conn.setDeadline(limits.HandshakeTimeout.Duration)
+
+	var err error
 	var aesConn unet.EncodeConn
-	aesConn, err = createAESEncryptedConnection(conn, async)
-	if err != nil {
+	var hello wire.ClientHello
+	var clientKey ssh.PublicKey
+
+	// use AES encryption from here on out
+	handshakeStarted := time.Now()
+	if aesConn, hello, clientKey, err = createEncryptedConnection(s.getHostKey(), s.getHostCertificate(), conn, limits.MaxFrameSize); err != nil {
 		log.Println("Failed to set up AES encrypted connection ", err.Error())
 		return
 	}
+	handshakeTime.Observe(sinceSeconds(handshakeStarted))
+	sess.setState(stateAuthenticating)
+	sess.certificate = hello.Certificate
+
+	if notifyShutdown(sess, aesConn) {
+		return
+	}
+
+	conn.setDeadline(limits.AuthTimeout.Duration)
 
 	var agent *user.User
-	agent, err = handleUserAuthorization(aesConn, s, clientPublicKey)
+	agent, err = handleUserAuthorization(sess, aesConn, s, clientKey)
 	if err != nil {
 		log.Println("Problem with user authorization: ", err)
 		return
 	}
 
-	if err = handleTransfer(agent, aesConn); err != nil {
-		log.Println("File transfer failed. ", err.Error())
+	if notifyShutdown(sess, aesConn) {
 		return
 	}
 
-}
+	var worker *server.WorkerClient
+	var stopWorker func()
+	sess.authenticated()
 
-func handleTransfer(agent *user.User, conn unet.EncodeConn) (e error) {
-	if e = conn.Write(wire.FileTransferInformationRequest); e != nil {
+	if worker, stopWorker, err = s.startWorker(sess, agent); err != nil {
+		workerFailures.Inc()
+		log.Println("Unable to start session worker: ", err)
 		return
 	}
+	defer stopWorker()
 
-	var transferInfo wire.FileTransferInformation
-	if e = conn.Read(&transferInfo); e != nil {
+	conn.setIdleTimeout(limits.IdleTimeout.Duration)
+
+	if err = handleTransfer(sess, s, agent, worker, aesConn); err != nil {
+		log.Println("File transfer failed. ", err.Error())
 		return
 	}
 
-	if transferInfo.FileTransferType == wire.FileSend {
-		e = sendFileToRemote(agent, conn, transferInfo)
-	} else {
-		e = receiveFileFromRemote(agent, conn, transferInfo)
+}
+
+// handleTransfer performs the transfer, or batch of transfers, the client
+// asks for
+func handleTransfer(sess *session, s servicable, agent *user.User, worker fileWorker, conn unet.EncodeConn) (e error) {
+	var transferInfo wire.FileTransferInformation
+	if transferInfo, e = requestTransfer(conn); e != nil {
+		return
 	}
 
-	return
+	if transferInfo.FileTransferType == wire.Batch {
+		return serveBatch(sess, s, agent, worker, conn, transferInfo)
+	}
+	return performTransfer(sess, s, agent, worker, conn, transferInfo)
 }
 
-func getIdsFromUser(u *user.User) (uid, gid uint32) {
-	val, _ := strconv.ParseUint(u.Uid, 10, 32)
-	uid = uint32(val)
-	val, _ = strconv.ParseUint(u.Gid, 10, 32)
-	gid = uint32(val)
+// requestTransfer asks the client what it wants to transfer
+func requestTransfer(conn unet.EncodeConn) (transferInfo wire.FileTransferInformation, e error) {
+	if e = conn.Write(wire.FileTransferInformationRequest); e != nil {
+		return
+	}
+
+	e = conn.Read(&transferInfo)
 	return
 }
 
-func userIsRoot() bool {
-	if u, e := user.Current(); e == nil {
-		return u.Uid == "0"
+// performTransfer performs a single transfer, then runs the hooks that
+// match it
+func performTransfer(sess *session, s servicable, agent *user.User, worker fileWorker, conn unet.EncodeConn, transferInfo wire.FileTransferInformation) (e error) {
+	started := time.Now()
+	event := sess.auditEvent(server.AuditTransferStart)
+	event.Path = transferInfo.FileName
+	event.Direction = transferDirection(transferInfo.FileTransferType)
+	sess.audit(event)
+
+	digest := newTransferDigest()
+	sess.startTransfer(transferInfo.FileName, event.Direction, digest)
+	defer sess.endTransfer()
+	upload := transferInfo.FileTransferType != wire.FileSend
+	var root, localName string
+	var limit int64
+	var reservation *quotaReservation
+	if transferInfo.FileTransferType == wire.Benchmark {
+		e = sendBenchmarkData(sess, conn, transferInfo, digest)
+	} else if !sess.config.PathPolicy.Permits(transferInfo.FileName) || !sess.keyOptions.PermitsPath(transferInfo.FileName, upload) {
+		e = wire.NewError(wire.PathDenied, fmt.Sprintf("Access to '%s' is not permitted", transferInfo.FileName))
+		transferInfo.Error = e
+		conn.Write(transferInfo)
+	} else if root, localName, e = confine(sess.config, agent, transferInfo.FileName, upload); e != nil {
+		e = wire.NewError(wire.PathDenied, e.Error())
+		transferInfo.Error = e
+		conn.Write(transferInfo)
+	} else if e = checkUploadOptions(sess, agent, transferInfo); e != nil {
+		transferInfo.Error = e
+		conn.Write(transferInfo)
+	} else if transferInfo.FileTransferType == wire.FileSend {
+		e = sendFileToRemote(sess, worker, conn, transferInfo, root, localName, digest)
+	} else if limit, reservation, e = checkQuotas(sess, agent, worker, transferInfo, localPath(root, localName)); e != nil {
+		transferInfo.Error = e
+		conn.Write(transferInfo)
+	} else {
+		e = receiveFileFromRemote(sess, worker, conn, transferInfo, root, localName, limit, reservation, digest)
+		reservation.release(e == nil)
 	}
 
-	return false
+	event.Event = server.AuditTransferEnd
+	event.Time = time.Time{}
+	event.Bytes = digest.count()
+	event.DurationMillis = durationMillis(started)
+	event.Hash = digest.sum()
+	event.Outcome = server.OutcomeSuccess
+	if e != nil {
+		event.Outcome = server.OutcomeFailure
+		event.Error = e.Error()
+	}
+	sess.audit(event)
 
-}
+	runHooks(sess, s, agent, event, localPath(root, localName))
 
-// Start process that will read a file as a user (agent) and send contents to stdout, this, the parent process
-// reads file bytes from stdout and sends them to remote client
-func sendFileToRemote(agent *user.User, conn unet.EncodeConn, transferInfo wire.FileTransferInformation) (e error) {
-	var (
-		listener  net.Listener
-		childConn net.Conn
-	)
+	return
+}
 
-	socketFileName := server.GetUniqueUnixSocketFileName()
+// confine resolves the file requested by agent against the confinement
+// rules. It returns the root directory the file must be opened under and the
+// path relative to it. If there are no rules root is empty and the name is
+// used as it is.
+func confine(cfg *server.Config, agent *user.User, name string, upload bool) (root, localName string, e error) {
+	if len(cfg.Confinement) == 0 {
+		return "", name, nil
+	}
 
-	if listener, e = net.Listen("unix", socketFileName); e != nil {
-		return
+	groups, err := server.UserGroups(agent)
+	if err != nil {
+		log.Println("Could not look up groups for", agent.Username, err.Error())
 	}
 
-	defer os.Remove(socketFileName)
+	rule := cfg.ConfinementFor(agent.Username, groups)
+	if rule == nil {
+		return "", "", server.ErrNoRoot
+	}
 
-	cmd := exec.Command("uproxy", fmt.Sprintf("-socket-path=%s", socketFileName))
+	return rule.Resolve(agent, name, upload)
+}
 
-	if userIsRoot() {
-		uid, gid := getIdsFromUser(agent)
-		cmd.SysProcAttr = &syscall.SysProcAttr{}
-		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+// checkUploadOptions returns an error if an upload's options can't be
+// used together, if its destination looks like the temporary file of an
+// upload, or if it would keep a backup the user may not write
+func checkUploadOptions(sess *session, agent *user.User, transferInfo wire.FileTransferInformation) error {
+	if transferInfo.FileTransferType != wire.FileReceive {
+		return nil
 	}
 
-	if e = cmd.Start(); e != nil {
-		return
-	}
-	fmt.Println("child started")
-	if childConn, e = listener.Accept(); e != nil {
-		return
+	if server.IsTempName(filepath.Base(transferInfo.FileName)) {
+		return wire.NewError(wire.PathDenied, server.ErrTempName.Error())
 	}
 
-	fmt.Println("connected to client ")
-
-	defer childConn.Close()
+	options := server.UploadOptions{NoClobber: transferInfo.NoClobber, BackupSuffix: transferInfo.BackupSuffix}
+	if err := options.Validate(); err != nil {
+		return wire.NewError(wire.UnknownError, err.Error())
+	}
 
-	rw := unet.NewReaderWriter(childConn)
-	encodedChildConn := unet.NewGobEncoderReaderWriter(rw)
+	if options.BackupSuffix == "" {
+		return nil
+	}
 
-	e = readFromChildProcessAndSendToRemote(encodedChildConn, conn, transferInfo)
+	backup := transferInfo.FileName + options.BackupSuffix
+	if !sess.config.PathPolicy.Permits(backup) || !sess.keyOptions.PermitsPath(backup, true) {
+		return wire.NewError(wire.PathDenied, fmt.Sprintf("Access to '%s' is not permitted", backup))
+	}
+	if _, _, err := confine(sess.config, agent, backup, true); err != nil {
+		return wire.NewError(wire.PathDenied, err.Error())
+	}
+	return nil
+}
 
-	cmd.Wait()
+// checkQuotas returns an error if an upload of the size the remote declared
+// to destination would exceed the maximum file size or a quota it counts
+// against. Otherwise it returns the largest file the upload may be, which
+// limits uploads whose size isn't known up front, and the room reserved for
+// it in its quotas, which must be released once it ends.
+func checkQuotas(sess *session, agent *user.User, worker fileWorker, transferInfo wire.FileTransferInformation, destination string) (limit int64, reservation *quotaReservation, e error) {
+	limit = noLimit
+	if max := sess.config.Limits.MaxFileSize; max > 0 {
+		if transferInfo.FileSize > max {
+			return limit, nil, wire.NewError(wire.QuotaExceeded, fmt.Sprintf("'%s' is larger than the maximum file size of %d bytes", transferInfo.FileName, max))
+		}
+		limit = max
+	}
 
+	if scopes := quotasFor(sess.config, agent, transferInfo.FileName, destination); len(scopes) > 0 {
+		reservation, e = quotas.reserve(worker, agent.Username, scopes, destination, transferInfo.FileSize)
+	}
 	return
-
 }
 
-// Read file bytes from remote client, send bytes to process running under account of user that owns the file via stdin
-func receiveFileFromRemote(agent *user.User, conn unet.EncodeConn, transferInfo wire.FileTransferInformation) (e error) {
-	uid, gid := getIdsFromUser(agent)
-	cmd := exec.Command("ucp_file_writer", fmt.Sprintf("-target-file=%s", transferInfo.FileName))
-	cmd.SysProcAttr = &syscall.SysProcAttr{}
-	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uid, Gid: gid}
+// quotasFor returns the quotas an upload by agent to name, stored at
+// destination, counts against. The user quota applies to everyone, confined
+// users also count against the quotas of their rule.
+func quotasFor(cfg *server.Config, agent *user.User, name, destination string) (scopes []server.QuotaScope) {
+	if cfg.Limits.UserQuota.IsSet() {
+		if scope, ok := cfg.Limits.UserQuota.ScopeFor(agent, destination); ok {
+			scopes = append(scopes, scope)
+		}
+	}
 
-	var stdIn io.WriteCloser
-	if stdIn, e = cmd.StdinPipe(); e != nil {
+	if len(cfg.Confinement) == 0 {
 		return
 	}
 
-	if e = cmd.Start(); e != nil {
-		return
+	groups, err := server.UserGroups(agent)
+	if err != nil {
+		log.Println("Could not look up groups for", agent.Username, err.Error())
 	}
 
-	for {
-		var buffer []byte
+	if rule := cfg.ConfinementFor(agent.Username, groups); rule != nil {
+		scopes = append(scopes, rule.QuotasFor(agent, name)...)
+	}
+	return
+}
 
-		if e = conn.Read(&buffer); e != nil {
-			cmd.Process.Kill()
-			break
-		}
+// localPath returns where the file named localName under root is on the
+// server
+func localPath(root, localName string) string {
+	if root == "" || localName == "" {
+		return localName
+	}
+	return filepath.Join(root, localName)
+}
 
-		if len(buffer) > 0 {
-			if _, e = stdIn.Write(buffer); e != nil {
-				break
-			}
-		}
+func durationMillis(started time.Time) int64 {
+	return int64(time.Since(started) / time.Millisecond)
+}
 
-		if len(buffer) < server.PipeBufferSize {
-			break
-		}
-	}
+func getIdsFromUser(u *user.User) (uid, gid uint32) {
+	val, _ := strconv.ParseUint(u.Uid, 10, 32)
+	uid = uint32(val)
+	val, _ = strconv.ParseUint(u.Gid, 10, 32)
+	gid = uint32(val)
+	return
+}
 
-	err := cmd.Wait()
-	if e == nil && err != nil {
-		e = err
+func userIsRoot() bool {
+	if u, e := user.Current(); e == nil {
+		return u.Uid == "0"
 	}
-	return
+
+	return false
+
 }
 
-func createEncryptedConnection(privateKey *rsa.PrivateKey, conn io.ReadWriteCloser) (econn *unet.GobEncoderReaderWriter, clientPubKey *rsa.PublicKey, e error) {
-	readerWriter := unet.NewReaderWriter(conn)
+// createEncryptedConnection performs the handshake with the client and
+// returns a connection that uses AES encryption. The AES key is agreed with
+// an ephemeral Curve25519 key exchange, then each end signs the session with
+// its identity key so the client knows it is talking to the holder of the
+// host key and the server knows the client holds the key it will
+// authenticate with. Frames larger than maxFrameSize are refused before they
+// are read.
+func createEncryptedConnection(hostKey ssh.Signer, hostCertificate []byte, conn io.ReadWriteCloser, maxFrameSize int) (aesConn unet.EncodeConn, hello wire.ClientHello, clientKey ssh.PublicKey, e error) {
+	readerWriter := unet.NewReaderWriterSize(conn, maxFrameSize)
 	rw := unet.NewGobEncoderReaderWriter(readerWriter)
 
-	if e = rw.Write(privateKey.PublicKey); e != nil {
+	var kex *crypto.KeyExchange
+	if kex, e = crypto.NewKeyExchange(); e != nil {
 		return
 	}
 
-	clientPubKey = &rsa.PublicKey{}
-	if e = rw.Read(clientPubKey); e != nil {
+	serverHello := wire.ServerHello{
+		HostKey:         hostKey.PublicKey().Marshal(),
+		HostCertificate: hostCertificate,
+		KeyExchange:     kex.Public,
+	}
+	if e = rw.Write(serverHello); e != nil {
 		return
 	}
 
-	econn = unet.NewGobEncoderReaderWriter(
-		unet.NewRSAReaderWriter(clientPubKey, privateKey, readerWriter),
-	)
+	if e = rw.Read(&hello); e != nil {
+		return
+	}
 
-	return
-}
+	if hello.PublicKey == nil {
+		e = ErrClientPublicKey
+		return
+	}
 
-func createAESEncryptedConnection(rootConn io.ReadWriteCloser, asymmConn unet.EncodeConn) (aesConn unet.EncodeConn, e error) {
-	aesParams := wire.SymmetricEncryptionParms{}
-	var block cipher.Block
-	if block, aesParams.Key, e = crypto.NewCipherBlock(); e != nil {
+	if clientKey, e = ssh.ParsePublicKey(hello.PublicKey); e != nil {
 		return
 	}
 
-	aesParams.InitializationVector = make([]byte, crypto.IVBlockSize)
-	rand.Read(aesParams.InitializationVector)
+	if _, ok := clientKey.(*ssh.Certificate); ok {
+		e = ErrClientPublicKey
+		return
+	}
 
-	if e = asymmConn.Write(aesParams); e != nil {
+	var secret []byte
+	if secret, e = kex.SharedSecret(hello.KeyExchange); e != nil {
 		return
 	}
 
-	log.Println("wrote aes connection")
+	sessionID := crypto.SessionID(serverHello.HostKey, serverHello.KeyExchange, hello.PublicKey, hello.KeyExchange, secret)
+
+	var seal, open cipher.AEAD
+	if seal, open, e = crypto.SessionCiphers(secret, sessionID, crypto.RoleServer); e != nil {
+		return
+	}
 
-	// expect a client response over aes channel
 	aesConn = unet.NewGobEncoderReaderWriter(
-		unet.NewCryptoReaderWriter(block, aesParams.InitializationVector,
-			unet.NewReaderWriter(rootConn),
-		),
+		unet.NewCryptoReaderWriter(seal, open, readerWriter),
 	)
 
-	if e = aesConn.Read(&aesParams); e != nil {
+	var serverSignature wire.SessionSignature
+	if serverSignature.Signature, e = crypto.SignSession(hostKey, crypto.RoleServer, sessionID); e != nil {
 		return
 	}
 
-	if !aesParams.ClientAck {
-		e = ErrClientAESKeyAck
+	if e = aesConn.Write(serverSignature); e != nil {
+		return
+	}
+
+	var clientSignature wire.SessionSignature
+	if e = aesConn.Read(&clientSignature); e != nil {
+		return
+	}
+
+	if e = crypto.VerifySession(clientKey, crypto.RoleClient, sessionID, clientSignature.Signature); e != nil {
+		e = ErrClientSignature
 	}
 
 	return
 }
 
-func handleUserAuthorization(conn unet.EncodeConn, s servicable, clientPubKey *rsa.PublicKey) (u *user.User, e error) {
+func handleUserAuthorization(sess *session, conn unet.EncodeConn, s servicable, sshPublicKey ssh.PublicKey) (u *user.User, e error) {
 
 	if e = conn.Write(wire.UserNameRequest); e != nil {
 		return
@@ -315,8 +577,18 @@ func handleUserAuthorization(conn unet.EncodeConn, s servicable, clientPubKey *r
 	}
 
 	fmt.Println("user name =", userName)
+	sess.user = userName
+
+	// got user see if requestor's public key in in authorized keys
+	sess.keyFingerprint = crypto.KeyFingerprint(sshPublicKey)
 
 	if u, e = s.lookupUser(userName); e != nil {
+		event := sess.auditEvent(server.AuditAuthFailure)
+		event.Error = e.Error()
+		sess.audit(event)
+		if sess.config.Auth.Password {
+			penalizeFailure(sess, "")
+		}
 		authResponse := wire.UserAuthorizationResponse{
 			AuthResponse: wire.NonexistantUser,
 			Description:  fmt.Sprintf("User '%s' is unknown", userName),
@@ -325,66 +597,135 @@ func handleUserAuthorization(conn unet.EncodeConn, s servicable, clientPubKey *r
 		return
 	}
 
-	// got user see if requestor's public key in in authorized keys
-	var sshPublicKey ssh.PublicKey
-	if sshPublicKey, e = ssh.NewPublicKey(clientPubKey); e != nil {
-		return
-	}
-
 	encodedPublicKey := ssh.MarshalAuthorizedKey(sshPublicKey)
 
 	var keyinAuthorizedKeys bool
-	keyinAuthorizedKeys, e = s.isKeyAuthorized(u, encodedPublicKey,
-		func() []byte {
-			if reader, err := os.Open(filepath.Join(u.HomeDir, ".ucp", "authorized_keys")); err == nil {
-				defer reader.Close()
-				if contents, ee := ioutil.ReadAll(reader); ee == nil {
-					return contents
-				}
+	var keyOptions server.KeyOptions
+	keyMethod := server.AuthMethodKey
+	if sess.config.Auth.PublicKey {
+		if sess.certificate != nil {
+			if keyOptions, e = checkUserCertificate(sess, s, u, sshPublicKey); e == nil {
+				keyinAuthorizedKeys = true
+				keyMethod = server.AuthMethodCertificate
 			}
-			return []byte{}
-		})
+			e = nil
+		}
 
-	if e != nil {
-		return
+		if !keyinAuthorizedKeys {
+			authorizedKeysPath := server.ExpandUserPath(sess.config.AuthorizedKeysFile, u)
+			keyinAuthorizedKeys, keyOptions, e = s.isKeyAuthorized(u, encodedPublicKey,
+				func() []byte {
+					if reader, err := os.Open(authorizedKeysPath); err == nil {
+						defer reader.Close()
+						if contents, ee := ioutil.ReadAll(reader); ee == nil {
+							return contents
+						}
+					}
+					return []byte{}
+				})
+
+			if e != nil {
+				return
+			}
+		}
+
+		if keyinAuthorizedKeys {
+			if err := keyOptions.Permits(sess.remoteAddress, time.Now()); err != nil {
+				keyinAuthorizedKeys = false
+				event := sess.auditEvent(server.AuditAuthFailure)
+				event.AuthMethod = keyMethod
+				event.Error = err.Error()
+				sess.audit(event)
+			}
+		}
 	}
 
 	authResponse := wire.UserAuthorizationResponse{}
 
 	if keyinAuthorizedKeys {
+		if e = sessions.claimUser(sess, u.Username); e != nil {
+			rejectUser(sess, conn, e)
+			return
+		}
 		authResponse.AuthResponse = wire.Authorized
-	} else {
+		sess.authMethod = keyMethod
+		sess.keyOptions = keyOptions
+		sess.audit(sess.auditEvent(server.AuditAuthSuccess))
+	} else if sess.config.Auth.Password {
+		if throttle.isLocked(&sess.config.Auth.Lockout, u.Username, sess.remoteAddress) {
+			e = wire.NewError(wire.LockedOut, "Too many failed password attempts, try again later")
+			rejectUser(sess, conn, e)
+			return
+		}
 		authResponse.AuthResponse = wire.PasswordRequired
+	} else {
+		authResponse.AuthResponse = wire.Unauthorized
+		authResponse.Description = "No acceptable authentication method"
+		event := sess.auditEvent(server.AuditAuthFailure)
+		event.Error = authResponse.Description
+		sess.audit(event)
 	}
 
 	if e = conn.Write(authResponse); e != nil {
 		return
 	}
 
-	if authResponse.AuthResponse == wire.PasswordRequired {
-		e = checkUserPassword(conn, s, u)
+	switch authResponse.AuthResponse {
+	case wire.PasswordRequired:
+		e = checkUserPassword(sess, conn, s, u)
+	case wire.Unauthorized:
+		e = wire.ErrUnauthorizedUser
+	}
+
+	return
+}
+
+// checkUserCertificate checks the certificate the client sent with its
+// public key. Failures are audited so the client can fall back to other
+// methods.
+func checkUserCertificate(sess *session, s servicable, u *user.User, key ssh.PublicKey) (options server.KeyOptions, e error) {
+	var cert *ssh.Certificate
+	if cert, e = server.ParseCertificate(sess.certificate); e == nil {
+		sess.certificateID = cert.KeyId
+		sess.serial = cert.Serial
+		options, e = s.checkUserCertificate(u, cert, key)
 	}
 
+	if e != nil {
+		event := sess.auditEvent(server.AuditAuthFailure)
+		event.AuthMethod = server.AuthMethodCertificate
+		event.Error = e.Error()
+		sess.audit(event)
+	}
 	return
 }
 
-func checkUserPassword(conn unet.EncodeConn, s servicable, user *user.User) (e error) {
+func checkUserPassword(sess *session, conn unet.EncodeConn, s servicable, user *user.User) (e error) {
 	var password string
 	if e = conn.Read(&password); e != nil {
 		return
 	}
 
-	fmt.Println("Got password", password)
-
 	e = s.validatePassword(user, password)
+	sess.authMethod = server.AuthMethodPassword
 
 	if e == nil {
+		throttle.recordSuccess(user.Username)
+		if e = sessions.claimUser(sess, user.Username); e != nil {
+			rejectUser(sess, conn, e)
+			return
+		}
 		fmt.Println("authorized")
+		sess.audit(sess.auditEvent(server.AuditAuthSuccess))
 		conn.Write(wire.UserAuthorizationResponse{
 			AuthResponse: wire.Authorized,
 			Description:  "Success",
 		})
 	} else {
+		event := sess.auditEvent(server.AuditAuthFailure)
+		event.Error = e.Error()
+		sess.audit(event)
+		penalizeFailure(sess, user.Username)
 		conn.Write(wire.UserAuthorizationResponse{
 			AuthResponse: wire.IncorrectPassword,
 			Description:  e.Error(),
@@ -394,3 +735,36 @@ func checkUserPassword(conn unet.EncodeConn, s servicable, user *user.User) (e e
 	return
 
 }
+
+// penalizeFailure records a failed attempt, audits the start of a lockout and
+// holds up the response to slow down password guessing
+func penalizeFailure(sess *session, userName string) {
+	delay, lockedOut := throttle.recordFailure(&sess.config.Auth.Lockout, userName, sess.remoteAddress)
+	if lockedOut {
+		sess.audit(sess.auditEvent(server.AuditAuthLockout))
+	}
+
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-sess.aborted:
+	}
+}
+
+// rejectUser tells an authenticated client that the session can't go ahead
+func rejectUser(sess *session, conn unet.EncodeConn, reason error) {
+	event := sess.auditEvent(server.AuditAuthFailure)
+	event.Error = reason.Error()
+	sess.audit(event)
+
+	conn.Write(wire.UserAuthorizationResponse{
+		AuthResponse: wire.Rejected,
+		Description:  reason.Error(),
+		Error:        reason,
+	})
+}
@@ -3,13 +3,18 @@ package main
 import (
 	"crypto/rand"
 	"crypto/rsa"
+	"net"
 	"os/user"
+	"syscall"
 	"testing"
 
 	"github.com/murphybytes/ucp/crypto"
+	unet "github.com/murphybytes/ucp/net"
+	"github.com/murphybytes/ucp/server"
 	"github.com/murphybytes/ucp/wire"
 	"github.com/stretchr/testify/mock"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ssh"
 )
 
 type MockEncodeConn struct {
@@ -20,14 +25,24 @@ type MockServiceable struct {
 	mock.Mock
 }
 
-func (ms *MockServiceable) getPrivateKey() *rsa.PrivateKey {
+func (ms *MockServiceable) getHostKey() ssh.Signer {
 	args := ms.Called()
-	return args.Get(0).(*rsa.PrivateKey)
+	return args.Get(0).(ssh.Signer)
 }
 
-func (ms *MockServiceable) isKeyAuthorized(u *user.User, key []byte, authFile func() []byte) (bool, error) {
+func (ms *MockServiceable) isKeyAuthorized(u *user.User, key []byte, authFile func() []byte) (bool, server.KeyOptions, error) {
 	args := ms.Called(u, key, authFile)
-	return args.Bool(0), args.Error(1)
+	return args.Bool(0), args.Get(1).(server.KeyOptions), args.Error(2)
+}
+
+func (ms *MockServiceable) getHostCertificate() []byte {
+	args := ms.Called()
+	return args.Get(0).([]byte)
+}
+
+func (ms *MockServiceable) checkUserCertificate(u *user.User, cert *ssh.Certificate, key ssh.PublicKey) (server.KeyOptions, error) {
+	args := ms.Called(u, cert, key)
+	return args.Get(0).(server.KeyOptions), args.Error(1)
 }
 
 func (ms *MockServiceable) lookupUser(userName string) (*user.User, error) {
@@ -40,6 +55,16 @@ func (ms *MockServiceable) validatePassword(user *user.User, password string) (e
 	return args.Error(0)
 }
 
+func (ms *MockServiceable) startWorker(sess *session, agent *user.User) (*server.WorkerClient, func(), error) {
+	args := ms.Called(sess, agent)
+	return args.Get(0).(*server.WorkerClient), args.Get(1).(func()), args.Error(2)
+}
+
+func (ms *MockServiceable) hookCredential(agent *user.User) (*syscall.Credential, error) {
+	args := ms.Called(agent)
+	return args.Get(0).(*syscall.Credential), args.Error(1)
+}
+
 func (m *MockEncodeConn) Read(a interface{}) error {
 	args := m.Called(a)
 	return args.Error(0)
@@ -50,25 +75,120 @@ func (m *MockEncodeConn) Write(a interface{}) error {
 	return args.Error(0)
 }
 
+func (m *MockEncodeConn) WriteData(data []byte) error {
+	args := m.Called(data)
+	return args.Error(0)
+}
+
+func (m *MockEncodeConn) ReadData(a interface{}) ([]byte, error) {
+	args := m.Called(a)
+	data, _ := args.Get(0).([]byte)
+	return data, args.Error(1)
+}
+
 //func(n *NetworkMock) Read()
 
 type ServerMainTestSuite struct {
 	suite.Suite
 	conn            *MockEncodeConn
 	service         *MockServiceable
-	clientPublicKey *rsa.PublicKey
+	clientPublicKey ssh.PublicKey
 }
 
 func (s *ServerMainTestSuite) SetupTest() {
 	s.conn = new(MockEncodeConn)
 	s.service = new(MockServiceable)
-	privateKey, _ := rsa.GenerateKey(rand.Reader, crypto.KeySize)
-	s.clientPublicKey = &privateKey.PublicKey
+	privateKey, _ := crypto.GenerateKey(crypto.KeyTypeEd25519)
+	signer, _ := ssh.NewSignerFromKey(privateKey)
+	s.clientPublicKey = signer.PublicKey()
 
 }
 
+// clientHandshake runs the client side of the connection handshake, signing
+// the session with signingKey
+func clientHandshake(conn net.Conn, clientKey, signingKey ssh.Signer) (aesConn unet.EncodeConn, e error) {
+	readerWriter := unet.NewReaderWriter(conn)
+	rw := unet.NewGobEncoderReaderWriter(readerWriter)
+
+	var hello wire.ServerHello
+	if e = rw.Read(&hello); e != nil {
+		return
+	}
+
+	kex, _ := crypto.NewKeyExchange()
+	clientHello := wire.ClientHello{
+		PublicKey:   clientKey.PublicKey().Marshal(),
+		KeyExchange: kex.Public,
+	}
+	if e = rw.Write(clientHello); e != nil {
+		return
+	}
+
+	secret, _ := kex.SharedSecret(hello.KeyExchange)
+	sessionID := crypto.SessionID(hello.HostKey, hello.KeyExchange, clientHello.PublicKey, kex.Public, secret)
+	seal, open, _ := crypto.SessionCiphers(secret, sessionID, crypto.RoleClient)
+	aesConn = unet.NewGobEncoderReaderWriter(unet.NewCryptoReaderWriter(seal, open, readerWriter))
+
+	var serverSignature wire.SessionSignature
+	if e = aesConn.Read(&serverSignature); e != nil {
+		return
+	}
+	hostKey, _ := ssh.ParsePublicKey(hello.HostKey)
+	if e = crypto.VerifySession(hostKey, crypto.RoleServer, sessionID, serverSignature.Signature); e != nil {
+		return
+	}
+
+	var clientSignature wire.SessionSignature
+	clientSignature.Signature, _ = crypto.SignSession(signingKey, crypto.RoleClient, sessionID)
+	e = aesConn.Write(clientSignature)
+	return
+}
+
 func (s *ServerMainTestSuite) TestCreateEncryptedConnection() {
+	hostPrivateKey, _ := crypto.GenerateKey(crypto.KeyTypeECDSA)
+	hostKey, _ := ssh.NewSignerFromKey(hostPrivateKey)
+	clientPrivateKey, _ := crypto.GenerateKey(crypto.KeyTypeEd25519)
+	clientKey, _ := ssh.NewSignerFromKey(clientPrivateKey)
+
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+
+	clientErrors := make(chan error, 1)
+	go func() {
+		conn, err := clientHandshake(clientSide, clientKey, clientKey)
+		if err == nil {
+			err = conn.Write(wire.UserNameRequest)
+		}
+		clientErrors <- err
+	}()
 
+	conn, _, authenticatedKey, err := createEncryptedConnection(hostKey, nil, serverSide, unet.DefaultMaxFrameSize)
+	s.Require().Nil(err)
+	s.Equal(clientKey.PublicKey().Marshal(), authenticatedKey.Marshal())
+
+	var request wire.Conversation
+	s.Nil(conn.Read(&request))
+	s.Equal(wire.UserNameRequest, request)
+	s.Nil(<-clientErrors)
+}
+
+func (s *ServerMainTestSuite) TestCreateEncryptedConnectionWrongKey() {
+	hostPrivateKey, _ := crypto.GenerateKey(crypto.KeyTypeEd25519)
+	hostKey, _ := ssh.NewSignerFromKey(hostPrivateKey)
+	clientPrivateKey, _ := crypto.GenerateKey(crypto.KeyTypeEd25519)
+	clientKey, _ := ssh.NewSignerFromKey(clientPrivateKey)
+	otherPrivateKey, _ := crypto.GenerateKey(crypto.KeyTypeEd25519)
+	otherKey, _ := ssh.NewSignerFromKey(otherPrivateKey)
+
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+
+	go clientHandshake(clientSide, clientKey, otherKey)
+
+	_, _, _, err := createEncryptedConnection(hostKey, nil, serverSide, unet.DefaultMaxFrameSize)
+	s.Equal(ErrClientSignature, err)
 }
 
 func (s *ServerMainTestSuite) TestCreateHandleUserAuthorization() {
@@ -101,6 +221,7 @@ func (s *ServerMainTestSuite) TestCreateHandleUserAuthorization() {
 		mock.AnythingOfType("func() []uint8"),
 	).Return(
 		true,
+		server.KeyOptions{},
 		nil,
 	)
 
@@ -113,12 +234,143 @@ func (s *ServerMainTestSuite) TestCreateHandleUserAuthorization() {
 		nil,
 	)
 
-	user, err := handleUserAuthorization(s.conn, s.service, s.clientPublicKey)
+	user, err := handleUserAuthorization(&session{config: server.NewConfig()}, s.conn, s.service, s.clientPublicKey)
 	s.Nil(err)
 	s.NotNil(user)
 
 }
 
+func (s *ServerMainTestSuite) TestHandleUserAuthorizationPasswordDisabled() {
+	userName := "bob"
+	expectedUser := user.User{
+		Username: userName,
+	}
+	cfg := server.NewConfig()
+	cfg.Auth.Password = false
+
+	s.conn.On("Write", wire.UserNameRequest).Return(nil)
+	s.conn.On(
+		"Read",
+		mock.AnythingOfType("*string"),
+	).Return(nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(*string)
+		*arg = userName
+	})
+
+	s.service.On(
+		"lookupUser",
+		userName,
+	).Return(
+		&expectedUser,
+		nil,
+	)
+
+	s.service.On(
+		"isKeyAuthorized",
+		&expectedUser,
+		mock.AnythingOfType("[]uint8"),
+		mock.AnythingOfType("func() []uint8"),
+	).Return(
+		false,
+		server.KeyOptions{},
+		nil,
+	)
+
+	s.conn.On(
+		"Write",
+		mock.AnythingOfType("wire.UserAuthorizationResponse"),
+	).Return(
+		nil,
+	)
+
+	_, err := handleUserAuthorization(&session{config: cfg}, s.conn, s.service, s.clientPublicKey)
+	s.Equal(wire.ErrUnauthorizedUser, err)
+	s.conn.AssertCalled(s.T(), "Write", wire.UserAuthorizationResponse{
+		AuthResponse: wire.Unauthorized,
+		Description:  "No acceptable authentication method",
+	})
+	s.service.AssertNotCalled(s.T(), "validatePassword", mock.Anything, mock.Anything)
+}
+
+func (s *ServerMainTestSuite) TestHandleUserAuthorizationCertificate() {
+	userName := "bob"
+	expectedUser := user.User{
+		Username: userName,
+	}
+
+	caKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	ca, _ := ssh.NewSignerFromKey(caKey)
+	cert := &ssh.Certificate{
+		Key:             s.clientPublicKey,
+		Serial:          7,
+		CertType:        ssh.UserCert,
+		KeyId:           "bob@example.com",
+		ValidPrincipals: []string{userName},
+		ValidBefore:     ssh.CertTimeInfinity,
+	}
+	s.Require().Nil(cert.SignCert(rand.Reader, ca))
+
+	s.conn.On("Write", wire.UserNameRequest).Return(nil)
+	s.conn.On(
+		"Read",
+		mock.AnythingOfType("*string"),
+	).Return(nil).Run(func(args mock.Arguments) {
+		arg := args.Get(0).(*string)
+		*arg = userName
+	})
+
+	s.service.On("lookupUser", userName).Return(&expectedUser, nil)
+	s.service.On(
+		"checkUserCertificate",
+		&expectedUser,
+		mock.AnythingOfType("*ssh.Certificate"),
+		mock.Anything,
+	).Return(
+		server.KeyOptions{},
+		nil,
+	)
+
+	s.conn.On(
+		"Write",
+		wire.UserAuthorizationResponse{
+			AuthResponse: wire.Authorized,
+		},
+	).Return(
+		nil,
+	)
+
+	sess := &session{config: server.NewConfig(), certificate: cert.Marshal()}
+	u, err := handleUserAuthorization(sess, s.conn, s.service, s.clientPublicKey)
+	s.Nil(err)
+	s.Equal(&expectedUser, u)
+	s.Equal(server.AuthMethodCertificate, sess.authMethod)
+	s.Equal("bob@example.com", sess.certificateID)
+	s.Equal(uint64(7), sess.serial)
+	s.service.AssertNotCalled(s.T(), "isKeyAuthorized", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func (s *ServerMainTestSuite) TestConfine() {
+	bob := &user.User{Username: "bob", HomeDir: "/home/bob"}
+	cfg := server.NewConfig()
+
+	root, name, err := confine(cfg, bob, "/etc/hosts", false)
+	s.Nil(err)
+	s.Equal("", root)
+	s.Equal("/etc/hosts", name)
+
+	cfg.Confinement = []server.ConfinementRule{{
+		Users: []string{"bob"},
+		Roots: []server.VirtualRoot{{Mount: "/", Directory: "%h"}},
+	}}
+	root, name, err = confine(cfg, bob, "/../etc/hosts", false)
+	s.Nil(err)
+	s.Equal("/home/bob", root)
+	s.Equal("etc/hosts", name)
+
+	_, _, err = confine(cfg, &user.User{Username: "alice"}, "/etc/hosts", false)
+	s.Equal(server.ErrNoRoot, err)
+}
+
 func TestServerMainTestSuite(t *testing.T) {
 	suite.Run(t, new(ServerMainTestSuite))
 }
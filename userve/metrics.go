@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/murphybytes/ucp/metrics"
+	"github.com/murphybytes/ucp/server"
+)
+
+// transferBuckets are upper bounds in seconds for transfer durations
+var transferBuckets = []float64{.1, .5, 1, 5, 10, 30, 60, 300, 900, 3600}
+
+var registry = metrics.NewRegistry()
+
+var (
+	activeSessions  = registry.NewGauge("ucp_active_sessions", "Client connections currently open.")
+	handshakeTime   = registry.NewHistogram("ucp_handshake_duration_seconds", "Time taken by the key exchange and session signatures.", nil)
+	authAttempts    = registry.NewCounterVec("ucp_auth_total", "Authentication attempts by method and outcome.", "method", "outcome")
+	transferBytes   = registry.NewCounterVec("ucp_transfer_bytes_total", "File bytes transferred by direction.", "direction")
+	transferTime    = registry.NewHistogramVec("ucp_transfer_duration_seconds", "Time taken by file transfers.", transferBuckets, "direction", "outcome")
+	chunkRoundTrip  = registry.NewHistogram("ucp_chunk_round_trip_seconds", "Time from sending a download chunk to the client asking for the next one.", nil)
+	workerFailures  = registry.NewCounter("ucp_worker_spawn_failures_total", "Session workers that could not be started.")
+	hookFailures    = registry.NewCounter("ucp_hook_failures_total", "Post-transfer hooks that failed or timed out.")
+	networkBytes    = registry.NewCounterVec("ucp_network_bytes_total", "Bytes read from and written to client connections, including protocol overhead.", "direction")
+	networkBytesIn  = networkBytes.With("in")
+	networkBytesOut = networkBytes.With("out")
+)
+
+// serving is set once the server is accepting connections
+var serving int32
+
+func setServing(on bool) {
+	var value int32
+	if on {
+		value = 1
+	}
+	atomic.StoreInt32(&serving, value)
+}
+
+// recordMetrics updates the metrics that are derived from audit events
+func recordMetrics(event server.AuditEvent) {
+	switch event.Event {
+	case server.AuditAuthSuccess:
+		authAttempts.With(authMethodLabel(event.AuthMethod), server.OutcomeSuccess).Inc()
+	case server.AuditAuthFailure:
+		authAttempts.With(authMethodLabel(event.AuthMethod), server.OutcomeFailure).Inc()
+	case server.AuditAuthLockout:
+		authAttempts.With(authMethodLabel(event.AuthMethod), "lockout").Inc()
+	case server.AuditTransferEnd:
+		transferBytes.With(event.Direction).Add(float64(event.Bytes))
+		transferTime.With(event.Direction, event.Outcome).Observe(float64(event.DurationMillis) / 1000)
+	case server.AuditHookFailure:
+		hookFailures.Inc()
+	}
+}
+
+// authMethodLabel names the method of failures that happen before the
+// client has chosen one
+func authMethodLabel(method string) string {
+	if method == "" {
+		return "none"
+	}
+	return method
+}
+
+func sinceSeconds(started time.Time) float64 {
+	return time.Since(started).Seconds()
+}
+
+// meteredConn counts the bytes read from and written to a client connection
+type meteredConn struct {
+	net.Conn
+}
+
+func (c meteredConn) Read(b []byte) (n int, e error) {
+	n, e = c.Conn.Read(b)
+	networkBytesIn.Add(float64(n))
+	return
+}
+
+func (c meteredConn) Write(b []byte) (n int, e error) {
+	n, e = c.Conn.Write(b)
+	networkBytesOut.Add(float64(n))
+	return
+}
+
+// serveMetrics starts the HTTP listener for metrics and health checks
+func serveMetrics(address string) (e error) {
+	var listener net.Listener
+	if listener, e = net.Listen("tcp", address); e != nil {
+		return
+	}
+
+	go func() {
+		if err := http.Serve(listener, metricsHandler()); err != nil {
+			log.Println("Metrics listener stopped: ", err)
+		}
+	}()
+	return
+}
+
+func metricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler(registry))
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if err := checkReady(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// checkReady returns why the server shouldn't be sent new connections, or
+// nil if it should
+func checkReady() error {
+	if atomic.LoadInt32(&serving) == 0 {
+		return fmt.Errorf("not accepting connections")
+	}
+
+	if sessions.isDraining() {
+		return fmt.Errorf("draining")
+	}
+
+	// sessions can't transfer files without a worker
+	if info, err := os.Stat(getConfig().ProxyPath); err != nil || info.Mode()&0111 == 0 {
+		return fmt.Errorf("worker program %s is not executable", getConfig().ProxyPath)
+	}
+
+	return nil
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/murphybytes/ucp/server"
+	"github.com/stretchr/testify/suite"
+)
+
+type MetricsTestSuite struct {
+	suite.Suite
+	previous *server.Config
+}
+
+func (s *MetricsTestSuite) SetupTest() {
+	s.previous = getConfig()
+	cfg := server.NewConfig()
+	cfg.ProxyPath = "/bin/sh"
+	setConfig(cfg)
+}
+
+func (s *MetricsTestSuite) TearDownTest() {
+	setServing(false)
+	setConfig(s.previous)
+}
+
+func (s *MetricsTestSuite) get(path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	metricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+	return recorder
+}
+
+func (s *MetricsTestSuite) TestAuditEventsAreCounted() {
+	recordMetrics(server.AuditEvent{Event: server.AuditAuthFailure})
+	recordMetrics(server.AuditEvent{Event: server.AuditAuthSuccess, AuthMethod: server.AuthMethodKey})
+	recordMetrics(server.AuditEvent{
+		Event:          server.AuditTransferEnd,
+		Direction:      "download",
+		Outcome:        server.OutcomeSuccess,
+		Bytes:          1024,
+		DurationMillis: 250,
+	})
+
+	recorder := s.get("/metrics")
+	s.Equal(http.StatusOK, recorder.Code)
+	body := recorder.Body.Bytes()
+	s.True(bytes.Contains(body, []byte(`ucp_auth_total{method="none",outcome="failure"}`)))
+	s.True(bytes.Contains(body, []byte(`ucp_auth_total{method="`+server.AuthMethodKey+`",outcome="success"}`)))
+	s.True(bytes.Contains(body, []byte(`ucp_transfer_bytes_total{direction="download"}`)))
+	s.True(bytes.Contains(body, []byte(`ucp_transfer_duration_seconds_bucket{direction="download",outcome="success",le="0.5"}`)))
+}
+
+func (s *MetricsTestSuite) TestHealthz() {
+	s.Equal(http.StatusOK, s.get("/healthz").Code)
+}
+
+func (s *MetricsTestSuite) TestReadyz() {
+	s.Equal(http.StatusServiceUnavailable, s.get("/readyz").Code)
+
+	setServing(true)
+	s.Equal(http.StatusOK, s.get("/readyz").Code)
+
+	cfg := server.NewConfig()
+	cfg.ProxyPath = "/nonexistent/uproxy"
+	setConfig(cfg)
+	s.Equal(http.StatusServiceUnavailable, s.get("/readyz").Code)
+}
+
+func TestMetricsTestSuite(t *testing.T) {
+	suite.Run(t, new(MetricsTestSuite))
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/murphybytes/ucp/server"
+	"github.com/murphybytes/ucp/wire"
+)
+
+// quotaLedger keeps track of the uploads to each quota scope. A walk of a
+// scope's directories leaves out the temporary files of uploads in flight,
+// which may not be as large as they will be, and is only as fresh as the
+// moment it was taken, so the ledger counts the uploads in flight and those
+// committed since. Checks against a scope are serialised so uploads running
+// at once can't all pass against the same usage.
+type quotaLedger struct {
+	mu     sync.Mutex
+	scopes map[string]*scopeEntry
+}
+
+// scopeEntry is what the ledger knows about a scope. It is kept while
+// uploads to the scope are in flight, once there are none a walk sees
+// everything committed. temps holds the temporary files of the uploads in
+// flight, any other file a walk finds is counted.
+type scopeEntry struct {
+	mu        sync.Mutex
+	key       string
+	inFlight  server.Usage
+	committed server.Usage
+	temps     map[string]bool
+	uploads   int
+}
+
+var quotas = newQuotaLedger()
+
+func newQuotaLedger() *quotaLedger {
+	return &quotaLedger{scopes: make(map[string]*scopeEntry)}
+}
+
+// scopeKey identifies a scope. Scopes that only count the files a user
+// owns are kept apart for each user.
+func scopeKey(scope server.QuotaScope, userName string) string {
+	owner := ""
+	if scope.Owned {
+		owner = userName
+	}
+	return fmt.Sprintf("%s\x00%s\x00%d\x00%d\x00%s", scope.Name, owner, scope.Quota.MaxBytes, scope.Quota.MaxFiles, strings.Join(scope.Directories, "\x00"))
+}
+
+func (l *quotaLedger) acquire(key string) *scopeEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry := l.scopes[key]
+	if entry == nil {
+		entry = &scopeEntry{key: key, temps: make(map[string]bool)}
+		l.scopes[key] = entry
+	}
+	entry.uploads++
+	return entry
+}
+
+func (l *quotaLedger) put(entry *scopeEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if entry.uploads--; entry.uploads == 0 {
+		delete(l.scopes, entry.key)
+	}
+}
+
+// reservedScope is a scope an upload counts against. base is the scope's
+// usage when the upload was checked less what the ledger had counted as
+// committed by then, so adding what is committed and in flight now gives
+// its usage now.
+type reservedScope struct {
+	scope server.QuotaScope
+	entry *scopeEntry
+	base  server.Usage
+}
+
+func (r *reservedScope) usage() server.Usage {
+	return r.base.Add(r.entry.committed).Add(r.entry.inFlight)
+}
+
+// quotaReservation is the room an upload holds in the scopes it counts
+// against until it ends. temp is the temporary file the upload is written
+// to.
+type quotaReservation struct {
+	ledger   *quotaLedger
+	scopes   []reservedScope
+	reserved server.Usage
+	written  int64
+	temp     string
+}
+
+// reserve checks an upload by userName of size bytes, which may be
+// unknown, to destination against scopes, and reserves room for it. The
+// upload must be written to the temporary file named by tempName, and the
+// reservation released once it has ended.
+func (l *quotaLedger) reserve(worker fileWorker, userName string, scopes []server.QuotaScope, destination string, size int64) (r *quotaReservation, e error) {
+	r = &quotaReservation{ledger: l, reserved: server.Usage{Bytes: size, Files: 1}}
+	r.temp = filepath.Join(filepath.Dir(destination), server.TempName(filepath.Base(destination)))
+	if size < 0 {
+		r.reserved.Bytes = 0
+	}
+
+	seen := make(map[string]bool)
+	for _, scope := range scopes {
+		key := scopeKey(scope, userName)
+		if !seen[key] {
+			seen[key] = true
+			r.scopes = append(r.scopes, reservedScope{scope: scope, entry: l.acquire(key)})
+		}
+	}
+
+	// every upload locks its scopes in the same order
+	sort.Slice(r.scopes, func(i, j int) bool {
+		return r.scopes[i].entry.key < r.scopes[j].entry.key
+	})
+
+	r.lock()
+	for i := range r.scopes {
+		reserved := &r.scopes[i]
+		exclude := []string{destination}
+		for temp := range reserved.entry.temps {
+			exclude = append(exclude, temp)
+		}
+
+		var usage server.Usage
+		if usage, e = worker.Usage(reserved.scope.Directories, exclude, reserved.scope.Owned); e != nil {
+			break
+		}
+
+		reserved.base = usage.Sub(reserved.entry.committed)
+		if err := reserved.scope.Quota.Check(reserved.scope.Name, reserved.usage(), size); err != nil {
+			e = wire.NewError(wire.QuotaExceeded, err.Error())
+			break
+		}
+	}
+
+	if e == nil {
+		for _, reserved := range r.scopes {
+			reserved.entry.inFlight = reserved.entry.inFlight.Add(r.reserved)
+			reserved.entry.temps[r.temp] = true
+		}
+	}
+	r.unlock()
+
+	if e != nil {
+		r.put()
+		return nil, e
+	}
+	return
+}
+
+func (r *quotaReservation) lock() {
+	for _, reserved := range r.scopes {
+		reserved.entry.mu.Lock()
+	}
+}
+
+func (r *quotaReservation) unlock() {
+	for _, reserved := range r.scopes {
+		reserved.entry.mu.Unlock()
+	}
+}
+
+func (r *quotaReservation) put() {
+	for _, reserved := range r.scopes {
+		r.ledger.put(reserved.entry)
+	}
+}
+
+// wrote counts n more bytes written by the upload, growing the reservation
+// if the upload is larger than it said. It returns a wire error if there
+// isn't room for them. A nil reservation has room for anything.
+func (r *quotaReservation) wrote(n int64) (e error) {
+	if r == nil {
+		return
+	}
+
+	extra := r.written + n - r.reserved.Bytes
+	if extra <= 0 {
+		r.written += n
+		return
+	}
+
+	r.lock()
+	defer r.unlock()
+
+	for i := range r.scopes {
+		reserved := &r.scopes[i]
+		if err := reserved.scope.Quota.CheckBytes(reserved.scope.Name, reserved.usage(), extra); err != nil {
+			return wire.NewError(wire.QuotaExceeded, err.Error())
+		}
+	}
+
+	for _, reserved := range r.scopes {
+		reserved.entry.inFlight.Bytes += extra
+	}
+	r.reserved.Bytes += extra
+	r.written += n
+	return
+}
+
+// tempName returns the name of the temporary file the upload must be
+// written to, or an empty string for a nil reservation, whose upload may
+// use any
+func (r *quotaReservation) tempName() string {
+	if r == nil {
+		return ""
+	}
+	return filepath.Base(r.temp)
+}
+
+// release gives back the room the upload reserved. If it was committed
+// what it wrote is counted until a walk sees it, a file it replaced is
+// counted too until then. Otherwise a temporary file that was kept is
+// counted by the next walk.
+func (r *quotaReservation) release(committed bool) {
+	if r == nil {
+		return
+	}
+
+	r.lock()
+	for _, reserved := range r.scopes {
+		reserved.entry.inFlight = reserved.entry.inFlight.Sub(r.reserved)
+		delete(reserved.entry.temps, r.temp)
+		if committed {
+			reserved.entry.committed = reserved.entry.committed.Add(server.Usage{Bytes: r.written, Files: 1})
+		}
+	}
+	r.unlock()
+
+	r.put()
+}
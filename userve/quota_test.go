@@ -0,0 +1,174 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/murphybytes/ucp/server"
+	"github.com/murphybytes/ucp/wire"
+	"github.com/stretchr/testify/suite"
+)
+
+// usageWorker finds the same usage in every scope, and keeps the paths it
+// was last asked to leave out
+type usageWorker struct {
+	fileWorker
+	usage   server.Usage
+	exclude []string
+}
+
+func (w *usageWorker) Usage(directories []string, exclude []string, owned bool) (server.Usage, error) {
+	w.exclude = exclude
+	return w.usage, nil
+}
+
+type QuotaTestSuite struct {
+	suite.Suite
+	ledger *quotaLedger
+	worker *usageWorker
+	scopes []server.QuotaScope
+}
+
+func (s *QuotaTestSuite) SetupTest() {
+	s.ledger = newQuotaLedger()
+	s.worker = &usageWorker{usage: server.Usage{Bytes: 200, Files: 2}}
+	s.scopes = []server.QuotaScope{{
+		Name:        server.QuotaUser,
+		Quota:       server.Quota{MaxBytes: 1000, MaxFiles: 5},
+		Directories: []string{"/home/bob"},
+		Owned:       true,
+	}}
+}
+
+func (s *QuotaTestSuite) reserve(size int64) (*quotaReservation, error) {
+	return s.ledger.reserve(s.worker, "bob", s.scopes, "/home/bob/file", size)
+}
+
+func (s *QuotaTestSuite) expectQuotaExceeded(err error) {
+	s.Require().NotNil(err)
+	s.Equal(wire.QuotaExceeded, err.(*wire.Error).Code)
+}
+
+func (s *QuotaTestSuite) TestUploadsInFlightCount() {
+	first, err := s.reserve(500)
+	s.Require().Nil(err)
+
+	// the walk doesn't see the first upload, the ledger does
+	_, err = s.reserve(400)
+	s.expectQuotaExceeded(err)
+
+	second, err := s.reserve(300)
+	s.Require().Nil(err)
+
+	first.release(false)
+	third, err := s.reserve(400)
+	s.Require().Nil(err)
+
+	second.release(false)
+	third.release(false)
+	s.Empty(s.ledger.scopes)
+}
+
+func (s *QuotaTestSuite) TestCommittedUploadsCount() {
+	streamed, err := s.reserve(wire.UnknownSize)
+	s.Require().Nil(err)
+
+	committed, err := s.reserve(500)
+	s.Require().Nil(err)
+	s.Nil(committed.wrote(500))
+	committed.release(true)
+	s.worker.usage = server.Usage{Bytes: 700, Files: 3}
+
+	// the streamed upload was checked before the other was committed, the
+	// ledger counts it since
+	s.expectQuotaExceeded(streamed.wrote(301))
+	s.Nil(streamed.wrote(300))
+
+	// a new walk sees the committed file, which isn't counted twice
+	empty, err := s.reserve(0)
+	s.Require().Nil(err)
+
+	empty.release(false)
+	streamed.release(false)
+	s.Empty(s.ledger.scopes)
+}
+
+func (s *QuotaTestSuite) TestFileCount() {
+	var reservations []*quotaReservation
+	for i := 0; i < 3; i++ {
+		reservation, err := s.reserve(0)
+		s.Require().Nil(err)
+		reservations = append(reservations, reservation)
+	}
+
+	_, err := s.reserve(0)
+	s.expectQuotaExceeded(err)
+
+	for _, reservation := range reservations {
+		reservation.release(false)
+	}
+}
+
+func (s *QuotaTestSuite) TestStreamedUploadGrows() {
+	streamed, err := s.reserve(wire.UnknownSize)
+	s.Require().Nil(err)
+	s.Nil(streamed.wrote(600))
+
+	other, err := s.reserve(100)
+	s.Require().Nil(err)
+
+	s.expectQuotaExceeded(streamed.wrote(101))
+	s.Nil(streamed.wrote(100))
+
+	other.release(false)
+	streamed.release(false)
+}
+
+func (s *QuotaTestSuite) TestUploadLargerThanDeclared() {
+	reservation, err := s.reserve(100)
+	s.Require().Nil(err)
+	s.Nil(reservation.wrote(100))
+	s.Nil(reservation.wrote(700))
+	s.expectQuotaExceeded(reservation.wrote(1))
+	reservation.release(false)
+}
+
+func (s *QuotaTestSuite) TestSameScopeTwice() {
+	s.scopes = append(s.scopes, s.scopes[0])
+	reservation, err := s.reserve(800)
+	s.Require().Nil(err)
+	s.Len(reservation.scopes, 1)
+	reservation.release(false)
+}
+
+func (s *QuotaTestSuite) TestTempFilesOfUploadsInFlightLeftOut() {
+	first, err := s.reserve(100)
+	s.Require().Nil(err)
+	s.Equal([]string{"/home/bob/file"}, s.worker.exclude)
+	s.True(server.IsTempName(first.tempName()))
+	s.Equal("/home/bob/"+first.tempName(), first.temp)
+
+	second, err := s.reserve(100)
+	s.Require().Nil(err)
+	s.Equal([]string{"/home/bob/file", first.temp}, s.worker.exclude)
+	s.NotEqual(first.temp, second.temp)
+
+	// a failed upload's temporary file may have been kept, it is counted
+	first.release(false)
+	third, err := s.reserve(100)
+	s.Require().Nil(err)
+	s.Equal([]string{"/home/bob/file", second.temp}, s.worker.exclude)
+
+	second.release(false)
+	third.release(false)
+}
+
+func (s *QuotaTestSuite) TestNilReservation() {
+	var reservation *quotaReservation
+	s.Empty(reservation.tempName())
+	s.Nil(reservation.wrote(1 << 40))
+	reservation.release(true)
+}
+
+func TestQuotaTestSuite(t *testing.T) {
+	suite.Run(t, new(QuotaTestSuite))
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/murphybytes/ucp/wire"
+)
+
+// sessionRegistry keeps track of active sessions so connection limits can
+// be enforced and sessions can be drained when the server shuts down
+type sessionRegistry struct {
+	mu        sync.Mutex
+	sessions  map[string]*session
+	addresses map[string]int
+	users     map[string]int
+	wg        sync.WaitGroup
+	draining  bool
+}
+
+var sessions = newSessionRegistry()
+
+func newSessionRegistry() *sessionRegistry {
+	return &sessionRegistry{
+		sessions:  make(map[string]*session),
+		addresses: make(map[string]int),
+		users:     make(map[string]int),
+	}
+}
+
+// add registers a session. It returns a wire error if the server is
+// draining or the global or per address connection limit has been reached.
+func (r *sessionRegistry) add(s *session) (e error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	limits := s.config.Limits
+	host := addressHost(s.remoteAddress)
+
+	switch {
+	case r.draining:
+		return wire.NewError(wire.ShuttingDown, wire.ErrServerShutdown.Error())
+	case limits.MaxConnections > 0 && len(r.sessions) >= limits.MaxConnections:
+		return wire.NewError(wire.TooManyConnections, "Server has too many connections")
+	case host != "" && limits.MaxSessionsPerAddress > 0 && r.addresses[host] >= limits.MaxSessionsPerAddress:
+		return wire.NewError(wire.TooManySessions, fmt.Sprintf("Too many sessions from %s", host))
+	}
+
+	r.sessions[s.id] = s
+	if host != "" {
+		r.addresses[host]++
+	}
+	r.wg.Add(1)
+	return
+}
+
+// claimUser counts the session against the user's session limit once the
+// user is known. It returns a wire error if the user has too many sessions.
+func (r *sessionRegistry) claimUser(s *session, userName string) (e error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.sessions[s.id]; !ok || s.claimedUser != "" {
+		return
+	}
+
+	limit := s.config.Limits.MaxSessionsPerUser
+	if limit > 0 && r.users[userName] >= limit {
+		return wire.NewError(wire.TooManySessions, fmt.Sprintf("User '%s' has too many sessions", userName))
+	}
+
+	r.users[userName]++
+	s.claimedUser = userName
+	return
+}
+
+func (r *sessionRegistry) remove(s *session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.sessions[s.id]; !ok {
+		return
+	}
+
+	delete(r.sessions, s.id)
+	if host := addressHost(s.remoteAddress); host != "" {
+		decrement(r.addresses, host)
+	}
+	if s.claimedUser != "" {
+		decrement(r.users, s.claimedUser)
+	}
+	r.wg.Done()
+}
+
+func decrement(counts map[string]int, key string) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+	} else {
+		counts[key]--
+	}
+}
+
+// addressHost returns the host part of a remote address or an empty string
+// if the address isn't known
+func addressHost(address string) string {
+	if address == "" || address == unknownAddress {
+		return ""
+	}
+
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		return host
+	}
+	return address
+}
+
+func (r *sessionRegistry) isDraining() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.draining
+}
+
+func (r *sessionRegistry) active() (active []*session) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, s := range r.sessions {
+		active = append(active, s)
+	}
+	return
+}
+
+// find returns the active session with id or nil if there isn't one
+func (r *sessionRegistry) find(id string) *session {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
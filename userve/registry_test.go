@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/murphybytes/ucp/server"
+	"github.com/murphybytes/ucp/wire"
+	"github.com/stretchr/testify/suite"
+)
+
+type RegistryTestSuite struct {
+	suite.Suite
+	registry *sessionRegistry
+}
+
+func (s *RegistryTestSuite) SetupTest() {
+	s.registry = newSessionRegistry()
+}
+
+func (s *RegistryTestSuite) newSession() *session {
+	sess := &session{
+		id:         newSessionID(),
+		config:     server.NewConfig(),
+		aborted:    make(chan struct{}),
+		terminated: make(chan struct{}),
+	}
+	s.Require().Nil(s.registry.add(sess))
+	return sess
+}
+
+func (s *RegistryTestSuite) TestMaxConnections() {
+	cfg := server.NewConfig()
+	cfg.Limits.MaxConnections = 2
+
+	first := &session{id: newSessionID(), config: cfg}
+	s.Nil(s.registry.add(first))
+	s.Nil(s.registry.add(&session{id: newSessionID(), config: cfg}))
+
+	err := s.registry.add(&session{id: newSessionID(), config: cfg})
+	s.Require().NotNil(err)
+	s.Equal(wire.TooManyConnections, err.(*wire.Error).Code)
+
+	s.registry.remove(first)
+	s.Nil(s.registry.add(&session{id: newSessionID(), config: cfg}))
+}
+
+func (s *RegistryTestSuite) TestMaxSessionsPerAddress() {
+	cfg := server.NewConfig()
+	cfg.Limits.MaxSessionsPerAddress = 1
+
+	s.Nil(s.registry.add(&session{id: newSessionID(), config: cfg, remoteAddress: "10.0.0.1:5000"}))
+	s.Nil(s.registry.add(&session{id: newSessionID(), config: cfg, remoteAddress: "10.0.0.2:5000"}))
+
+	err := s.registry.add(&session{id: newSessionID(), config: cfg, remoteAddress: "10.0.0.1:5001"})
+	s.Require().NotNil(err)
+	s.Equal(wire.TooManySessions, err.(*wire.Error).Code)
+
+	// addresses that can't be determined aren't limited
+	s.Nil(s.registry.add(&session{id: newSessionID(), config: cfg, remoteAddress: unknownAddress}))
+	s.Nil(s.registry.add(&session{id: newSessionID(), config: cfg, remoteAddress: unknownAddress}))
+}
+
+func (s *RegistryTestSuite) TestMaxSessionsPerUser() {
+	cfg := server.NewConfig()
+	cfg.Limits.MaxSessionsPerUser = 1
+
+	first := &session{id: newSessionID(), config: cfg}
+	second := &session{id: newSessionID(), config: cfg}
+	s.Nil(s.registry.add(first))
+	s.Nil(s.registry.add(second))
+
+	s.Nil(s.registry.claimUser(first, "bob"))
+	err := s.registry.claimUser(second, "bob")
+	s.Require().NotNil(err)
+	s.Equal(wire.TooManySessions, err.(*wire.Error).Code)
+	s.Nil(s.registry.claimUser(second, "alice"))
+
+	s.registry.remove(first)
+	third := &session{id: newSessionID(), config: cfg}
+	s.Nil(s.registry.add(third))
+	s.Nil(s.registry.claimUser(third, "bob"))
+}
+
+func TestRegistryTestSuite(t *testing.T) {
+	suite.Run(t, new(RegistryTestSuite))
+}
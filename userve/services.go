@@ -2,65 +2,208 @@ package main
 
 import (
 	"bytes"
-	"crypto/rsa"
+	"errors"
+	"fmt"
+	"log"
 	"os/user"
-	"path/filepath"
+	"sync"
+	"syscall"
 
 	"github.com/murphybytes/ucp/crypto"
 	"github.com/murphybytes/ucp/pam"
+	"github.com/murphybytes/ucp/server"
+	"golang.org/x/crypto/ssh"
 )
 
 type servicable interface {
-	getPrivateKey() *rsa.PrivateKey
-	isKeyAuthorized(*user.User, []byte, func() []byte) (bool, error)
+	getHostKey() ssh.Signer
+	getHostCertificate() []byte
+	isKeyAuthorized(*user.User, []byte, func() []byte) (bool, server.KeyOptions, error)
+	checkUserCertificate(*user.User, *ssh.Certificate, ssh.PublicKey) (server.KeyOptions, error)
 	lookupUser(string) (*user.User, error)
 	validatePassword(*user.User, string) error
+	startWorker(*session, *user.User) (*server.WorkerClient, func(), error)
+	hookCredential(*user.User) (*syscall.Credential, error)
 }
 
+var ErrCertificatesNotAccepted = errors.New("User certificates are not accepted")
+
 type userLookupFunc func(string) (*user.User, error)
 
 // osServices wraps os functionality, file access act
 type osService struct {
-	privateKey *rsa.PrivateKey
+	mu              sync.RWMutex
+	hostKey         ssh.Signer
+	hostCertificate []byte
+	userCA          *server.CertificateAuthority
+	revoked         *server.RevocationList
+	pamService      string
 }
 
-func newOsService() (service *osService, e error) {
+func newOsService(cfg *server.Config) (service *osService, e error) {
 	service = &osService{}
-	service.privateKey, e = crypto.GetPrivateKey(filepath.Join(ucpDirectory, "private-key.pem"))
-	if e != nil {
+	e = service.reload(cfg)
+	return
+}
+
+// reload reads the host key, certificates, revoked keys and PAM settings
+// from cfg
+func (s *osService) reload(cfg *server.Config) (e error) {
+	var hostKey ssh.Signer
+	if hostKey, e = crypto.GetSigner(cfg.PrivateKeyPath()); e != nil {
 		return
 	}
 
+	var hostCertificate []byte
+	if cfg.HostCertificate != "" {
+		if hostCertificate, e = loadHostCertificate(cfg.HostCertificate, hostKey.PublicKey()); e != nil {
+			return
+		}
+	}
+
+	var revoked *server.RevocationList
+	if cfg.Auth.RevokedKeys != "" {
+		if revoked, e = server.LoadRevocationList(cfg.Auth.RevokedKeys); e != nil {
+			return
+		}
+	}
+
+	var userCA *server.CertificateAuthority
+	if cfg.Auth.UserCAKeys != "" {
+		var keys []ssh.PublicKey
+		if keys, e = server.LoadPublicKeys(cfg.Auth.UserCAKeys); e != nil {
+			return
+		}
+		if len(keys) == 0 {
+			return fmt.Errorf("%s: no CA keys found", cfg.Auth.UserCAKeys)
+		}
+		userCA = server.NewCertificateAuthority(keys, revoked)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hostKey = hostKey
+	s.hostCertificate = hostCertificate
+	s.userCA = userCA
+	s.revoked = revoked
+	s.pamService = cfg.Auth.PamService
+
 	return
 }
 
-func (s *osService) getPrivateKey() (key *rsa.PrivateKey) {
-	return s.privateKey
+// loadHostCertificate reads a host certificate and checks that it is for
+// hostKey
+func loadHostCertificate(path string, hostKey ssh.PublicKey) (encoded []byte, e error) {
+	if encoded, e = server.LoadCertificate(path); e != nil {
+		return
+	}
+
+	var cert *ssh.Certificate
+	if cert, e = server.ParseCertificate(encoded); e != nil {
+		return
+	}
+
+	if cert.CertType != ssh.HostCert {
+		return nil, fmt.Errorf("%s: not a host certificate", path)
+	}
+
+	if !bytes.Equal(cert.Key.Marshal(), hostKey.Marshal()) {
+		return nil, fmt.Errorf("%s: %s", path, server.ErrCertificateKeyMismatch.Error())
+	}
+
+	return
+}
+
+func (s *osService) getHostKey() ssh.Signer {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hostKey
+}
+
+func (s *osService) getHostCertificate() []byte {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.hostCertificate
 }
 
+// isKeyAuthorized looks for encodedKey in the authorized keys returned by
+// authfile. The options of the first matching entry are returned, an entry
+// with options that can't be parsed doesn't authorize the key.
 func (s *osService) isKeyAuthorized(usr *user.User, encodedKey []byte,
-	authfile func() []byte) (auth bool, e error) {
+	authfile func() []byte) (auth bool, options server.KeyOptions, e error) {
 
-	contents := authfile()
+	var clientKey ssh.PublicKey
+	if clientKey, _, _, _, e = ssh.ParseAuthorizedKey(encodedKey); e != nil {
+		return
+	}
 
-	// strip off line feed
-	encodedKey = encodedKey[:len(encodedKey)-1]
+	s.mu.RLock()
+	revoked := s.revoked
+	s.mu.RUnlock()
+	if revoked.IsRevoked(clientKey) {
+		log.Println("Refusing revoked key ", crypto.KeyFingerprint(clientKey), " for ", usr.Username)
+		return
+	}
 
-	for _, line := range bytes.Split(contents, []byte{'\n'}) {
+	rest := authfile()
+	for len(rest) > 0 {
+		var (
+			key        ssh.PublicKey
+			rawOptions []string
+			err        error
+		)
+		if key, _, rawOptions, rest, err = ssh.ParseAuthorizedKey(rest); err != nil {
+			break
+		}
 
-		if bytes.Equal(line, encodedKey) {
-			return true, nil
+		if !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+			continue
 		}
+
+		if options, err = server.ParseKeyOptions(rawOptions); err != nil {
+			log.Println("Ignoring authorized key for ", usr.Username, ": ", err)
+			return false, server.KeyOptions{}, nil
+		}
+		return true, options, nil
 	}
 
-	return false, nil
+	return
 
 }
 
+// checkUserCertificate checks that cert is a valid certificate for key signed
+// by a trusted user CA
+func (s *osService) checkUserCertificate(usr *user.User, cert *ssh.Certificate, key ssh.PublicKey) (options server.KeyOptions, e error) {
+	s.mu.RLock()
+	userCA := s.userCA
+	s.mu.RUnlock()
+
+	if userCA == nil {
+		return options, ErrCertificatesNotAccepted
+	}
+
+	return userCA.CheckUserCertificate(cert, key, usr.Username)
+}
+
 func (s *osService) lookupUser(userName string) (u *user.User, e error) {
 	return user.Lookup(userName)
 }
 
-func (s osService) validatePassword(user *user.User, password string) error {
-	return pam.AuthorizeUser(user.Username, password)
+func (s *osService) validatePassword(user *user.User, password string) error {
+	s.mu.RLock()
+	service := s.pamService
+	s.mu.RUnlock()
+	return pam.AuthorizeServiceUser(service, user.Username, password)
+}
+
+// startWorker starts the process that handles the session's files as the
+// authenticated user
+func (s *osService) startWorker(sess *session, agent *user.User) (*server.WorkerClient, func(), error) {
+	return spawnWorker(sess, agent)
+}
+
+// hookCredential returns the credentials hook commands run with, which are
+// those of the session worker
+func (s *osService) hookCredential(agent *user.User) (*syscall.Credential, error) {
+	return workerCredential(agent)
 }
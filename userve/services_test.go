@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/rand"
 	"crypto/rsa"
 	"os/user"
@@ -19,21 +20,21 @@ type ServicesTestSuite struct {
 
 func (s *ServicesTestSuite) SetupTest() {
 	s.service = &osService{}
-	s.service.privateKey, _ = rsa.GenerateKey(rand.Reader, uc.KeySize)
-	s.authorizedKeys, _ = uc.CreateBase64EncodedPublicKey(s.service.privateKey)
+	privateKey, _ := rsa.GenerateKey(rand.Reader, uc.KeySize)
+	s.authorizedKeys, _ = uc.CreateBase64EncodedPublicKey(privateKey)
 
 	p, _ := rsa.GenerateKey(rand.Reader, uc.KeySize)
 	b, _ := uc.CreateBase64EncodedPublicKey(p)
 	s.authorizedKeys = append(s.authorizedKeys, b...)
 
-	s.encodedKey, _ = uc.CreateBase64EncodedPublicKey(s.service.privateKey)
+	s.encodedKey, _ = uc.CreateBase64EncodedPublicKey(privateKey)
 
 }
 
 func (s *ServicesTestSuite) TestAuthorizedKeyPresent() {
 	// dead fox
 	var u user.User
-	auth, e := s.service.isKeyAuthorized(&u, s.encodedKey, func() []byte { return s.authorizedKeys })
+	auth, _, e := s.service.isKeyAuthorized(&u, s.encodedKey, func() []byte { return s.authorizedKeys })
 	s.Nil(e)
 	s.True(auth)
 
@@ -50,7 +51,7 @@ func (s *ServicesTestSuite) TestAuthorizedKeyNotPresent() {
 	}
 
 	var u user.User
-	auth, e := s.service.isKeyAuthorized(&u, s.encodedKey, func() []byte { return someKeys })
+	auth, _, e := s.service.isKeyAuthorized(&u, s.encodedKey, func() []byte { return someKeys })
 	s.Nil(e)
 	s.False(auth)
 
@@ -59,12 +60,35 @@ func (s *ServicesTestSuite) TestAuthorizedKeyNotPresent() {
 func (s *ServicesTestSuite) TestAuthorizedKeyFileEmpty() {
 
 	var u user.User
-	auth, e := s.service.isKeyAuthorized(&u, s.encodedKey, func() []byte { return []byte{} })
+	auth, _, e := s.service.isKeyAuthorized(&u, s.encodedKey, func() []byte { return []byte{} })
 	s.Nil(e)
 	s.False(auth)
 
 }
 
+func (s *ServicesTestSuite) TestAuthorizedKeyWithOptionsAndComment() {
+	line := append([]byte(`# automation key
+from="10.0.0.0/8",no-upload,permit-paths="/data/*" `), bytes.TrimSpace(s.encodedKey)...)
+	line = append(line, []byte(" backup@example.com\n")...)
+
+	var u user.User
+	auth, options, e := s.service.isKeyAuthorized(&u, s.encodedKey, func() []byte { return line })
+	s.Nil(e)
+	s.True(auth)
+	s.Equal([]string{"10.0.0.0/8"}, options.From)
+	s.Equal([]string{"/data/*"}, options.PermitPaths)
+	s.True(options.ReadOnly)
+}
+
+func (s *ServicesTestSuite) TestAuthorizedKeyWithUnsupportedOption() {
+	line := append([]byte(`command="/bin/sh" `), s.encodedKey...)
+
+	var u user.User
+	auth, _, e := s.service.isKeyAuthorized(&u, s.encodedKey, func() []byte { return line })
+	s.Nil(e)
+	s.False(auth)
+}
+
 func TestServicesTestSuite(t *testing.T) {
 	suite.Run(t, new(ServicesTestSuite))
 }
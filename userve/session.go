@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/murphybytes/ucp/server"
+	"github.com/murphybytes/ucp/wire"
+)
+
+const unknownAddress = "unknown"
+
+// Session states reported over the admin socket
+const (
+	stateHandshake      = "handshake"
+	stateAuthenticating = "authenticating"
+	stateIdle           = "idle"
+	stateTransferring   = "transferring"
+)
+
+// session holds information about a single client connection that is
+// recorded in the audit log
+type session struct {
+	id             string
+	remoteAddress  string
+	started        time.Time
+	user           string
+	authMethod     string
+	keyFingerprint string
+	keyOptions     server.KeyOptions
+	certificate    []byte
+	certificateID  string
+	serial         uint64
+	config         *server.Config
+	claimedUser    string
+
+	abortOnce     sync.Once
+	aborted       chan struct{}
+	terminateOnce sync.Once
+	terminated    chan struct{}
+
+	// status is read by the admin socket while the session runs
+	mu     sync.Mutex
+	status sessionStatus
+}
+
+// sessionStatus is what the admin socket reports about a session
+type sessionStatus struct {
+	state           string
+	user            string
+	authMethod      string
+	keyFingerprint  string
+	certificateID   string
+	serial          uint64
+	workerPID       int
+	path            string
+	direction       string
+	transferStarted time.Time
+	digest          *transferDigest
+	transfers       int
+}
+
+func newSession(conn net.Conn) *session {
+	return &session{
+		id:            newSessionID(),
+		remoteAddress: remoteAddress(conn),
+		started:       time.Now(),
+		config:        getConfig(),
+		aborted:       make(chan struct{}),
+		terminated:    make(chan struct{}),
+		status:        sessionStatus{state: stateHandshake},
+	}
+}
+
+func (s *session) setState(state string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.state = state
+}
+
+// authenticated publishes the details of the authenticated user
+func (s *session) authenticated() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.state = stateIdle
+	s.status.user = s.user
+	s.status.authMethod = s.authMethod
+	s.status.keyFingerprint = s.keyFingerprint
+	s.status.certificateID = s.certificateID
+	s.status.serial = s.serial
+}
+
+func (s *session) setWorkerPID(pid int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status.workerPID = pid
+}
+
+// startTransfer records the transfer in progress, digest counts its bytes.
+// While a batch runs several transfers the latest one is reported.
+func (s *session) startTransfer(path, direction string, digest *transferDigest) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.transfers++
+	s.status.state = stateTransferring
+	s.status.path = path
+	s.status.direction = direction
+	s.status.transferStarted = time.Now()
+	s.status.digest = digest
+}
+
+// endTransfer leaves the details of the last transfer in place so they are
+// still reported while the session winds down. The session is idle once no
+// transfers are running.
+func (s *session) endTransfer() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.status.transfers--; s.status.transfers == 0 {
+		s.status.state = stateIdle
+	}
+}
+
+// snapshot returns the admin socket's view of the session, detail adds the
+// fields only reported by a dump
+func (s *session) snapshot(detail bool) server.AdminSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := server.AdminSession{
+		ID:            s.id,
+		RemoteAddress: s.remoteAddress,
+		User:          s.status.user,
+		State:         s.status.state,
+		Path:          s.status.path,
+		Direction:     s.status.direction,
+		Started:       s.started,
+		Age:           time.Since(s.started),
+	}
+
+	if s.status.digest != nil {
+		info.Bytes = s.status.digest.count()
+		if s.status.state == stateTransferring {
+			if elapsed := time.Since(s.status.transferStarted).Seconds(); elapsed > 0 {
+				info.Rate = float64(info.Bytes) / elapsed
+			}
+		}
+	}
+
+	if detail {
+		info.AuthMethod = s.status.authMethod
+		info.KeyFingerprint = s.status.keyFingerprint
+		info.CertificateID = s.status.certificateID
+		info.CertificateSerial = s.status.serial
+		info.WorkerPID = s.status.workerPID
+		info.TransferStarted = s.status.transferStarted
+		info.Aborted = s.isAborted()
+	}
+
+	return info
+}
+
+// abort asks the session to stop at the next opportunity and tell the
+// client that the server is going away
+func (s *session) abort() {
+	s.abortOnce.Do(func() { close(s.aborted) })
+}
+
+func (s *session) isAborted() bool {
+	select {
+	case <-s.aborted:
+		return true
+	default:
+		return false
+	}
+}
+
+// terminate aborts the session and runs the functions registered with
+// whenTerminated, closing its connections and killing child processes
+func (s *session) terminate() {
+	s.abort()
+	s.terminateOnce.Do(func() { close(s.terminated) })
+}
+
+// whenTerminated calls f if the session is terminated before release is
+// called
+func (s *session) whenTerminated(f func()) (release func()) {
+	finished := make(chan struct{})
+	var once sync.Once
+	go func() {
+		select {
+		case <-s.terminated:
+			once.Do(f)
+		case <-finished:
+		}
+	}()
+
+	return func() {
+		// once.Do stops f running after release returns
+		once.Do(func() {})
+		close(finished)
+	}
+}
+
+func newSessionID() string {
+	buffer := make([]byte, 8)
+	rand.Read(buffer)
+	return hex.EncodeToString(buffer)
+}
+
+// remoteAddress returns the address of the remote end of conn. UDT connections
+// do not always report an address so fall back to unknown.
+func remoteAddress(conn net.Conn) string {
+	if addr := conn.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return unknownAddress
+}
+
+// auditEvent returns an audit event populated with the session details
+func (s *session) auditEvent(event string) server.AuditEvent {
+	return server.AuditEvent{
+		Event:             event,
+		SessionID:         s.id,
+		RemoteAddress:     s.remoteAddress,
+		User:              s.user,
+		AuthMethod:        s.authMethod,
+		KeyFingerprint:    s.keyFingerprint,
+		CertificateID:     s.certificateID,
+		CertificateSerial: s.serial,
+	}
+}
+
+func (s *session) audit(event server.AuditEvent) {
+	recordMetrics(event)
+	if err := auditLog.Log(event); err != nil {
+		log.Println("Unable to write audit log: ", err)
+	}
+}
+
+// transferDigest counts and hashes the bytes of a file transfer
+type transferDigest struct {
+	hash  hash.Hash
+	bytes int64
+}
+
+func newTransferDigest() *transferDigest {
+	return &transferDigest{
+		hash: sha256.New(),
+	}
+}
+
+func (d *transferDigest) Write(b []byte) (n int, e error) {
+	n, e = d.hash.Write(b)
+	atomic.AddInt64(&d.bytes, int64(n))
+	return
+}
+
+// count returns the bytes written so far, it may be called while the
+// transfer is running
+func (d *transferDigest) count() int64 {
+	return atomic.LoadInt64(&d.bytes)
+}
+
+func (d *transferDigest) sum() string {
+	return hex.EncodeToString(d.hash.Sum(nil))
+}
+
+func transferDirection(t wire.TransferType) string {
+	switch t {
+	case wire.FileSend:
+		return "download"
+	case wire.Benchmark:
+		return "benchmark"
+	}
+	return "upload"
+}
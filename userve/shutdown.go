@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// terminateGracePeriod is how long aborted sessions get to tell their
+// clients the server is going away before their connections are closed
+var terminateGracePeriod = 5 * time.Second
+
+// wait waits up to timeout for all sessions to finish, it returns false if
+// sessions are still active
+func (r *sessionRegistry) wait(timeout time.Duration) bool {
+	finished := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// drain stops new sessions and gives active sessions up to timeout to
+// finish. Sessions that are still running are then aborted and, if they
+// don't stop on their own, terminated. Closing force causes drain to skip
+// straight to aborting sessions.
+func (r *sessionRegistry) drain(timeout time.Duration, force <-chan struct{}) {
+	r.mu.Lock()
+	r.draining = true
+	r.mu.Unlock()
+
+	log.Printf("Draining %d active sessions\n", len(r.active()))
+
+	finished := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return
+	case <-time.After(timeout):
+	case <-force:
+	}
+
+	remaining := r.active()
+	log.Printf("Aborting %d sessions\n", len(remaining))
+	for _, s := range remaining {
+		s.abort()
+	}
+
+	if r.wait(terminateGracePeriod) {
+		return
+	}
+
+	for _, s := range r.active() {
+		s.terminate()
+	}
+
+	r.wait(terminateGracePeriod)
+}
+
+// drainRequested is closed when a drain is requested over the admin socket
+var drainRequested = make(chan struct{})
+var drainOnce sync.Once
+
+// requestDrain shuts the server down as if it had received SIGTERM
+func requestDrain() {
+	drainOnce.Do(func() { close(drainRequested) })
+}
+
+// waitForShutdownSignal blocks until the process receives SIGTERM or SIGINT
+// or a drain is requested. The returned channel is closed if a signal
+// arrives after that.
+func waitForShutdownSignal() (force <-chan struct{}) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	select {
+	case sig := <-signals:
+		log.Println("Received ", sig, ", shutting down")
+	case <-drainRequested:
+		log.Println("Drain requested, shutting down")
+	}
+
+	forced := make(chan struct{})
+	go func() {
+		sig := <-signals
+		log.Println("Received ", sig, ", aborting active sessions")
+		close(forced)
+	}()
+
+	return forced
+}
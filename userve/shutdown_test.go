@@ -0,0 +1,120 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/murphybytes/ucp/server"
+	"github.com/murphybytes/ucp/wire"
+	"github.com/stretchr/testify/suite"
+)
+
+type ShutdownTestSuite struct {
+	suite.Suite
+	registry *sessionRegistry
+}
+
+func (s *ShutdownTestSuite) SetupTest() {
+	s.registry = newSessionRegistry()
+	terminateGracePeriod = 50 * time.Millisecond
+}
+
+func (s *ShutdownTestSuite) newSession() *session {
+	sess := &session{
+		id:         newSessionID(),
+		config:     server.NewConfig(),
+		aborted:    make(chan struct{}),
+		terminated: make(chan struct{}),
+	}
+	s.Require().Nil(s.registry.add(sess))
+	return sess
+}
+
+func (s *ShutdownTestSuite) TestDrainWaitsForSessions() {
+	sess := s.newSession()
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		s.registry.remove(sess)
+	}()
+
+	s.registry.drain(time.Second, nil)
+	s.False(sess.isAborted())
+	s.Empty(s.registry.active())
+}
+
+func (s *ShutdownTestSuite) TestDrainRefusesNewSessions() {
+	s.registry.drain(time.Second, nil)
+	s.True(s.registry.isDraining())
+	err := s.registry.add(&session{id: newSessionID(), config: server.NewConfig()})
+	s.Require().NotNil(err)
+	s.Equal(wire.ShuttingDown, err.(*wire.Error).Code)
+}
+
+func (s *ShutdownTestSuite) TestDrainAbortsSessionsAfterTimeout() {
+	sess := s.newSession()
+
+	go func() {
+		<-sess.aborted
+		s.registry.remove(sess)
+	}()
+
+	s.registry.drain(10*time.Millisecond, nil)
+	s.True(sess.isAborted())
+	s.Empty(s.registry.active())
+}
+
+func (s *ShutdownTestSuite) TestDrainTerminatesStuckSessions() {
+	sess := s.newSession()
+
+	terminated := make(chan struct{})
+	sess.whenTerminated(func() {
+		close(terminated)
+		s.registry.remove(sess)
+	})
+
+	s.registry.drain(10*time.Millisecond, nil)
+
+	select {
+	case <-terminated:
+	default:
+		s.Fail("session was not terminated")
+	}
+	s.Empty(s.registry.active())
+}
+
+func (s *ShutdownTestSuite) TestForceSkipsDrainTimeout() {
+	sess := s.newSession()
+
+	go func() {
+		<-sess.aborted
+		s.registry.remove(sess)
+	}()
+
+	force := make(chan struct{})
+	close(force)
+
+	started := time.Now()
+	s.registry.drain(time.Hour, force)
+	s.True(time.Since(started) < time.Second)
+	s.True(sess.isAborted())
+}
+
+func (s *ShutdownTestSuite) TestReleasedFunctionNotCalledOnTerminate() {
+	// terminate often runs before the goroutine waiting on the session has
+	// started, so it is tried on many sessions
+	called := make(chan struct{}, 100)
+	for i := 0; i < cap(called); i++ {
+		sess := s.newSession()
+		release := sess.whenTerminated(func() { called <- struct{}{} })
+		release()
+		sess.terminate()
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	s.Len(called, 0)
+}
+
+func TestShutdownTestSuite(t *testing.T) {
+	suite.Run(t, new(ShutdownTestSuite))
+}
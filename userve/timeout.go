@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/murphybytes/ucp/wire"
+)
+
+// timeoutConn closes the underlying connection when a deadline passes. UDT
+// connections accept deadlines but don't enforce them, so besides passing
+// the deadline on to the connection a timer is used. Activity only moves
+// the deadline, the timer checks it when it fires and waits again if it has
+// been pushed back, so a busy connection doesn't reset the timer each frame.
+type timeoutConn struct {
+	net.Conn
+	mu       sync.Mutex
+	timer    *time.Timer
+	deadline time.Time
+	idle     time.Duration
+	timedOut bool
+}
+
+func newTimeoutConn(conn net.Conn) *timeoutConn {
+	return &timeoutConn{
+		Conn: conn,
+	}
+}
+
+// setDeadline closes the connection if it is still open after timeout. A
+// timeout of zero removes the deadline.
+func (c *timeoutConn) setDeadline(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.idle = 0
+	c.arm(timeout)
+}
+
+// setIdleTimeout closes the connection if nothing is read or written for
+// timeout. A timeout of zero disables the idle timeout.
+func (c *timeoutConn) setIdleTimeout(timeout time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.idle = timeout
+	c.arm(timeout)
+}
+
+func (c *timeoutConn) arm(timeout time.Duration) {
+	if timeout <= 0 {
+		c.deadline = time.Time{}
+		c.Conn.SetDeadline(time.Time{})
+		if c.timer != nil {
+			c.timer.Stop()
+		}
+		return
+	}
+
+	c.deadline = time.Now().Add(timeout)
+	c.Conn.SetDeadline(c.deadline)
+	if c.timer == nil {
+		c.timer = time.AfterFunc(timeout, c.check)
+	} else {
+		c.timer.Reset(timeout)
+	}
+}
+
+// check closes the connection if its deadline has passed, otherwise it
+// waits for the deadline again
+func (c *timeoutConn) check() {
+	c.mu.Lock()
+	if c.deadline.IsZero() {
+		c.mu.Unlock()
+		return
+	}
+	if remaining := time.Until(c.deadline); remaining > 0 {
+		c.timer.Reset(remaining)
+		c.mu.Unlock()
+		return
+	}
+	c.mu.Unlock()
+
+	c.expire()
+}
+
+func (c *timeoutConn) expire() {
+	c.mu.Lock()
+	c.timedOut = true
+	c.mu.Unlock()
+
+	c.Conn.Close()
+}
+
+func (c *timeoutConn) isTimedOut() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.timedOut
+}
+
+// touch pushes back the idle timeout after network activity
+func (c *timeoutConn) touch() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.idle > 0 && !c.timedOut {
+		c.deadline = time.Now().Add(c.idle)
+		c.Conn.SetDeadline(c.deadline)
+	}
+}
+
+// checkError replaces errors caused by a deadline passing with ErrTimeout
+func (c *timeoutConn) checkError(e error) error {
+	if e == nil {
+		return nil
+	}
+
+	if netErr, ok := e.(net.Error); ok && netErr.Timeout() {
+		c.expire()
+	}
+
+	if c.isTimedOut() {
+		return wire.ErrTimeout
+	}
+	return e
+}
+
+func (c *timeoutConn) Read(b []byte) (n int, e error) {
+	n, e = c.Conn.Read(b)
+	e = c.checkError(e)
+	c.touch()
+	return
+}
+
+func (c *timeoutConn) Write(b []byte) (n int, e error) {
+	n, e = c.Conn.Write(b)
+	e = c.checkError(e)
+	c.touch()
+	return
+}
+
+// Close stops the timer and closes the connection
+func (c *timeoutConn) Close() error {
+	c.mu.Lock()
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.deadline = time.Time{}
+	c.idle = 0
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
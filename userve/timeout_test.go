@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/murphybytes/ucp/wire"
+	"github.com/stretchr/testify/suite"
+)
+
+type TimeoutConnTestSuite struct {
+	suite.Suite
+	conn   *timeoutConn
+	remote net.Conn
+}
+
+func (s *TimeoutConnTestSuite) SetupTest() {
+	var local net.Conn
+	local, s.remote = net.Pipe()
+	s.conn = newTimeoutConn(local)
+}
+
+func (s *TimeoutConnTestSuite) TearDownTest() {
+	s.conn.Close()
+	s.remote.Close()
+}
+
+func (s *TimeoutConnTestSuite) TestDeadlineClosesConnection() {
+	s.conn.setDeadline(20 * time.Millisecond)
+
+	buffer := make([]byte, 10)
+	_, err := s.conn.Read(buffer)
+	s.Equal(wire.ErrTimeout, err)
+	s.True(s.conn.isTimedOut())
+}
+
+func (s *TimeoutConnTestSuite) TestZeroDeadlineDisablesTimeout() {
+	s.conn.setDeadline(20 * time.Millisecond)
+	s.conn.setDeadline(0)
+
+	time.Sleep(40 * time.Millisecond)
+	s.False(s.conn.isTimedOut())
+}
+
+func (s *TimeoutConnTestSuite) TestActivityResetsIdleTimeout() {
+	s.conn.setIdleTimeout(50 * time.Millisecond)
+
+	go func() {
+		for i := 0; i < 4; i++ {
+			time.Sleep(20 * time.Millisecond)
+			s.remote.Write([]byte("x"))
+		}
+	}()
+
+	buffer := make([]byte, 1)
+	for i := 0; i < 4; i++ {
+		_, err := s.conn.Read(buffer)
+		s.Require().Nil(err)
+	}
+	s.False(s.conn.isTimedOut())
+
+	_, err := s.conn.Read(buffer)
+	s.Equal(wire.ErrTimeout, err)
+}
+
+// ignoresDeadlines stands in for a UDT connection, which accepts deadlines
+// but doesn't enforce them
+type ignoresDeadlines struct {
+	net.Conn
+}
+
+func (ignoresDeadlines) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (s *TimeoutConnTestSuite) TestTimerFollowsIdleDeadline() {
+	local, remote := net.Pipe()
+	defer remote.Close()
+	conn := newTimeoutConn(ignoresDeadlines{local})
+	defer conn.Close()
+	conn.setIdleTimeout(50 * time.Millisecond)
+
+	go func() {
+		for i := 0; i < 4; i++ {
+			time.Sleep(20 * time.Millisecond)
+			remote.Write([]byte("x"))
+		}
+	}()
+
+	// the timer fires while the connection is in use and waits again
+	buffer := make([]byte, 1)
+	for i := 0; i < 4; i++ {
+		_, err := conn.Read(buffer)
+		s.Require().Nil(err)
+	}
+	s.False(conn.isTimedOut())
+
+	_, err := conn.Read(buffer)
+	s.Equal(wire.ErrTimeout, err)
+	s.True(conn.isTimedOut())
+}
+
+func TestTimeoutConnTestSuite(t *testing.T) {
+	suite.Run(t, new(TimeoutConnTestSuite))
+}
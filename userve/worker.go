@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	"github.com/murphybytes/ucp/server"
+)
+
+var ErrWorkerUser = errors.New("Server must run as root to serve other users")
+
+// spawnWorker starts the process that performs file operations for the
+// session. It runs as agent, with agent's supplementary groups, in agent's
+// home directory, so the server never opens user files itself. The worker
+// lives until the session ends and is killed if the session is terminated.
+func spawnWorker(sess *session, agent *user.User) (worker *server.WorkerClient, stop func(), e error) {
+	var credential *syscall.Credential
+	if credential, e = workerCredential(agent); e != nil {
+		return
+	}
+
+	var (
+		conn     net.Conn
+		childEnd *os.File
+		nonce    string
+	)
+
+	if conn, childEnd, e = server.NewProxySocketPair(); e != nil {
+		return
+	}
+
+	if nonce, e = server.NewProxyNonce(); e != nil {
+		childEnd.Close()
+		conn.Close()
+		return
+	}
+
+	cmd := exec.Command(sess.config.ProxyPath,
+		fmt.Sprintf("-umask=%s", sess.config.WorkerUmask),
+		fmt.Sprintf("-home=%s", agent.HomeDir),
+	)
+	cmd.ExtraFiles = []*os.File{childEnd}
+	cmd.Env = []string{
+		fmt.Sprintf("%s=%s", server.ProxyNonceVariable, nonce),
+		fmt.Sprintf("HOME=%s", agent.HomeDir),
+		fmt.Sprintf("USER=%s", agent.Username),
+		fmt.Sprintf("LOGNAME=%s", agent.Username),
+	}
+	if credential != nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: credential}
+	}
+
+	e = cmd.Start()
+	// the child holds its own copy, closing ours lets reads see EOF if it exits
+	childEnd.Close()
+	if e != nil {
+		conn.Close()
+		return
+	}
+
+	sess.setWorkerPID(cmd.Process.Pid)
+
+	release := sess.whenTerminated(func() {
+		conn.Close()
+		cmd.Process.Kill()
+	})
+
+	worker = server.NewWorkerClient(conn)
+
+	// closing the connection tells the worker to exit
+	stop = func() {
+		release()
+		worker.Close()
+		cmd.Wait()
+	}
+
+	var received string
+	if received, e = worker.Hello(); e == nil {
+		e = server.CheckProxyNonce(nonce, received)
+	}
+	if e != nil {
+		cmd.Process.Kill()
+		stop()
+		return nil, nil, e
+	}
+
+	return
+}
+
+// workerCredential returns the credentials the worker runs with. When the
+// server runs as root the worker switches to agent along with every group
+// agent belongs to, as initgroups would. Otherwise the worker can only run
+// as the server's own user, which must be agent.
+func workerCredential(agent *user.User) (credential *syscall.Credential, e error) {
+	if !userIsRoot() {
+		if strconv.Itoa(os.Getuid()) != agent.Uid {
+			e = ErrWorkerUser
+		}
+		return
+	}
+
+	uid, gid := getIdsFromUser(agent)
+	credential = &syscall.Credential{Uid: uid, Gid: gid, Groups: []uint32{}}
+
+	var groupIds []string
+	if groupIds, e = agent.GroupIds(); e != nil {
+		return nil, e
+	}
+
+	for _, groupId := range groupIds {
+		var id uint64
+		if id, e = strconv.ParseUint(groupId, 10, 32); e != nil {
+			return nil, e
+		}
+		credential.Groups = append(credential.Groups, uint32(id))
+	}
+
+	return
+}
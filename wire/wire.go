@@ -1,8 +1,51 @@
 package wire
 
-import "errors"
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+)
 
 var ErrUnauthorizedUser = errors.New("Unauthorized user")
+var ErrServerShutdown = errors.New("Server is shutting down")
+var ErrTimeout = errors.New("Connection timed out")
+var ErrStreamHash = errors.New("Hash of the data received does not match the hash sent")
+
+func init() {
+	gob.Register(&Error{})
+}
+
+type ErrorCode int
+
+const (
+	UnknownError ErrorCode = iota
+	PathDenied
+	ShuttingDown
+	TooManyConnections
+	TooManySessions
+	LockedOut
+	BenchmarksDisabled
+	FileExists
+	QuotaExceeded
+)
+
+// Error is an error that can be sent to the remote end of a connection,
+// for example in FileTransferInformation
+type Error struct {
+	Code        ErrorCode
+	Description string
+}
+
+func NewError(code ErrorCode, description string) *Error {
+	return &Error{
+		Code:        code,
+		Description: description,
+	}
+}
+
+func (e *Error) Error() string {
+	return e.Description
+}
 
 type Conversation string
 
@@ -15,14 +58,35 @@ const (
 	FileTransferAbort              Conversation = "FILE_TRANSFER_ABORT"
 	FileTransferMore               Conversation = "FILE_TRANSFER_MORE"
 	FileTransferComplete           Conversation = "FILE_TRANSFER_COMPLETE"
+	ServerShutdown                 Conversation = "SERVER_SHUTDOWN"
 )
 
-// SymmetricEncryptionParms contains values used for AES encryption
-// that are generated by server
-type SymmetricEncryptionParms struct {
-	Key                  []byte
-	InitializationVector []byte
-	ClientAck            bool
+// ServerHello is the first message sent by the server. It carries the
+// server host key in SSH wire format, the server's key exchange value or an
+// error if the server won't accept the connection. HostCertificate holds an
+// SSH host certificate for the host key in wire format if the server has
+// one.
+type ServerHello struct {
+	HostKey         []byte
+	HostCertificate []byte
+	KeyExchange     []byte
+	Error           error
+}
+
+// ClientHello is the client's reply to ServerHello. PublicKey holds the
+// client identity key in SSH wire format, Certificate holds an SSH user
+// certificate for the key if the client has one.
+type ClientHello struct {
+	PublicKey   []byte
+	Certificate []byte
+	KeyExchange []byte
+}
+
+// SessionSignature proves that the sender holds the private key for the
+// identity it sent in its hello. It is the first message sent in each
+// direction once the connection is encrypted.
+type SessionSignature struct {
+	Signature []byte
 }
 
 type AuthorizationCode int
@@ -32,12 +96,15 @@ const (
 	PasswordRequired
 	NonexistantUser
 	IncorrectPassword
+	Unauthorized
+	Rejected
 )
 
 // UserAuthorizationResponse indicated if user is authorized or not
 type UserAuthorizationResponse struct {
 	AuthResponse AuthorizationCode
 	Description  string
+	Error        error
 }
 
 type TransferType int
@@ -45,16 +112,71 @@ type TransferType int
 const (
 	FileSend TransferType = iota
 	FileReceive
+	// Benchmark is a download of FileSize bytes the server generates
+	// rather than reads from a file
+	Benchmark
+	// Batch runs a number of transfers over the session at once, each on a
+	// channel of its own
+	Batch
 )
 
+// BenchmarkPattern is the data the server generates for a benchmark
+type BenchmarkPattern int
+
+const (
+	ZeroPattern BenchmarkPattern = iota
+	RandomPattern
+)
+
+// FileTransferInformation describes a transfer. For uploads the server
+// sends it back before the upload starts, with ChunkSize set to the size of
+// the buffers it expects, and again once the file has been written with
+// FileSize set to the bytes received. FileSize is UnknownSize when the
+// sender can't tell how long the file is before it has been sent, such as
+// when it reads a pipe. Pattern is only used by benchmarks. NoClobber
+// refuses an upload to a file that exists, BackupSuffix keeps the file an
+// upload replaces under its name with the suffix added. Concurrency is the
+// number of transfers a Batch asks to run at once, the server's reply holds
+// the number it allows.
 type FileTransferInformation struct {
 	FileTransferType TransferType
 	FileName         string
 	FileSize         int64
+	ChunkSize        int
+	Pattern          BenchmarkPattern
+	NoClobber        bool
+	BackupSuffix     string
+	Concurrency      int
 	Error            error
 }
 
+// UnknownSize is the FileSize of a stream whose length isn't known until
+// it ends
+const UnknownSize = -1
+
+// FileChunk is sent in place of a buffer of file data when a transfer
+// fails part way, or with End set once all of the data has been sent. The
+// data itself travels in raw data frames.
 type FileChunk struct {
-	Buffer []byte
-	Error  error
+	Error error
+	End   *EndOfStream
+}
+
+// EndOfStream follows the file data sent in either direction. Size is the
+// number of bytes sent and Hash their hex encoded SHA-256, so the receiver
+// can tell whether it got all of them.
+type EndOfStream struct {
+	Size int64
+	Hash string
+}
+
+// Check returns an error unless size and hash match the bytes received
+func (end *EndOfStream) Check(size int64, hash string) error {
+	if end.Size != size {
+		return fmt.Errorf("Received %d of %d bytes", size, end.Size)
+	}
+	if end.Hash != hash {
+		return ErrStreamHash
+	}
+	return nil
 }